@@ -0,0 +1,138 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when invoking an operation while the circuit
+// breaker is open after too many consecutive invocation failures
+var ErrCircuitOpen = errors.New("Wasm guest circuit breaker is open")
+
+// CircuitState is the state of a WasmGuest circuit breaker
+type CircuitState string
+
+const (
+	// CircuitClosed allows invocations
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen rejects invocations until the cooldown has passed
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen allows a single invocation to probe whether the guest
+	// has recovered
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// invocationOutcome is how an invocation affects the circuit breaker
+type invocationOutcome int
+
+const (
+	// outcomeSuccess is an invocation which ran the guest to completion,
+	// including operations where the guest reported an error
+	outcomeSuccess invocationOutcome = iota
+	// outcomeFailure is an invocation which trapped, panicked or timed out
+	outcomeFailure
+	// outcomeNeutral is an invocation which did not run the guest, or which was
+	// cancelled by the caller
+	outcomeNeutral
+)
+
+// WithCircuitBreaker opens a circuit breaker after the specified number of
+// consecutive invocations trap, panic or exceed the maximum execution time.
+// While the breaker is open, invocations fail immediately with ErrCircuitOpen
+// during the cooldown. After the cooldown, the breaker is half-open and allows
+// a single invocation through, which closes the breaker again if the guest runs
+// to completion, or reopens it for another cooldown if it fails.
+//
+// Errors reported by the guest itself are not failures, and reset the count of
+// consecutive failures.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if threshold < 1 {
+			return fmt.Errorf("Invalid circuit breaker threshold %d: must be at least 1", threshold)
+		}
+		if cooldown <= 0 {
+			return fmt.Errorf("Invalid circuit breaker cooldown %s: must be positive", cooldown)
+		}
+		wg.breaker = &circuitBreaker{threshold: threshold, cooldown: cooldown, state: CircuitClosed}
+		return nil
+	}
+}
+
+// circuitBreaker counts consecutive invocation failures
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     CircuitState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+// allow returns ErrCircuitOpen if an invocation should not be attempted. Every
+// allowed invocation must report its outcome by calling done.
+func (cb *circuitBreaker) allow() error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		remaining := cb.cooldown - time.Since(cb.openedAt)
+		if remaining > 0 {
+			return fmt.Errorf("%w: retry in %s", ErrCircuitOpen, remaining.Round(time.Millisecond))
+		}
+		cb.state = CircuitHalfOpen
+		cb.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if cb.probing {
+			return fmt.Errorf("%w: waiting for probe invocation", ErrCircuitOpen)
+		}
+		cb.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// done records the outcome of an allowed invocation, returning the state of
+// the breaker and whether it changed
+func (cb *circuitBreaker) done(outcome invocationOutcome) (CircuitState, bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	previous := cb.state
+	switch outcome {
+	case outcomeSuccess:
+		cb.failures = 0
+		cb.state = CircuitClosed
+	case outcomeFailure:
+		cb.failures++
+		if cb.state == CircuitHalfOpen || cb.failures >= cb.threshold {
+			cb.state = CircuitOpen
+			cb.openedAt = time.Now()
+		}
+	}
+	if previous == CircuitHalfOpen {
+		cb.probing = false
+	}
+
+	return cb.state, cb.state != previous
+}
+
+// currentState returns the state of the breaker, which is half-open if the
+// cooldown has passed since it opened
+func (cb *circuitBreaker) currentState() CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.cooldown {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
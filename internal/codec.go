@@ -0,0 +1,186 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec marshals requests to, and unmarshals responses from, the encoding
+// expected by a Wasm guest
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// CodecEnv is the WASI environment variable which tells guests the name of the
+// codec configured using the WithCodec option
+const CodecEnv = "WASM_GUEST_CODEC"
+
+// RawCodec passes guest payloads through unchanged, and only supports []byte
+// and string requests, and *[]byte and *string responses. It is the codec of a
+// WasmGuest unless configured using the WithCodec option.
+var RawCodec Codec = rawCodec{}
+
+// JSONCodec encodes guest payloads as JSON
+var JSONCodec Codec = jsonCodec{}
+
+// ProtoCodec encodes guest payloads as protocol buffers, with map entries
+// sorted by key, and only supports values which are proto.Message
+var ProtoCodec Codec = protoCodec{}
+
+// LookupCodec returns the built in codec with the name, for example to
+// configure a WasmGuest using the codec named by a guest SDK
+func LookupCodec(name string) (Codec, error) {
+	for _, codec := range []Codec{RawCodec, JSONCodec, MsgpackCodec, ProtoCodec} {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown codec %q: must be one of raw, json, msgpack or proto", name)
+}
+
+// WithCodec sets the codec which WasmGuest.InvokeTyped uses for guest
+// payloads. The codec name is passed to WASI guests of the default engine in
+// the CodecEnv environment variable, so that guest SDKs supporting more than
+// one encoding can check they agree with the host.
+func WithCodec(codec Codec) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if codec == nil {
+			return errors.New("Invalid codec: must not be nil")
+		}
+		wg.codec = codec
+		return nil
+	}
+}
+
+// Codec returns the codec configured using the WithCodec option, or RawCodec
+func (wg *WasmGuest) Codec() Codec {
+	if wg.codec == nil {
+		return RawCodec
+	}
+	return wg.codec
+}
+
+// InvokeTyped invokes the Wasm guest operation like the InvokeTyped function,
+// using the codec of the WasmGuest
+func (wg *WasmGuest) InvokeTyped(ctx context.Context, operation string, request interface{}, response interface{}) error {
+	return InvokeTyped(ctx, wg, wg.Codec(), operation, request, response)
+}
+
+// guestEnv returns the WASI environment variables, including the codec name
+// if one was configured
+func (wg *WasmGuest) guestEnv() []wasiEnv {
+	if wg.codec == nil {
+		return wg.wasiEnv
+	}
+
+	env := append([]wasiEnv(nil), wg.wasiEnv...)
+	return append(env, wasiEnv{key: CodecEnv, value: wg.codec.Name()})
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return value, nil
+	case string:
+		return []byte(value), nil
+	}
+
+	return nil, fmt.Errorf("Cannot marshal %T: not []byte or string", v)
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch value := v.(type) {
+	case *[]byte:
+		*value = append([]byte(nil), data...)
+		return nil
+	case *string:
+		*value = string(data)
+		return nil
+	}
+
+	return fmt.Errorf("Cannot unmarshal into %T: not *[]byte or *string", v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("Cannot marshal %T: not a proto.Message", v)
+	}
+
+	return marshalDeterministic(message)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("Cannot unmarshal into %T: not a proto.Message", v)
+	}
+
+	return proto.Unmarshal(data, message)
+}
+
+// InvokeTyped marshals the request using the codec, invokes the Wasm guest
+// operation, and unmarshals the result into the response, which must be a
+// pointer as for json.Unmarshal. A nil response discards the result.
+//
+// Note: this takes interface{} values rather than type parameters so that the
+// module can still be built with Go 1.14.
+func InvokeTyped(ctx context.Context, invoker WasmGuestInvoker, codec Codec, operation string, request interface{}, response interface{}) error {
+	payload, err := codec.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal %s request for operation %s: %w", codec.Name(), operation, err)
+	}
+
+	result, err := invoker.InvokeWasmOperation(ctx, operation, payload)
+	if err != nil {
+		return err
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	if err := codec.Unmarshal(result, response); err != nil {
+		return fmt.Errorf("Failed to unmarshal %s response from operation %s: %w", codec.Name(), operation, err)
+	}
+
+	return nil
+}
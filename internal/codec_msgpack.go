@@ -0,0 +1,369 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// MsgpackCodec encodes guest payloads as MessagePack. Values are converted
+// using their JSON encoding, so struct fields are named by their json tags, and
+// byte slices inside other values are base64 strings, although a []byte
+// request is sent as MessagePack binary. Map keys must be strings.
+//
+// Note: this avoids adding a MessagePack dependency, and only supports the
+// types which have a JSON equivalent, so extension types cannot be decoded.
+var MsgpackCodec Codec = msgpackCodec{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if b, ok := v.([]byte); ok {
+		writeMsgpackBinary(&buf, b)
+		return buf.Bytes(), nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	if err := writeMsgpack(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	reader := &msgpackReader{data: data}
+	value, err := reader.read()
+	if err != nil {
+		return err
+	}
+	if reader.offset != len(data) {
+		return fmt.Errorf("Invalid msgpack: %d unexpected bytes after value", len(data)-reader.offset)
+	}
+
+	converted, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(converted, v)
+}
+
+// writeMsgpack writes a value decoded from JSON using json.Number
+func writeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		return writeMsgpackNumber(buf, v)
+	case string:
+		writeMsgpackString(buf, v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 16, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		writeMsgpackHeader(buf, len(v), 0x80, 16, 0xde, 0xdf)
+		for _, key := range keys {
+			writeMsgpackString(buf, key)
+			if err := writeMsgpack(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Cannot marshal %T as msgpack", value)
+	}
+
+	return nil
+}
+
+func writeMsgpackNumber(buf *bytes.Buffer, number json.Number) error {
+	if i, err := strconv.ParseInt(string(number), 10, 64); err == nil {
+		switch {
+		case i >= 0 && i <= 0x7f, i < 0 && i >= -32:
+			buf.WriteByte(byte(i))
+		case i >= math.MinInt8 && i <= math.MaxInt8:
+			buf.Write([]byte{0xd0, byte(i)})
+		case i >= math.MinInt16 && i <= math.MaxInt16:
+			buf.WriteByte(0xd1)
+			binary.Write(buf, binary.BigEndian, int16(i))
+		case i >= math.MinInt32 && i <= math.MaxInt32:
+			buf.WriteByte(0xd2)
+			binary.Write(buf, binary.BigEndian, int32(i))
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, i)
+		}
+		return nil
+	}
+
+	if u, err := strconv.ParseUint(string(number), 10, 64); err == nil {
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, u)
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(string(number), 64)
+	if err != nil {
+		return fmt.Errorf("Cannot marshal number %s as msgpack: %w", number, err)
+	}
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+
+	return nil
+}
+
+func writeMsgpackString(buf *bytes.Buffer, s string) {
+	if len(s) < 32 {
+		buf.WriteByte(0xa0 | byte(len(s)))
+	} else {
+		writeMsgpackLength(buf, len(s), 0xd9, 0xda, 0xdb)
+	}
+	buf.WriteString(s)
+}
+
+func writeMsgpackBinary(buf *bytes.Buffer, b []byte) {
+	writeMsgpackLength(buf, len(b), 0xc4, 0xc5, 0xc6)
+	buf.Write(b)
+}
+
+// writeMsgpackHeader writes the header of an array or map with n items, which
+// uses the fixed format for fewer than fixLimit items
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fixFormat byte, fixLimit int, format16, format32 byte) {
+	if n < fixLimit {
+		buf.WriteByte(fixFormat | byte(n))
+		return
+	}
+	if n <= math.MaxUint16 {
+		buf.WriteByte(format16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+		return
+	}
+	buf.WriteByte(format32)
+	binary.Write(buf, binary.BigEndian, uint32(n))
+}
+
+// writeMsgpackLength writes the format and length of a string or binary value
+func writeMsgpackLength(buf *bytes.Buffer, n int, format8, format16, format32 byte) {
+	switch {
+	case n <= math.MaxUint8:
+		buf.Write([]byte{format8, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(format16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(format32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+var errMsgpackTruncated = errors.New("Invalid msgpack: unexpected end of data")
+
+// msgpackReader decodes MessagePack into values which can be encoded as JSON
+type msgpackReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.offset < n {
+		return nil, errMsgpackTruncated
+	}
+	b := r.data[r.offset : r.offset+n]
+	r.offset += n
+	return b, nil
+}
+
+func (r *msgpackReader) uint(size int) (uint64, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (r *msgpackReader) read() (interface{}, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	format := b[0]
+
+	switch {
+	case format <= 0x7f:
+		return json.Number(strconv.Itoa(int(format))), nil
+	case format >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(format)))), nil
+	case format&0xf0 == 0x80:
+		return r.readMap(int(format & 0x0f))
+	case format&0xf0 == 0x90:
+		return r.readArray(int(format & 0x0f))
+	case format&0xe0 == 0xa0:
+		return r.readString(int(format & 0x1f))
+	}
+
+	switch format {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (format - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bin, err := r.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(bin), nil
+	case 0xca:
+		u, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return msgpackFloat(float64(math.Float32frombits(uint32(u))))
+	case 0xcb:
+		u, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return msgpackFloat(math.Float64frombits(u))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := r.uint(1 << (format - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatUint(u, 10)), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (format - 0xd0)
+		u, err := r.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := uint(64 - 8*size)
+		return json.Number(strconv.FormatInt(int64(u<<shift)>>shift, 10)), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (format - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.readString(int(n))
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (format - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.readArray(int(n))
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (format - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.readMap(int(n))
+	}
+
+	return nil, fmt.Errorf("Invalid msgpack: unsupported format 0x%02x", format)
+}
+
+func msgpackFloat(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("Cannot unmarshal msgpack float %v", f)
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+func (r *msgpackReader) readString(n int) (interface{}, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (r *msgpackReader) readArray(n int) (interface{}, error) {
+	if n > len(r.data)-r.offset {
+		return nil, errMsgpackTruncated
+	}
+
+	items := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		item, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (r *msgpackReader) readMap(n int) (interface{}, error) {
+	if n > len(r.data)-r.offset {
+		return nil, errMsgpackTruncated
+	}
+
+	entries := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid msgpack: map key %v is not a string", key)
+		}
+
+		value, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		entries[name] = value
+	}
+	return entries, nil
+}
@@ -0,0 +1,304 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal_test
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hyperledgendary/fabric-chaincode-wasm/internal"
+	"github.com/hyperledgendary/fabric-chaincode-wasm/internal/fakes"
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+)
+
+type greeting struct {
+	Name    string `json:"name"`
+	Message string `json:"message,omitempty"`
+}
+
+var _ = Describe("InvokeTyped", func() {
+	var invoker *fakes.WasmGuestInvoker
+
+	BeforeEach(func() {
+		invoker = &fakes.WasmGuestInvoker{}
+	})
+
+	Context("With the JSON codec", func() {
+		It("should marshal the request and unmarshal the response", func() {
+			invoker.InvokeWasmOperationReturns([]byte(`{"name":"bond","message":"hello bond"}`), nil)
+
+			response := &greeting{}
+			err := internal.InvokeTyped(context.Background(), invoker, internal.JSONCodec, "greet", greeting{Name: "bond"}, response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(&greeting{Name: "bond", Message: "hello bond"}))
+
+			Expect(invoker.InvokeWasmOperationCallCount()).To(Equal(1))
+			_, operation, payload := invoker.InvokeWasmOperationArgsForCall(0)
+			Expect(operation).To(Equal("greet"))
+			Expect(payload).To(MatchJSON(`{"name":"bond"}`))
+		})
+
+		It("should discard the result with a nil response", func() {
+			invoker.InvokeWasmOperationReturns([]byte("not json"), nil)
+
+			err := internal.InvokeTyped(context.Background(), invoker, internal.JSONCodec, "greet", greeting{Name: "bond"}, nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should return an error if the request cannot be marshalled", func() {
+			err := internal.InvokeTyped(context.Background(), invoker, internal.JSONCodec, "greet", make(chan int), &greeting{})
+			Expect(err).To(MatchError(HavePrefix("Failed to marshal json request for operation greet: ")))
+			Expect(invoker.InvokeWasmOperationCallCount()).To(Equal(0))
+		})
+
+		It("should return an error if the response cannot be unmarshalled", func() {
+			invoker.InvokeWasmOperationReturns([]byte("not json"), nil)
+
+			err := internal.InvokeTyped(context.Background(), invoker, internal.JSONCodec, "greet", greeting{Name: "bond"}, &greeting{})
+			Expect(err).To(MatchError(HavePrefix("Failed to unmarshal json response from operation greet: ")))
+		})
+	})
+
+	Context("With the proto codec", func() {
+		It("should marshal the request and unmarshal the response", func() {
+			result, err := proto.Marshal(&contract.InvokeTransactionResponse{Payload: []byte("bond")})
+			Expect(err).NotTo(HaveOccurred())
+			invoker.InvokeWasmOperationReturns(result, nil)
+
+			request := &contract.InvokeTransactionRequest{TransactionName: "greet"}
+			response := &contract.InvokeTransactionResponse{}
+			err = internal.InvokeTyped(context.Background(), invoker, internal.ProtoCodec, internal.InvokeOperation, request, response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.GetPayload()).To(Equal([]byte("bond")))
+
+			_, _, payload := invoker.InvokeWasmOperationArgsForCall(0)
+			sent := &contract.InvokeTransactionRequest{}
+			Expect(proto.Unmarshal(payload, sent)).To(Succeed())
+			Expect(sent.GetTransactionName()).To(Equal("greet"))
+		})
+
+		It("should not marshal values which are not protocol buffers", func() {
+			err := internal.InvokeTyped(context.Background(), invoker, internal.ProtoCodec, "greet", greeting{Name: "bond"}, nil)
+			Expect(err).To(MatchError("Failed to marshal proto request for operation greet: Cannot marshal internal_test.greeting: not a proto.Message"))
+		})
+
+		It("should not unmarshal into values which are not protocol buffers", func() {
+			err := internal.InvokeTyped(context.Background(), invoker, internal.ProtoCodec, "greet", &contract.InvokeTransactionRequest{}, &greeting{})
+			Expect(err).To(MatchError("Failed to unmarshal proto response from operation greet: Cannot unmarshal into *internal_test.greeting: not a proto.Message"))
+		})
+	})
+
+	Context("With the msgpack codec", func() {
+		It("should marshal the request and unmarshal the response", func() {
+			invoker.InvokeWasmOperationReturns([]byte("\x82\xa7message\xaahello bond\xa4name\xa4bond"), nil)
+
+			response := &greeting{}
+			err := internal.InvokeTyped(context.Background(), invoker, internal.MsgpackCodec, "greet", greeting{Name: "bond"}, response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(&greeting{Name: "bond", Message: "hello bond"}))
+
+			_, _, payload := invoker.InvokeWasmOperationArgsForCall(0)
+			Expect(payload).To(Equal([]byte("\x81\xa4name\xa4bond")))
+		})
+
+		It("should round trip values with a JSON equivalent", func() {
+			request := map[string]interface{}{
+				"nil":    nil,
+				"bool":   true,
+				"small":  7,
+				"minus":  -7,
+				"large":  int64(1) << 40,
+				"max":    uint64(1<<64 - 1),
+				"float":  0.5,
+				"string": string(make([]byte, 300)),
+				"array":  []interface{}{"a", false},
+			}
+			payload, err := internal.MsgpackCodec.Marshal(request)
+			Expect(err).NotTo(HaveOccurred())
+
+			var response map[string]interface{}
+			Expect(internal.MsgpackCodec.Unmarshal(payload, &response)).To(Succeed())
+			expected, err := internal.JSONCodec.Marshal(request)
+			Expect(err).NotTo(HaveOccurred())
+			actual, err := internal.JSONCodec.Marshal(response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(actual).To(MatchJSON(expected))
+		})
+
+		It("should marshal byte slices as binary", func() {
+			payload, err := internal.MsgpackCodec.Marshal([]byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(payload).To(Equal([]byte("\xc4\x04bond")))
+
+			var response []byte
+			Expect(internal.MsgpackCodec.Unmarshal(payload, &response)).To(Succeed())
+			Expect(response).To(Equal([]byte("bond")))
+		})
+
+		It("should return an error if the response is not valid msgpack", func() {
+			invoker.InvokeWasmOperationReturns([]byte("\x82\xa4name"), nil)
+
+			err := internal.InvokeTyped(context.Background(), invoker, internal.MsgpackCodec, "greet", greeting{Name: "bond"}, &greeting{})
+			Expect(err).To(MatchError("Failed to unmarshal msgpack response from operation greet: Invalid msgpack: unexpected end of data"))
+
+			Expect(internal.MsgpackCodec.Unmarshal([]byte("\xc0\xc0"), &greeting{})).To(MatchError("Invalid msgpack: 1 unexpected bytes after value"))
+			Expect(internal.MsgpackCodec.Unmarshal([]byte("\xd4\x01\x00"), &greeting{})).To(MatchError("Invalid msgpack: unsupported format 0xd4"))
+			Expect(internal.MsgpackCodec.Unmarshal([]byte("\x81\x01\xc0"), &greeting{})).To(MatchError("Invalid msgpack: map key 1 is not a string"))
+		})
+	})
+
+	Context("With the raw codec", func() {
+		It("should pass the request and response through unchanged", func() {
+			invoker.InvokeWasmOperationReturns([]byte("hello bond"), nil)
+
+			var response string
+			err := internal.InvokeTyped(context.Background(), invoker, internal.RawCodec, "greet", "bond", &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal("hello bond"))
+
+			_, _, payload := invoker.InvokeWasmOperationArgsForCall(0)
+			Expect(payload).To(Equal([]byte("bond")))
+		})
+
+		It("should not marshal other values", func() {
+			err := internal.InvokeTyped(context.Background(), invoker, internal.RawCodec, "greet", greeting{Name: "bond"}, nil)
+			Expect(err).To(MatchError("Failed to marshal raw request for operation greet: Cannot marshal internal_test.greeting: not []byte or string"))
+		})
+	})
+
+	It("should return invocation errors unchanged", func() {
+		invokeErr := errors.New("guest failed")
+		invoker.InvokeWasmOperationReturns(nil, invokeErr)
+
+		err := internal.InvokeTyped(context.Background(), invoker, internal.JSONCodec, "greet", greeting{Name: "bond"}, &greeting{})
+		Expect(err).To(BeIdenticalTo(invokeErr))
+	})
+})
+
+var _ = Describe("Codecs", func() {
+	It("should look up the built in codecs by name", func() {
+		for _, name := range []string{"raw", "json", "msgpack", "proto"} {
+			codec, err := internal.LookupCodec(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(codec.Name()).To(Equal(name))
+		}
+
+		_, err := internal.LookupCodec("cbor")
+		Expect(err).To(MatchError(`Unknown codec "cbor": must be one of raw, json, msgpack or proto`))
+	})
+
+	Context("With a Wasm guest", func() {
+		var proxy *internal.FabricProxy
+
+		BeforeEach(func() {
+			proxy = internal.NewFabricProxy(internal.NewContextStore())
+		})
+
+		It("should use the raw codec by default", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes(testGuestWasm(), proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Codec()).To(Equal(internal.RawCodec))
+
+			var result []byte
+			Expect(wasmGuest.InvokeTyped(context.Background(), "echo", []byte("bond"), &result)).To(Succeed())
+			Expect(result).To(Equal([]byte("bond")))
+
+			Expect(wasmGuest.InvokeTyped(context.Background(), "vars", nil, &result)).To(Succeed())
+			Expect(result).To(BeEmpty())
+		})
+
+		It("should use the configured codec and tell the guest its name", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes(testGuestWasm(), proxy, internal.WithPoolSize(1),
+				internal.WithWasiEnv("CHAINCODE_ID", "wasmcc:1"),
+				internal.WithCodec(internal.MsgpackCodec),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Codec()).To(Equal(internal.MsgpackCodec))
+
+			response := &greeting{}
+			Expect(wasmGuest.InvokeTyped(context.Background(), "echo", greeting{Name: "bond"}, response)).To(Succeed())
+			Expect(response).To(Equal(&greeting{Name: "bond"}))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "vars", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result)).To(Equal("CHAINCODE_ID=wasmcc:1\x00WASM_GUEST_CODEC=msgpack\x00"))
+		})
+
+		It("should not accept invalid codecs", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes(testGuestWasm(), proxy, internal.WithCodec(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid codec: must not be nil"))
+
+			wasmGuest, err = internal.NewWasmGuestFromBytes(testGuestWasm(), proxy, internal.WithWasiEnv(internal.CodecEnv, "json"))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError(`Invalid WASI environment variable "WASM_GUEST_CODEC": set using WithCodec`))
+		})
+	})
+})
+
+var _ = Describe("InvokeMulti", func() {
+	var invoker *fakes.WasmGuestInvoker
+
+	BeforeEach(func() {
+		invoker = &fakes.WasmGuestInvoker{}
+	})
+
+	It("should split the result into the values framed by the guest", func() {
+		invoker.InvokeWasmOperationReturns([]byte("\x04\x00\x00\x00bond\x00\x00\x00\x00\x03\x00\x00\x00007"), nil)
+
+		values, err := internal.InvokeMulti(context.Background(), invoker, "agents", []byte("mi6"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values).To(Equal([][]byte{[]byte("bond"), {}, []byte("007")}))
+
+		_, operation, payload := invoker.InvokeWasmOperationArgsForCall(0)
+		Expect(operation).To(Equal("agents"))
+		Expect(payload).To(Equal([]byte("mi6")))
+	})
+
+	It("should return no values for an empty result", func() {
+		values, err := internal.InvokeMulti(context.Background(), invoker, "agents", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values).To(BeEmpty())
+	})
+
+	It("should return the error if the operation fails", func() {
+		invokeErr := errors.New("guest failed")
+		invoker.InvokeWasmOperationReturns(nil, invokeErr)
+
+		values, err := internal.InvokeMulti(context.Background(), invoker, "agents", nil)
+		Expect(values).To(BeNil())
+		Expect(err).To(BeIdenticalTo(invokeErr))
+	})
+
+	It("should return an error if a value length is truncated", func() {
+		invoker.InvokeWasmOperationReturns([]byte("\x04\x00\x00\x00bond\x01\x00"), nil)
+
+		values, err := internal.InvokeMulti(context.Background(), invoker, "agents", nil)
+		Expect(values).To(BeNil())
+		Expect(err).To(MatchError("Failed to decode result from operation agents: Invalid multiple result: 2 bytes at offset 8 is too short for a value length"))
+	})
+
+	It("should return an error if a value is truncated", func() {
+		invoker.InvokeWasmOperationReturns([]byte("\x04\x00\x00\x00bond\x05\x00\x00\x00007"), nil)
+
+		values, err := internal.InvokeMulti(context.Background(), invoker, "agents", nil)
+		Expect(values).To(BeNil())
+		Expect(err).To(MatchError("Failed to decode result from operation agents: Invalid multiple result: value 2 of 5 bytes exceeds the 3 remaining bytes"))
+	})
+
+	It("should decode values framed by EncodeMultiResult", func() {
+		values := [][]byte{[]byte("bond"), nil, []byte("james bond")}
+		decoded, err := internal.DecodeMultiResult(internal.EncodeMultiResult(values))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal([][]byte{[]byte("bond"), {}, []byte("james bond")}))
+	})
+})
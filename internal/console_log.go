@@ -0,0 +1,143 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// consoleLogFunction is the waPC host function guests call to log a message
+const consoleLogFunction = "__console_log"
+
+// shortDigestLength is how much of the Wasm module digest identifies the
+// module in guest console messages
+const shortDigestLength = 12
+
+type invocationKey struct{}
+
+type consoleLogKey struct{}
+
+// withInvocation returns a context which identifies the operation being
+// invoked, for anything the guest logs while invoking it
+func withInvocation(ctx context.Context, operation string) context.Context {
+	return context.WithValue(ctx, invocationKey{}, operation)
+}
+
+// withConsoleLog returns a context which makes newRuntime replace the waPC
+// console log host function with one which logs messages from the module with
+// the specified digest, along with the invocation they were logged during
+func withConsoleLog(ctx context.Context, digest string) context.Context {
+	return context.WithValue(ctx, consoleLogKey{}, digest)
+}
+
+// guestConsoleLog logs a message from the guest console, with fields
+// identifying the module, and the operation and transaction being invoked if
+// they are in the context
+func (wg *WasmGuest) guestConsoleLog(ctx context.Context, digest, msg string) {
+	if len(digest) > shortDigestLength {
+		digest = digest[:shortDigestLength]
+	}
+	fields := []string{"module=" + digest}
+	if operation, ok := ctx.Value(invocationKey{}).(string); ok {
+		fields = append(fields, "operation="+operation)
+	}
+	if tx, ok := transactionFromContext(ctx); ok {
+		fields = append(fields, "channel="+tx.key.channelID, "txid="+tx.key.txID)
+	}
+
+	wg.logger.Infof("[guest] %s: %s", strings.Join(fields, " "), msg)
+}
+
+// consoleRuntime is a wazero runtime which replaces the waPC console log host
+// function with one which passes the invocation context to the WasmGuest,
+// since the waPC logger is only given the message. Messages from instances of
+// a module shared by a ModuleRegistry go to the WasmGuest which instantiated
+// them.
+type consoleRuntime struct {
+	wazero.Runtime
+	wg     *WasmGuest
+	digest string
+}
+
+func (r consoleRuntime) NewHostModuleBuilder(moduleName string) wazero.HostModuleBuilder {
+	builder := r.Runtime.NewHostModuleBuilder(moduleName)
+	if moduleName != "wapc" {
+		return builder
+	}
+
+	return consoleModuleBuilder{HostModuleBuilder: builder, runtime: r}
+}
+
+// consoleLog is the replacement waPC console log host function, which logs
+// the message at the given offset and length in the guest memory
+func (r consoleRuntime) consoleLog(ctx context.Context, m api.Module, params []uint64) []uint64 {
+	msg, ok := m.Memory().Read(ctx, uint32(params[0]), uint32(params[1]))
+	if !ok {
+		panic(fmt.Errorf("out of memory reading msg"))
+	}
+	wg := r.wg
+	if module, ok := sharedModuleFromContext(ctx); ok {
+		wg = module.wg
+	}
+	wg.guestConsoleLog(ctx, r.digest, string(msg))
+
+	return nil
+}
+
+// consoleModuleBuilder builds the waPC host module, with the console log
+// function replaced
+type consoleModuleBuilder struct {
+	wazero.HostModuleBuilder
+	runtime consoleRuntime
+}
+
+func (b consoleModuleBuilder) NewFunctionBuilder() wazero.HostFunctionBuilder {
+	return &consoleFunctionBuilder{HostFunctionBuilder: b.HostModuleBuilder.NewFunctionBuilder(), module: b}
+}
+
+// consoleFunctionBuilder builds a waPC host function, replacing the
+// implementation of the console log function when it is exported
+type consoleFunctionBuilder struct {
+	wazero.HostFunctionBuilder
+	module consoleModuleBuilder
+}
+
+func (b *consoleFunctionBuilder) WithGoFunction(fn api.GoFunction, params, results []api.ValueType) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithGoFunction(fn, params, results)
+	return b
+}
+
+func (b *consoleFunctionBuilder) WithGoModuleFunction(fn api.GoModuleFunction, params, results []api.ValueType) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithGoModuleFunction(fn, params, results)
+	return b
+}
+
+func (b *consoleFunctionBuilder) WithFunc(fn interface{}) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithFunc(fn)
+	return b
+}
+
+func (b *consoleFunctionBuilder) WithName(name string) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithName(name)
+	return b
+}
+
+func (b *consoleFunctionBuilder) WithParameterNames(names ...string) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithParameterNames(names...)
+	return b
+}
+
+func (b *consoleFunctionBuilder) Export(name string) wazero.HostModuleBuilder {
+	if name == consoleLogFunction {
+		b.HostFunctionBuilder = b.HostFunctionBuilder.WithGoModuleFunction(api.GoModuleFunc(b.module.runtime.consoleLog), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{})
+	}
+	b.HostFunctionBuilder.Export(name)
+
+	return b.module
+}
@@ -4,8 +4,11 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"sync"
 
 	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
@@ -16,16 +19,50 @@ type stubKey struct {
 	channelID, txID string
 }
 
-// ContextStore keeps track of which stub belongs to which channel ID + transaction ID context
+type transactionKey struct{}
+
+// transaction is the Fabric transaction being invoked with a context
+type transaction struct {
+	key  stubKey
+	stub shim.ChaincodeStubInterface
+}
+
+// WithTransaction returns a context carrying the stub for the transaction
+// being invoked, which WasmContract passes to the Wasm guest. FabricProxy uses
+// that stub for host calls made with the context, and rejects host calls for
+// any other transaction context, so that a guest invoked for one transaction
+// cannot read or write the state of another transaction in progress at the
+// same time. Host calls made without a transaction in the context use the
+// stubs in the ContextStore.
+func WithTransaction(ctx context.Context, channelID string, txID string, stub shim.ChaincodeStubInterface) context.Context {
+	return context.WithValue(ctx, transactionKey{}, transaction{key: stubKey{channelID: channelID, txID: txID}, stub: stub})
+}
+
+// transactionFromContext returns the transaction carried by the context, if
+// there is one
+func transactionFromContext(ctx context.Context) (transaction, bool) {
+	tx, ok := ctx.Value(transactionKey{}).(transaction)
+	return tx, ok
+}
+
+// ContextStore keeps track of which stub belongs to which channel ID + transaction ID context,
+// along with any iterators opened for that context
 type ContextStore struct {
 	sync.RWMutex
-	stubs map[stubKey]shim.ChaincodeStubInterface
+	stubs          map[stubKey]shim.ChaincodeStubInterface
+	iterators      map[stubKey]map[string]shim.CommonIteratorInterface
+	readCaches     map[stubKey]*readCache
+	writeSetSizes  map[stubKey]*writeSetSize
+	nextIteratorID uint64
 }
 
 // NewContextStore returns a new store for keeping track of transaction context stubs
 func NewContextStore() *ContextStore {
 	store := ContextStore{}
 	store.stubs = make(map[stubKey]shim.ChaincodeStubInterface)
+	store.iterators = make(map[stubKey]map[string]shim.CommonIteratorInterface)
+	store.readCaches = make(map[stubKey]*readCache)
+	store.writeSetSizes = make(map[stubKey]*writeSetSize)
 
 	return &store
 }
@@ -72,7 +109,10 @@ func (store *ContextStore) Put(channelID string, txID string, stub shim.Chaincod
 	return nil
 }
 
-// Remove removes the specified stub from the context store
+// Remove removes the specified stub from the context store, along with its
+// read cache and write set size, and closes any iterators opened for that
+// context which are still open. Iterators should be closed by the guest, so a
+// warning is logged for each one closed.
 func (store *ContextStore) Remove(channelID string, txID string) error {
 	key := stubKey{
 		channelID,
@@ -82,13 +122,142 @@ func (store *ContextStore) Remove(channelID string, txID string) error {
 	log.Printf("[host] Removing stub for context chid %s txid %s\n", key.channelID, key.txID)
 
 	store.Lock()
-	defer store.Unlock()
-
 	if _, ok := store.stubs[key]; !ok {
+		store.Unlock()
 		return fmt.Errorf("No stub found for transaction context %s %s", key.channelID, key.txID)
 	}
 
 	delete(store.stubs, key)
+	delete(store.readCaches, key)
+	delete(store.writeSetSizes, key)
+	iterators := store.iterators[key]
+	delete(store.iterators, key)
+	store.Unlock()
+
+	ids := make([]string, 0, len(iterators))
+	for id := range iterators {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		log.Printf("[host] warning: closing iterator %s which was left open by the guest for context chid %s txid %s\n", id, key.channelID, key.txID)
+		if err := iterators[id].Close(); err != nil {
+			log.Printf("[host] error closing iterator %s for context chid %s txid %s: %s\n", id, key.channelID, key.txID, err)
+		}
+	}
 
 	return nil
 }
+
+// readCache returns the read cache for the specified context, or nil if there
+// is no stub for the context
+func (store *ContextStore) readCache(key stubKey) *readCache {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.stubs[key]; !ok {
+		return nil
+	}
+
+	cache, ok := store.readCaches[key]
+	if !ok {
+		cache = &readCache{states: make(map[string][]byte)}
+		store.readCaches[key] = cache
+	}
+
+	return cache
+}
+
+// writeSetSize returns the write set size for the specified context, or nil if
+// there is no stub for the context
+func (store *ContextStore) writeSetSize(key stubKey) *writeSetSize {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.stubs[key]; !ok {
+		return nil
+	}
+
+	size, ok := store.writeSetSizes[key]
+	if !ok {
+		size = &writeSetSize{keys: make(map[string]int)}
+		store.writeSetSizes[key] = size
+	}
+
+	return size
+}
+
+// OpenIterators returns the number of iterators opened for the specified
+// context which have not been closed
+func (store *ContextStore) OpenIterators(channelID string, txID string) int {
+	store.RLock()
+	defer store.RUnlock()
+
+	return len(store.iterators[stubKey{channelID, txID}])
+}
+
+// PutIterator stores an iterator opened for the specified context, returning
+// the ID used to refer to it. Iterators which are still open when the stub is
+// removed are closed.
+func (store *ContextStore) PutIterator(context *contract.TransactionContext, iterator shim.CommonIteratorInterface) (string, error) {
+	key := stubKey{
+		channelID: context.ChannelId,
+		txID:      context.TransactionId,
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.stubs[key]; !ok {
+		return "", fmt.Errorf("No stub found for transaction context %s %s", key.channelID, key.txID)
+	}
+
+	store.nextIteratorID++
+	id := strconv.FormatUint(store.nextIteratorID, 10)
+
+	if store.iterators[key] == nil {
+		store.iterators[key] = make(map[string]shim.CommonIteratorInterface)
+	}
+	store.iterators[key][id] = iterator
+
+	return id, nil
+}
+
+// GetIterator returns the specified iterator from the context store
+func (store *ContextStore) GetIterator(context *contract.TransactionContext, id string) (shim.CommonIteratorInterface, error) {
+	key := stubKey{
+		channelID: context.ChannelId,
+		txID:      context.TransactionId,
+	}
+
+	store.RLock()
+	defer store.RUnlock()
+
+	iterator, ok := store.iterators[key][id]
+	if !ok {
+		return nil, fmt.Errorf("No iterator %s found for transaction context %s %s", id, key.channelID, key.txID)
+	}
+
+	return iterator, nil
+}
+
+// RemoveIterator closes the specified iterator and removes it from the
+// context store
+func (store *ContextStore) RemoveIterator(context *contract.TransactionContext, id string) error {
+	key := stubKey{
+		channelID: context.ChannelId,
+		txID:      context.TransactionId,
+	}
+
+	store.Lock()
+	iterator, ok := store.iterators[key][id]
+	delete(store.iterators[key], id)
+	store.Unlock()
+
+	if !ok {
+		return fmt.Errorf("No iterator %s found for transaction context %s %s", id, key.channelID, key.txID)
+	}
+
+	return iterator.Close()
+}
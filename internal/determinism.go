@@ -0,0 +1,213 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+	"google.golang.org/protobuf/proto"
+)
+
+// SyscallPolicy controls what WASI guests see when they read the clocks or
+// random bytes, which would make endorsement nondeterministic if they came
+// from the host
+type SyscallPolicy int
+
+const (
+	// SyscallsFake uses the wazero defaults, where the clocks start at a fixed
+	// time and advance 1ms each time they are read, and random bytes come from a
+	// fixed sequence. The clocks and random bytes carry on from one invocation to
+	// the next in the same waPC instance, so results can depend on which
+	// instance runs a transaction.
+	SyscallsFake SyscallPolicy = iota
+
+	// SyscallsDeterministic restarts the clocks and random bytes for every
+	// invocation. The wall clock starts at the transaction timestamp, the
+	// monotonic clock starts at zero, and both advance 1ms each time they are
+	// read. Random bytes are a SHA-256 stream seeded by the transaction ID. See
+	// WithTransactionSeed.
+	SyscallsDeterministic
+
+	// SyscallsTrap fails the invocation with ErrNondeterministicSyscall if the
+	// guest reads the clocks or random bytes
+	SyscallsTrap
+)
+
+// String returns the name of the policy
+func (policy SyscallPolicy) String() string {
+	switch policy {
+	case SyscallsFake:
+		return "fake"
+	case SyscallsDeterministic:
+		return "deterministic"
+	case SyscallsTrap:
+		return "trap"
+	default:
+		return fmt.Sprintf("SyscallPolicy(%d)", int(policy))
+	}
+}
+
+// ErrNondeterministicSyscall is returned when a guest reads the clocks or
+// random bytes using the SyscallsTrap policy
+var ErrNondeterministicSyscall = errors.New("Nondeterministic WASI call rejected")
+
+// clockResolution is how far the clocks advance each time they are read,
+// unless they are the wazero defaults
+const clockResolution = sys.ClockResolution(time.Millisecond)
+
+// WithSyscallPolicy sets what WASI guests see when they read the clocks or
+// random bytes. The default is SyscallsFake.
+func WithSyscallPolicy(policy SyscallPolicy) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if policy < SyscallsFake || policy > SyscallsTrap {
+			return fmt.Errorf("Invalid syscall policy %s", policy)
+		}
+		wg.syscallPolicy = policy
+		return nil
+	}
+}
+
+type transactionSeedKey struct{}
+
+// transactionSeed is the starting point for the clocks and random bytes seen by
+// the guest using the SyscallsDeterministic policy
+type transactionSeed struct {
+	timestamp time.Time
+	seed      []byte
+}
+
+// WithTransactionSeed returns a context which starts the guest wall clock at
+// the timestamp, and seeds the guest random bytes, when invoking an operation
+// with that context using the SyscallsDeterministic policy. Every endorsing
+// peer should use the same values, such as the proposal timestamp and
+// transaction ID, which is what WasmContract uses. Without a seed the wall
+// clock starts at the Unix epoch with an empty seed.
+func WithTransactionSeed(ctx context.Context, timestamp time.Time, seed []byte) context.Context {
+	return context.WithValue(ctx, transactionSeedKey{}, transactionSeed{timestamp: timestamp, seed: seed})
+}
+
+// withSyscallPolicy configures the clocks and random bytes for a module
+// instance using the policy
+func withSyscallPolicy(ctx context.Context, policy SyscallPolicy, config wazero.ModuleConfig) wazero.ModuleConfig {
+	switch policy {
+	case SyscallsDeterministic:
+		instance, ok := ctx.Value(outputInstanceKey{}).(*outputInstance)
+		if !ok {
+			return config
+		}
+		instance.syscalls = &deterministicSyscalls{}
+		return config.
+			WithWalltime(instance.syscalls.walltime, clockResolution).
+			WithNanotime(instance.syscalls.nanotime, clockResolution).
+			WithRandSource(instance.syscalls)
+	case SyscallsTrap:
+		return config.
+			WithWalltime(func(context.Context) (int64, int32) { panic(nondeterministicSyscall("wall clock")) }, clockResolution).
+			WithNanotime(func(context.Context) int64 { panic(nondeterministicSyscall("monotonic clock")) }, clockResolution).
+			WithRandSource(trappingRandom{})
+	default:
+		return config
+	}
+}
+
+func nondeterministicSyscall(source string) error {
+	return fmt.Errorf("Guest read the %s: %w", source, ErrNondeterministicSyscall)
+}
+
+type trappingRandom struct{}
+
+func (trappingRandom) Read([]byte) (int, error) {
+	panic(nondeterministicSyscall("random bytes"))
+}
+
+// deterministicSyscalls are the clocks and random bytes of a waPC instance,
+// which are reset for each invocation
+type deterministicSyscalls struct {
+	mutex         sync.Mutex
+	timestamp     time.Time
+	walltimeReads int64
+	nanotimeReads int64
+	seed          []byte
+	block         []byte
+	counter       uint64
+}
+
+// reset restarts the clocks at the timestamp in the context, and the random
+// bytes from its seed
+func (s *deterministicSyscalls) reset(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seed, _ := ctx.Value(transactionSeedKey{}).(transactionSeed)
+	s.timestamp = seed.timestamp
+	if s.timestamp.IsZero() {
+		s.timestamp = time.Unix(0, 0)
+	}
+	s.walltimeReads = 0
+	s.nanotimeReads = 0
+	s.seed = seed.seed
+	s.block = nil
+	s.counter = 0
+}
+
+func (s *deterministicSyscalls) walltime(context.Context) (int64, int32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.timestamp.Add(time.Duration(s.walltimeReads) * time.Millisecond)
+	s.walltimeReads++
+
+	return now.Unix(), int32(now.Nanosecond())
+}
+
+func (s *deterministicSyscalls) nanotime(context.Context) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.nanotimeReads * int64(time.Millisecond)
+	s.nanotimeReads++
+
+	return now
+}
+
+// Read fills p with the next bytes of SHA-256(seed || counter) for successive
+// big endian counters
+func (s *deterministicSyscalls) Read(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if len(s.block) == 0 {
+			var counter [8]byte
+			binary.BigEndian.PutUint64(counter[:], s.counter)
+			s.counter++
+
+			block := sha256.Sum256(append(append([]byte{}, s.seed...), counter[:]...))
+			s.block = block[:]
+		}
+
+		copied := copy(p[n:], s.block)
+		s.block = s.block[copied:]
+		n += copied
+	}
+
+	return n, nil
+}
+
+// marshalDeterministic marshals a protocol buffer for the guest with map
+// entries sorted by key, since proto.Marshal writes them in random order, and
+// every endorsing peer must send the guest the same bytes. Payloads marshalled
+// as JSON are already deterministic, because encoding/json sorts map keys.
+func marshalDeterministic(message proto.Message) ([]byte, error) {
+	return proto.MarshalOptions{Deterministic: true}.Marshal(message)
+}
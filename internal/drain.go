@@ -0,0 +1,65 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrGuestDraining is returned when invoking an operation on a WasmGuest which
+// is being drained, as an InvokeError matching ErrAcquireFailed, since the
+// invocation can be retried on another chaincode instance
+var ErrGuestDraining = errors.New("Wasm guest is draining")
+
+// Drain stops the WasmGuest accepting new invocations, which fail fast with
+// ErrGuestDraining, and waits until the invocations already in progress have
+// finished, or the context is done. Unlike CloseWithTimeout, it does not close
+// the WasmGuest or interrupt invocations, so that the WasmGuest can be closed
+// once the chaincode has stopped being sent work. The WasmGuest remains
+// draining if the context is done first, and Ping also fails while draining.
+func (wg *WasmGuest) Drain(ctx context.Context) error {
+	wg.mutex.Lock()
+	if wg.closed {
+		wg.mutex.Unlock()
+		return ErrGuestClosed
+	}
+	if !wg.draining {
+		wg.logger.Infof("[host] Draining Wasm guest")
+	}
+	wg.draining = true
+	module := wg.module
+	wg.mutex.Unlock()
+	wg.releasePins()
+
+	drained := make(chan struct{})
+	go func() {
+		module.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		wg.logger.Infof("[host] Drained Wasm guest")
+		return nil
+	case <-ctx.Done():
+	}
+
+	active := module.inFlight.active()
+	if active == 0 {
+		return nil
+	}
+
+	wg.logger.Errorf("[host] Stopped waiting for %d invocations to finish draining: %s", active, ctx.Err())
+	return fmt.Errorf("Failed to drain Wasm guest with %d invocations in progress: %w", active, ctx.Err())
+}
+
+// Draining returns whether Drain has been called
+func (wg *WasmGuest) Draining() bool {
+	wg.mutex.RLock()
+	defer wg.mutex.RUnlock()
+
+	return wg.draining
+}
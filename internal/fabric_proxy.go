@@ -8,27 +8,58 @@ import (
 	"fmt"
 	"log"
 	"runtime/debug"
+	"time"
 
 	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
 	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"google.golang.org/protobuf/proto"
 )
 
+// fabricNamespaces are the waPC host call namespaces handled by FabricProxy,
+// which cannot be used for custom host call handlers
+var fabricNamespaces = map[string]bool{
+	"LedgerService": true,
+}
+
 // FabricProxy routes calls from Wasm contract to the correct Fabric stub
 type FabricProxy struct {
-	contextStore *ContextStore
+	contextStore      *ContextStore
+	hostCallTimeout   time.Duration
+	operationTimeouts map[string]time.Duration
+	readCache         bool
+	maxRangeDeletes   int
+	maxWriteSet       int
 }
 
+// FabricProxyOption configures a FabricProxy when it is created
+type FabricProxyOption func(proxy *FabricProxy)
+
 // NewFabricProxy returns a new proxy to handle calls to the Fabric contract API
-func NewFabricProxy(contextStore *ContextStore) *FabricProxy {
+func NewFabricProxy(contextStore *ContextStore, opts ...FabricProxyOption) *FabricProxy {
 	proxy := FabricProxy{}
 	proxy.contextStore = contextStore
+	proxy.operationTimeouts = make(map[string]time.Duration)
+	for _, opt := range opts {
+		opt(&proxy)
+	}
 
 	return &proxy
 }
 
-// FabricCall is the waPC HostCall function for interacting with the ledger
-func (proxy *FabricProxy) FabricCall(ctx context.Context, binding, namespace, operation string, payload []byte) (result []byte, err error) {
+// FabricCall is the waPC HostCall function for interacting with the ledger.
+// Calls which take longer than their host call timeout, or the deadline of the
+// context, return an error to the guest. See WithHostCallTimeout. If the
+// context is already done, such as when the deadline of the transaction has
+// passed, the error from the context is returned without calling the stub.
+// Errors with a known cause are returned as a HostCallError with an
+// ErrorCode.
+func (proxy *FabricProxy) FabricCall(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+	result, err := proxy.callWithTimeout(ctx, binding, namespace, operation, payload)
+	return result, classifyHostCallError(err)
+}
+
+// call routes a host call to the handler for the operation
+func (proxy *FabricProxy) call(ctx context.Context, binding, namespace, operation string, payload []byte) (result []byte, err error) {
 	// Route the payload to any custom functionality accordingly.
 	// You can even route to other waPC modules!!!
 	log.Printf("[host] bd %s ns %s op %s payload length %d\n", binding, namespace, operation, len(payload))
@@ -47,29 +78,198 @@ func (proxy *FabricProxy) FabricCall(ctx context.Context, binding, namespace, op
 		switch operation {
 		case "CreateState":
 			log.Printf("[host] Processing CreateStateRequest...\n")
-			return proxy.createState(payload)
+			return proxy.createState(ctx, payload)
 		case "ReadState":
 			log.Printf("[host] Processing ReadStateRequest...\n")
-			return proxy.readState(payload)
+			return proxy.readState(ctx, payload)
 		case "ExistsState":
 			log.Printf("[host] Processing ExistsStateRequest...\n")
-			return proxy.existsState(payload)
+			return proxy.existsState(ctx, payload)
 		case "UpdateState":
 			log.Printf("[host] Processing UpdateStateRequest...\n")
-			return proxy.updateState(payload)
+			return proxy.updateState(ctx, payload)
 		case "GetHash":
 			log.Printf("[host] Processing GetHash...\n")
-			return proxy.getHash(payload)
+			return proxy.getHash(ctx, payload)
 		case "GetStates":
 			log.Printf("[host] Processing GetStatesRequest...\n")
-			return proxy.getStates(payload)
+			return proxy.getStates(ctx, payload)
+		case "GetMultipleStates":
+			log.Printf("[host] Processing GetMultipleStatesRequest...\n")
+			return proxy.getMultipleStates(ctx, payload)
+		case "GetPrivateData":
+			log.Printf("[host] Processing GetPrivateDataRequest...\n")
+			return proxy.getPrivateData(ctx, payload)
+		case "GetPrivateDataHash":
+			log.Printf("[host] Processing GetPrivateDataHashRequest...\n")
+			return proxy.getPrivateDataHash(ctx, payload)
+		case "PutPrivateData":
+			log.Printf("[host] Processing PutPrivateDataRequest...\n")
+			return proxy.putPrivateData(ctx, payload)
+		case "DelPrivateData":
+			log.Printf("[host] Processing DelPrivateDataRequest...\n")
+			return proxy.delPrivateData(ctx, payload)
+		case "PurgePrivateData":
+			log.Printf("[host] Processing PurgePrivateDataRequest...\n")
+			return proxy.purgePrivateData(ctx, payload)
+		case "GetStateValidationParameter":
+			log.Printf("[host] Processing GetStateValidationParameterRequest...\n")
+			return proxy.getStateValidationParameter(ctx, payload)
+		case "SetStateValidationParameter":
+			log.Printf("[host] Processing SetStateValidationParameterRequest...\n")
+			return proxy.setStateValidationParameter(ctx, payload)
+		case "SetEvent":
+			log.Printf("[host] Processing SetEventRequest...\n")
+			return proxy.setEvent(ctx, payload)
+		case "GetTxID":
+			log.Printf("[host] Processing GetTxIDRequest...\n")
+			return proxy.getTxID(ctx, payload)
+		case "GetChannelID":
+			log.Printf("[host] Processing GetChannelIDRequest...\n")
+			return proxy.getChannelID(ctx, payload)
+		case "GetTxTimestamp":
+			log.Printf("[host] Processing GetTxTimestampRequest...\n")
+			return proxy.getTxTimestamp(ctx, payload)
+		case "GetTransient":
+			log.Printf("[host] Processing GetTransientRequest...\n")
+			return proxy.getTransient(ctx, payload)
+		case "InvokeChaincode":
+			log.Printf("[host] Processing InvokeChaincodeRequest...\n")
+			return proxy.invokeChaincode(ctx, payload)
+		case "GetCreator":
+			log.Printf("[host] Processing GetCreatorRequest...\n")
+			return proxy.getCreator(ctx, payload)
+		case "GetMSPID":
+			log.Printf("[host] Processing GetMSPIDRequest...\n")
+			return proxy.getMSPID(ctx, payload)
+		case "GetX509Certificate":
+			log.Printf("[host] Processing GetX509CertificateRequest...\n")
+			return proxy.getX509Certificate(ctx, payload)
+		case "GetID":
+			log.Printf("[host] Processing GetIDRequest...\n")
+			return proxy.getID(ctx, payload)
+		case "GetAttributeValue":
+			log.Printf("[host] Processing GetAttributeValueRequest...\n")
+			return proxy.getAttributeValue(ctx, payload)
+		case "AssertAttributeValue":
+			log.Printf("[host] Processing AssertAttributeValueRequest...\n")
+			return proxy.assertAttributeValue(ctx, payload)
+		case "GetStateByRange":
+			log.Printf("[host] Processing GetStateByRangeRequest...\n")
+			return proxy.getStateByRange(ctx, payload)
+		case "GetStateByRangeWithPagination":
+			log.Printf("[host] Processing GetStateByRangeWithPaginationRequest...\n")
+			return proxy.getStateByRangeWithPagination(ctx, payload)
+		case "DelStateByRange":
+			log.Printf("[host] Processing DelStateByRangeRequest...\n")
+			return proxy.delStateByRange(ctx, payload)
+		case "CreateCompositeKey":
+			log.Printf("[host] Processing CreateCompositeKeyRequest...\n")
+			return proxy.createCompositeKey(ctx, payload)
+		case "SplitCompositeKey":
+			log.Printf("[host] Processing SplitCompositeKeyRequest...\n")
+			return proxy.splitCompositeKey(ctx, payload)
+		case "GetStateByPartialCompositeKey":
+			log.Printf("[host] Processing GetStateByPartialCompositeKeyRequest...\n")
+			return proxy.getStateByPartialCompositeKey(ctx, payload)
+		case "GetStateByPartialCompositeKeyWithPagination":
+			log.Printf("[host] Processing GetStateByPartialCompositeKeyWithPaginationRequest...\n")
+			return proxy.getStateByPartialCompositeKeyWithPagination(ctx, payload)
+		case "GetQueryResult":
+			log.Printf("[host] Processing GetQueryResultRequest...\n")
+			return proxy.getQueryResult(ctx, payload)
+		case "GetQueryResultWithPagination":
+			log.Printf("[host] Processing GetQueryResultWithPaginationRequest...\n")
+			return proxy.getQueryResultWithPagination(ctx, payload)
+		case "GetHistoryForKey":
+			log.Printf("[host] Processing GetHistoryForKeyRequest...\n")
+			return proxy.getHistoryForKey(ctx, payload)
+		case "HistoryIteratorNext":
+			log.Printf("[host] Processing HistoryIteratorNextRequest...\n")
+			return proxy.historyIteratorNext(ctx, payload)
+		case "IteratorNext":
+			log.Printf("[host] Processing IteratorNextRequest...\n")
+			return proxy.iteratorNext(ctx, payload)
+		case "IteratorClose":
+			log.Printf("[host] Processing IteratorCloseRequest...\n")
+			return proxy.iteratorClose(ctx, payload)
 		}
 	}
 
 	return nil, fmt.Errorf("Operation not supported: %s %s %s", binding, namespace, operation)
 }
 
-func (proxy *FabricProxy) createState(payload []byte) ([]byte, error) {
+// checkTransaction returns an error if the transaction context of a host
+// call is not the transaction carried by the context, if there is one
+func checkTransaction(ctx context.Context, txContext *contract.TransactionContext) error {
+	tx, ok := transactionFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	if txContext.GetChannelId() != tx.key.channelID || txContext.GetTransactionId() != tx.key.txID {
+		return fmt.Errorf("Transaction context %s %s does not match the transaction being invoked", txContext.GetChannelId(), txContext.GetTransactionId())
+	}
+
+	return nil
+}
+
+// getStub returns the stub for the transaction context of a host call, which
+// is the stub carried by the context if there is one, or otherwise the stub in
+// the context store. The stub buffers writes if the context is simulating an
+// invocation.
+func (proxy *FabricProxy) getStub(ctx context.Context, txContext *contract.TransactionContext) (shim.ChaincodeStubInterface, error) {
+	if err := checkTransaction(ctx, txContext); err != nil {
+		return nil, err
+	}
+
+	if tx, ok := transactionFromContext(ctx); ok {
+		return simulate(ctx, proxy.withWriteSetLimit(tx.key, proxy.withReadCache(tx.key, tx.stub))), nil
+	}
+
+	stub, err := proxy.contextStore.Get(txContext)
+	if err != nil {
+		return nil, err
+	}
+	key := stubKey{channelID: txContext.GetChannelId(), txID: txContext.GetTransactionId()}
+
+	return simulate(ctx, proxy.withWriteSetLimit(key, proxy.withReadCache(key, stub))), nil
+}
+
+// getIterator returns an iterator opened for the transaction context of a
+// host call
+func (proxy *FabricProxy) getIterator(ctx context.Context, txContext *contract.TransactionContext, id string) (shim.CommonIteratorInterface, error) {
+	if err := checkTransaction(ctx, txContext); err != nil {
+		return nil, err
+	}
+
+	return proxy.contextStore.GetIterator(txContext, id)
+}
+
+// removeIterator closes an iterator opened for the transaction context of a
+// host call
+func (proxy *FabricProxy) removeIterator(ctx context.Context, txContext *contract.TransactionContext, id string) error {
+	if err := checkTransaction(ctx, txContext); err != nil {
+		return err
+	}
+
+	return proxy.contextStore.RemoveIterator(txContext, id)
+}
+
+// traceKey adds the state key to the current host call span
+func traceKey(ctx context.Context, key string) {
+	spanFromContext(ctx).SetAttributes(SpanAttribute{Key: "fabric.key", Value: key})
+}
+
+// traceRange adds the range of state keys to the current host call span
+func traceRange(ctx context.Context, startKey, endKey string) {
+	spanFromContext(ctx).SetAttributes(
+		SpanAttribute{Key: "fabric.start_key", Value: startKey},
+		SpanAttribute{Key: "fabric.end_key", Value: endKey},
+	)
+}
+
+func (proxy *FabricProxy) createState(ctx context.Context, payload []byte) ([]byte, error) {
 	request := &contract.CreateStateRequest{}
 	err := proto.Unmarshal(payload, request)
 	if err != nil {
@@ -80,8 +280,9 @@ func (proxy *FabricProxy) createState(payload []byte) ([]byte, error) {
 	state := request.GetState()
 	stateKey := state.GetKey()
 	log.Printf("[host] CreateState txid %s chid %s key %s value length %d\n", context.TransactionId, context.ChannelId, stateKey, len(state.Value))
+	traceKey(ctx, stateKey)
 
-	stub, err := proxy.contextStore.Get(context)
+	stub, err := proxy.getStub(ctx, context)
 	if err != nil {
 		return nil, fmt.Errorf("CreateState failed: %s", err.Error())
 	}
@@ -123,7 +324,7 @@ func (proxy *FabricProxy) createState(payload []byte) ([]byte, error) {
 	return nil, nil
 }
 
-func (proxy *FabricProxy) updateState(payload []byte) ([]byte, error) {
+func (proxy *FabricProxy) updateState(ctx context.Context, payload []byte) ([]byte, error) {
 	request := &contract.UpdateStateRequest{}
 	err := proto.Unmarshal(payload, request)
 	if err != nil {
@@ -134,8 +335,9 @@ func (proxy *FabricProxy) updateState(payload []byte) ([]byte, error) {
 	state := request.GetState()
 	stateKey := state.GetKey()
 	log.Printf("[host] UpdateState txid %s chid %s key %s value length %d\n", context.TransactionId, context.ChannelId, stateKey, len(state.Value))
+	traceKey(ctx, stateKey)
 
-	stub, err := proxy.contextStore.Get(context)
+	stub, err := proxy.getStub(ctx, context)
 	if err != nil {
 		return nil, fmt.Errorf("UpdateState failed: %s", err.Error())
 	}
@@ -177,7 +379,7 @@ func (proxy *FabricProxy) updateState(payload []byte) ([]byte, error) {
 	return nil, nil
 }
 
-func (proxy *FabricProxy) readState(payload []byte) ([]byte, error) {
+func (proxy *FabricProxy) readState(ctx context.Context, payload []byte) ([]byte, error) {
 	request := &contract.ReadStateRequest{}
 	err := proto.Unmarshal(payload, request)
 	if err != nil {
@@ -187,8 +389,9 @@ func (proxy *FabricProxy) readState(payload []byte) ([]byte, error) {
 	context := request.GetContext()
 	stateKey := request.GetStateKey()
 	log.Printf("[host] ReadState txid %s chid %s key %s\n", context.TransactionId, context.ChannelId, request.StateKey)
+	traceKey(ctx, stateKey)
 
-	stub, err := proxy.contextStore.Get(context)
+	stub, err := proxy.getStub(ctx, context)
 	if err != nil {
 		return nil, fmt.Errorf("ReadState failed: %s", err.Error())
 	}
@@ -225,10 +428,10 @@ func (proxy *FabricProxy) readState(payload []byte) ([]byte, error) {
 	response.State = state
 
 	log.Printf("[host] Read State done\n")
-	return proto.Marshal(response)
+	return marshalDeterministic(response)
 }
 
-func (proxy *FabricProxy) existsState(payload []byte) ([]byte, error) {
+func (proxy *FabricProxy) existsState(ctx context.Context, payload []byte) ([]byte, error) {
 	request := &contract.ExistsStateRequest{}
 	err := proto.Unmarshal(payload, request)
 	if err != nil {
@@ -238,8 +441,9 @@ func (proxy *FabricProxy) existsState(payload []byte) ([]byte, error) {
 	context := request.GetContext()
 	stateKey := request.GetStateKey()
 	log.Printf("[host] ExistsState txid %s chid %s key %s\n", context.TransactionId, context.ChannelId, request.StateKey)
+	traceKey(ctx, stateKey)
 
-	stub, err := proxy.contextStore.Get(context)
+	stub, err := proxy.getStub(ctx, context)
 	if err != nil {
 		return nil, fmt.Errorf("ExistsState failed: %s", err.Error())
 	}
@@ -269,10 +473,10 @@ func (proxy *FabricProxy) existsState(payload []byte) ([]byte, error) {
 	}
 
 	log.Printf("[host] Exists State done")
-	return proto.Marshal(response)
+	return marshalDeterministic(response)
 }
 
-func (proxy *FabricProxy) getHash(payload []byte) ([]byte, error) {
+func (proxy *FabricProxy) getHash(ctx context.Context, payload []byte) ([]byte, error) {
 	request := &contract.GetHashRequest{}
 	err := proto.Unmarshal(payload, request)
 	if err != nil {
@@ -282,8 +486,9 @@ func (proxy *FabricProxy) getHash(payload []byte) ([]byte, error) {
 	context := request.GetContext()
 	stateKey := request.GetStateKey()
 	log.Printf("[host] GetHash txid %s chid %s key %s\n", context.TransactionId, context.ChannelId, request.StateKey)
+	traceKey(ctx, stateKey)
 
-	stub, err := proxy.contextStore.Get(context)
+	stub, err := proxy.getStub(ctx, context)
 	if err != nil {
 		return nil, fmt.Errorf("GetHash failed: %s", err.Error())
 	}
@@ -310,10 +515,10 @@ func (proxy *FabricProxy) getHash(payload []byte) ([]byte, error) {
 	response.Hash = hashBytes
 
 	log.Printf("[host] GetHash done\n")
-	return proto.Marshal(response)
+	return marshalDeterministic(response)
 }
 
-func (proxy *FabricProxy) getStates(payload []byte) ([]byte, error) {
+func (proxy *FabricProxy) getStates(ctx context.Context, payload []byte) ([]byte, error) {
 	request := &contract.GetStatesRequest{}
 	err := proto.Unmarshal(payload, request)
 	if err != nil {
@@ -323,7 +528,7 @@ func (proxy *FabricProxy) getStates(payload []byte) ([]byte, error) {
 	context := request.GetContext()
 	log.Printf("[host] GetStates txid %s chid %s\n", context.TransactionId, context.ChannelId)
 
-	stub, err := proxy.contextStore.Get(context)
+	stub, err := proxy.getStub(ctx, context)
 	if err != nil {
 		return nil, fmt.Errorf("GetStates failed: %s", err.Error())
 	}
@@ -362,5 +567,5 @@ func (proxy *FabricProxy) getStatesByKeyRange(stub shim.ChaincodeStubInterface,
 	response.States = states
 
 	log.Printf("[host] Get States (ByKeyRange) done")
-	return proto.Marshal(response)
+	return marshalDeterministic(response)
 }
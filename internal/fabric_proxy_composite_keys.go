@@ -0,0 +1,177 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// compositeKeyNamespace and compositeKeySeparator must match the shim, so that
+// composite keys created by Wasm chaincode can be read by Go chaincode
+const (
+	compositeKeyNamespace = "\x00"
+	compositeKeySeparator = 0x00
+)
+
+// CompositeKeyRequest creates a composite key from an object type and
+// attributes
+type CompositeKeyRequest struct {
+	ObjectType string   `json:"object_type"`
+	Attributes []string `json:"attributes"`
+}
+
+// CompositeKeyResponse contains a composite key
+type CompositeKeyResponse struct {
+	Key string `json:"key"`
+}
+
+// SplitCompositeKeyRequest splits a composite key into its object type and
+// attributes
+type SplitCompositeKeyRequest struct {
+	Key string `json:"key"`
+}
+
+// SplitCompositeKeyResponse contains the object type and attributes of a
+// composite key
+type SplitCompositeKeyResponse struct {
+	ObjectType string   `json:"object_type"`
+	Attributes []string `json:"attributes"`
+}
+
+// GetStateByPartialCompositeKeyRequest opens an iterator over the states
+// with composite keys matching the object type and leading attributes
+type GetStateByPartialCompositeKeyRequest struct {
+	Context    *contract.TransactionContext `json:"context"`
+	ObjectType string                       `json:"object_type"`
+	Attributes []string                     `json:"attributes"`
+}
+
+// GetStateByPartialCompositeKeyWithPaginationRequest opens an iterator over a
+// page of the states with composite keys matching the object type and leading
+// attributes, starting from the bookmark returned with the previous page
+type GetStateByPartialCompositeKeyWithPaginationRequest struct {
+	Context    *contract.TransactionContext `json:"context"`
+	ObjectType string                       `json:"object_type"`
+	Attributes []string                     `json:"attributes"`
+	PageSize   int32                        `json:"page_size"`
+	Bookmark   string                       `json:"bookmark"`
+}
+
+func (proxy *FabricProxy) createCompositeKey(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &CompositeKeyRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[host] CreateCompositeKey object type %s attributes %d\n", request.ObjectType, len(request.Attributes))
+
+	key, err := shim.CreateCompositeKey(request.ObjectType, request.Attributes)
+	if err != nil {
+		return nil, fmt.Errorf("CreateCompositeKey failed: %s", err.Error())
+	}
+
+	log.Printf("[host] CreateCompositeKey done\n")
+	return json.Marshal(&CompositeKeyResponse{Key: key})
+}
+
+func (proxy *FabricProxy) splitCompositeKey(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &SplitCompositeKeyRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[host] SplitCompositeKey key length %d\n", len(request.Key))
+
+	objectType, attributes, err := splitCompositeKey(request.Key)
+	if err != nil {
+		return nil, fmt.Errorf("SplitCompositeKey failed: %s", err.Error())
+	}
+
+	log.Printf("[host] SplitCompositeKey done\n")
+	return json.Marshal(&SplitCompositeKeyResponse{ObjectType: objectType, Attributes: attributes})
+}
+
+// splitCompositeKey splits a composite key in the same way as the shim, but
+// returns an error instead of panicking if the key is not a composite key
+func splitCompositeKey(key string) (string, []string, error) {
+	if len(key) < 2 || key[:1] != compositeKeyNamespace || key[len(key)-1] != compositeKeySeparator {
+		return "", nil, fmt.Errorf("Invalid composite key %q", key)
+	}
+
+	start := 1
+	components := []string{}
+	for i := 1; i < len(key); i++ {
+		if key[i] == compositeKeySeparator {
+			components = append(components, key[start:i])
+			start = i + 1
+		}
+	}
+
+	return components[0], components[1:], nil
+}
+
+func (proxy *FabricProxy) getStateByPartialCompositeKey(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &GetStateByPartialCompositeKeyRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetStateByPartialCompositeKey failed: Missing transaction context")
+	}
+	log.Printf("[host] GetStateByPartialCompositeKey txid %s chid %s object type %s attributes %d\n", context.TransactionId, context.ChannelId, request.ObjectType, len(request.Attributes))
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetStateByPartialCompositeKey failed: %s", err.Error())
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(request.ObjectType, request.Attributes)
+	if err != nil {
+		return nil, fmt.Errorf("GetStateByPartialCompositeKey failed: %s", err.Error())
+	}
+
+	return proxy.openIterator("GetStateByPartialCompositeKey", context, iterator, nil)
+}
+
+// getStateByPartialCompositeKeyWithPagination passes the object type and
+// attributes to the stub, rather than a prefix created by the host, so that
+// the shim selects exactly the same keys as it would for Go chaincode
+func (proxy *FabricProxy) getStateByPartialCompositeKeyWithPagination(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &GetStateByPartialCompositeKeyWithPaginationRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetStateByPartialCompositeKeyWithPagination failed: Missing transaction context")
+	}
+	log.Printf("[host] GetStateByPartialCompositeKeyWithPagination txid %s chid %s object type %s attributes %d page size %d\n", context.TransactionId, context.ChannelId, request.ObjectType, len(request.Attributes), request.PageSize)
+
+	if request.PageSize <= 0 {
+		return nil, fmt.Errorf("GetStateByPartialCompositeKeyWithPagination failed: Invalid page size %d", request.PageSize)
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetStateByPartialCompositeKeyWithPagination failed: %s", err.Error())
+	}
+
+	iterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(request.ObjectType, request.Attributes, request.PageSize, request.Bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("GetStateByPartialCompositeKeyWithPagination failed: %s", err.Error())
+	}
+
+	return proxy.openIterator("GetStateByPartialCompositeKeyWithPagination", context, iterator, newQueryResponseMetadata(metadata))
+}
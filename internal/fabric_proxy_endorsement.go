@@ -0,0 +1,108 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+)
+
+// StateValidationParameterRequest identifies the key to get the key-level
+// endorsement policy for, in the world state or a private data collection
+type StateValidationParameterRequest struct {
+	Context    *contract.TransactionContext `json:"context"`
+	Collection string                       `json:"collection,omitempty"`
+	Key        string                       `json:"key"`
+}
+
+// SetStateValidationParameterRequest sets the key-level endorsement policy
+// for a key. The policy is a marshaled SignaturePolicyEnvelope, which is
+// passed to the stub unchanged.
+type SetStateValidationParameterRequest struct {
+	Context    *contract.TransactionContext `json:"context"`
+	Collection string                       `json:"collection,omitempty"`
+	Key        string                       `json:"key"`
+	Policy     []byte                       `json:"policy"`
+}
+
+// StateValidationParameterResponse contains the key-level endorsement policy
+// for a key, which is nil if the key does not have one
+type StateValidationParameterResponse struct {
+	Policy []byte `json:"policy"`
+}
+
+func (proxy *FabricProxy) getStateValidationParameter(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &StateValidationParameterRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetStateValidationParameter failed: Missing transaction context")
+	}
+	log.Printf("[host] GetStateValidationParameter txid %s chid %s key %s\n", context.TransactionId, context.ChannelId, request.Key)
+	traceKey(ctx, request.Key)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetStateValidationParameter failed: %s", err.Error())
+	}
+
+	var policy []byte
+	if request.Collection != "" {
+		policy, err = stub.GetPrivateDataValidationParameter(request.Collection, request.Key)
+		if err != nil {
+			return nil, fmt.Errorf("GetStateValidationParameter failed for collection %s: %s", request.Collection, err.Error())
+		}
+	} else {
+		policy, err = stub.GetStateValidationParameter(request.Key)
+		if err != nil {
+			return nil, fmt.Errorf("GetStateValidationParameter failed: %s", err.Error())
+		}
+	}
+
+	log.Printf("[host] GetStateValidationParameter done\n")
+	return json.Marshal(&StateValidationParameterResponse{Policy: policy})
+}
+
+func (proxy *FabricProxy) setStateValidationParameter(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &SetStateValidationParameterRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("SetStateValidationParameter failed: Missing transaction context")
+	}
+	log.Printf("[host] SetStateValidationParameter txid %s chid %s key %s policy length %d\n", context.TransactionId, context.ChannelId, request.Key, len(request.Policy))
+	traceKey(ctx, request.Key)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("SetStateValidationParameter failed: %s", err.Error())
+	}
+
+	if request.Collection != "" {
+		err = stub.SetPrivateDataValidationParameter(request.Collection, request.Key, request.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("SetStateValidationParameter failed for collection %s: %s", request.Collection, err.Error())
+		}
+	} else {
+		err = stub.SetStateValidationParameter(request.Key, request.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("SetStateValidationParameter failed: %s", err.Error())
+		}
+	}
+
+	log.Printf("[host] SetStateValidationParameter done\n")
+	return nil, nil
+}
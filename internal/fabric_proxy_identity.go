@@ -0,0 +1,242 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+)
+
+// CreatorResponse contains the serialized identity of the transaction
+// creator, exactly as provided by the stub
+type CreatorResponse struct {
+	Creator []byte `json:"creator"`
+}
+
+// MSPIDResponse contains the MSP ID of the transaction creator
+type MSPIDResponse struct {
+	MSPID string `json:"msp_id"`
+}
+
+// IDResponse contains the unique ID of the transaction creator within its
+// MSP, which is the same as the ID returned by the Go cid package
+type IDResponse struct {
+	ID string `json:"id"`
+}
+
+// AttributeRequest gets the value of an attribute of the transaction creator,
+// or asserts that it has the specified value
+type AttributeRequest struct {
+	Context *contract.TransactionContext `json:"context"`
+	Name    string                       `json:"name"`
+	Value   string                       `json:"value,omitempty"`
+}
+
+// AttributeValueResponse contains the value of an attribute of the transaction
+// creator. Found is false if the creator does not have the attribute, to tell
+// it apart from an attribute with an empty value.
+type AttributeValueResponse struct {
+	Value string `json:"value"`
+	Found bool   `json:"found"`
+}
+
+// AssertAttributeValueResponse contains whether the transaction creator has
+// an attribute, and whether it has the asserted value
+type AssertAttributeValueResponse struct {
+	Found   bool `json:"found"`
+	Matches bool `json:"matches"`
+}
+
+// X509CertificateResponse contains the DER encoded X.509 certificate of the
+// transaction creator, which is nil if the creator was not identified by an
+// X.509 certificate
+type X509CertificateResponse struct {
+	Certificate []byte `json:"certificate"`
+}
+
+func (proxy *FabricProxy) getCreator(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &TransactionRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetCreator failed: Missing transaction context")
+	}
+	log.Printf("[host] GetCreator txid %s chid %s\n", context.TransactionId, context.ChannelId)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetCreator failed: %s", err.Error())
+	}
+
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return nil, fmt.Errorf("GetCreator failed: %s", err.Error())
+	}
+
+	log.Printf("[host] GetCreator done\n")
+	return json.Marshal(&CreatorResponse{Creator: creator})
+}
+
+func (proxy *FabricProxy) getMSPID(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &TransactionRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetMSPID failed: Missing transaction context")
+	}
+	log.Printf("[host] GetMSPID txid %s chid %s\n", context.TransactionId, context.ChannelId)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetMSPID failed: %s", err.Error())
+	}
+
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, fmt.Errorf("GetMSPID failed: %s", err.Error())
+	}
+
+	log.Printf("[host] GetMSPID done\n")
+	return json.Marshal(&MSPIDResponse{MSPID: mspID})
+}
+
+func (proxy *FabricProxy) getX509Certificate(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &TransactionRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetX509Certificate failed: Missing transaction context")
+	}
+	log.Printf("[host] GetX509Certificate txid %s chid %s\n", context.TransactionId, context.ChannelId)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetX509Certificate failed: %s", err.Error())
+	}
+
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return nil, fmt.Errorf("GetX509Certificate failed: %s", err.Error())
+	}
+
+	response := &X509CertificateResponse{}
+	if cert != nil {
+		response.Certificate = cert.Raw
+	}
+
+	log.Printf("[host] GetX509Certificate done\n")
+	return json.Marshal(response)
+}
+
+func (proxy *FabricProxy) getID(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &TransactionRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetID failed: Missing transaction context")
+	}
+	log.Printf("[host] GetID txid %s chid %s\n", context.TransactionId, context.ChannelId)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetID failed: %s", err.Error())
+	}
+
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return nil, fmt.Errorf("GetID failed: %s", err.Error())
+	}
+
+	log.Printf("[host] GetID done\n")
+	return json.Marshal(&IDResponse{ID: id})
+}
+
+// getAttributeValue gets an attribute of the transaction creator from its
+// certificate or idemix credential, the same way as the Go cid package
+func (proxy *FabricProxy) getAttributeValue(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &AttributeRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetAttributeValue failed: Missing transaction context")
+	}
+	log.Printf("[host] GetAttributeValue txid %s chid %s name %s\n", context.TransactionId, context.ChannelId, request.Name)
+
+	if request.Name == "" {
+		return nil, fmt.Errorf("GetAttributeValue failed: Missing attribute name")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetAttributeValue failed: %s", err.Error())
+	}
+
+	value, found, err := cid.GetAttributeValue(stub, request.Name)
+	if err != nil {
+		return nil, fmt.Errorf("GetAttributeValue failed: %s", err.Error())
+	}
+
+	log.Printf("[host] GetAttributeValue done\n")
+	return json.Marshal(&AttributeValueResponse{Value: value, Found: found})
+}
+
+// assertAttributeValue checks an attribute of the transaction creator, which
+// the Go cid package reports as an error if it is missing or has a different
+// value, but which is reported to the guest in the response so that it can
+// tell the two apart
+func (proxy *FabricProxy) assertAttributeValue(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &AttributeRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("AssertAttributeValue failed: Missing transaction context")
+	}
+	log.Printf("[host] AssertAttributeValue txid %s chid %s name %s\n", context.TransactionId, context.ChannelId, request.Name)
+
+	if request.Name == "" {
+		return nil, fmt.Errorf("AssertAttributeValue failed: Missing attribute name")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("AssertAttributeValue failed: %s", err.Error())
+	}
+
+	value, found, err := cid.GetAttributeValue(stub, request.Name)
+	if err != nil {
+		return nil, fmt.Errorf("AssertAttributeValue failed: %s", err.Error())
+	}
+
+	log.Printf("[host] AssertAttributeValue done\n")
+	return json.Marshal(&AssertAttributeValueResponse{Found: found, Matches: found && value == request.Value})
+}
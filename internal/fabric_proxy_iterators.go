@@ -0,0 +1,415 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// DefaultIteratorBatchSize is the number of states returned by IteratorNext
+// when the request does not specify a maximum
+const DefaultIteratorBatchSize = 100
+
+// There are no ledger protos for iterators yet, so the iterator host calls use
+// JSON encoded messages. The transaction context uses the JSON names from
+// the protos.
+
+// GetStateByRangeRequest opens an iterator over the states from the start key
+// (inclusive) to the end key (exclusive). Empty keys mean an open range.
+type GetStateByRangeRequest struct {
+	Context  *contract.TransactionContext `json:"context"`
+	StartKey string                       `json:"start_key"`
+	EndKey   string                       `json:"end_key"`
+}
+
+// GetStateByRangeWithPaginationRequest opens an iterator over a page of the
+// states from the start key (inclusive) to the end key (exclusive), starting
+// from the bookmark returned with the previous page
+type GetStateByRangeWithPaginationRequest struct {
+	Context  *contract.TransactionContext `json:"context"`
+	StartKey string                       `json:"start_key"`
+	EndKey   string                       `json:"end_key"`
+	PageSize int32                        `json:"page_size"`
+	Bookmark string                       `json:"bookmark"`
+}
+
+// GetQueryResultRequest opens an iterator over the results of a rich query,
+// such as a CouchDB selector query
+type GetQueryResultRequest struct {
+	Context *contract.TransactionContext `json:"context"`
+	Query   string                       `json:"query"`
+}
+
+// GetQueryResultWithPaginationRequest opens an iterator over a page of the
+// results of a rich query, starting from the bookmark returned with the
+// previous page
+type GetQueryResultWithPaginationRequest struct {
+	Context  *contract.TransactionContext `json:"context"`
+	Query    string                       `json:"query"`
+	PageSize int32                        `json:"page_size"`
+	Bookmark string                       `json:"bookmark"`
+}
+
+// GetHistoryForKeyRequest opens an iterator over the modification history of
+// a key
+type GetHistoryForKeyRequest struct {
+	Context *contract.TransactionContext `json:"context"`
+	Key     string                       `json:"key"`
+}
+
+// QueryResponseMetadata describes a page of results, including the bookmark
+// to use for the next page. The bookmark is returned exactly as Fabric returned
+// it, so that it can be saved and used to resume the query in a later
+// transaction.
+type QueryResponseMetadata struct {
+	FetchedRecordsCount int32  `json:"fetched_records_count"`
+	Bookmark            string `json:"bookmark"`
+}
+
+// IteratorResponse identifies an iterator opened by the host, with the
+// metadata for paginated queries
+type IteratorResponse struct {
+	IteratorID string                 `json:"iterator_id"`
+	Metadata   *QueryResponseMetadata `json:"metadata,omitempty"`
+}
+
+// IteratorNextRequest asks for the next batch of states from an iterator
+type IteratorNextRequest struct {
+	Context    *contract.TransactionContext `json:"context"`
+	IteratorID string                       `json:"iterator_id"`
+	MaxResults int                          `json:"max_results,omitempty"`
+}
+
+// IteratorNextResponse contains the next batch of states from an iterator,
+// and whether there are more states to come
+type IteratorNextResponse struct {
+	States  []*contract.State `json:"states"`
+	HasMore bool              `json:"has_more"`
+}
+
+// HistoryIteratorNextResponse contains the next batch of modifications from a
+// history iterator, and whether there are more modifications to come
+type HistoryIteratorNextResponse struct {
+	Modifications []*KeyModification `json:"modifications"`
+	HasMore       bool               `json:"has_more"`
+}
+
+// KeyModification is one entry in the history of a key. Deleted entries have
+// IsDelete set, and no value.
+type KeyModification struct {
+	TxID      string    `json:"tx_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Value     []byte    `json:"value"`
+	IsDelete  bool      `json:"is_delete"`
+}
+
+// IteratorCloseRequest closes an iterator which is no longer needed
+type IteratorCloseRequest struct {
+	Context    *contract.TransactionContext `json:"context"`
+	IteratorID string                       `json:"iterator_id"`
+}
+
+func (proxy *FabricProxy) getStateByRange(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &GetStateByRangeRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetStateByRange failed: Missing transaction context")
+	}
+	log.Printf("[host] GetStateByRange txid %s chid %s start %s end %s\n", context.TransactionId, context.ChannelId, request.StartKey, request.EndKey)
+	traceRange(ctx, request.StartKey, request.EndKey)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetStateByRange failed: %s", err.Error())
+	}
+
+	iterator, err := stub.GetStateByRange(request.StartKey, request.EndKey)
+	if err != nil {
+		return nil, fmt.Errorf("GetStateByRange failed: %s", err.Error())
+	}
+
+	return proxy.openIterator("GetStateByRange", context, iterator, nil)
+}
+
+func (proxy *FabricProxy) getStateByRangeWithPagination(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &GetStateByRangeWithPaginationRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetStateByRangeWithPagination failed: Missing transaction context")
+	}
+	log.Printf("[host] GetStateByRangeWithPagination txid %s chid %s start %s end %s page size %d\n", context.TransactionId, context.ChannelId, request.StartKey, request.EndKey, request.PageSize)
+	traceRange(ctx, request.StartKey, request.EndKey)
+
+	if request.PageSize <= 0 {
+		return nil, fmt.Errorf("GetStateByRangeWithPagination failed: Invalid page size %d", request.PageSize)
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetStateByRangeWithPagination failed: %s", err.Error())
+	}
+
+	iterator, metadata, err := stub.GetStateByRangeWithPagination(request.StartKey, request.EndKey, request.PageSize, request.Bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("GetStateByRangeWithPagination failed: %s", err.Error())
+	}
+
+	return proxy.openIterator("GetStateByRangeWithPagination", context, iterator, newQueryResponseMetadata(metadata))
+}
+
+func (proxy *FabricProxy) getQueryResult(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &GetQueryResultRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetQueryResult failed: Missing transaction context")
+	}
+	log.Printf("[host] GetQueryResult txid %s chid %s query %s\n", context.TransactionId, context.ChannelId, request.Query)
+
+	if request.Query == "" {
+		return nil, fmt.Errorf("GetQueryResult failed: Missing query")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetQueryResult failed: %s", err.Error())
+	}
+
+	iterator, err := stub.GetQueryResult(request.Query)
+	if err != nil {
+		return nil, fmt.Errorf("GetQueryResult failed: Query rejected by state database: %s", err.Error())
+	}
+
+	return proxy.openIterator("GetQueryResult", context, iterator, nil)
+}
+
+func (proxy *FabricProxy) getQueryResultWithPagination(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &GetQueryResultWithPaginationRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetQueryResultWithPagination failed: Missing transaction context")
+	}
+	log.Printf("[host] GetQueryResultWithPagination txid %s chid %s query %s page size %d\n", context.TransactionId, context.ChannelId, request.Query, request.PageSize)
+
+	if request.Query == "" {
+		return nil, fmt.Errorf("GetQueryResultWithPagination failed: Missing query")
+	}
+	if request.PageSize <= 0 {
+		return nil, fmt.Errorf("GetQueryResultWithPagination failed: Invalid page size %d", request.PageSize)
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetQueryResultWithPagination failed: %s", err.Error())
+	}
+
+	iterator, metadata, err := stub.GetQueryResultWithPagination(request.Query, request.PageSize, request.Bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("GetQueryResultWithPagination failed: Query rejected by state database: %s", err.Error())
+	}
+
+	return proxy.openIterator("GetQueryResultWithPagination", context, iterator, newQueryResponseMetadata(metadata))
+}
+
+// newQueryResponseMetadata converts the metadata returned by the stub
+func newQueryResponseMetadata(metadata *peer.QueryResponseMetadata) *QueryResponseMetadata {
+	return &QueryResponseMetadata{
+		FetchedRecordsCount: metadata.GetFetchedRecordsCount(),
+		Bookmark:            metadata.GetBookmark(),
+	}
+}
+
+// openIterator stores a new iterator for the transaction and returns its ID,
+// along with any query metadata
+func (proxy *FabricProxy) openIterator(operation string, context *contract.TransactionContext, iterator shim.CommonIteratorInterface, metadata *QueryResponseMetadata) ([]byte, error) {
+	id, err := proxy.contextStore.PutIterator(context, iterator)
+	if err != nil {
+		iterator.Close()
+		return nil, fmt.Errorf("%s failed: %s", operation, err.Error())
+	}
+
+	log.Printf("[host] %s done, iterator %s\n", operation, id)
+	return json.Marshal(&IteratorResponse{IteratorID: id, Metadata: metadata})
+}
+
+func (proxy *FabricProxy) iteratorNext(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &IteratorNextRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("IteratorNext failed: Missing transaction context")
+	}
+	log.Printf("[host] IteratorNext txid %s chid %s iterator %s\n", context.TransactionId, context.ChannelId, request.IteratorID)
+
+	iterator, err := proxy.getIterator(ctx, context, request.IteratorID)
+	if err != nil {
+		return nil, fmt.Errorf("IteratorNext failed: %s", err.Error())
+	}
+
+	stateIterator, ok := iterator.(shim.StateQueryIteratorInterface)
+	if !ok {
+		return nil, fmt.Errorf("IteratorNext failed: Iterator %s is not a state iterator", request.IteratorID)
+	}
+
+	maxResults := request.MaxResults
+	if maxResults <= 0 {
+		maxResults = DefaultIteratorBatchSize
+	}
+
+	response := &IteratorNextResponse{States: []*contract.State{}}
+	for len(response.States) < maxResults && stateIterator.HasNext() {
+		queryResponse, err := stateIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("IteratorNext failed: %s", err.Error())
+		}
+
+		state := &contract.State{}
+		state.Key = queryResponse.Key
+		state.Value = queryResponse.Value
+
+		response.States = append(response.States, state)
+	}
+	response.HasMore = stateIterator.HasNext()
+
+	log.Printf("[host] IteratorNext done, %d states\n", len(response.States))
+	return json.Marshal(response)
+}
+
+func (proxy *FabricProxy) getHistoryForKey(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &GetHistoryForKeyRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetHistoryForKey failed: Missing transaction context")
+	}
+	log.Printf("[host] GetHistoryForKey txid %s chid %s key %s\n", context.TransactionId, context.ChannelId, request.Key)
+	traceKey(ctx, request.Key)
+
+	if request.Key == "" {
+		return nil, fmt.Errorf("GetHistoryForKey failed: Missing key")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetHistoryForKey failed: %s", err.Error())
+	}
+
+	iterator, err := stub.GetHistoryForKey(request.Key)
+	if err != nil {
+		return nil, fmt.Errorf("GetHistoryForKey failed: Check the history database is enabled on the peer: %s", err.Error())
+	}
+
+	return proxy.openIterator("GetHistoryForKey", context, iterator, nil)
+}
+
+func (proxy *FabricProxy) historyIteratorNext(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &IteratorNextRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("HistoryIteratorNext failed: Missing transaction context")
+	}
+	log.Printf("[host] HistoryIteratorNext txid %s chid %s iterator %s\n", context.TransactionId, context.ChannelId, request.IteratorID)
+
+	iterator, err := proxy.getIterator(ctx, context, request.IteratorID)
+	if err != nil {
+		return nil, fmt.Errorf("HistoryIteratorNext failed: %s", err.Error())
+	}
+
+	historyIterator, ok := iterator.(shim.HistoryQueryIteratorInterface)
+	if !ok {
+		return nil, fmt.Errorf("HistoryIteratorNext failed: Iterator %s is not a history iterator", request.IteratorID)
+	}
+
+	maxResults := request.MaxResults
+	if maxResults <= 0 {
+		maxResults = DefaultIteratorBatchSize
+	}
+
+	response := &HistoryIteratorNextResponse{Modifications: []*KeyModification{}}
+	for len(response.Modifications) < maxResults && historyIterator.HasNext() {
+		keyModification, err := historyIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("HistoryIteratorNext failed: %s", err.Error())
+		}
+
+		modification := &KeyModification{
+			TxID:     keyModification.TxId,
+			IsDelete: keyModification.IsDelete,
+		}
+		if timestamp := keyModification.Timestamp; timestamp != nil {
+			modification.Timestamp = time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC()
+		}
+		if !modification.IsDelete {
+			modification.Value = keyModification.Value
+		}
+
+		response.Modifications = append(response.Modifications, modification)
+	}
+	response.HasMore = historyIterator.HasNext()
+
+	log.Printf("[host] HistoryIteratorNext done, %d modifications\n", len(response.Modifications))
+	return json.Marshal(response)
+}
+
+func (proxy *FabricProxy) iteratorClose(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &IteratorCloseRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("IteratorClose failed: Missing transaction context")
+	}
+	log.Printf("[host] IteratorClose txid %s chid %s iterator %s\n", context.TransactionId, context.ChannelId, request.IteratorID)
+
+	err = proxy.removeIterator(ctx, context, request.IteratorID)
+	if err != nil {
+		return nil, fmt.Errorf("IteratorClose failed: %s", err.Error())
+	}
+
+	log.Printf("[host] IteratorClose done\n")
+	return nil, nil
+}
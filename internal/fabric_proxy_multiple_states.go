@@ -0,0 +1,75 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+)
+
+// GetMultipleStatesRequest reads several keys in one host call, from world
+// state, or from a private data collection if one is specified
+type GetMultipleStatesRequest struct {
+	Context    *contract.TransactionContext `json:"context"`
+	Collection string                       `json:"collection,omitempty"`
+	Keys       []string                     `json:"keys"`
+}
+
+// StateEntry is the value of a key read by GetMultipleStates. Found is false
+// if the key does not exist, in which case the value is nil.
+type StateEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	Found bool   `json:"found"`
+}
+
+// GetMultipleStatesResponse contains an entry for each requested key, in the
+// order they were requested, including keys which do not exist
+type GetMultipleStatesResponse struct {
+	States []StateEntry `json:"states"`
+}
+
+func (proxy *FabricProxy) getMultipleStates(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &GetMultipleStatesRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetMultipleStates failed: Missing transaction context")
+	}
+	log.Printf("[host] GetMultipleStates txid %s chid %s collection %s keys %d\n", context.TransactionId, context.ChannelId, request.Collection, len(request.Keys))
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetMultipleStates failed: %s", err.Error())
+	}
+
+	response := &GetMultipleStatesResponse{States: make([]StateEntry, 0, len(request.Keys))}
+	for _, key := range request.Keys {
+		var value []byte
+		if request.Collection != "" {
+			value, err = stub.GetPrivateData(request.Collection, key)
+			if err != nil {
+				return nil, fmt.Errorf("GetMultipleStates failed for collection %s key %s: %s", request.Collection, key, err.Error())
+			}
+		} else {
+			value, err = stub.GetState(key)
+			if err != nil {
+				return nil, fmt.Errorf("GetMultipleStates failed for key %s: %s", key, err.Error())
+			}
+		}
+
+		response.States = append(response.States, StateEntry{Key: key, Value: value, Found: value != nil})
+	}
+
+	log.Printf("[host] GetMultipleStates done\n")
+	return json.Marshal(response)
+}
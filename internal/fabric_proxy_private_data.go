@@ -0,0 +1,235 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// PrivateDataRequest identifies a key in a private data collection, for the
+// GetPrivateData, GetPrivateDataHash, DelPrivateData and PurgePrivateData host
+// calls
+type PrivateDataRequest struct {
+	Context    *contract.TransactionContext `json:"context"`
+	Collection string                       `json:"collection"`
+	Key        string                       `json:"key"`
+}
+
+// PutPrivateDataRequest writes a value to a key in a private data collection
+type PutPrivateDataRequest struct {
+	Context    *contract.TransactionContext `json:"context"`
+	Collection string                       `json:"collection"`
+	Key        string                       `json:"key"`
+	Value      []byte                       `json:"value"`
+}
+
+// PrivateDataResponse contains the value of a key in a private data
+// collection, which is nil if the key does not exist
+type PrivateDataResponse struct {
+	Value []byte `json:"value"`
+}
+
+// privateDataPurger is implemented by chaincode stubs from versions of the
+// Fabric chaincode shim which support purging private data, which was added in
+// Fabric v2.5
+type privateDataPurger interface {
+	PurgePrivateData(collection, key string) error
+}
+
+// errPurgeNotSupported is returned by purgeStubPrivateData when the stub does
+// not support purging private data
+var errPurgeNotSupported = errors.New("Not supported by this version of the Fabric chaincode shim, which requires Fabric v2.5 or later")
+
+// purgeStubPrivateData purges a private data value with the stub, if it
+// supports purging. Stubs which wrap another stub use this to pass purges on,
+// since embedding the stub interface hides the PurgePrivateData method.
+func purgeStubPrivateData(stub shim.ChaincodeStubInterface, collection, key string) error {
+	purger, ok := stub.(privateDataPurger)
+	if !ok {
+		return errPurgeNotSupported
+	}
+
+	return purger.PurgePrivateData(collection, key)
+}
+
+// PrivateDataHashResponse contains the hash of the value of a key in a private
+// data collection, which is nil if the key does not exist
+type PrivateDataHashResponse struct {
+	Hash []byte `json:"hash"`
+}
+
+func (proxy *FabricProxy) getPrivateData(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &PrivateDataRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetPrivateData failed: Missing transaction context")
+	}
+	log.Printf("[host] GetPrivateData txid %s chid %s collection %s key %s\n", context.TransactionId, context.ChannelId, request.Collection, request.Key)
+	traceKey(ctx, request.Key)
+
+	if request.Collection == "" {
+		return nil, fmt.Errorf("GetPrivateData failed: Missing collection")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetPrivateData failed: %s", err.Error())
+	}
+
+	value, err := stub.GetPrivateData(request.Collection, request.Key)
+	if err != nil {
+		return nil, fmt.Errorf("GetPrivateData failed for collection %s: %s", request.Collection, err.Error())
+	}
+
+	log.Printf("[host] GetPrivateData done\n")
+	return json.Marshal(&PrivateDataResponse{Value: value})
+}
+
+// getPrivateDataHash returns the hash of a private data value, which is
+// available to peers that are not members of the collection and so cannot read
+// the value itself
+func (proxy *FabricProxy) getPrivateDataHash(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &PrivateDataRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetPrivateDataHash failed: Missing transaction context")
+	}
+	log.Printf("[host] GetPrivateDataHash txid %s chid %s collection %s key %s\n", context.TransactionId, context.ChannelId, request.Collection, request.Key)
+	traceKey(ctx, request.Key)
+
+	if request.Collection == "" {
+		return nil, fmt.Errorf("GetPrivateDataHash failed: Missing collection")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetPrivateDataHash failed: %s", err.Error())
+	}
+
+	hash, err := stub.GetPrivateDataHash(request.Collection, request.Key)
+	if err != nil {
+		return nil, fmt.Errorf("GetPrivateDataHash failed for collection %s: %s", request.Collection, err.Error())
+	}
+
+	log.Printf("[host] GetPrivateDataHash done\n")
+	return json.Marshal(&PrivateDataHashResponse{Hash: hash})
+}
+
+func (proxy *FabricProxy) putPrivateData(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &PutPrivateDataRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("PutPrivateData failed: Missing transaction context")
+	}
+	log.Printf("[host] PutPrivateData txid %s chid %s collection %s key %s value length %d\n", context.TransactionId, context.ChannelId, request.Collection, request.Key, len(request.Value))
+	traceKey(ctx, request.Key)
+
+	if request.Collection == "" {
+		return nil, fmt.Errorf("PutPrivateData failed: Missing collection")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("PutPrivateData failed: %s", err.Error())
+	}
+
+	err = stub.PutPrivateData(request.Collection, request.Key, request.Value)
+	if err != nil {
+		return nil, fmt.Errorf("PutPrivateData failed for collection %s: %s", request.Collection, err.Error())
+	}
+
+	log.Printf("[host] PutPrivateData done\n")
+	return nil, nil
+}
+
+func (proxy *FabricProxy) delPrivateData(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &PrivateDataRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("DelPrivateData failed: Missing transaction context")
+	}
+	log.Printf("[host] DelPrivateData txid %s chid %s collection %s key %s\n", context.TransactionId, context.ChannelId, request.Collection, request.Key)
+	traceKey(ctx, request.Key)
+
+	if request.Collection == "" {
+		return nil, fmt.Errorf("DelPrivateData failed: Missing collection")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("DelPrivateData failed: %s", err.Error())
+	}
+
+	err = stub.DelPrivateData(request.Collection, request.Key)
+	if err != nil {
+		return nil, fmt.Errorf("DelPrivateData failed for collection %s: %s", request.Collection, err.Error())
+	}
+
+	log.Printf("[host] DelPrivateData done\n")
+	return nil, nil
+}
+
+// purgePrivateData permanently removes a private data value, including any
+// historical versions, unlike delPrivateData
+func (proxy *FabricProxy) purgePrivateData(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &PrivateDataRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("PurgePrivateData failed: Missing transaction context")
+	}
+	log.Printf("[host] PurgePrivateData txid %s chid %s collection %s key %s\n", context.TransactionId, context.ChannelId, request.Collection, request.Key)
+	traceKey(ctx, request.Key)
+
+	if request.Collection == "" {
+		return nil, fmt.Errorf("PurgePrivateData failed: Missing collection")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("PurgePrivateData failed: %s", err.Error())
+	}
+
+	err = purgeStubPrivateData(stub, request.Collection, request.Key)
+	if errors.Is(err, errPurgeNotSupported) {
+		return nil, fmt.Errorf("PurgePrivateData failed: %s", err.Error())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("PurgePrivateData failed for collection %s: %s", request.Collection, err.Error())
+	}
+
+	log.Printf("[host] PurgePrivateData done\n")
+	return nil, nil
+}
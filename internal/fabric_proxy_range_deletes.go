@@ -0,0 +1,116 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+)
+
+// DefaultMaxRangeDeletes is the most keys a single DelStateByRange host call
+// deletes unless WithMaxRangeDeletes is used
+const DefaultMaxRangeDeletes = 1000
+
+// WithMaxRangeDeletes sets the most keys a single DelStateByRange host call
+// deletes, so that one call cannot build an arbitrarily large write set. A
+// guest can ask for fewer, but not more. A limit of zero or less uses
+// DefaultMaxRangeDeletes.
+func WithMaxRangeDeletes(limit int) FabricProxyOption {
+	return func(proxy *FabricProxy) {
+		proxy.maxRangeDeletes = limit
+	}
+}
+
+// DelStateByRangeRequest deletes the states from the start key (inclusive) to
+// the end key (exclusive), up to the maximum number of keys if one is
+// specified. Empty keys mean an open range.
+type DelStateByRangeRequest struct {
+	Context  *contract.TransactionContext `json:"context"`
+	StartKey string                       `json:"start_key"`
+	EndKey   string                       `json:"end_key"`
+	MaxKeys  int                          `json:"max_keys,omitempty"`
+}
+
+// DelStateByRangeResponse is the number of keys deleted. If the limit was
+// reached before the end of the range, HasMore is set and NextKey is the start
+// key for another DelStateByRange call to carry on from.
+type DelStateByRangeResponse struct {
+	Deleted int    `json:"deleted"`
+	HasMore bool   `json:"has_more"`
+	NextKey string `json:"next_key,omitempty"`
+}
+
+// rangeDeleteLimit returns the most keys to delete for a request, which is the
+// smaller of the limits of the request and the FabricProxy
+func (proxy *FabricProxy) rangeDeleteLimit(requested int) int {
+	limit := proxy.maxRangeDeletes
+	if limit <= 0 {
+		limit = DefaultMaxRangeDeletes
+	}
+	if requested > 0 && requested < limit {
+		return requested
+	}
+	return limit
+}
+
+func (proxy *FabricProxy) delStateByRange(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &DelStateByRangeRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("DelStateByRange failed: Missing transaction context")
+	}
+	limit := proxy.rangeDeleteLimit(request.MaxKeys)
+	log.Printf("[host] DelStateByRange txid %s chid %s start %s end %s limit %d\n", context.TransactionId, context.ChannelId, request.StartKey, request.EndKey, limit)
+	traceRange(ctx, request.StartKey, request.EndKey)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("DelStateByRange failed: %s", err.Error())
+	}
+
+	iterator, err := stub.GetStateByRange(request.StartKey, request.EndKey)
+	if err != nil {
+		return nil, fmt.Errorf("DelStateByRange failed: %s", err.Error())
+	}
+
+	// The keys are read before deleting any of them, so that the deletes
+	// cannot affect the iterator
+	keys := []string{}
+	response := &DelStateByRangeResponse{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return nil, fmt.Errorf("DelStateByRange failed: %s", err.Error())
+		}
+		if len(keys) == limit {
+			response.HasMore = true
+			response.NextKey = kv.GetKey()
+			break
+		}
+		keys = append(keys, kv.GetKey())
+	}
+	if err := iterator.Close(); err != nil {
+		return nil, fmt.Errorf("DelStateByRange failed: %s", err.Error())
+	}
+
+	for _, key := range keys {
+		if err := stub.DelState(key); err != nil {
+			return nil, fmt.Errorf("DelStateByRange failed for key %s after deleting %d keys: %s", key, response.Deleted, err.Error())
+		}
+		response.Deleted++
+	}
+
+	log.Printf("[host] DelStateByRange deleted %d keys, has more %t\n", response.Deleted, response.HasMore)
+	return json.Marshal(response)
+}
@@ -0,0 +1,110 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"log"
+	"sync"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// WithReadCache caches the world state read by each transaction, so that
+// reading the same key again in the transaction does not call the stub. Writes
+// and deletes made by the transaction update the cache, so later reads in the
+// same transaction see them, unlike reading from the stub, where Fabric
+// returns the value from before the transaction.
+//
+// The cache for a transaction is discarded when its stub is removed from the
+// ContextStore, so it is never shared between transactions. Transactions which
+// are only in the invocation context, and not in the ContextStore, are not
+// cached. Writes buffered by a simulated invocation do not update the cache.
+func WithReadCache() FabricProxyOption {
+	return func(proxy *FabricProxy) {
+		proxy.readCache = true
+	}
+}
+
+// readCache holds the world state read or written by one transaction, where a
+// nil value is a key which does not exist or has been deleted
+type readCache struct {
+	mutex  sync.Mutex
+	states map[string][]byte
+}
+
+func (cache *readCache) get(key string) ([]byte, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	value, ok := cache.states[key]
+	return value, ok
+}
+
+func (cache *readCache) put(key string, value []byte) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.states[key] = value
+}
+
+// cachedStub is a stub which reads the world state through the cache for the
+// transaction, and passes everything else to the stub it wraps
+type cachedStub struct {
+	shim.ChaincodeStubInterface
+	cache *readCache
+}
+
+// withReadCache wraps the stub for a transaction in the ContextStore with the
+// cache for the transaction, if the proxy caches reads
+func (proxy *FabricProxy) withReadCache(key stubKey, stub shim.ChaincodeStubInterface) shim.ChaincodeStubInterface {
+	if !proxy.readCache {
+		return stub
+	}
+
+	cache := proxy.contextStore.readCache(key)
+	if cache == nil {
+		return stub
+	}
+
+	return &cachedStub{ChaincodeStubInterface: stub, cache: cache}
+}
+
+func (stub *cachedStub) GetState(key string) ([]byte, error) {
+	if value, ok := stub.cache.get(key); ok {
+		log.Printf("[host] Cached GetState key %s\n", key)
+		return append([]byte(nil), value...), nil
+	}
+
+	value, err := stub.ChaincodeStubInterface.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	stub.cache.put(key, append([]byte(nil), value...))
+
+	return value, nil
+}
+
+func (stub *cachedStub) PutState(key string, value []byte) error {
+	if err := stub.ChaincodeStubInterface.PutState(key, value); err != nil {
+		return err
+	}
+	stub.cache.put(key, append([]byte{}, value...))
+
+	return nil
+}
+
+func (stub *cachedStub) DelState(key string) error {
+	if err := stub.ChaincodeStubInterface.DelState(key); err != nil {
+		return err
+	}
+	stub.cache.put(key, nil)
+
+	return nil
+}
+
+// PurgePrivateData passes the purge to the wrapped stub, if it supports
+// purging, since private data is not cached
+func (stub *cachedStub) PurgePrivateData(collection, key string) error {
+	return purgeStubPrivateData(stub.ChaincodeStubInterface, collection, key)
+}
@@ -0,0 +1,118 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+type simulationKey struct{}
+
+// StateWrite is a write buffered by a simulated invocation, to world state if
+// there is no collection, or otherwise to private data
+type StateWrite struct {
+	Collection string
+	Key        string
+	Value      []byte
+	// IsDelete is set for deletes, which have no value
+	IsDelete bool
+	// IsPurge is set for private data purges, which have no value
+	IsPurge bool
+}
+
+// WriteSet is the writes buffered by a simulated invocation
+type WriteSet struct {
+	mutex  sync.Mutex
+	writes []StateWrite
+}
+
+// Writes returns the buffered writes in the order the guest made them
+func (ws *WriteSet) Writes() []StateWrite {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	return append([]StateWrite(nil), ws.writes...)
+}
+
+func (ws *WriteSet) add(write StateWrite) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	ws.writes = append(ws.writes, write)
+}
+
+// WithSimulation returns a context which makes the FabricProxy buffer every
+// state and private data write made by the guest while invoking an operation
+// with that context, instead of passing them to the stub, so that the effect
+// of a transaction can be previewed without changing its write set. Reads
+// still go to the stub, and, as for Fabric, do not see the buffered writes of
+// the same transaction. The buffered writes are added to the returned WriteSet.
+func WithSimulation(ctx context.Context) (context.Context, *WriteSet) {
+	writeSet := &WriteSet{}
+	return context.WithValue(ctx, simulationKey{}, writeSet), writeSet
+}
+
+// Simulate invokes a Wasm guest operation like InvokeWasmOperation using
+// WithSimulation, returning the result along with the writes the guest made
+// instead of passing them to the stub
+func (wg *WasmGuest) Simulate(ctx context.Context, operation string, payload []byte) ([]byte, *WriteSet, error) {
+	ctx, writeSet := WithSimulation(ctx)
+	result, err := wg.InvokeWasmOperation(ctx, operation, payload)
+
+	return result, writeSet, err
+}
+
+// simulatedStub is a stub which buffers writes in a WriteSet, and passes
+// everything else to the stub it wraps
+type simulatedStub struct {
+	shim.ChaincodeStubInterface
+	writeSet *WriteSet
+}
+
+// simulate wraps the stub for the transaction of a host call if the context
+// is simulating an invocation
+func simulate(ctx context.Context, stub shim.ChaincodeStubInterface) shim.ChaincodeStubInterface {
+	writeSet, ok := ctx.Value(simulationKey{}).(*WriteSet)
+	if !ok {
+		return stub
+	}
+
+	return &simulatedStub{ChaincodeStubInterface: stub, writeSet: writeSet}
+}
+
+func (stub *simulatedStub) PutState(key string, value []byte) error {
+	log.Printf("[host] Simulating PutState key %s\n", key)
+	stub.writeSet.add(StateWrite{Key: key, Value: value})
+	return nil
+}
+
+func (stub *simulatedStub) DelState(key string) error {
+	log.Printf("[host] Simulating DelState key %s\n", key)
+	stub.writeSet.add(StateWrite{Key: key, IsDelete: true})
+	return nil
+}
+
+func (stub *simulatedStub) PutPrivateData(collection, key string, value []byte) error {
+	log.Printf("[host] Simulating PutPrivateData collection %s key %s\n", collection, key)
+	stub.writeSet.add(StateWrite{Collection: collection, Key: key, Value: value})
+	return nil
+}
+
+func (stub *simulatedStub) DelPrivateData(collection, key string) error {
+	log.Printf("[host] Simulating DelPrivateData collection %s key %s\n", collection, key)
+	stub.writeSet.add(StateWrite{Collection: collection, Key: key, IsDelete: true})
+	return nil
+}
+
+// PurgePrivateData buffers the purge, whether or not the wrapped stub
+// supports purging private data
+func (stub *simulatedStub) PurgePrivateData(collection, key string) error {
+	log.Printf("[host] Simulating PurgePrivateData collection %s key %s\n", collection, key)
+	stub.writeSet.add(StateWrite{Collection: collection, Key: key, IsPurge: true})
+	return nil
+}
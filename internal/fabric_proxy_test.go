@@ -5,8 +5,28 @@ package internal_test
 
 import (
 	"context"
-
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	legacyproto "github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -838,6 +858,2052 @@ var _ = Describe("FabricProxy", func() {
 				Expect(endKey).To(Equal(""), "Should call GetStateByRange with an unspecified end key")
 			})
 		})
-	})
 
-})
+		Context("With a GetMultipleStates request", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetStateStub = func(key string) ([]byte, error) {
+					if key == "missing" {
+						return nil, nil
+					}
+					return []byte("value " + key), nil
+				}
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should return an entry for every key in order, including missing keys", func() {
+				payload, _ := json.Marshal(&internal.GetMultipleStatesRequest{Context: context, Keys: []string{"b", "missing", "a"}})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetMultipleStates", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.GetMultipleStatesResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.States).To(Equal([]internal.StateEntry{
+					{Key: "b", Value: []byte("value b"), Found: true},
+					{Key: "missing"},
+					{Key: "a", Value: []byte("value a"), Found: true},
+				}))
+				Expect(stub.GetStateCallCount()).To(Equal(3))
+			})
+
+			It("should return an empty list if no keys are requested", func() {
+				payload, _ := json.Marshal(&internal.GetMultipleStatesRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetMultipleStates", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal(`{"states":[]}`))
+			})
+
+			It("should read private data from a collection", func() {
+				stub.GetPrivateDataReturns([]byte("secret"), nil)
+
+				payload, _ := json.Marshal(&internal.GetMultipleStatesRequest{Context: context, Collection: "orgs", Keys: []string{"007"}})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetMultipleStates", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				collection, key := stub.GetPrivateDataArgsForCall(0)
+				Expect(collection).To(Equal("orgs"))
+				Expect(key).To(Equal("007"))
+				Expect(stub.GetStateCallCount()).To(Equal(0))
+
+				response := &internal.GetMultipleStatesResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.States).To(Equal([]internal.StateEntry{{Key: "007", Value: []byte("secret"), Found: true}}))
+			})
+
+			It("should fail if any key cannot be read", func() {
+				stub.GetStateStub = nil
+				stub.GetStateReturns(nil, errors.New("ledger unavailable"))
+
+				payload, _ := json.Marshal(&internal.GetMultipleStatesRequest{Context: context, Keys: []string{"a", "b"}})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetMultipleStates", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetMultipleStates failed for key a: ledger unavailable"))
+			})
+
+			It("should fail without a transaction context", func() {
+				payload, _ := json.Marshal(&internal.GetMultipleStatesRequest{Keys: []string{"a"}})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetMultipleStates", payload)
+				Expect(err).To(MatchError("GetMultipleStates failed: Missing transaction context"))
+			})
+		})
+
+		Context("With a GetStateByRange request", func() {
+			var (
+				context *contract.TransactionContext
+				sqi     *fakes.StateQueryIteratorInterface
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				sqi = &fakes.StateQueryIteratorInterface{}
+				sqi.HasNextReturnsOnCall(0, true)
+				sqi.HasNextReturnsOnCall(1, true)
+				sqi.HasNextReturnsOnCall(2, true)
+				sqi.HasNextReturnsOnCall(3, false)
+				sqi.NextReturnsOnCall(0, &queryresult.KV{
+					Key:   "007",
+					Value: []byte("bond"),
+				}, nil)
+				sqi.NextReturnsOnCall(1, &queryresult.KV{
+					Key:   "008",
+					Value: []byte("not bond"),
+				}, nil)
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetStateByRangeReturns(sqi, nil)
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			openIterator := func(startKey, endKey string) string {
+				payload, _ := json.Marshal(&internal.GetStateByRangeRequest{Context: context, StartKey: startKey, EndKey: endKey})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRange", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.IteratorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.IteratorID).NotTo(BeEmpty())
+				return response.IteratorID
+			}
+
+			next := func(iteratorID string, maxResults int) *internal.IteratorNextResponse {
+				payload, _ := json.Marshal(&internal.IteratorNextRequest{Context: context, IteratorID: iteratorID, MaxResults: maxResults})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorNext", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.IteratorNextResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				return response
+			}
+
+			It("should open an iterator over the specified range", func() {
+				openIterator("001", "009")
+
+				Expect(stub.GetStateByRangeCallCount()).To(Equal(1), "Should call GetStateByRange once")
+				startKey, endKey := stub.GetStateByRangeArgsForCall(0)
+				Expect(startKey).To(Equal("001"), "Should call GetStateByRange with specified start key")
+				Expect(endKey).To(Equal("009"), "Should call GetStateByRange with specified end key")
+				Expect(sqi.NextCallCount()).To(Equal(0), "Should not read any states until asked")
+			})
+
+			It("should pass an open range on to the stub", func() {
+				openIterator("", "")
+
+				startKey, endKey := stub.GetStateByRangeArgsForCall(0)
+				Expect(startKey).To(Equal(""))
+				Expect(endKey).To(Equal(""))
+			})
+
+			It("should return the states in batches", func() {
+				iteratorID := openIterator("001", "009")
+
+				response := next(iteratorID, 1)
+				Expect(response.States).To(HaveLen(1))
+				Expect(response.States[0].Key).To(Equal("007"))
+				Expect(response.States[0].Value).To(Equal([]byte("bond")))
+				Expect(response.HasMore).To(BeTrue())
+
+				response = next(iteratorID, 1)
+				Expect(response.States).To(HaveLen(1))
+				Expect(response.States[0].Key).To(Equal("008"))
+				Expect(response.States[0].Value).To(Equal([]byte("not bond")))
+				Expect(response.HasMore).To(BeFalse())
+			})
+
+			It("should return an empty batch for an empty range", func() {
+				empty := &fakes.StateQueryIteratorInterface{}
+				stub.GetStateByRangeReturns(empty, nil)
+				iteratorID := openIterator("100", "200")
+
+				response := next(iteratorID, 0)
+				Expect(response.States).To(BeEmpty())
+				Expect(response.HasMore).To(BeFalse())
+			})
+
+			It("should close an iterator", func() {
+				iteratorID := openIterator("001", "009")
+
+				payload, _ := json.Marshal(&internal.IteratorCloseRequest{Context: context, IteratorID: iteratorID})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorClose", payload)
+				Expect(result).To(BeNil())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(sqi.CloseCallCount()).To(Equal(1))
+
+				payload, _ = json.Marshal(&internal.IteratorNextRequest{Context: context, IteratorID: iteratorID})
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorNext", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("IteratorNext failed: No iterator " + iteratorID + " found for transaction context channel1 txn1"))
+			})
+
+			It("should close open iterators when the transaction completes", func() {
+				openIterator("001", "009")
+
+				Expect(contextStore.Remove("channel1", "txn1")).To(Succeed())
+				Expect(sqi.CloseCallCount()).To(Equal(1))
+			})
+
+			It("should not close iterators again when the transaction completes", func() {
+				iteratorID := openIterator("001", "009")
+				Expect(contextStore.OpenIterators("channel1", "txn1")).To(Equal(1))
+
+				payload, _ := json.Marshal(&internal.IteratorCloseRequest{Context: context, IteratorID: iteratorID})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorClose", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contextStore.OpenIterators("channel1", "txn1")).To(Equal(0))
+
+				Expect(contextStore.Remove("channel1", "txn1")).To(Succeed())
+				Expect(sqi.CloseCallCount()).To(Equal(1))
+			})
+
+			It("should only close the iterators of the transaction which completes", func() {
+				openIterator("001", "009")
+
+				otherIterator := &fakes.StateQueryIteratorInterface{}
+				other := &fakes.ChaincodeStubInterface{}
+				other.GetStateByRangeReturns(otherIterator, nil)
+				contextStore.Put("channel1", "txn2", other)
+				otherContext := &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn2"}
+				payload, _ := json.Marshal(&internal.GetStateByRangeRequest{Context: otherContext, StartKey: "001", EndKey: "009"})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRange", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(contextStore.Remove("channel1", "txn2")).To(Succeed())
+				Expect(otherIterator.CloseCallCount()).To(Equal(1))
+				Expect(contextStore.OpenIterators("channel1", "txn2")).To(Equal(0))
+
+				Expect(sqi.CloseCallCount()).To(Equal(0))
+				Expect(contextStore.OpenIterators("channel1", "txn1")).To(Equal(1))
+			})
+
+			It("should not find iterators from other transactions", func() {
+				iteratorID := openIterator("001", "009")
+				contextStore.Put("channel1", "txn2", &fakes.ChaincodeStubInterface{})
+
+				other := &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn2"}
+				payload, _ := json.Marshal(&internal.IteratorNextRequest{Context: other, IteratorID: iteratorID})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorNext", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("IteratorNext failed: No iterator " + iteratorID + " found for transaction context channel1 txn2"))
+			})
+
+			It("should fail if the stub cannot open the range", func() {
+				stub.GetStateByRangeReturns(nil, errors.New("rangey range"))
+
+				payload, _ := json.Marshal(&internal.GetStateByRangeRequest{Context: context, StartKey: "001", EndKey: "009"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRange", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetStateByRange failed: rangey range"))
+			})
+
+			It("should fail without the correct context available", func() {
+				context.TransactionId = "txn3"
+
+				payload, _ := json.Marshal(&internal.GetStateByRangeRequest{Context: context, StartKey: "001", EndKey: "009"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRange", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetStateByRange failed: No stub found for transaction context channel1 txn3"))
+			})
+		})
+
+		Context("With a GetStateByRangeWithPagination request", func() {
+			var (
+				context *contract.TransactionContext
+				sqi     *fakes.StateQueryIteratorInterface
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				sqi = &fakes.StateQueryIteratorInterface{}
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetStateByRangeWithPaginationReturns(sqi, &peer.QueryResponseMetadata{FetchedRecordsCount: 2, Bookmark: "008"}, nil)
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should open an iterator over a page of the range", func() {
+				payload, _ := json.Marshal(&internal.GetStateByRangeWithPaginationRequest{Context: context, StartKey: "001", EndKey: "009", PageSize: 2, Bookmark: "005"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRangeWithPagination", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.GetStateByRangeWithPaginationCallCount()).To(Equal(1))
+				startKey, endKey, pageSize, bookmark := stub.GetStateByRangeWithPaginationArgsForCall(0)
+				Expect(startKey).To(Equal("001"))
+				Expect(endKey).To(Equal("009"))
+				Expect(pageSize).To(Equal(int32(2)))
+				Expect(bookmark).To(Equal("005"))
+
+				response := &internal.IteratorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.IteratorID).NotTo(BeEmpty())
+				Expect(response.Metadata).To(Equal(&internal.QueryResponseMetadata{FetchedRecordsCount: 2, Bookmark: "008"}))
+
+				iterator, err := contextStore.GetIterator(context, response.IteratorID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(iterator).To(BeIdenticalTo(sqi))
+			})
+
+			It("should serialize the metadata in a stable format", func() {
+				stub.GetStateByRangeWithPaginationReturns(sqi, &peer.QueryResponseMetadata{}, nil)
+
+				payload, _ := json.Marshal(&internal.GetStateByRangeWithPaginationRequest{Context: context, PageSize: 2})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRangeWithPagination", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal(`{"iterator_id":"1","metadata":{"fetched_records_count":0,"bookmark":""}}`))
+			})
+
+			It("should fail with an invalid page size", func() {
+				payload, _ := json.Marshal(&internal.GetStateByRangeWithPaginationRequest{Context: context, StartKey: "001", EndKey: "009"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRangeWithPagination", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetStateByRangeWithPagination failed: Invalid page size 0"))
+				Expect(stub.GetStateByRangeWithPaginationCallCount()).To(Equal(0))
+			})
+
+			It("should return bookmarks from the stub verbatim, so a saved bookmark resumes the range", func() {
+				keys := []string{"001", "002", "003", "004", "005", "006", "007"}
+				stub.GetStateByRangeWithPaginationStub = func(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+					if bookmark != "" {
+						startKey = strings.TrimPrefix(bookmark, "opaque:")
+					}
+					var page []string
+					for _, key := range keys {
+						if key >= startKey && key < endKey && len(page) < int(pageSize) {
+							page = append(page, key)
+						}
+					}
+
+					metadata := &peer.QueryResponseMetadata{FetchedRecordsCount: int32(len(page))}
+					for _, key := range keys {
+						if len(page) > 0 && key > page[len(page)-1] && key < endKey {
+							metadata.Bookmark = "opaque:" + key
+							break
+						}
+					}
+
+					iterator := &fakes.StateQueryIteratorInterface{}
+					iterator.HasNextStub = func() bool { return iterator.NextCallCount() < len(page) }
+					iterator.NextStub = func() (*queryresult.KV, error) {
+						key := page[iterator.NextCallCount()-1]
+						return &queryresult.KV{Key: key, Value: []byte("value " + key)}, nil
+					}
+					return iterator, metadata, nil
+				}
+
+				readPage := func(proxy *internal.FabricProxy, bookmark string) ([]string, string) {
+					payload, _ := json.Marshal(&internal.GetStateByRangeWithPaginationRequest{Context: context, StartKey: "002", EndKey: "007", PageSize: 2, Bookmark: bookmark})
+					result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRangeWithPagination", payload)
+					Expect(err).NotTo(HaveOccurred())
+					response := &internal.IteratorResponse{}
+					Expect(json.Unmarshal(result, response)).To(Succeed())
+
+					payload, _ = json.Marshal(&internal.IteratorNextRequest{Context: context, IteratorID: response.IteratorID})
+					result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorNext", payload)
+					Expect(err).NotTo(HaveOccurred())
+					next := &internal.IteratorNextResponse{}
+					Expect(json.Unmarshal(result, next)).To(Succeed())
+					Expect(next.HasMore).To(BeFalse())
+
+					var pageKeys []string
+					for _, state := range next.States {
+						pageKeys = append(pageKeys, state.Key)
+					}
+					return pageKeys, response.Metadata.Bookmark
+				}
+
+				page, bookmark := readPage(proxy, "")
+				Expect(page).To(Equal([]string{"002", "003"}))
+				Expect(bookmark).To(Equal("opaque:004"))
+
+				again, sameBookmark := readPage(proxy, "")
+				Expect(again).To(Equal(page))
+				Expect(sameBookmark).To(Equal(bookmark))
+
+				// Resume with the saved bookmark using a new proxy, as after a restart
+				restartedStore := internal.NewContextStore()
+				restartedStore.Put("channel1", "txn1", stub)
+				restarted := internal.NewFabricProxy(restartedStore)
+
+				scanned := page
+				for bookmark != "" {
+					page, bookmark = readPage(restarted, bookmark)
+					scanned = append(scanned, page...)
+				}
+				Expect(scanned).To(Equal([]string{"002", "003", "004", "005", "006"}))
+
+				_, _, _, passedBookmark := stub.GetStateByRangeWithPaginationArgsForCall(2)
+				Expect(passedBookmark).To(Equal("opaque:004"))
+			})
+
+			It("should fail if the stub cannot open the range", func() {
+				stub.GetStateByRangeWithPaginationReturns(nil, nil, errors.New("paging mr bond"))
+
+				payload, _ := json.Marshal(&internal.GetStateByRangeWithPaginationRequest{Context: context, PageSize: 2})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRangeWithPagination", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetStateByRangeWithPagination failed: paging mr bond"))
+			})
+		})
+
+		Context("With composite key requests", func() {
+			createCompositeKey := func(objectType string, attributes []string) (string, error) {
+				payload, _ := json.Marshal(&internal.CompositeKeyRequest{ObjectType: objectType, Attributes: attributes})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "CreateCompositeKey", payload)
+				if err != nil {
+					return "", err
+				}
+
+				response := &internal.CompositeKeyResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				return response.Key, nil
+			}
+
+			splitCompositeKey := func(key string) (*internal.SplitCompositeKeyResponse, error) {
+				payload, _ := json.Marshal(&internal.SplitCompositeKeyRequest{Key: key})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "SplitCompositeKey", payload)
+				if err != nil {
+					return nil, err
+				}
+
+				response := &internal.SplitCompositeKeyResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				return response, nil
+			}
+
+			It("should create composite keys with the same encoding as the shim", func() {
+				key, err := createCompositeKey("asset", []string{"bond", "007"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect([]byte(key)).To(Equal([]byte("\x00asset\x00bond\x00007\x00")))
+
+				expected, err := shim.CreateCompositeKey("asset", []string{"bond", "007"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(key).To(Equal(expected))
+			})
+
+			It("should split composite keys created by the shim", func() {
+				key, err := shim.CreateCompositeKey("asset", []string{"bond", "", "007"})
+				Expect(err).NotTo(HaveOccurred())
+
+				response, err := splitCompositeKey(key)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response.ObjectType).To(Equal("asset"))
+				Expect(response.Attributes).To(Equal([]string{"bond", "", "007"}))
+			})
+
+			It("should split a composite key with no attributes", func() {
+				response, err := splitCompositeKey("\x00asset\x00")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response.ObjectType).To(Equal("asset"))
+				Expect(response.Attributes).To(BeEmpty())
+			})
+
+			It("should fail to create a composite key with invalid attributes", func() {
+				_, err := createCompositeKey("asset", []string{"bond\x00007"})
+				Expect(err).To(MatchError(HavePrefix("CreateCompositeKey failed: input contains unicode")))
+			})
+
+			It("should fail to split a key which is not a composite key", func() {
+				_, err := splitCompositeKey("asset")
+				Expect(err).To(MatchError(`SplitCompositeKey failed: Invalid composite key "asset"`))
+			})
+
+			It("should open an iterator over a partial composite key", func() {
+				sqi := &fakes.StateQueryIteratorInterface{}
+				stub := &fakes.ChaincodeStubInterface{}
+				stub.GetStateByPartialCompositeKeyReturns(sqi, nil)
+				contextStore.Put("channel1", "txn1", stub)
+
+				context := &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				payload, _ := json.Marshal(&internal.GetStateByPartialCompositeKeyRequest{Context: context, ObjectType: "asset", Attributes: []string{"bond"}})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByPartialCompositeKey", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.GetStateByPartialCompositeKeyCallCount()).To(Equal(1))
+				objectType, attributes := stub.GetStateByPartialCompositeKeyArgsForCall(0)
+				Expect(objectType).To(Equal("asset"))
+				Expect(attributes).To(Equal([]string{"bond"}))
+
+				response := &internal.IteratorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				iterator, err := contextStore.GetIterator(context, response.IteratorID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(iterator).To(BeIdenticalTo(sqi))
+			})
+
+			It("should open an iterator over a page of a partial composite key", func() {
+				sqi := &fakes.StateQueryIteratorInterface{}
+				stub := &fakes.ChaincodeStubInterface{}
+				stub.GetStateByPartialCompositeKeyWithPaginationReturns(sqi, &peer.QueryResponseMetadata{FetchedRecordsCount: 2, Bookmark: "\x00asset\x00bond\x00009\x00"}, nil)
+				contextStore.Put("channel1", "txn1", stub)
+
+				context := &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				payload, _ := json.Marshal(&internal.GetStateByPartialCompositeKeyWithPaginationRequest{Context: context, ObjectType: "asset", Attributes: []string{"bond"}, PageSize: 2, Bookmark: "\x00asset\x00bond\x00007\x00"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByPartialCompositeKeyWithPagination", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.GetStateByPartialCompositeKeyWithPaginationCallCount()).To(Equal(1))
+				objectType, attributes, pageSize, bookmark := stub.GetStateByPartialCompositeKeyWithPaginationArgsForCall(0)
+				Expect(objectType).To(Equal("asset"))
+				Expect(attributes).To(Equal([]string{"bond"}))
+				Expect(pageSize).To(Equal(int32(2)))
+				Expect(bookmark).To(Equal("\x00asset\x00bond\x00007\x00"))
+
+				response := &internal.IteratorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Metadata).To(Equal(&internal.QueryResponseMetadata{FetchedRecordsCount: 2, Bookmark: "\x00asset\x00bond\x00009\x00"}))
+				iterator, err := contextStore.GetIterator(context, response.IteratorID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(iterator).To(BeIdenticalTo(sqi))
+			})
+
+			It("should reject a page of a partial composite key with an invalid page size", func() {
+				stub := &fakes.ChaincodeStubInterface{}
+				contextStore.Put("channel1", "txn1", stub)
+
+				context := &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				payload, _ := json.Marshal(&internal.GetStateByPartialCompositeKeyWithPaginationRequest{Context: context, ObjectType: "asset"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByPartialCompositeKeyWithPagination", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetStateByPartialCompositeKeyWithPagination failed: Invalid page size 0"))
+				Expect(stub.GetStateByPartialCompositeKeyWithPaginationCallCount()).To(Equal(0))
+			})
+
+			It("should return an error if the stub fails to page a partial composite key", func() {
+				stub := &fakes.ChaincodeStubInterface{}
+				stub.GetStateByPartialCompositeKeyWithPaginationReturns(nil, nil, errors.New("input contains unicode"))
+				contextStore.Put("channel1", "txn1", stub)
+
+				context := &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				payload, _ := json.Marshal(&internal.GetStateByPartialCompositeKeyWithPaginationRequest{Context: context, ObjectType: "asset", PageSize: 2})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByPartialCompositeKeyWithPagination", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetStateByPartialCompositeKeyWithPagination failed: input contains unicode"))
+			})
+		})
+
+		Context("With a GetQueryResult request", func() {
+			const query = `{"selector":{"owner":"bond"}}`
+
+			var (
+				context *contract.TransactionContext
+				sqi     *fakes.StateQueryIteratorInterface
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				sqi = &fakes.StateQueryIteratorInterface{}
+				sqi.HasNextReturnsOnCall(0, true)
+				sqi.HasNextReturnsOnCall(1, false)
+				sqi.NextReturnsOnCall(0, &queryresult.KV{
+					Key:   "007",
+					Value: []byte(`{"owner":"bond"}`),
+				}, nil)
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetQueryResultReturns(sqi, nil)
+				stub.GetQueryResultWithPaginationReturns(sqi, &peer.QueryResponseMetadata{FetchedRecordsCount: 1, Bookmark: "g1AAAA"}, nil)
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should stream the query results using the iterator protocol", func() {
+				payload, _ := json.Marshal(&internal.GetQueryResultRequest{Context: context, Query: query})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetQueryResult", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.GetQueryResultCallCount()).To(Equal(1))
+				Expect(stub.GetQueryResultArgsForCall(0)).To(Equal(query))
+
+				response := &internal.IteratorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Metadata).To(BeNil())
+
+				payload, _ = json.Marshal(&internal.IteratorNextRequest{Context: context, IteratorID: response.IteratorID})
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorNext", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				nextResponse := &internal.IteratorNextResponse{}
+				Expect(json.Unmarshal(result, nextResponse)).To(Succeed())
+				Expect(nextResponse.States).To(HaveLen(1))
+				Expect(nextResponse.States[0].Key).To(Equal("007"))
+				Expect(nextResponse.States[0].Value).To(Equal([]byte(`{"owner":"bond"}`)))
+				Expect(nextResponse.HasMore).To(BeFalse())
+			})
+
+			It("should return a clear error if the state database rejects the query", func() {
+				stub.GetQueryResultReturns(nil, errors.New("ExecuteQuery not supported for leveldb"))
+
+				payload, _ := json.Marshal(&internal.GetQueryResultRequest{Context: context, Query: query})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetQueryResult", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetQueryResult failed: Query rejected by state database: ExecuteQuery not supported for leveldb"))
+			})
+
+			It("should fail without a query", func() {
+				payload, _ := json.Marshal(&internal.GetQueryResultRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetQueryResult", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetQueryResult failed: Missing query"))
+				Expect(stub.GetQueryResultCallCount()).To(Equal(0))
+			})
+
+			It("should fail without the correct context available", func() {
+				contextStore.Remove("channel1", "txn1")
+
+				payload, _ := json.Marshal(&internal.GetQueryResultRequest{Context: context, Query: query})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetQueryResult", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetQueryResult failed: No stub found for transaction context channel1 txn1"))
+			})
+
+			It("should open an iterator over a page of the query results", func() {
+				payload, _ := json.Marshal(&internal.GetQueryResultWithPaginationRequest{Context: context, Query: query, PageSize: 10, Bookmark: "g1AA"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetQueryResultWithPagination", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.GetQueryResultWithPaginationCallCount()).To(Equal(1))
+				actualQuery, pageSize, bookmark := stub.GetQueryResultWithPaginationArgsForCall(0)
+				Expect(actualQuery).To(Equal(query))
+				Expect(pageSize).To(Equal(int32(10)))
+				Expect(bookmark).To(Equal("g1AA"))
+
+				response := &internal.IteratorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Metadata).To(Equal(&internal.QueryResponseMetadata{FetchedRecordsCount: 1, Bookmark: "g1AAAA"}))
+			})
+
+			It("should fail with an invalid page size", func() {
+				payload, _ := json.Marshal(&internal.GetQueryResultWithPaginationRequest{Context: context, Query: query, PageSize: -1})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetQueryResultWithPagination", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetQueryResultWithPagination failed: Invalid page size -1"))
+			})
+
+			It("should return a clear error if the state database rejects the paginated query", func() {
+				stub.GetQueryResultWithPaginationReturns(nil, nil, errors.New("invalid selector"))
+
+				payload, _ := json.Marshal(&internal.GetQueryResultWithPaginationRequest{Context: context, Query: query, PageSize: 10})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetQueryResultWithPagination", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetQueryResultWithPagination failed: Query rejected by state database: invalid selector"))
+			})
+		})
+
+		Context("With a GetHistoryForKey request", func() {
+			var (
+				context *contract.TransactionContext
+				hqi     *fakes.HistoryQueryIteratorInterface
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				hqi = &fakes.HistoryQueryIteratorInterface{}
+				hqi.HasNextReturnsOnCall(0, true)
+				hqi.HasNextReturnsOnCall(1, true)
+				hqi.HasNextReturnsOnCall(2, false)
+				hqi.NextReturnsOnCall(0, &queryresult.KeyModification{
+					TxId:      "txn3",
+					Timestamp: &timestamp.Timestamp{Seconds: 1600000200, Nanos: 7},
+					IsDelete:  true,
+				}, nil)
+				hqi.NextReturnsOnCall(1, &queryresult.KeyModification{
+					TxId:      "txn2",
+					Timestamp: &timestamp.Timestamp{Seconds: 1600000100},
+					Value:     []byte{},
+				}, nil)
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetHistoryForKeyReturns(hqi, nil)
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			openIterator := func() string {
+				payload, _ := json.Marshal(&internal.GetHistoryForKeyRequest{Context: context, Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetHistoryForKey", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.IteratorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				return response.IteratorID
+			}
+
+			It("should return the history of the key in order", func() {
+				iteratorID := openIterator()
+				Expect(stub.GetHistoryForKeyCallCount()).To(Equal(1))
+				Expect(stub.GetHistoryForKeyArgsForCall(0)).To(Equal("007"))
+
+				payload, _ := json.Marshal(&internal.IteratorNextRequest{Context: context, IteratorID: iteratorID})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "HistoryIteratorNext", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.HistoryIteratorNextResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.HasMore).To(BeFalse())
+				Expect(response.Modifications).To(HaveLen(2))
+				Expect(response.Modifications[0].TxID).To(Equal("txn3"))
+				Expect(response.Modifications[0].Timestamp).To(Equal(time.Unix(1600000200, 7).UTC()))
+				Expect(response.Modifications[1].TxID).To(Equal("txn2"))
+				Expect(response.Modifications[1].Timestamp).To(Equal(time.Unix(1600000100, 0).UTC()))
+			})
+
+			It("should distinguish a delete from an empty value", func() {
+				iteratorID := openIterator()
+
+				payload, _ := json.Marshal(&internal.IteratorNextRequest{Context: context, IteratorID: iteratorID})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "HistoryIteratorNext", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal(`{"modifications":[` +
+					`{"tx_id":"txn3","timestamp":"2020-09-13T12:30:00.000000007Z","value":null,"is_delete":true},` +
+					`{"tx_id":"txn2","timestamp":"2020-09-13T12:28:20Z","value":"","is_delete":false}` +
+					`],"has_more":false}`))
+			})
+
+			It("should close a history iterator", func() {
+				iteratorID := openIterator()
+
+				payload, _ := json.Marshal(&internal.IteratorCloseRequest{Context: context, IteratorID: iteratorID})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorClose", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(hqi.CloseCallCount()).To(Equal(1))
+			})
+
+			It("should not read a state iterator as a history iterator", func() {
+				stub.GetStateByRangeReturns(&fakes.StateQueryIteratorInterface{}, nil)
+				payload, _ := json.Marshal(&internal.GetStateByRangeRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRange", payload)
+				Expect(err).NotTo(HaveOccurred())
+				response := &internal.IteratorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+
+				payload, _ = json.Marshal(&internal.IteratorNextRequest{Context: context, IteratorID: response.IteratorID})
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "HistoryIteratorNext", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError(fmt.Sprintf("HistoryIteratorNext failed: Iterator %s is not a history iterator", response.IteratorID)))
+			})
+
+			It("should return an informative error if history is not available", func() {
+				stub.GetHistoryForKeyReturns(nil, errors.New("history database not enabled"))
+
+				payload, _ := json.Marshal(&internal.GetHistoryForKeyRequest{Context: context, Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetHistoryForKey", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetHistoryForKey failed: Check the history database is enabled on the peer: history database not enabled"))
+			})
+
+			It("should fail without a key", func() {
+				payload, _ := json.Marshal(&internal.GetHistoryForKeyRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetHistoryForKey", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetHistoryForKey failed: Missing key"))
+			})
+		})
+
+		Context("With private data requests", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				stub = &fakes.ChaincodeStubInterface{}
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should get private data from the collection", func() {
+				stub.GetPrivateDataReturns([]byte("secret"), nil)
+
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetPrivateData", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.GetPrivateDataCallCount()).To(Equal(1))
+				collection, key := stub.GetPrivateDataArgsForCall(0)
+				Expect(collection).To(Equal("orgs"))
+				Expect(key).To(Equal("007"))
+
+				response := &internal.PrivateDataResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Value).To(Equal([]byte("secret")))
+			})
+
+			It("should return a nil value for private data which does not exist", func() {
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetPrivateData", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal(`{"value":null}`))
+			})
+
+			It("should return the Fabric error if the peer is not a member of the collection", func() {
+				stub.GetPrivateDataReturns(nil, errors.New("tx creator does not have read access permission on privatedata in chaincodeName:basic collectionName: orgs"))
+
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetPrivateData", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetPrivateData failed for collection orgs: tx creator does not have read access permission on privatedata in chaincodeName:basic collectionName: orgs"))
+			})
+
+			It("should get the hash of private data without reading the value", func() {
+				hash := sha256.Sum256([]byte("secret"))
+				stub.GetPrivateDataHashReturns(hash[:], nil)
+				stub.GetPrivateDataReturns(nil, errors.New("tx creator does not have read access permission"))
+
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetPrivateDataHash", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.GetPrivateDataHashCallCount()).To(Equal(1))
+				collection, key := stub.GetPrivateDataHashArgsForCall(0)
+				Expect(collection).To(Equal("orgs"))
+				Expect(key).To(Equal("007"))
+				Expect(stub.GetPrivateDataCallCount()).To(Equal(0))
+
+				response := &internal.PrivateDataHashResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Hash).To(Equal(hash[:]))
+			})
+
+			It("should return a nil hash for private data which does not exist", func() {
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetPrivateDataHash", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal(`{"hash":null}`))
+			})
+
+			It("should fail if the stub cannot get the private data hash", func() {
+				stub.GetPrivateDataHashReturns(nil, errors.New("collection orgs not found"))
+
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetPrivateDataHash", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetPrivateDataHash failed for collection orgs: collection orgs not found"))
+			})
+
+			It("should fail to get a private data hash without a collection", func() {
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetPrivateDataHash", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetPrivateDataHash failed: Missing collection"))
+				Expect(stub.GetPrivateDataHashCallCount()).To(Equal(0))
+			})
+
+			It("should put private data in the collection", func() {
+				payload, _ := json.Marshal(&internal.PutPrivateDataRequest{Context: context, Collection: "orgs", Key: "007", Value: []byte("secret")})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "PutPrivateData", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(BeNil())
+
+				Expect(stub.PutPrivateDataCallCount()).To(Equal(1))
+				collection, key, value := stub.PutPrivateDataArgsForCall(0)
+				Expect(collection).To(Equal("orgs"))
+				Expect(key).To(Equal("007"))
+				Expect(value).To(Equal([]byte("secret")))
+			})
+
+			It("should fail if the stub cannot put the private data", func() {
+				stub.PutPrivateDataReturns(errors.New("collection orgs not found"))
+
+				payload, _ := json.Marshal(&internal.PutPrivateDataRequest{Context: context, Collection: "orgs", Key: "007", Value: []byte("secret")})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "PutPrivateData", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("PutPrivateData failed for collection orgs: collection orgs not found"))
+			})
+
+			It("should delete private data from the collection", func() {
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "DelPrivateData", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(BeNil())
+
+				Expect(stub.DelPrivateDataCallCount()).To(Equal(1))
+				collection, key := stub.DelPrivateDataArgsForCall(0)
+				Expect(collection).To(Equal("orgs"))
+				Expect(key).To(Equal("007"))
+			})
+
+			It("should purge private data from the collection if the shim supports it", func() {
+				purgingStub := &purgingStub{ChaincodeStubInterface: stub}
+				contextStore.Remove("channel1", "txn1")
+				contextStore.Put("channel1", "txn1", purgingStub)
+
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "PurgePrivateData", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(BeNil())
+
+				Expect(purgingStub.purged).To(Equal([]string{"orgs/007"}))
+				Expect(stub.DelPrivateDataCallCount()).To(Equal(0))
+			})
+
+			It("should fail to purge private data if the peer rejects it", func() {
+				purgingStub := &purgingStub{ChaincodeStubInterface: stub, err: errors.New("collection orgs not found")}
+				contextStore.Remove("channel1", "txn1")
+				contextStore.Put("channel1", "txn1", purgingStub)
+
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "PurgePrivateData", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("PurgePrivateData failed for collection orgs: collection orgs not found"))
+			})
+
+			It("should fail to purge private data if the shim does not support it", func() {
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "PurgePrivateData", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("PurgePrivateData failed: Not supported by this version of the Fabric chaincode shim, which requires Fabric v2.5 or later"))
+				Expect(stub.DelPrivateDataCallCount()).To(Equal(0))
+			})
+
+			It("should fail without a collection", func() {
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: context, Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "DelPrivateData", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("DelPrivateData failed: Missing collection"))
+				Expect(stub.DelPrivateDataCallCount()).To(Equal(0))
+			})
+
+			It("should fail without the correct context available", func() {
+				contextStore.Remove("channel1", "txn1")
+
+				payload, _ := json.Marshal(&internal.PutPrivateDataRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "PutPrivateData", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("PutPrivateData failed: No stub found for transaction context channel1 txn1"))
+			})
+		})
+
+		Context("With state validation parameter requests", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+				policy  []byte
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				policy = []byte{0x12, 0x0c, 0x12, 0x0a, 0x08, 0x01, 0x12, 0x02, 0x08, 0x00}
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetStateValidationParameterReturns(policy, nil)
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should set the policy bytes for a key unchanged", func() {
+				payload, _ := json.Marshal(&internal.SetStateValidationParameterRequest{Context: context, Key: "007", Policy: policy})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "SetStateValidationParameter", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(BeNil())
+
+				Expect(stub.SetStateValidationParameterCallCount()).To(Equal(1))
+				key, actualPolicy := stub.SetStateValidationParameterArgsForCall(0)
+				Expect(key).To(Equal("007"))
+				Expect(actualPolicy).To(Equal(policy))
+			})
+
+			It("should get the policy bytes for a key", func() {
+				payload, _ := json.Marshal(&internal.StateValidationParameterRequest{Context: context, Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateValidationParameter", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.GetStateValidationParameterArgsForCall(0)).To(Equal("007"))
+				response := &internal.StateValidationParameterResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Policy).To(Equal(policy))
+			})
+
+			It("should set the policy bytes for a key in a named collection", func() {
+				payload, _ := json.Marshal(&internal.SetStateValidationParameterRequest{Context: context, Collection: "orgs", Key: "007", Policy: policy})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "SetStateValidationParameter", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.SetStateValidationParameterCallCount()).To(Equal(0))
+				Expect(stub.SetPrivateDataValidationParameterCallCount()).To(Equal(1))
+				collection, key, actualPolicy := stub.SetPrivateDataValidationParameterArgsForCall(0)
+				Expect(collection).To(Equal("orgs"))
+				Expect(key).To(Equal("007"))
+				Expect(actualPolicy).To(Equal(policy))
+			})
+
+			It("should get the policy bytes for a key in a named collection", func() {
+				stub.GetPrivateDataValidationParameterReturns(policy, nil)
+
+				payload, _ := json.Marshal(&internal.StateValidationParameterRequest{Context: context, Collection: "orgs", Key: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateValidationParameter", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				collection, key := stub.GetPrivateDataValidationParameterArgsForCall(0)
+				Expect(collection).To(Equal("orgs"))
+				Expect(key).To(Equal("007"))
+				response := &internal.StateValidationParameterResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Policy).To(Equal(policy))
+			})
+
+			It("should fail if the stub cannot set the policy", func() {
+				stub.SetStateValidationParameterReturns(errors.New("bad policy"))
+
+				payload, _ := json.Marshal(&internal.SetStateValidationParameterRequest{Context: context, Key: "007", Policy: policy})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "SetStateValidationParameter", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("SetStateValidationParameter failed: bad policy"))
+			})
+		})
+
+		Context("With a SetEvent request", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				stub = &fakes.ChaincodeStubInterface{}
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should set the event on the stub", func() {
+				payload, _ := json.Marshal(&internal.SetEventRequest{Context: context, Name: "AssetCreated", Payload: []byte("007")})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "SetEvent", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(BeNil())
+
+				Expect(stub.SetEventCallCount()).To(Equal(1))
+				name, eventPayload := stub.SetEventArgsForCall(0)
+				Expect(name).To(Equal("AssetCreated"))
+				Expect(eventPayload).To(Equal([]byte("007")))
+			})
+
+			It("should pass every event on to the stub so that the last one wins", func() {
+				for _, name := range []string{"AssetCreated", "AssetTransferred"} {
+					payload, _ := json.Marshal(&internal.SetEventRequest{Context: context, Name: name})
+					_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "SetEvent", payload)
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				Expect(stub.SetEventCallCount()).To(Equal(2))
+				name, _ := stub.SetEventArgsForCall(1)
+				Expect(name).To(Equal("AssetTransferred"))
+			})
+
+			It("should fail without an event name", func() {
+				payload, _ := json.Marshal(&internal.SetEventRequest{Context: context, Payload: []byte("007")})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "SetEvent", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("SetEvent failed: Missing event name"))
+				Expect(stub.SetEventCallCount()).To(Equal(0))
+			})
+
+			It("should fail if the stub cannot set the event", func() {
+				stub.SetEventReturns(errors.New("event failed"))
+
+				payload, _ := json.Marshal(&internal.SetEventRequest{Context: context, Name: "AssetCreated"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "SetEvent", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("SetEvent failed: event failed"))
+			})
+		})
+
+		Context("With transaction metadata requests", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetTxIDReturns("txn1")
+				stub.GetChannelIDReturns("channel1")
+				stub.GetTxTimestampReturns(&timestamp.Timestamp{Seconds: 1600000000, Nanos: 7000}, nil)
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should return the transaction ID from the stub", func() {
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetTxID", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal(`{"tx_id":"txn1"}`))
+				Expect(stub.GetTxIDCallCount()).To(Equal(1))
+			})
+
+			It("should return the channel ID from the stub", func() {
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetChannelID", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal(`{"channel_id":"channel1"}`))
+				Expect(stub.GetChannelIDCallCount()).To(Equal(1))
+			})
+
+			It("should return the proposal timestamp from the stub", func() {
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetTxTimestamp", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal(`{"timestamp":"2020-09-13T12:26:40.000007Z"}`))
+
+				response := &internal.TxTimestampResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Timestamp).To(BeTemporally("==", time.Unix(1600000000, 7000)))
+			})
+
+			It("should fail if the stub cannot get the proposal timestamp", func() {
+				stub.GetTxTimestampReturns(nil, errors.New("no proposal"))
+
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetTxTimestamp", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetTxTimestamp failed: no proposal"))
+			})
+		})
+
+		Context("With a GetTransient request", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				stub = &fakes.ChaincodeStubInterface{}
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should return the transient data unmodified", func() {
+				stub.GetTransientReturns(map[string][]byte{
+					"secret": {0x00, 0xff, 0x07},
+					"empty":  {},
+				}, nil)
+
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetTransient", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.TransientResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Transient).To(Equal(map[string][]byte{
+					"secret": {0x00, 0xff, 0x07},
+					"empty":  {},
+				}))
+			})
+
+			It("should serialize the transient data deterministically", func() {
+				transient := map[string][]byte{}
+				for i := 0; i < 50; i++ {
+					transient[fmt.Sprintf("key%d", i)] = []byte{byte(i)}
+				}
+				stub.GetTransientReturns(transient, nil)
+
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				expected, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetTransient", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(expected)).To(HavePrefix(`{"transient":{"key0":"AA==","key1":"AQ==","key10":"Cg==",`))
+
+				for i := 0; i < 100; i++ {
+					result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetTransient", payload)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result).To(Equal(expected))
+				}
+			})
+
+			It("should return an empty map if there is no transient data", func() {
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetTransient", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal(`{"transient":{}}`))
+			})
+
+			It("should fail if the stub cannot get the transient data", func() {
+				stub.GetTransientReturns(nil, errors.New("no proposal"))
+
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetTransient", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetTransient failed: no proposal"))
+			})
+		})
+
+		Context("With an InvokeChaincode request", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.InvokeChaincodeReturns(peer.Response{Status: 200, Payload: []byte("007")})
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should invoke the chaincode and return its response", func() {
+				payload, _ := json.Marshal(&internal.InvokeChaincodeRequest{Context: context, Chaincode: "assets", Args: [][]byte{[]byte("ReadAsset"), []byte("007")}, Channel: "channel2"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "InvokeChaincode", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.InvokeChaincodeCallCount()).To(Equal(1))
+				chaincode, args, channel := stub.InvokeChaincodeArgsForCall(0)
+				Expect(chaincode).To(Equal("assets"))
+				Expect(args).To(Equal([][]byte{[]byte("ReadAsset"), []byte("007")}))
+				Expect(channel).To(Equal("channel2"))
+
+				response := &internal.ChaincodeResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response).To(Equal(&internal.ChaincodeResponse{Status: 200, Payload: []byte("007")}))
+			})
+
+			It("should invoke the chaincode on the same channel as part of the transaction", func() {
+				payload, _ := json.Marshal(&internal.InvokeChaincodeRequest{Context: context, Chaincode: "assets", Channel: "channel1"})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "InvokeChaincode", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, channel := stub.InvokeChaincodeArgsForCall(0)
+				Expect(channel).To(BeEmpty())
+			})
+
+			It("should preserve error responses from the chaincode", func() {
+				stub.InvokeChaincodeReturns(peer.Response{Status: 404, Message: "Asset 007 not found"})
+
+				payload, _ := json.Marshal(&internal.InvokeChaincodeRequest{Context: context, Chaincode: "assets"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "InvokeChaincode", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.ChaincodeResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Status).To(Equal(int32(404)))
+				Expect(response.Message).To(Equal("Asset 007 not found"))
+			})
+
+			It("should return the complete response when the chaincode fails", func() {
+				stub.InvokeChaincodeReturns(peer.Response{Status: 500, Message: "Ledger unavailable", Payload: []byte("retry")})
+
+				payload, _ := json.Marshal(&internal.InvokeChaincodeRequest{Context: context, Chaincode: "assets", Args: [][]byte{[]byte("ReadAsset")}})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "InvokeChaincode", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(MatchJSON(`{"status":500,"message":"Ledger unavailable","payload":"cmV0cnk="}`))
+
+				response := &internal.ChaincodeResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response).To(Equal(&internal.ChaincodeResponse{Status: 500, Message: "Ledger unavailable", Payload: []byte("retry")}))
+			})
+
+			It("should fail without a chaincode name", func() {
+				payload, _ := json.Marshal(&internal.InvokeChaincodeRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "InvokeChaincode", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("InvokeChaincode failed: Missing chaincode name"))
+				Expect(stub.InvokeChaincodeCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("With client identity requests", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+				cert    []byte
+				creator []byte
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{}
+				context.ChannelId = "channel1"
+				context.TransactionId = "txn1"
+
+				cert = testCertificate()
+				creator = testCreator("Org1MSP", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetCreatorReturns(creator, nil)
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			It("should return the creator bytes unmodified", func() {
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetCreator", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.CreatorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Creator).To(Equal(creator))
+			})
+
+			It("should return the MSP ID of the creator", func() {
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetMSPID", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.MSPIDResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.MSPID).To(Equal("Org1MSP"))
+			})
+
+			It("should return the X.509 certificate of the creator", func() {
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetX509Certificate", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.X509CertificateResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.Certificate).To(Equal(cert))
+			})
+
+			It("should return the ID of the creator", func() {
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetID", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				expected, err := cid.GetID(stub)
+				Expect(err).NotTo(HaveOccurred())
+				response := &internal.IDResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				Expect(response.ID).To(Equal(expected))
+			})
+
+			getAttributeValue := func(name string) *internal.AttributeValueResponse {
+				payload, _ := json.Marshal(&internal.AttributeRequest{Context: context, Name: name})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetAttributeValue", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.AttributeValueResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				return response
+			}
+
+			It("should return the attribute values of the creator", func() {
+				Expect(getAttributeValue("role")).To(Equal(&internal.AttributeValueResponse{Value: "admin", Found: true}))
+				Expect(getAttributeValue("clearance")).To(Equal(&internal.AttributeValueResponse{Value: "", Found: true}))
+				Expect(getAttributeValue("licence")).To(Equal(&internal.AttributeValueResponse{Value: "", Found: false}))
+			})
+
+			It("should assert the attribute values of the creator", func() {
+				assertAttributeValue := func(name, value string) *internal.AssertAttributeValueResponse {
+					payload, _ := json.Marshal(&internal.AttributeRequest{Context: context, Name: name, Value: value})
+					result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "AssertAttributeValue", payload)
+					Expect(err).NotTo(HaveOccurred())
+
+					response := &internal.AssertAttributeValueResponse{}
+					Expect(json.Unmarshal(result, response)).To(Succeed())
+					return response
+				}
+
+				Expect(assertAttributeValue("role", "admin")).To(Equal(&internal.AssertAttributeValueResponse{Found: true, Matches: true}))
+				Expect(assertAttributeValue("role", "user")).To(Equal(&internal.AssertAttributeValueResponse{Found: true, Matches: false}))
+				Expect(assertAttributeValue("clearance", "")).To(Equal(&internal.AssertAttributeValueResponse{Found: true, Matches: true}))
+				Expect(assertAttributeValue("licence", "")).To(Equal(&internal.AssertAttributeValueResponse{Found: false, Matches: false}))
+			})
+
+			It("should fail without an attribute name", func() {
+				for _, operation := range []string{"GetAttributeValue", "AssertAttributeValue"} {
+					payload, _ := json.Marshal(&internal.AttributeRequest{Context: context})
+					result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", operation, payload)
+					Expect(result).To(BeNil())
+					Expect(err).To(MatchError(operation + " failed: Missing attribute name"))
+				}
+			})
+
+			It("should fail if the creator is not a valid identity", func() {
+				stub.GetCreatorReturns([]byte("not an identity"), nil)
+
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetMSPID", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError(HavePrefix("GetMSPID failed: failed to unmarshal transaction invoker's identity")))
+			})
+
+			It("should fail if the stub cannot get the creator", func() {
+				stub.GetCreatorReturns(nil, errors.New("no creator"))
+
+				payload, _ := json.Marshal(&internal.TransactionRequest{Context: context})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetCreator", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("GetCreator failed: no creator"))
+			})
+		})
+
+		Context("With a host call timeout", func() {
+			var (
+				txContext *contract.TransactionContext
+				stub      *fakes.ChaincodeStubInterface
+				release   chan struct{}
+			)
+
+			BeforeEach(func() {
+				txContext = &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"}
+
+				release = make(chan struct{})
+				blocked := release
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetStateStub = func(key string) ([]byte, error) {
+					<-blocked
+					return []byte("bond"), nil
+				}
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			AfterEach(func() {
+				close(release)
+			})
+
+			readState := func(proxy *internal.FabricProxy) ([]byte, error) {
+				payload, _ := proto.Marshal(&contract.ReadStateRequest{Context: txContext, StateKey: "007"})
+				return proxy.FabricCall(ctx, "wapc", "LedgerService", "ReadState", payload)
+			}
+
+			It("should return an error if the host call exceeds the timeout", func() {
+				proxy = internal.NewFabricProxy(contextStore, internal.WithHostCallTimeout(10*time.Millisecond))
+
+				result, err := readState(proxy)
+				Expect(result).To(BeNil())
+				Expect(errors.Is(err, internal.ErrHostCallTimeout)).To(BeTrue())
+				Expect(err).To(MatchError("Host call timed out: LedgerService ReadState after 10ms"))
+			})
+
+			It("should use the timeout for the operation", func() {
+				proxy = internal.NewFabricProxy(contextStore, internal.WithHostCallTimeout(time.Hour), internal.WithOperationTimeout("ReadState", 10*time.Millisecond))
+
+				_, err := readState(proxy)
+				Expect(err).To(MatchError("Host call timed out: LedgerService ReadState after 10ms"))
+			})
+
+			It("should return an error if the context deadline passes", func() {
+				var cancel func()
+				ctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+				defer cancel()
+
+				result, err := readState(proxy)
+				Expect(result).To(BeNil())
+				Expect(errors.Is(err, internal.ErrHostCallTimeout)).To(BeTrue())
+				Expect(err).To(MatchError("Host call timed out: LedgerService ReadState interrupted: context deadline exceeded"))
+			})
+
+			It("should not call the stub if the context deadline has already passed", func() {
+				var cancel func()
+				ctx, cancel = context.WithDeadline(ctx, time.Now().Add(-time.Second))
+				defer cancel()
+
+				result, err := readState(proxy)
+				Expect(result).To(BeNil())
+				Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+				Expect(err).To(MatchError("Host call LedgerService ReadState not started: context deadline exceeded"))
+				Expect(stub.GetStateCallCount()).To(Equal(0))
+			})
+
+			It("should not call the stub if the context has already been cancelled", func() {
+				var cancel func()
+				ctx, cancel = context.WithCancel(ctx)
+				cancel()
+
+				_, err := readState(internal.NewFabricProxy(contextStore, internal.WithHostCallTimeout(time.Minute)))
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+				Expect(stub.GetStateCallCount()).To(Equal(0))
+			})
+
+			It("should return the result of host calls which complete in time", func() {
+				proxy = internal.NewFabricProxy(contextStore, internal.WithHostCallTimeout(time.Minute))
+				stub.GetStateStub = nil
+				stub.GetStateReturns([]byte("bond"), nil)
+
+				result, err := readState(proxy)
+				Expect(err).NotTo(HaveOccurred())
+				response := &contract.ReadStateResponse{}
+				Expect(proto.Unmarshal(result, response)).To(Succeed())
+				Expect(response.GetState().GetValue()).To(Equal([]byte("bond")))
+			})
+		})
+
+		Context("With a DelStateByRangeRequest", func() {
+			var (
+				txContext *contract.TransactionContext
+				ledger    *internal.MemoryLedger
+				stub      *internal.MemoryStub
+			)
+
+			BeforeEach(func() {
+				txContext = &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"}
+
+				ledger = internal.NewMemoryLedger()
+				for _, key := range []string{"001", "002", "003", "004", "005"} {
+					ledger.PutState(key, []byte("agent "+key))
+				}
+				stub = ledger.NewStub("channel1", "txn1")
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			delStateByRange := func(request *internal.DelStateByRangeRequest) *internal.DelStateByRangeResponse {
+				request.Context = txContext
+				payload, _ := json.Marshal(request)
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "DelStateByRange", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &internal.DelStateByRangeResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+				return response
+			}
+
+			It("should delete every key in the range", func() {
+				response := delStateByRange(&internal.DelStateByRangeRequest{StartKey: "002", EndKey: "005"})
+				Expect(response).To(Equal(&internal.DelStateByRangeResponse{Deleted: 3}))
+
+				stub.Commit()
+				Expect(ledger.State()).To(Equal(map[string][]byte{
+					"001": []byte("agent 001"),
+					"005": []byte("agent 005"),
+				}))
+			})
+
+			It("should stop at the maximum number of keys requested, and return the key to carry on from", func() {
+				response := delStateByRange(&internal.DelStateByRangeRequest{MaxKeys: 2})
+				Expect(response).To(Equal(&internal.DelStateByRangeResponse{Deleted: 2, HasMore: true, NextKey: "003"}))
+
+				response = delStateByRange(&internal.DelStateByRangeRequest{StartKey: response.NextKey, MaxKeys: 2})
+				Expect(response).To(Equal(&internal.DelStateByRangeResponse{Deleted: 2, HasMore: true, NextKey: "005"}))
+
+				stub.Commit()
+				Expect(ledger.State()).To(Equal(map[string][]byte{"005": []byte("agent 005")}))
+			})
+
+			It("should not delete more keys than the FabricProxy allows", func() {
+				proxy = internal.NewFabricProxy(contextStore, internal.WithMaxRangeDeletes(1))
+
+				response := delStateByRange(&internal.DelStateByRangeRequest{MaxKeys: 10})
+				Expect(response).To(Equal(&internal.DelStateByRangeResponse{Deleted: 1, HasMore: true, NextKey: "002"}))
+			})
+
+			It("should not report more keys when the range ends at the limit", func() {
+				response := delStateByRange(&internal.DelStateByRangeRequest{StartKey: "004", MaxKeys: 2})
+				Expect(response).To(Equal(&internal.DelStateByRangeResponse{Deleted: 2}))
+			})
+
+			It("should return an error without a transaction context", func() {
+				payload, _ := json.Marshal(&internal.DelStateByRangeRequest{})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "DelStateByRange", payload)
+				Expect(err).To(MatchError("DelStateByRange failed: Missing transaction context"))
+			})
+		})
+
+		Context("With a read cache", func() {
+			var (
+				txContext *contract.TransactionContext
+				stub      *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				txContext = &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"}
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetStateReturns([]byte("bond"), nil)
+				contextStore.Put("channel1", "txn1", stub)
+				proxy = internal.NewFabricProxy(contextStore, internal.WithReadCache())
+			})
+
+			readState := func(ctx context.Context) []byte {
+				payload, _ := proto.Marshal(&contract.ReadStateRequest{Context: txContext, StateKey: "007"})
+				result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "ReadState", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &contract.ReadStateResponse{}
+				Expect(proto.Unmarshal(result, response)).To(Succeed())
+				return response.GetState().GetValue()
+			}
+
+			updateState := func(ctx context.Context, value string) {
+				payload, _ := proto.Marshal(&contract.UpdateStateRequest{Context: txContext, State: &contract.State{Key: "007", Value: []byte(value)}})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "UpdateState", payload)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			It("should only read each key from the stub once per transaction", func() {
+				Expect(readState(ctx)).To(Equal([]byte("bond")))
+				Expect(readState(ctx)).To(Equal([]byte("bond")))
+				Expect(stub.GetStateCallCount()).To(Equal(1))
+			})
+
+			It("should read the writes of the same transaction", func() {
+				Expect(readState(ctx)).To(Equal([]byte("bond")))
+				updateState(ctx, "james bond")
+
+				Expect(readState(ctx)).To(Equal([]byte("james bond")))
+				Expect(stub.GetStateCallCount()).To(Equal(1))
+				Expect(stub.PutStateCallCount()).To(Equal(1))
+			})
+
+			It("should cache reads for the transaction in the invocation context", func() {
+				txCtx := internal.WithTransaction(ctx, "channel1", "txn1", stub)
+				Expect(readState(txCtx)).To(Equal([]byte("bond")))
+				Expect(readState(ctx)).To(Equal([]byte("bond")))
+				Expect(stub.GetStateCallCount()).To(Equal(1))
+			})
+
+			It("should not share the cache between transactions", func() {
+				Expect(readState(ctx)).To(Equal([]byte("bond")))
+				Expect(contextStore.Remove("channel1", "txn1")).To(Succeed())
+
+				nextStub := &fakes.ChaincodeStubInterface{}
+				nextStub.GetStateReturns([]byte("not bond"), nil)
+				contextStore.Put("channel1", "txn1", nextStub)
+
+				Expect(readState(ctx)).To(Equal([]byte("not bond")))
+				Expect(nextStub.GetStateCallCount()).To(Equal(1))
+			})
+
+			It("should not cache the writes of a simulated invocation", func() {
+				simulationCtx, writeSet := internal.WithSimulation(ctx)
+				updateState(simulationCtx, "james bond")
+				Expect(writeSet.Writes()).To(HaveLen(1))
+
+				Expect(readState(ctx)).To(Equal([]byte("bond")))
+				Expect(stub.PutStateCallCount()).To(Equal(0))
+			})
+
+			It("should purge private data if the shim supports it", func() {
+				purgingStub := &purgingStub{ChaincodeStubInterface: stub}
+				Expect(contextStore.Remove("channel1", "txn1")).To(Succeed())
+				contextStore.Put("channel1", "txn1", purgingStub)
+
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: txContext, Collection: "orgs", Key: "007"})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "PurgePrivateData", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(purgingStub.purged).To(Equal([]string{"orgs/007"}))
+			})
+
+			It("should fail to purge private data if the shim does not support it", func() {
+				payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: txContext, Collection: "orgs", Key: "007"})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "PurgePrivateData", payload)
+				Expect(err).To(MatchError("PurgePrivateData failed: Not supported by this version of the Fabric chaincode shim, which requires Fabric v2.5 or later"))
+			})
+		})
+
+		Context("With a write set limit", func() {
+			var (
+				txContext *contract.TransactionContext
+				stub      *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				txContext = &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"}
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetStateReturns([]byte("bond"), nil)
+				contextStore.Put("channel1", "txn1", stub)
+				proxy = internal.NewFabricProxy(contextStore, internal.WithMaxWriteSetBytes(16))
+			})
+
+			updateState := func(ctx context.Context, key, value string) error {
+				payload, _ := proto.Marshal(&contract.UpdateStateRequest{Context: txContext, State: &contract.State{Key: key, Value: []byte(value)}})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "UpdateState", payload)
+				return err
+			}
+
+			It("should fail a write which would exceed the limit without calling the stub", func() {
+				Expect(updateState(ctx, "007", "bond")).To(Succeed())
+				Expect(updateState(ctx, "008", "bond")).To(Succeed())
+
+				err := updateState(ctx, "009", "bond")
+				Expect(err).To(MatchError("UpdateState failed: Transaction write set too large: writing key 009 would make the write set 21 bytes, exceeding the limit of 16 bytes"))
+				Expect(stub.PutStateCallCount()).To(Equal(2))
+			})
+
+			It("should only count the last write of each key", func() {
+				Expect(updateState(ctx, "007", "james bond")).To(Succeed())
+				Expect(updateState(ctx, "007", "bond")).To(Succeed())
+				Expect(updateState(ctx, "008", "bond")).To(Succeed())
+				Expect(stub.PutStateCallCount()).To(Equal(3))
+			})
+
+			It("should count deleted keys", func() {
+				ledger := internal.NewMemoryLedger()
+				for _, key := range []string{"001", "002", "003", "004", "005", "006"} {
+					ledger.PutState(key, []byte("agent "+key))
+				}
+				Expect(contextStore.Remove("channel1", "txn1")).To(Succeed())
+				contextStore.Put("channel1", "txn1", ledger.NewStub("channel1", "txn1"))
+
+				payload, _ := json.Marshal(&internal.DelStateByRangeRequest{Context: txContext})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "DelStateByRange", payload)
+				Expect(err).To(MatchError("DelStateByRange failed for key 006 after deleting 5 keys: Transaction write set too large: writing key 006 would make the write set 18 bytes, exceeding the limit of 16 bytes"))
+			})
+
+			It("should reset the limit for each transaction", func() {
+				Expect(updateState(ctx, "007", "james bond")).To(Succeed())
+				Expect(contextStore.Remove("channel1", "txn1")).To(Succeed())
+
+				contextStore.Put("channel1", "txn1", stub)
+				Expect(updateState(ctx, "007", "james bond")).To(Succeed())
+				Expect(stub.PutStateCallCount()).To(Equal(2))
+			})
+
+			It("should limit the transaction in the invocation context", func() {
+				txCtx := internal.WithTransaction(ctx, "channel1", "txn1", stub)
+				Expect(updateState(txCtx, "007", "james bond")).To(Succeed())
+				Expect(updateState(ctx, "008", "james bond")).To(MatchError(ContainSubstring(internal.ErrWriteSetTooLarge.Error())))
+			})
+
+			It("should not count the writes of a simulated invocation", func() {
+				simulationCtx, writeSet := internal.WithSimulation(ctx)
+				Expect(updateState(simulationCtx, "007", "james bond")).To(Succeed())
+				Expect(updateState(simulationCtx, "008", "james bond")).To(Succeed())
+				Expect(writeSet.Writes()).To(HaveLen(2))
+
+				Expect(updateState(ctx, "007", "james bond")).To(Succeed())
+			})
+
+			It("should purge private data without counting it, with or without the read cache", func() {
+				purgingStub := &purgingStub{ChaincodeStubInterface: stub}
+				cachedProxy := internal.NewFabricProxy(contextStore, internal.WithMaxWriteSetBytes(16), internal.WithReadCache())
+				for _, purgingProxy := range []*internal.FabricProxy{proxy, cachedProxy} {
+					Expect(contextStore.Remove("channel1", "txn1")).To(Succeed())
+					contextStore.Put("channel1", "txn1", purgingStub)
+
+					payload, _ := json.Marshal(&internal.PrivateDataRequest{Context: txContext, Collection: "orgs", Key: "james bond"})
+					_, err := purgingProxy.FabricCall(ctx, "wapc", "LedgerService", "PurgePrivateData", payload)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(updateState(ctx, "007", "james bond")).To(Succeed())
+				}
+				Expect(purgingStub.purged).To(Equal([]string{"orgs/james bond", "orgs/james bond"}))
+			})
+		})
+
+		Context("With a simulated invocation", func() {
+			var (
+				context  *contract.TransactionContext
+				stub     *fakes.ChaincodeStubInterface
+				writeSet *internal.WriteSet
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"}
+
+				stub = &fakes.ChaincodeStubInterface{}
+				contextStore.Put("channel1", "txn1", stub)
+				ctx, writeSet = internal.WithSimulation(ctx)
+			})
+
+			It("should buffer state writes instead of passing them to the stub", func() {
+				payload, _ := proto.Marshal(&contract.CreateStateRequest{Context: context, State: &contract.State{Key: "007", Value: []byte("bond")}})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "CreateState", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				stub.GetStateReturns([]byte("bond"), nil)
+				payload, _ = proto.Marshal(&contract.UpdateStateRequest{Context: context, State: &contract.State{Key: "007", Value: []byte("james")}})
+				_, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "UpdateState", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.GetStateCallCount()).To(Equal(2), "Should read from the stub")
+				Expect(stub.PutStateCallCount()).To(Equal(0), "Should not call PutState")
+				Expect(writeSet.Writes()).To(Equal([]internal.StateWrite{
+					{Key: "007", Value: []byte("bond")},
+					{Key: "007", Value: []byte("james")},
+				}))
+			})
+
+			It("should buffer private data writes instead of passing them to the stub", func() {
+				payload, _ := json.Marshal(&internal.PutPrivateDataRequest{Context: context, Collection: "orgs", Key: "007", Value: []byte("bond")})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "PutPrivateData", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				payload, _ = json.Marshal(&internal.PrivateDataRequest{Context: context, Collection: "orgs", Key: "006"})
+				_, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "DelPrivateData", payload)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "PurgePrivateData", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stub.PutPrivateDataCallCount()).To(Equal(0), "Should not call PutPrivateData")
+				Expect(stub.DelPrivateDataCallCount()).To(Equal(0), "Should not call DelPrivateData")
+				Expect(writeSet.Writes()).To(Equal([]internal.StateWrite{
+					{Collection: "orgs", Key: "007", Value: []byte("bond")},
+					{Collection: "orgs", Key: "006", IsDelete: true},
+					{Collection: "orgs", Key: "006", IsPurge: true},
+				}))
+			})
+
+			It("should buffer writes for the stub in the context", func() {
+				other := &fakes.ChaincodeStubInterface{}
+				ctx = internal.WithTransaction(ctx, "channel1", "txn1", other)
+
+				payload, _ := proto.Marshal(&contract.CreateStateRequest{Context: context, State: &contract.State{Key: "007", Value: []byte("bond")}})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "CreateState", payload)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(other.GetStateCallCount()).To(Equal(1))
+				Expect(other.PutStateCallCount()).To(Equal(0))
+				Expect(writeSet.Writes()).To(HaveLen(1))
+			})
+		})
+
+		Context("With a transaction in the context", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"}
+
+				stub = &fakes.ChaincodeStubInterface{}
+				stub.GetStateReturns([]byte("bond"), nil)
+				ctx = internal.WithTransaction(ctx, "channel1", "txn1", stub)
+			})
+
+			readState := func(context *contract.TransactionContext) ([]byte, error) {
+				payload, _ := proto.Marshal(&contract.ReadStateRequest{Context: context, StateKey: "007"})
+				return proxy.FabricCall(ctx, "wapc", "LedgerService", "ReadState", payload)
+			}
+
+			It("should use the stub from the context", func() {
+				result, err := readState(context)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := &contract.ReadStateResponse{}
+				Expect(proto.Unmarshal(result, response)).To(Succeed())
+				Expect(response.GetState().GetValue()).To(Equal([]byte("bond")))
+				Expect(stub.GetStateCallCount()).To(Equal(1))
+			})
+
+			It("should not use the stubs of other transactions in the context store", func() {
+				other := &fakes.ChaincodeStubInterface{}
+				contextStore.Put("channel1", "txn2", other)
+
+				result, err := readState(&contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn2"})
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("ReadState failed: Transaction context channel1 txn2 does not match the transaction being invoked"))
+				Expect(other.GetStateCallCount()).To(Equal(0))
+
+				result, err = readState(&contract.TransactionContext{ChannelId: "channel2", TransactionId: "txn1"})
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("ReadState failed: Transaction context channel2 txn1 does not match the transaction being invoked"))
+			})
+
+			It("should not use the iterators of other transactions in the context store", func() {
+				other := &fakes.ChaincodeStubInterface{}
+				other.GetStateByRangeReturns(&fakes.StateQueryIteratorInterface{}, nil)
+				contextStore.Put("channel1", "txn2", other)
+				otherContext := &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn2"}
+
+				payload, _ := json.Marshal(&internal.GetStateByRangeRequest{Context: otherContext, StartKey: "001", EndKey: "009"})
+				result, err := proxy.FabricCall(internal.WithTransaction(ctx, "channel1", "txn2", other), "wapc", "LedgerService", "GetStateByRange", payload)
+				Expect(err).NotTo(HaveOccurred())
+				response := &internal.IteratorResponse{}
+				Expect(json.Unmarshal(result, response)).To(Succeed())
+
+				payload, _ = json.Marshal(&internal.IteratorNextRequest{Context: otherContext, IteratorID: response.IteratorID})
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorNext", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("IteratorNext failed: Transaction context channel1 txn2 does not match the transaction being invoked"))
+
+				payload, _ = json.Marshal(&internal.IteratorCloseRequest{Context: otherContext, IteratorID: response.IteratorID})
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorClose", payload)
+				Expect(result).To(BeNil())
+				Expect(err).To(MatchError("IteratorClose failed: Transaction context channel1 txn2 does not match the transaction being invoked"))
+			})
+		})
+
+		Context("With error codes", func() {
+			var (
+				context *contract.TransactionContext
+				stub    *fakes.ChaincodeStubInterface
+			)
+
+			BeforeEach(func() {
+				context = &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"}
+				stub = &fakes.ChaincodeStubInterface{}
+				contextStore.Put("channel1", "txn1", stub)
+			})
+
+			readPrivateData := func() ([]byte, error) {
+				payload, _ := proto.Marshal(&contract.ReadStateRequest{Context: context, StateKey: "007", Collection: &contract.Collection{Name: "orgs"}})
+				return proxy.FabricCall(ctx, "wapc", "LedgerService", "ReadState", payload)
+			}
+
+			errorCode := func(err error) internal.ErrorCode {
+				var hostCallErr *internal.HostCallError
+				Expect(errors.As(err, &hostCallErr)).To(BeTrue(), "Should return a HostCallError for %q", err)
+				return hostCallErr.Code
+			}
+
+			It("should map errors from the peer to error codes", func() {
+				messages := map[string]internal.ErrorCode{
+					"collection orgs not found":                                                                  internal.ErrorCodeCollectionNotFound,
+					"collection [mychannel/basic/orgs] could not be found":                                       internal.ErrorCodeCollectionNotFound,
+					"tx creator does not have read access permission on privatedata in chaincodeName:basic":      internal.ErrorCodeAccessDenied,
+					"access denied for [GetPrivateData][mychannel]":                                              internal.ErrorCodeAccessDenied,
+					"failed evaluating policy on signed data during check policy [/Channel/Application/Readers]": internal.ErrorCodePolicyFailure,
+					"transaction invalidated with status (MVCC_READ_CONFLICT)":                                   internal.ErrorCodeMVCCReadConflict,
+					"transaction invalidated with status (PHANTOM_READ_CONFLICT)":                                internal.ErrorCodePhantomReadConflict,
+				}
+				for message, code := range messages {
+					stub.GetPrivateDataReturns(nil, errors.New(message))
+
+					result, err := readPrivateData()
+					Expect(result).To(BeNil())
+					Expect(errorCode(err)).To(Equal(code), "Should map %q to %s", message, code)
+					Expect(err).To(MatchError("ReadState failed for collection orgs: "+message), "Should not change the message")
+				}
+			})
+
+			It("should map errors from the host to error codes", func() {
+				result, err := readPrivateData()
+				Expect(result).To(BeNil())
+				Expect(errorCode(err)).To(Equal(internal.ErrorCodeStateNotFound))
+
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "ReadState", []byte{0xff})
+				Expect(result).To(BeNil())
+				Expect(errorCode(err)).To(Equal(internal.ErrorCodeInvalidRequest))
+
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "ReadState", []byte{0x0f})
+				Expect(result).To(BeNil())
+				Expect(errorCode(err)).To(Equal(internal.ErrorCodeInvalidRequest))
+
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRange", []byte("{"))
+				Expect(result).To(BeNil())
+				Expect(errorCode(err)).To(Equal(internal.ErrorCodeInvalidRequest))
+
+				payload, _ := json.Marshal(&internal.GetStateByRangeWithPaginationRequest{Context: context})
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRangeWithPagination", payload)
+				Expect(result).To(BeNil())
+				Expect(errorCode(err)).To(Equal(internal.ErrorCodeInvalidRequest))
+
+				payload, _ = json.Marshal(&internal.IteratorNextRequest{Context: context, IteratorID: "missing"})
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "IteratorNext", payload)
+				Expect(result).To(BeNil())
+				Expect(errorCode(err)).To(Equal(internal.ErrorCodeIteratorNotFound))
+
+				payload, _ = proto.Marshal(&contract.ReadStateRequest{Context: &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn2"}, StateKey: "007"})
+				result, err = proxy.FabricCall(ctx, "wapc", "LedgerService", "ReadState", payload)
+				Expect(result).To(BeNil())
+				Expect(errorCode(err)).To(Equal(internal.ErrorCodeTransactionNotFound))
+
+				result, err = proxy.FabricCall(ctx, "wapc", "TeaService", "Brew", nil)
+				Expect(result).To(BeNil())
+				Expect(errorCode(err)).To(Equal(internal.ErrorCodeNotSupported))
+			})
+
+			It("should map host call timeouts to an error code", func() {
+				stub.GetPrivateDataStub = func(collection, key string) ([]byte, error) {
+					time.Sleep(50 * time.Millisecond)
+					return []byte("bond"), nil
+				}
+				proxy = internal.NewFabricProxy(contextStore, internal.WithHostCallTimeout(time.Millisecond))
+
+				result, err := readPrivateData()
+				Expect(result).To(BeNil())
+				Expect(errorCode(err)).To(Equal(internal.ErrorCodeHostCallTimeout))
+				Expect(errors.Is(err, internal.ErrHostCallTimeout)).To(BeTrue())
+			})
+
+			It("should not add an error code to errors with an unknown cause", func() {
+				stub.GetPrivateDataReturns(nil, errors.New("no mr bond"))
+
+				result, err := readPrivateData()
+				Expect(result).To(BeNil())
+				var hostCallErr *internal.HostCallError
+				Expect(errors.As(err, &hostCallErr)).To(BeFalse())
+				Expect(err).To(MatchError("ReadState failed for collection orgs: no mr bond"))
+			})
+
+			It("should have stable names for the error codes", func() {
+				Expect(internal.ErrorCodeCollectionNotFound.String()).To(Equal("COLLECTION_NOT_FOUND"))
+				Expect(internal.ErrorCodeMVCCReadConflict.String()).To(Equal("MVCC_READ_CONFLICT"))
+				Expect(int(internal.ErrorCodeMVCCReadConflict)).To(Equal(10))
+				Expect(internal.ErrorCode(99).String()).To(Equal("ErrorCode(99)"))
+			})
+		})
+	})
+
+})
+
+// testCertificate returns a DER encoded self-signed certificate, with Fabric
+// CA attributes for a role of admin and an empty clearance
+func testCertificate() []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject:      pkix.Name{CommonName: "bond", Organization: []string{"Org1"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: []byte(`{"attrs":{"role":"admin","clearance":""}}`)},
+		},
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+
+	return cert
+}
+
+// testCreator returns a serialized identity for the creator of a transaction
+func testCreator(mspID string, idBytes []byte) []byte {
+	creator, err := legacyproto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: idBytes})
+	if err != nil {
+		panic(err)
+	}
+
+	return creator
+}
+
+// purgingStub is a chaincode stub from a version of the shim which supports
+// purging private data
+type purgingStub struct {
+	*fakes.ChaincodeStubInterface
+	purged []string
+	err    error
+}
+
+func (stub *purgingStub) PurgePrivateData(collection, key string) error {
+	stub.purged = append(stub.purged, collection+"/"+key)
+	return stub.err
+}
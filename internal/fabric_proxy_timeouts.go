@@ -0,0 +1,89 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrHostCallTimeout is returned to the guest when a host call does not
+// complete within its timeout, or before the deadline of the invocation
+var ErrHostCallTimeout = errors.New("Host call timed out")
+
+// WithHostCallTimeout sets how long the FabricProxy waits for each host call,
+// such as a range scan or rich query, before returning ErrHostCallTimeout to
+// the guest, so that one slow ledger operation cannot keep a waPC instance
+// checked out indefinitely. Host calls are always bounded by the deadline of
+// the invocation context, if it has one, and a timeout of zero only uses the
+// deadline.
+//
+// Note: the stub cannot be interrupted, so a host call which times out carries
+// on in the background until the peer responds, and the transaction should be
+// treated as failed.
+func WithHostCallTimeout(timeout time.Duration) FabricProxyOption {
+	return func(proxy *FabricProxy) {
+		proxy.hostCallTimeout = timeout
+	}
+}
+
+// WithOperationTimeout overrides the host call timeout for one LedgerService
+// operation, for example to allow GetQueryResult longer than GetState. A
+// timeout of zero only uses the deadline of the invocation context.
+func WithOperationTimeout(operation string, timeout time.Duration) FabricProxyOption {
+	return func(proxy *FabricProxy) {
+		proxy.operationTimeouts[operation] = timeout
+	}
+}
+
+// operationTimeout returns the host call timeout for the operation
+func (proxy *FabricProxy) operationTimeout(operation string) time.Duration {
+	if timeout, ok := proxy.operationTimeouts[operation]; ok {
+		return timeout
+	}
+	return proxy.hostCallTimeout
+}
+
+// callWithTimeout makes a host call, returning early if it exceeds the host
+// call timeout for the operation or the context is done. The call is not made
+// at all if the context is already done.
+func (proxy *FabricProxy) callWithTimeout(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("[host] Host call %s %s not started: %s\n", namespace, operation, err)
+		return nil, fmt.Errorf("Host call %s %s not started: %w", namespace, operation, err)
+	}
+
+	timeout := proxy.operationTimeout(operation)
+	if timeout <= 0 && ctx.Done() == nil {
+		return proxy.call(ctx, binding, namespace, operation, payload)
+	}
+
+	callCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan InvokeResult, 1)
+	go func() {
+		result, err := proxy.call(callCtx, binding, namespace, operation, payload)
+		done <- InvokeResult{Result: result, Err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.Result, r.Err
+	case <-callCtx.Done():
+		if ctx.Err() != nil {
+			log.Printf("[host] Host call %s %s interrupted: %s\n", namespace, operation, ctx.Err())
+			return nil, fmt.Errorf("%w: %s %s interrupted: %s", ErrHostCallTimeout, namespace, operation, ctx.Err())
+		}
+		log.Printf("[host] Host call %s %s timed out after %s\n", namespace, operation, timeout)
+		return nil, fmt.Errorf("%w: %s %s after %s", ErrHostCallTimeout, namespace, operation, timeout)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+)
+
+// TransactionRequest is used by host calls which only need the transaction
+// context
+type TransactionRequest struct {
+	Context *contract.TransactionContext `json:"context"`
+}
+
+// TxIDResponse contains the ID of the transaction
+type TxIDResponse struct {
+	TxID string `json:"tx_id"`
+}
+
+// ChannelIDResponse contains the ID of the channel for the transaction
+type ChannelIDResponse struct {
+	ChannelID string `json:"channel_id"`
+}
+
+// TxTimestampResponse contains the timestamp from the transaction proposal,
+// which is the same for every endorser, unlike the host clock
+type TxTimestampResponse struct {
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TransientResponse contains the transient data for the transaction proposal,
+// which is marshalled with the keys in sorted order
+type TransientResponse struct {
+	Transient map[string][]byte `json:"transient"`
+}
+
+// InvokeChaincodeRequest calls another chaincode. An empty channel, or the
+// channel of the transaction, invokes the chaincode as part of the current
+// transaction, otherwise the peer only allows the other chaincode to query the
+// ledger on that channel.
+type InvokeChaincodeRequest struct {
+	Context   *contract.TransactionContext `json:"context"`
+	Chaincode string                       `json:"chaincode"`
+	Args      [][]byte                     `json:"args"`
+	Channel   string                       `json:"channel"`
+}
+
+// ChaincodeResponse is the complete response from an invoked chaincode.
+// Error responses are returned like any other, rather than failing the host
+// call, so that the guest can act on the status and message.
+type ChaincodeResponse struct {
+	Status  int32  `json:"status"`
+	Message string `json:"message"`
+	Payload []byte `json:"payload"`
+}
+
+// SetEventRequest sets the chaincode event for the transaction. Only one event
+// can be set per transaction, so a later event replaces an earlier one.
+type SetEventRequest struct {
+	Context *contract.TransactionContext `json:"context"`
+	Name    string                       `json:"name"`
+	Payload []byte                       `json:"payload"`
+}
+
+func (proxy *FabricProxy) setEvent(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &SetEventRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("SetEvent failed: Missing transaction context")
+	}
+	log.Printf("[host] SetEvent txid %s chid %s name %s payload length %d\n", context.TransactionId, context.ChannelId, request.Name, len(request.Payload))
+
+	if request.Name == "" {
+		return nil, fmt.Errorf("SetEvent failed: Missing event name")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("SetEvent failed: %s", err.Error())
+	}
+
+	err = stub.SetEvent(request.Name, request.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("SetEvent failed: %s", err.Error())
+	}
+
+	log.Printf("[host] SetEvent done\n")
+	return nil, nil
+}
+
+func (proxy *FabricProxy) getTxID(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &TransactionRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetTxID failed: Missing transaction context")
+	}
+	log.Printf("[host] GetTxID txid %s chid %s\n", context.TransactionId, context.ChannelId)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetTxID failed: %s", err.Error())
+	}
+
+	log.Printf("[host] GetTxID done\n")
+	return json.Marshal(&TxIDResponse{TxID: stub.GetTxID()})
+}
+
+func (proxy *FabricProxy) getChannelID(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &TransactionRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetChannelID failed: Missing transaction context")
+	}
+	log.Printf("[host] GetChannelID txid %s chid %s\n", context.TransactionId, context.ChannelId)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetChannelID failed: %s", err.Error())
+	}
+
+	log.Printf("[host] GetChannelID done\n")
+	return json.Marshal(&ChannelIDResponse{ChannelID: stub.GetChannelID()})
+}
+
+func (proxy *FabricProxy) getTxTimestamp(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &TransactionRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetTxTimestamp failed: Missing transaction context")
+	}
+	log.Printf("[host] GetTxTimestamp txid %s chid %s\n", context.TransactionId, context.ChannelId)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetTxTimestamp failed: %s", err.Error())
+	}
+
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("GetTxTimestamp failed: %s", err.Error())
+	}
+	if timestamp == nil {
+		return nil, fmt.Errorf("GetTxTimestamp failed: Missing proposal timestamp")
+	}
+
+	log.Printf("[host] GetTxTimestamp done\n")
+	return json.Marshal(&TxTimestampResponse{Timestamp: time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC()})
+}
+
+func (proxy *FabricProxy) getTransient(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &TransactionRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("GetTransient failed: Missing transaction context")
+	}
+	log.Printf("[host] GetTransient txid %s chid %s\n", context.TransactionId, context.ChannelId)
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("GetTransient failed: %s", err.Error())
+	}
+
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("GetTransient failed: %s", err.Error())
+	}
+
+	// Always return a map, even if there is no transient data
+	if transient == nil {
+		transient = map[string][]byte{}
+	}
+
+	log.Printf("[host] GetTransient done, %d keys\n", len(transient))
+	return json.Marshal(&TransientResponse{Transient: transient})
+}
+
+func (proxy *FabricProxy) invokeChaincode(ctx context.Context, payload []byte) ([]byte, error) {
+	request := &InvokeChaincodeRequest{}
+	err := json.Unmarshal(payload, request)
+	if err != nil {
+		return nil, err
+	}
+
+	context := request.Context
+	if context == nil {
+		return nil, fmt.Errorf("InvokeChaincode failed: Missing transaction context")
+	}
+	log.Printf("[host] InvokeChaincode txid %s chid %s chaincode %s channel %s\n", context.TransactionId, context.ChannelId, request.Chaincode, request.Channel)
+
+	if request.Chaincode == "" {
+		return nil, fmt.Errorf("InvokeChaincode failed: Missing chaincode name")
+	}
+
+	stub, err := proxy.getStub(ctx, context)
+	if err != nil {
+		return nil, fmt.Errorf("InvokeChaincode failed: %s", err.Error())
+	}
+
+	// The shim treats an empty channel as the current channel
+	channel := request.Channel
+	if channel == context.ChannelId {
+		channel = ""
+	}
+
+	// Error responses from the other chaincode are returned to the guest,
+	// since the status is part of the response
+	response := stub.InvokeChaincode(request.Chaincode, request.Args, channel)
+
+	log.Printf("[host] InvokeChaincode done, status %d\n", response.Status)
+	return json.Marshal(&ChaincodeResponse{
+		Status:  response.Status,
+		Message: response.Message,
+		Payload: response.Payload,
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ErrWriteSetTooLarge is returned to the guest when a write would take the
+// write set of the transaction over the limit set with WithMaxWriteSetBytes
+var ErrWriteSetTooLarge = errors.New("Transaction write set too large")
+
+// WithMaxWriteSetBytes limits the size of the world state write set of each
+// transaction, so that a transaction which Fabric would reject at commit for
+// being too large fails while it is being endorsed instead. A write which
+// would take the write set over the limit is not passed to the stub, and
+// returns an error wrapping ErrWriteSetTooLarge to the guest, which can handle
+// it like any other host call error.
+//
+// Each key written counts its length plus the length of its value, and each
+// key deleted counts its length. Writing the same key again replaces its
+// earlier size, as Fabric only keeps the last write of each key. Private data
+// writes and purges are not counted, since the private data is not part of
+// the transaction.
+//
+// The size for a transaction is discarded when its stub is removed from the
+// ContextStore, so the limit applies to each transaction separately.
+// Transactions which are only in the invocation context, and not in the
+// ContextStore, are not limited. Writes buffered by a simulated invocation are
+// not counted. A limit of zero or less, the default, does not limit write sets.
+func WithMaxWriteSetBytes(limit int) FabricProxyOption {
+	return func(proxy *FabricProxy) {
+		proxy.maxWriteSet = limit
+	}
+}
+
+// writeSetSize is the size of the world state write set of one transaction,
+// and of each key in it
+type writeSetSize struct {
+	mutex sync.Mutex
+	keys  map[string]int
+	total int
+}
+
+// add records a write of the specified size to the key, unless it would take
+// the total size over the limit
+func (size *writeSetSize) add(key string, keySize int, limit int) error {
+	size.mutex.Lock()
+	defer size.mutex.Unlock()
+
+	total := size.total - size.keys[key] + keySize
+	if total > limit {
+		return fmt.Errorf("%w: writing key %s would make the write set %d bytes, exceeding the limit of %d bytes", ErrWriteSetTooLarge, key, total, limit)
+	}
+	size.keys[key] = keySize
+	size.total = total
+
+	return nil
+}
+
+// limitedStub is a stub which rejects writes which would take the write set
+// of the transaction over the limit, and passes everything else to the stub
+// it wraps
+type limitedStub struct {
+	shim.ChaincodeStubInterface
+	size  *writeSetSize
+	limit int
+}
+
+// withWriteSetLimit wraps the stub for a transaction in the ContextStore with
+// the write set size for the transaction, if the proxy limits write sets
+func (proxy *FabricProxy) withWriteSetLimit(key stubKey, stub shim.ChaincodeStubInterface) shim.ChaincodeStubInterface {
+	if proxy.maxWriteSet <= 0 {
+		return stub
+	}
+
+	size := proxy.contextStore.writeSetSize(key)
+	if size == nil {
+		return stub
+	}
+
+	return &limitedStub{ChaincodeStubInterface: stub, size: size, limit: proxy.maxWriteSet}
+}
+
+func (stub *limitedStub) PutState(key string, value []byte) error {
+	if err := stub.size.add(key, len(key)+len(value), stub.limit); err != nil {
+		log.Printf("[host] Rejecting PutState key %s: %s\n", key, err)
+		return err
+	}
+
+	return stub.ChaincodeStubInterface.PutState(key, value)
+}
+
+func (stub *limitedStub) DelState(key string) error {
+	if err := stub.size.add(key, len(key), stub.limit); err != nil {
+		log.Printf("[host] Rejecting DelState key %s: %s\n", key, err)
+		return err
+	}
+
+	return stub.ChaincodeStubInterface.DelState(key)
+}
+
+// PurgePrivateData passes the purge to the wrapped stub, if it supports
+// purging, without counting it, since private data is not limited
+func (stub *limitedStub) PurgePrivateData(collection, key string) error {
+	return purgeStubPrivateData(stub.ChaincodeStubInterface, collection, key)
+}
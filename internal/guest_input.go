@@ -0,0 +1,90 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+type guestInputKey struct{}
+
+// WithStdin sets what the guest reads from WASI stdin, for guests such as
+// off-the-shelf WASI programs which read their configuration or input from
+// stdin. The reader is read in full when the WasmGuest is created, and every
+// invocation, on every waPC instance, reads the same input from the start,
+// unless it is replaced using WithGuestInput. By default, stdin is empty.
+func WithStdin(stdin io.Reader) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if stdin == nil {
+			return fmt.Errorf("Invalid stdin: must not be nil")
+		}
+		content, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("Invalid stdin: %s", err.Error())
+		}
+		wg.stdin = content
+		return nil
+	}
+}
+
+// WithGuestInput returns a context which makes the guest read from the reader
+// when it reads WASI stdin while invoking an operation with that context,
+// instead of the stdin set using WithStdin
+func WithGuestInput(ctx context.Context, stdin io.Reader) context.Context {
+	return context.WithValue(ctx, guestInputKey{}, stdin)
+}
+
+// inputReader reads from the current reader, which is reset for each
+// invocation. The mutex only guards swapping the current reader, so that a
+// reader which blocks, such as a pipe, does not block resetting it when the
+// instance is released.
+type inputReader struct {
+	mutex   sync.Mutex
+	content []byte
+	current io.Reader
+}
+
+func (r *inputReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	current := r.current
+	r.mutex.Unlock()
+
+	if current == nil {
+		return 0, io.EOF
+	}
+	return current.Read(p)
+}
+
+// reset reads from the specified reader until it is reset again, with a nil
+// reader reading the default content from the start. A read in progress
+// carries on with the previous reader.
+func (r *inputReader) reset(current io.Reader) {
+	if current == nil {
+		current = bytes.NewReader(r.content)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.current = current
+}
+
+// input resets the guest stdin of the leased instance for an invocation with
+// the context, reading from the reader in the context if there is one
+func (lease *instanceLease) input(ctx context.Context) {
+	instance, ok := lease.instance.(*outputInstance)
+	if !ok {
+		return
+	}
+
+	stdin, _ := ctx.Value(guestInputKey{}).(io.Reader)
+	instance.stdin.reset(stdin)
+	if stdin != nil {
+		lease.onRelease(func() { instance.stdin.reset(nil) })
+	}
+}
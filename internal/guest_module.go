@@ -0,0 +1,88 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wapc/wapc-go"
+)
+
+// guestModule is a compiled Wasm module with its own pool of waPC instances.
+// Reloading a WasmGuest replaces its guestModule, and the old one is closed
+// once the invocations using it have finished.
+type guestModule struct {
+	module            wapc.Module
+	pool              *instancePool
+	digest            string
+	exportedFunctions map[string]bool
+	customSections    map[string][]byte
+	inFlight          inFlightGroup
+}
+
+// inFlightGroup is a wait group for the invocations using a module, which also
+// counts them
+type inFlightGroup struct {
+	count int64
+	sync.WaitGroup
+}
+
+func (g *inFlightGroup) Add(delta int) {
+	atomic.AddInt64(&g.count, int64(delta))
+	g.WaitGroup.Add(delta)
+}
+
+func (g *inFlightGroup) Done() {
+	g.Add(-1)
+}
+
+// active returns the number of invocations using the module
+func (g *inFlightGroup) active() int {
+	return int(atomic.LoadInt64(&g.count))
+}
+
+// requireOperations returns an error listing any of the specified operations
+// which are not exported by the Wasm module
+func (gm *guestModule) requireOperations(operations ...string) error {
+	missing := []string{}
+	for _, operation := range operations {
+		if !gm.exportedFunctions[operation] {
+			missing = append(missing, operation)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing required Wasm operations: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// wapcFunctions are the functions exported by waPC guests for the waPC
+// protocol, rather than as operations
+var wapcFunctions = map[string]bool{
+	"__guest_call": true,
+	"wapc_init":    true,
+	"_start":       true,
+	"_initialize":  true,
+	"__handshake":  true,
+}
+
+// operations returns the sorted names of the functions exported by the Wasm
+// module, apart from the waPC protocol functions
+func (gm *guestModule) operations() []string {
+	operations := []string{}
+	for name := range gm.exportedFunctions {
+		if !wapcFunctions[name] {
+			operations = append(operations, name)
+		}
+	}
+	sort.Strings(operations)
+
+	return operations
+}
@@ -0,0 +1,194 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/wapc/wapc-go"
+)
+
+type guestOutputKey struct{}
+
+type outputInstanceKey struct{}
+
+// guestOutput holds the writers for anything the guest writes to stdout and
+// stderr during an invocation
+type guestOutput struct {
+	stdout, stderr io.Writer
+}
+
+// WithGuestOutput returns a context which captures anything written by the
+// guest to stdout or stderr while invoking an operation with that context, so
+// that guest output can be attributed to a transaction. Nil writers use the
+// writers configured for the WasmGuest.
+func WithGuestOutput(ctx context.Context, stdout, stderr io.Writer) context.Context {
+	return context.WithValue(ctx, guestOutputKey{}, guestOutput{stdout: stdout, stderr: stderr})
+}
+
+// outputLinePrefix returns the prefix for lines written by the guest while
+// invoking the operation, with the ID of the transaction in the context if
+// there is one
+func outputLinePrefix(ctx context.Context, operation string) string {
+	if tx, ok := transactionFromContext(ctx); ok {
+		return "[txid=" + tx.key.txID + "] [op=" + operation + "] "
+	}
+	return "[op=" + operation + "] "
+}
+
+// redirectWriter writes to the current writer, if there is one, or otherwise
+// to the default writer. If prefixLines is set, output is written a line at a
+// time with the current prefix.
+type redirectWriter struct {
+	mutex         sync.Mutex
+	defaultWriter io.Writer
+	current       io.Writer
+	prefixLines   bool
+	linePrefix    string
+	partial       []byte
+}
+
+func (w *redirectWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.prefixLines {
+		return w.writer().Write(p)
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, p...)
+			break
+		}
+
+		w.partial = append(w.partial, p[:i+1]...)
+		if err := w.writeLine(); err != nil {
+			return 0, err
+		}
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+func (w *redirectWriter) writer() io.Writer {
+	if w.current != nil {
+		return w.current
+	}
+	return w.defaultWriter
+}
+
+// writeLine writes the buffered line with the current prefix in a single write,
+// so that lines from different instances sharing a writer are not mixed up
+func (w *redirectWriter) writeLine() error {
+	line := make([]byte, 0, len(w.linePrefix)+len(w.partial))
+	line = append(append(line, w.linePrefix...), w.partial...)
+	w.partial = w.partial[:0]
+
+	_, err := w.writer().Write(line)
+	return err
+}
+
+func (w *redirectWriter) redirect(current io.Writer) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.current = current
+}
+
+// prefix sets the prefix for the lines written from now on, first writing any
+// partial line with the previous prefix and a newline, so that it is not
+// attributed to the next invocation
+func (w *redirectWriter) prefix(linePrefix string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.partial) > 0 {
+		// There is no writer to return an error to, as with output written
+		// by the guest after an invocation is interrupted
+		w.partial = append(w.partial, '\n')
+		_ = w.writeLine()
+	}
+	w.linePrefix = linePrefix
+}
+
+// outputInstance is a waPC instance with its own stdout and stderr writers,
+// and stdin reader, which can be redirected for each invocation, and its own
+// clocks and random
+// bytes when using the SyscallsDeterministic policy. It also records whether
+// the handshake has been performed with the guest instance.
+type outputInstance struct {
+	wapc.Instance
+	stdout, stderr *redirectWriter
+	stdin          *inputReader
+	syscalls       *deterministicSyscalls
+	prefixLines    bool
+	handshaken     bool
+	handshakeErr   error
+}
+
+// redirect sends guest output to the specified writers until it is redirected
+// again, with nil writers reverting to the default writers
+func (instance *outputInstance) redirect(output guestOutput) {
+	instance.stdout.redirect(output.stdout)
+	instance.stderr.redirect(output.stderr)
+}
+
+// prefix sets the prefix for each line of guest output until it is set again
+func (instance *outputInstance) prefix(linePrefix string) {
+	instance.stdout.prefix(linePrefix)
+	instance.stderr.prefix(linePrefix)
+}
+
+// outputModule is a waPC module which creates outputInstances, which prefix
+// each line of output if prefixLines is set, and read stdin from the content
+// unless it is redirected
+type outputModule struct {
+	wapc.Module
+	stdout, stderr io.Writer
+	stdin          []byte
+	prefixLines    bool
+}
+
+// Instantiate creates a new instance of the module which writes to the
+// module's stdout and stderr unless it is redirected
+func (module *outputModule) Instantiate(ctx context.Context) (wapc.Instance, error) {
+	instance := &outputInstance{
+		stdout:      &redirectWriter{defaultWriter: module.stdout, prefixLines: module.prefixLines},
+		stderr:      &redirectWriter{defaultWriter: module.stderr, prefixLines: module.prefixLines},
+		stdin:       &inputReader{content: module.stdin},
+		prefixLines: module.prefixLines,
+	}
+	instance.stdin.reset(nil)
+
+	wapcInstance, err := module.Module.Instantiate(context.WithValue(ctx, outputInstanceKey{}, instance))
+	if err != nil {
+		return nil, err
+	}
+	instance.Instance = wapcInstance
+
+	return instance, nil
+}
+
+// outputRuntime is a wazero runtime which configures the writers and reader
+// for each outputInstance as it is instantiated
+type outputRuntime struct {
+	wazero.Runtime
+}
+
+func (r outputRuntime) InstantiateModule(ctx context.Context, compiled wazero.CompiledModule, config wazero.ModuleConfig) (api.Module, error) {
+	if instance, ok := ctx.Value(outputInstanceKey{}).(*outputInstance); ok {
+		config = config.WithStdout(instance.stdout).WithStderr(instance.stderr).WithStdin(instance.stdin)
+	}
+
+	return r.Runtime.InstantiateModule(ctx, compiled, config)
+}
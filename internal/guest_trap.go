@@ -0,0 +1,128 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// TrapKind is the reason the Wasm runtime gave for a guest trap
+type TrapKind string
+
+// The kinds of trap reported by the wazero runtime. Other kinds are reported
+// with the message from the runtime.
+const (
+	TrapUnreachable                TrapKind = "unreachable"
+	TrapOutOfBoundsMemoryAccess    TrapKind = "out of bounds memory access"
+	TrapIntegerDivideByZero        TrapKind = "integer divide by zero"
+	TrapIntegerOverflow            TrapKind = "integer overflow"
+	TrapInvalidConversionToInteger TrapKind = "invalid conversion to integer"
+	TrapStackOverflow              TrapKind = "stack overflow"
+	TrapInvalidTableAccess         TrapKind = "invalid table access"
+	TrapIndirectCallTypeMismatch   TrapKind = "indirect call type mismatch"
+)
+
+const (
+	// wasmErrorPrefix starts the message of the error wrapping a trap from
+	// the wazero runtime
+	wasmErrorPrefix = "wasm error: "
+	// wasmStackTraceSeparator precedes the guest stack trace in the message,
+	// with one function per line
+	wasmStackTraceSeparator = "\nwasm stack trace:\n\t"
+	// engineInvokePrefix starts the message of the errors from the waPC
+	// engines when calling the guest fails, or the instance is closed, as
+	// opposed to an error reported by the guest
+	engineInvokePrefix = "error invoking guest"
+)
+
+// GuestTrap is the error returned when the guest code traps while invoking an
+// operation, for example by executing an unreachable instruction or accessing
+// memory out of bounds. A trap is a deterministic bug in the guest, which
+// would happen again given the same request and state, unlike an error from
+// the host or the Wasm runtime. The trapped instance is discarded rather than
+// returned to the pool, since its state is unrecoverable. Use errors.As to
+// find the GuestTrap in an InvokeError.
+type GuestTrap struct {
+	Operation string
+	Kind      TrapKind
+	// Stack is the guest functions active at the trap, innermost first, if
+	// the runtime reported them
+	Stack []string
+	Err   error
+}
+
+// Error returns the operation and kind of trap, with the error from the
+// runtime
+func (e *GuestTrap) Error() string {
+	return fmt.Sprintf("Operation %s trapped with %s: %s", e.Operation, e.Kind, e.Err)
+}
+
+// Unwrap returns the error from the runtime
+func (e *GuestTrap) Unwrap() error {
+	return e.Err
+}
+
+// classifyTrap returns a GuestTrap wrapping the error from invoking an
+// operation if it is a trap, or otherwise returns the error unchanged
+func classifyTrap(operation string, err error) error {
+	for wrapped := err; wrapped != nil; wrapped = errors.Unwrap(wrapped) {
+		// wazero wraps its runtime errors, which are not exported, in an
+		// error with the guest stack trace
+		msg := wrapped.Error()
+		runtimeErr := errors.Unwrap(wrapped)
+		if !strings.HasPrefix(msg, wasmErrorPrefix) || runtimeErr == nil {
+			continue
+		}
+
+		trap := &GuestTrap{Operation: operation, Kind: TrapKind(runtimeErr.Error()), Err: err}
+		if i := strings.Index(msg, wasmStackTraceSeparator); i >= 0 {
+			trap.Stack = strings.Split(msg[i+len(wasmStackTraceSeparator):], "\n\t")
+		}
+		return trap
+	}
+
+	return err
+}
+
+// runtimeError is an error from the engine or the Wasm runtime, rather than
+// from the guest, while invoking an operation, after which the instance may
+// be in an inconsistent state
+type runtimeError struct {
+	err error
+}
+
+// Error returns the message of the error from the engine
+func (e *runtimeError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error from the engine
+func (e *runtimeError) Unwrap() error {
+	return e.err
+}
+
+// classifyRuntimeError returns a runtimeError wrapping the error from
+// invoking an operation if it came from the engine or the Wasm runtime, such
+// as a guest exit or a panic in a host function, or otherwise returns the
+// error unchanged. Traps are already a GuestTrap. The error must be classified
+// as it is returned by the engine, before anything else can wrap it.
+func classifyRuntimeError(err error) error {
+	var trap *GuestTrap
+	if errors.As(err, &trap) {
+		return err
+	}
+
+	var exitErr *sys.ExitError
+	var goErr runtime.Error
+	if errors.As(err, &exitErr) || errors.As(err, &goErr) || strings.HasPrefix(err.Error(), engineInvokePrefix) {
+		return &runtimeError{err: err}
+	}
+
+	return err
+}
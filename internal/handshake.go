@@ -0,0 +1,121 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// HandshakeOperation is the conventional operation the host invokes once
+	// on each waPC instance, before its first invocation, to check that the
+	// guest speaks a compatible protocol version
+	HandshakeOperation = "__handshake"
+
+	// ProtocolVersion is the newest version of the host protocol, including
+	// the LedgerService host calls, which this host supports
+	ProtocolVersion = 1
+
+	// LegacyProtocolVersion is the protocol version of guests which do not
+	// have the HandshakeOperation
+	LegacyProtocolVersion = 0
+)
+
+// ErrProtocolMismatch is returned when the protocol version of the guest is
+// not supported by the host
+var ErrProtocolMismatch = errors.New("Guest protocol version not supported")
+
+// HandshakeRequest is the payload of the HandshakeOperation, which is the
+// range of protocol versions the host supports
+type HandshakeRequest struct {
+	ProtocolVersion    int `json:"protocol_version"`
+	MinProtocolVersion int `json:"min_protocol_version"`
+}
+
+// HandshakeResponse is the result of the HandshakeOperation, which is the
+// protocol version the guest speaks, and optionally the version of the SDK it
+// was built with
+type HandshakeResponse struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	SDKVersion      string `json:"sdk_version,omitempty"`
+}
+
+// WithMinProtocolVersion rejects guests which speak an older protocol version,
+// including legacy guests which do not have the HandshakeOperation if the
+// version is above LegacyProtocolVersion. The version is checked by the
+// handshake, so guests are rejected when they are first invoked, rather than
+// when they are loaded. By default, every version up to ProtocolVersion is
+// supported.
+func WithMinProtocolVersion(version int) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if version < LegacyProtocolVersion || version > ProtocolVersion {
+			return fmt.Errorf("Invalid minimum protocol version %d: must be between %d and %d", version, LegacyProtocolVersion, ProtocolVersion)
+		}
+		wg.minProtocolVersion = version
+		return nil
+	}
+}
+
+// checkProtocolVersion returns an error wrapping ErrProtocolMismatch if the
+// guest protocol version is not supported
+func (wg *WasmGuest) checkProtocolVersion(response HandshakeResponse) error {
+	if response.ProtocolVersion >= wg.minProtocolVersion && response.ProtocolVersion <= ProtocolVersion {
+		return nil
+	}
+
+	sdk := ""
+	if response.SDKVersion != "" {
+		sdk = fmt.Sprintf(" (SDK %s)", response.SDKVersion)
+	}
+	return fmt.Errorf("%w: guest speaks version %d%s, host supports versions %d to %d", ErrProtocolMismatch, response.ProtocolVersion, sdk, wg.minProtocolVersion, ProtocolVersion)
+}
+
+// handshake invokes the HandshakeOperation on the leased instance through
+// __guest_call, like any other operation, if the instance has not already been
+// checked. A guest which reports that it has no such operation is a legacy
+// guest. A protocol mismatch is remembered for the instance, so later
+// invocations fail fast, whereas the instance is discarded if the handshake
+// itself fails.
+func (lease *instanceLease) handshake(ctx context.Context) error {
+	wg := lease.wg
+	instance, ok := lease.instance.(*outputInstance)
+	if !ok {
+		return nil
+	}
+	if instance.handshaken {
+		return instance.handshakeErr
+	}
+
+	request, err := json.Marshal(&HandshakeRequest{ProtocolVersion: ProtocolVersion, MinProtocolVersion: wg.minProtocolVersion})
+	if err != nil {
+		return err
+	}
+
+	result, err := wg.invoke(ctx, instance, HandshakeOperation, request)
+	if isUnknownOperation(err) {
+		wg.logger.Debugf("[host] Handshake with legacy guest, which has no %s operation", HandshakeOperation)
+		instance.handshaken = true
+		instance.handshakeErr = wg.checkProtocolVersion(HandshakeResponse{ProtocolVersion: LegacyProtocolVersion})
+		return instance.handshakeErr
+	}
+	if err != nil {
+		lease.failed = true
+		return fmt.Errorf("Handshake failed: %w", err)
+	}
+
+	response := HandshakeResponse{}
+	if err := json.Unmarshal(result, &response); err != nil {
+		lease.failed = true
+		return fmt.Errorf("Handshake failed: invalid response: %s", err.Error())
+	}
+
+	wg.logger.Debugf("[host] Handshake with guest protocol version %d", response.ProtocolVersion)
+	instance.handshaken = true
+	instance.handshakeErr = wg.checkProtocolVersion(response)
+
+	return instance.handshakeErr
+}
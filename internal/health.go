@@ -0,0 +1,123 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// healthWindow is the number of recent invocations the health report error
+// rate is calculated from
+const healthWindow = 100
+
+// HealthReport summarizes the health of a WasmGuest, with JSON field names so
+// that it can be returned by an HTTP health check handler as it is.
+//
+// Live reports whether the WasmGuest can run invocations at all, so a
+// chaincode which is not live should be restarted. Ready reports whether it
+// can accept another invocation now, so a chaincode which is live but not
+// ready should be sent work elsewhere until it is.
+type HealthReport struct {
+	// Live is whether the WasmGuest is loaded and its circuit breaker is not
+	// open
+	Live bool `json:"live"`
+	// Ready is whether the WasmGuest is live, is not draining, and has an
+	// idle instance or room in the pool to create one
+	Ready bool `json:"ready"`
+	// Loaded is whether a Wasm module is loaded, which is until the WasmGuest
+	// is closed
+	Loaded   bool `json:"loaded"`
+	Draining bool `json:"draining"`
+	Closed   bool `json:"closed"`
+	// Digest is the SHA-256 digest of the loaded Wasm module
+	Digest  string       `json:"digest"`
+	Circuit CircuitState `json:"circuit"`
+	// PoolCapacity is the maximum number of instances in the pool, of which
+	// PoolSize have been created
+	PoolCapacity int `json:"pool_capacity"`
+	PoolSize     int `json:"pool_size"`
+	PoolInUse    int `json:"pool_in_use"`
+	PoolIdle     int `json:"pool_idle"`
+	// RecentInvocations is the number of the last 100 invocations of the
+	// guest which are included in the error rate, of which RecentErrors
+	// returned an error
+	RecentInvocations int     `json:"recent_invocations"`
+	RecentErrors      int     `json:"recent_errors"`
+	ErrorRate         float64 `json:"error_rate"`
+	// LastSuccess is when an invocation of the guest last succeeded, or the
+	// zero time if none has
+	LastSuccess time.Time `json:"last_success"`
+}
+
+// healthTracker records whether each of the most recent invocations returned
+// an error, and when one last succeeded. The zero value is ready to use.
+type healthTracker struct {
+	mutex       sync.Mutex
+	failed      [healthWindow]bool
+	count       int
+	next        int
+	lastSuccess time.Time
+}
+
+func (t *healthTracker) observe(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.failed[t.next] = err != nil
+	t.next = (t.next + 1) % healthWindow
+	if t.count < healthWindow {
+		t.count++
+	}
+	if err == nil {
+		t.lastSuccess = time.Now()
+	}
+}
+
+// report adds the recent invocations to the health report
+func (t *healthTracker) report(report *HealthReport) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	report.RecentInvocations = t.count
+	report.RecentErrors = 0
+	for i := 0; i < t.count; i++ {
+		if t.failed[i] {
+			report.RecentErrors++
+		}
+	}
+	if t.count > 0 {
+		report.ErrorRate = float64(report.RecentErrors) / float64(t.count)
+	}
+	report.LastSuccess = t.lastSuccess
+}
+
+// Health returns a report of whether the WasmGuest is live and ready, along
+// with the state of its pool and the error rate of recent invocations. The
+// error rate counts every invocation which ran the guest, including errors
+// reported by the guest itself.
+func (wg *WasmGuest) Health() HealthReport {
+	wg.mutex.RLock()
+	closed, draining, module := wg.closed, wg.draining, wg.module
+	wg.mutex.RUnlock()
+
+	stats := module.pool.stats()
+	report := HealthReport{
+		Loaded:       !closed,
+		Draining:     draining,
+		Closed:       closed,
+		Digest:       module.digest,
+		Circuit:      wg.CircuitState(),
+		PoolCapacity: module.pool.capacity(),
+		PoolSize:     stats.Size,
+		PoolInUse:    stats.InUse,
+		PoolIdle:     stats.Idle,
+	}
+	wg.health.report(&report)
+
+	report.Live = report.Loaded && report.Circuit != CircuitOpen
+	report.Ready = report.Live && !draining && (stats.Idle > 0 || stats.Size < report.PoolCapacity)
+
+	return report
+}
@@ -0,0 +1,46 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"errors"
+
+	"github.com/wapc/wapc-go"
+)
+
+// HostCallDecorator wraps the handler for the host calls made by the guest,
+// for example to record the host calls made during a test, or to stub Fabric
+// operations without a peer. The handler it returns should call next for any
+// host calls it does not handle itself.
+type HostCallDecorator func(next wapc.HostCallHandler) wapc.HostCallHandler
+
+// WithHostCallDecorators adds decorators around the handler for host calls made
+// by the guest. The first decorator is the outermost, and the innermost next
+// calls a handler registered using WithHostCallHandler for the namespace, or
+// otherwise FabricProxy.FabricCall. Decorated handlers run inside the host call
+// tracing span.
+//
+// Note: decorators are not used for a HostCallHandler set using
+// WithModuleConfig.
+func WithHostCallDecorators(decorators ...HostCallDecorator) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		for _, decorator := range decorators {
+			if decorator == nil {
+				return errors.New("Invalid host call decorator: must not be nil")
+			}
+		}
+		wg.hostCallDecorators = append(wg.hostCallDecorators, decorators...)
+		return nil
+	}
+}
+
+// decorateHostCall returns a handler which calls the decorators in order
+// around the handler
+func decorateHostCall(decorators []HostCallDecorator, handler wapc.HostCallHandler) wapc.HostCallHandler {
+	for i := len(decorators) - 1; i >= 0; i-- {
+		handler = decorators[i](handler)
+	}
+
+	return handler
+}
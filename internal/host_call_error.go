@@ -0,0 +1,185 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrorCode identifies the kind of failure of a host call, so that guest code
+// can handle errors without matching the message, which may change between
+// Fabric versions. The numbers and names are stable, and new codes are only
+// ever added.
+type ErrorCode int
+
+// The error codes returned to the guest with failed host calls. Errors which
+// are not recognised have no code, and are returned to the guest unchanged.
+const (
+	ErrorCodeUnknown             ErrorCode = 0
+	ErrorCodeInvalidRequest      ErrorCode = 1
+	ErrorCodeNotSupported        ErrorCode = 2
+	ErrorCodeTransactionNotFound ErrorCode = 3
+	ErrorCodeIteratorNotFound    ErrorCode = 4
+	ErrorCodeStateNotFound       ErrorCode = 5
+	ErrorCodeStateExists         ErrorCode = 6
+	ErrorCodeCollectionNotFound  ErrorCode = 7
+	ErrorCodeAccessDenied        ErrorCode = 8
+	ErrorCodePolicyFailure       ErrorCode = 9
+	ErrorCodeMVCCReadConflict    ErrorCode = 10
+	ErrorCodePhantomReadConflict ErrorCode = 11
+	ErrorCodeHostCallTimeout     ErrorCode = 12
+	ErrorCodeCancelled           ErrorCode = 13
+	ErrorCodeWriteSetTooLarge    ErrorCode = 14
+	ErrorCodeQueryRejected       ErrorCode = 15
+	ErrorCodeInternal            ErrorCode = 16
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrorCodeUnknown:             "UNKNOWN",
+	ErrorCodeInvalidRequest:      "INVALID_REQUEST",
+	ErrorCodeNotSupported:        "NOT_SUPPORTED",
+	ErrorCodeTransactionNotFound: "TRANSACTION_NOT_FOUND",
+	ErrorCodeIteratorNotFound:    "ITERATOR_NOT_FOUND",
+	ErrorCodeStateNotFound:       "STATE_NOT_FOUND",
+	ErrorCodeStateExists:         "STATE_EXISTS",
+	ErrorCodeCollectionNotFound:  "COLLECTION_NOT_FOUND",
+	ErrorCodeAccessDenied:        "ACCESS_DENIED",
+	ErrorCodePolicyFailure:       "POLICY_FAILURE",
+	ErrorCodeMVCCReadConflict:    "MVCC_READ_CONFLICT",
+	ErrorCodePhantomReadConflict: "PHANTOM_READ_CONFLICT",
+	ErrorCodeHostCallTimeout:     "HOST_CALL_TIMEOUT",
+	ErrorCodeCancelled:           "CANCELLED",
+	ErrorCodeWriteSetTooLarge:    "WRITE_SET_TOO_LARGE",
+	ErrorCodeQueryRejected:       "QUERY_REJECTED",
+	ErrorCodeInternal:            "INTERNAL",
+}
+
+// String returns the stable name of the error code
+func (code ErrorCode) String() string {
+	if name, ok := errorCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(code))
+}
+
+// HostCallError is the error returned by FabricCall for a failure with a known
+// cause, such as a missing collection or an access control failure reported
+// by the peer. The message is unchanged, and the code is only added when the
+// error is returned to the guest, which receives it in the form
+//
+//	[<number> <NAME>] <message>
+//
+// for example "[7 COLLECTION_NOT_FOUND] ReadState failed for collection orgs:
+// collection orgs not found". Custom host call handlers and decorators can
+// return a HostCallError to give their own errors a code.
+type HostCallError struct {
+	Code ErrorCode
+	Err  error
+}
+
+// Error returns the message of the error, without the code
+func (e *HostCallError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error with the code
+func (e *HostCallError) Unwrap() error {
+	return e.Err
+}
+
+// errorCodeMatcher recognises the message of an error with a code. The stub
+// returns errors from the peer as plain messages, and most host calls add the
+// message to their own error, so errors are mostly recognised by message.
+type errorCodeMatcher struct {
+	code    ErrorCode
+	pattern *regexp.Regexp
+}
+
+// errorCodeMatchers are checked in order, so more specific messages come
+// before the more general ones which could also match them. MVCC and phantom
+// read conflicts are normally only reported when a transaction is validated,
+// but are recognised in case the peer reports one to a host call, such as
+// InvokeChaincode.
+var errorCodeMatchers = []errorCodeMatcher{
+	{ErrorCodeWriteSetTooLarge, regexp.MustCompile(regexp.QuoteMeta(ErrWriteSetTooLarge.Error()))},
+	{ErrorCodeMVCCReadConflict, regexp.MustCompile(`MVCC_READ_CONFLICT`)},
+	{ErrorCodePhantomReadConflict, regexp.MustCompile(`PHANTOM_READ_CONFLICT`)},
+	{ErrorCodePolicyFailure, regexp.MustCompile(`ENDORSEMENT_POLICY_FAILURE|failed evaluating policy|signature set did not satisfy policy`)},
+	{ErrorCodeAccessDenied, regexp.MustCompile(`(?i)access denied|does not have (read|write) access permission`)},
+	{ErrorCodeCollectionNotFound, regexp.MustCompile(`(?i)collection \S+ (not found|could not be found|not defined|does not exist)`)},
+	{ErrorCodeQueryRejected, regexp.MustCompile(`Query rejected by state database`)},
+	{ErrorCodeTransactionNotFound, regexp.MustCompile(`No stub found for transaction context`)},
+	{ErrorCodeIteratorNotFound, regexp.MustCompile(`No iterator \S+ found`)},
+	{ErrorCodeStateNotFound, regexp.MustCompile(`State \S+ does not exist|No state exists for key`)},
+	{ErrorCodeStateExists, regexp.MustCompile(`State already exists for key`)},
+	{ErrorCodeNotSupported, regexp.MustCompile(`^Operation not supported: |Not supported by this version|Check the history database is enabled`)},
+	{ErrorCodeInternal, regexp.MustCompile(`^Operation panicked: `)},
+	{ErrorCodeInvalidRequest, regexp.MustCompile(`failed: Missing |failed: Invalid page size|does not match the transaction being invoked|Invalid composite key|input contains unicode`)},
+}
+
+// classifyHostCallError returns a HostCallError with the code for the error
+// from a host call if the cause is known, or otherwise returns the error
+// unchanged
+func classifyHostCallError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var hostCallErr *HostCallError
+	if errors.As(err, &hostCallErr) {
+		return err
+	}
+	if code, ok := errorCode(err); ok {
+		return &HostCallError{Code: code, Err: err}
+	}
+
+	return err
+}
+
+// errorCode returns the code for the error, if the cause is known
+func errorCode(err error) (ErrorCode, bool) {
+	switch {
+	case errors.Is(err, ErrHostCallTimeout):
+		return ErrorCodeHostCallTimeout, true
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ErrorCodeCancelled, true
+	case errors.Is(err, ErrWriteSetTooLarge):
+		return ErrorCodeWriteSetTooLarge, true
+	}
+
+	// Requests which cannot be decoded return the error from decoding, and
+	// a truncated protobuf message returns io.ErrUnexpectedEOF
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, proto.Error) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorCodeInvalidRequest, true
+	}
+
+	msg := err.Error()
+	for _, matcher := range errorCodeMatchers {
+		if matcher.pattern.MatchString(msg) {
+			return matcher.code, true
+		}
+	}
+
+	return ErrorCodeUnknown, false
+}
+
+// encodeHostCallError adds the code to the message of a HostCallError, which
+// is all the guest receives of the error
+func encodeHostCallError(err error) error {
+	var hostCallErr *HostCallError
+	if err == nil || !errors.As(err, &hostCallErr) {
+		return err
+	}
+
+	return fmt.Errorf("[%d %s] %w", int(hostCallErr.Code), hostCallErr.Code, err)
+}
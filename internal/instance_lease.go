@@ -0,0 +1,179 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wapc/wapc-go"
+)
+
+// instanceLease is a waPC instance checked out of the pool for one or more
+// invocations, which must be released when they are done
+type instanceLease struct {
+	wg       *WasmGuest
+	module   *guestModule
+	instance wapc.Instance
+	cleanup  []func()
+
+	// failed is set if the instance may have been left in an inconsistent
+	// state, so it should be discarded on release
+	failed bool
+	// outcome is how the invocations affect the circuit breaker
+	outcome invocationOutcome
+}
+
+// acquireLease checks out a waPC instance from the current module, waiting
+// for the circuit breaker, concurrency limit and pool. Errors are returned as
+// an InvokeError for the operation.
+func (wg *WasmGuest) acquireLease(ctx context.Context, operation string) (_ *instanceLease, err error) {
+	lease := &instanceLease{wg: wg, outcome: outcomeNeutral}
+	defer func() {
+		if err != nil {
+			lease.release()
+		}
+	}()
+
+	if wg.breaker != nil {
+		if err := wg.breaker.allow(); err != nil {
+			wg.logger.Errorf("[host] error invoking operation %s: %s", operation, err)
+			return nil, &InvokeError{Operation: operation, Phase: PhaseAcquire, Err: err}
+		}
+		lease.onRelease(func() { wg.recordOutcome(lease.outcome) })
+	}
+
+	module, err := wg.acquireModule()
+	if err != nil {
+		return nil, &InvokeError{Operation: operation, Phase: PhaseAcquire, Err: err}
+	}
+	lease.onRelease(module.inFlight.Done)
+
+	if wg.concurrency != nil {
+		if err := wg.acquireConcurrency(ctx); err != nil {
+			wg.logger.Errorf("[host] error waiting to invoke operation: %s", err)
+			return nil, &InvokeError{Operation: operation, Phase: PhaseAcquire, Err: err}
+		}
+		lease.onRelease(func() { <-wg.concurrency })
+	}
+
+	wapcInstance, err := wg.getInstance(ctx, module)
+	if err != nil {
+		wg.logger.Errorf("[host] error getting waPC instance: %s", err)
+		return nil, &InvokeError{Operation: operation, Phase: PhaseAcquire, Err: err}
+	}
+	lease.module = module
+	lease.instance = wapcInstance
+	lease.onRelease(func() { wg.release(module, wapcInstance, lease.failed) })
+
+	if output, ok := ctx.Value(guestOutputKey{}).(guestOutput); ok {
+		if instance, ok := wapcInstance.(*outputInstance); ok {
+			instance.redirect(output)
+			lease.onRelease(func() { instance.redirect(guestOutput{}) })
+		}
+	}
+	lease.input(ctx)
+	if instance, ok := wapcInstance.(*outputInstance); ok && instance.syscalls != nil {
+		instance.syscalls.reset(ctx)
+	}
+
+	if err := lease.handshake(ctx); err != nil {
+		wg.logger.Errorf("[host] error checking guest protocol: %s", err)
+		return nil, &InvokeError{Operation: operation, Phase: PhaseInvoke, Err: err}
+	}
+
+	return lease, nil
+}
+
+// getInstance gets a waPC instance from the pool of the module, retrying
+// with backoff if the pool is still saturated after the acquire timeout
+func (wg *WasmGuest) getInstance(ctx context.Context, module *guestModule) (wapc.Instance, error) {
+	backoff := wg.acquireBackoff
+	for attempt := 1; ; attempt++ {
+		wg.logger.Debugf("[host] Getting waPC Instance")
+		acquireStart := time.Now()
+		wapcInstance, err := module.pool.get(ctx, wg.acquireTimeout)
+		wg.metrics.ObserveAcquire(time.Since(acquireStart), err)
+		if err == nil || !errors.Is(err, ErrPoolExhausted) || attempt >= wg.acquireAttempts {
+			if err != nil && attempt > 1 {
+				return nil, fmt.Errorf("%w after %d attempts", err, attempt)
+			}
+			return wapcInstance, err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return nil, fmt.Errorf("%w, and the deadline would pass before the next attempt in %s", err, backoff)
+		}
+
+		wg.logger.Debugf("[host] Retrying waPC instance in %s after %d of %d attempts: %s", backoff, attempt, wg.acquireAttempts, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-wg.context.Done():
+			timer.Stop()
+			return nil, ErrGuestClosed
+		}
+		backoff *= 2
+	}
+}
+
+// onRelease adds a function to be called when the lease is released, in reverse
+// order to the order they were added
+func (lease *instanceLease) onRelease(f func()) {
+	lease.cleanup = append(lease.cleanup, f)
+}
+
+// release returns the instance to the pool, or discards it if it failed, and
+// releases everything else held by the lease
+func (lease *instanceLease) release() {
+	for i := len(lease.cleanup) - 1; i >= 0; i-- {
+		lease.cleanup[i]()
+	}
+	lease.cleanup = nil
+}
+
+// invoke calls an operation on the leased instance. Errors are returned as an
+// InvokeError.
+func (lease *instanceLease) invoke(ctx context.Context, operation string, payload []byte) ([]byte, error) {
+	wg := lease.wg
+
+	wg.logger.Debugf("[host] Invoking operation %s", operation)
+	if instance, ok := lease.instance.(*outputInstance); ok && instance.prefixLines {
+		instance.prefix(outputLinePrefix(ctx, operation))
+		defer instance.prefix("")
+	}
+	invokeStart := time.Now()
+	result, err := wg.invoke(ctx, lease.instance, operation, payload)
+	invokeDuration := time.Since(invokeStart)
+	wg.metrics.ObserveInvocation(operation, invokeDuration, err)
+	wg.operationStats.observe(operation, invokeDuration, err)
+	wg.health.observe(err)
+	if err != nil {
+		wg.logger.Errorf("[host] error invoking transaction: %s", err)
+		failed := isInvocationFailure(ctx, err)
+		lease.failed = lease.failed || failed
+		if ctx.Err() == nil && failed {
+			lease.outcome = outcomeFailure
+		} else if ctx.Err() == nil && lease.outcome != outcomeFailure {
+			lease.outcome = outcomeSuccess
+		}
+		return nil, &InvokeError{Operation: operation, Phase: PhaseInvoke, Err: err}
+	}
+	if lease.outcome != outcomeFailure {
+		lease.outcome = outcomeSuccess
+	}
+
+	if wg.maxResult > 0 && len(result) > wg.maxResult {
+		err := fmt.Errorf("Result of operation %s is %d bytes, exceeding the maximum of %d bytes: %w", operation, len(result), wg.maxResult, ErrPayloadTooLarge)
+		wg.logger.Errorf("[host] error invoking transaction: %s", err)
+		return nil, &InvokeError{Operation: operation, Phase: PhaseInvoke, Err: err}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,617 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wapc/wapc-go"
+)
+
+// instancePool is a pool of up to size waPC instances. Unlike wapc.Pool,
+// waiting for an instance can be cancelled using a context, instances beyond
+// the initial warm count are only created when they are first needed, and the
+// pool can be resized or have its idle instances evicted.
+type instancePool struct {
+	inUse     int64
+	context   context.Context
+	module    wapc.Module
+	maxUses   int
+	retry     instantiationRetry
+	resizing  sync.Mutex
+	mutex     sync.Mutex
+	size      int
+	instances []wapc.Instance
+	uses      map[wapc.Instance]int
+	idleSince map[wapc.Instance]time.Time
+	memory    map[wapc.Instance]uint32
+	ids       map[wapc.Instance]uint64
+	stale     map[wapc.Instance]bool
+	nextID    uint64
+	hooks     []PoolHook
+	events    []PoolEvent
+	pending   int
+	available chan wapc.Instance
+	resized   chan struct{}
+	closed    bool
+}
+
+// ErrPoolExhausted is matched by the error returned when no waPC instance
+// becomes available in the pool before the acquire timeout, for example to shed
+// load or scale up when every instance is busy, rather than retrying
+var ErrPoolExhausted = errors.New("waiting for waPC instance")
+
+// PoolStats describes the current state of a waPC instance pool
+type PoolStats struct {
+	// Size is the number of instances which have been created in the pool
+	Size int
+	// InUse is the number of instances currently checked out of the pool
+	InUse int
+	// Idle is the number of instances available in the pool
+	Idle int
+	// Memory is the linear memory of the instances in the pool
+	Memory MemoryStats
+}
+
+// MemoryStats describes the linear memory of the instances in a pool, in
+// bytes. The memory of each instance is measured when it is created and when
+// it is returned to the pool, so checked out instances report their size from
+// before the invocation which is in progress.
+type MemoryStats struct {
+	Total uint64
+	Max   uint64
+	Mean  uint64
+}
+
+// InstanceMemory is the linear memory of an instance in a pool, as of when it
+// was created or last returned to the pool
+type InstanceMemory struct {
+	Bytes uint64
+	Pages uint32
+}
+
+// newInstancePool returns a pool of up to size instances of the module, with
+// warm instances created immediately. Instances are replaced after maxUses
+// invocations, unless maxUses is zero. The hooks are called for each change to
+// the instances in the pool.
+func newInstancePool(ctx context.Context, module wapc.Module, size int, warm int, maxUses int, retry instantiationRetry, hooks []PoolHook) (*instancePool, error) {
+	pool := &instancePool{
+		context:   ctx,
+		module:    module,
+		size:      size,
+		maxUses:   maxUses,
+		retry:     retry,
+		hooks:     hooks,
+		instances: make([]wapc.Instance, 0, size),
+		uses:      make(map[wapc.Instance]int),
+		idleSince: make(map[wapc.Instance]time.Time),
+		memory:    make(map[wapc.Instance]uint32),
+		ids:       make(map[wapc.Instance]uint64),
+		stale:     make(map[wapc.Instance]bool),
+		available: make(chan wapc.Instance, size),
+		resized:   make(chan struct{}),
+	}
+
+	for i := 0; i < warm; i++ {
+		instance, err := pool.instantiate()
+		if err != nil {
+			pool.close(ctx)
+			return nil, err
+		}
+
+		pool.instances = append(pool.instances, instance)
+		pool.idleSince[instance] = time.Now()
+		pool.track(instance)
+		pool.available <- instance
+	}
+	pool.notify()
+
+	return pool, nil
+}
+
+// channels returns the current channel of available instances, and a channel
+// which is closed when the pool is resized and the first channel is replaced,
+// or when a discarded instance could not be replaced
+func (pool *instancePool) channels() (chan wapc.Instance, chan struct{}) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.available, pool.resized
+}
+
+// get returns an instance from the pool, creating a new one if none are
+// available and the pool is not full, or otherwise waiting up to the timeout
+// for one to become available. A timeout of zero waits until the context is
+// done.
+func (pool *instancePool) get(ctx context.Context, timeout time.Duration) (wapc.Instance, error) {
+	start := time.Now()
+	available, resized := pool.channels()
+
+	select {
+	case instance := <-available:
+		atomic.AddInt64(&pool.inUse, 1)
+		pool.acquired(instance, time.Since(start))
+		return instance, nil
+	default:
+	}
+
+	if instance, err := pool.grow(); instance != nil || err != nil {
+		if instance != nil {
+			pool.acquired(instance, time.Since(start))
+		}
+		return instance, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case instance := <-available:
+			atomic.AddInt64(&pool.inUse, 1)
+			pool.acquired(instance, time.Since(start))
+			return instance, nil
+		case <-resized:
+			available, resized = pool.channels()
+			if instance, err := pool.grow(); instance != nil || err != nil {
+				if instance != nil {
+					pool.acquired(instance, time.Since(start))
+				}
+				return instance, err
+			}
+		case <-expired:
+			return nil, fmt.Errorf("Timed out after %s %w", timeout, ErrPoolExhausted)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pool.context.Done():
+			return nil, ErrGuestClosed
+		}
+	}
+}
+
+// grow creates a new checked out instance if the pool is not full, or
+// returns nil if there is no room for another instance
+func (pool *instancePool) grow() (wapc.Instance, error) {
+	if !pool.reserve(pool.capacity()) {
+		return nil, nil
+	}
+
+	instance, err := pool.instantiate()
+	if err != nil {
+		pool.unreserve()
+		return nil, fmt.Errorf("Failed to create waPC instance: %w", err)
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.pending--
+	if pool.closed {
+		instance.Close(pool.context)
+		return nil, ErrGuestClosed
+	}
+	pool.instances = append(pool.instances, instance)
+	pool.track(instance)
+	atomic.AddInt64(&pool.inUse, 1)
+
+	return instance, nil
+}
+
+// reserve records that a new instance is being created, unless the pool is
+// full or already has the specified number of instances
+func (pool *instancePool) reserve(limit int) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if count := len(pool.instances) + pool.pending; pool.closed || count >= limit || count >= pool.size {
+		return false
+	}
+	pool.pending++
+
+	return true
+}
+
+// unreserve records that a reserved instance was not created
+func (pool *instancePool) unreserve() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.pending--
+}
+
+// put returns an instance to the pool, replacing it instead if it has been
+// used the maximum number of times or the pool has been reset since it was
+// checked out, or closing it if the pool has shrunk
+func (pool *instancePool) put(instance wapc.Instance) error {
+	defer pool.notify()
+
+	if pool.isStale(instance) || pool.maxUses > 0 && pool.use(instance) >= pool.maxUses {
+		return pool.discard(pool.context, instance)
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.closed {
+		atomic.AddInt64(&pool.inUse, -1)
+		return nil
+	}
+	if len(pool.instances) > pool.size {
+		atomic.AddInt64(&pool.inUse, -1)
+		pool.emit(PoolInstanceReturned, instance, 0)
+		return pool.remove(instance)
+	}
+
+	pool.observeMemory(instance)
+	select {
+	case pool.available <- instance:
+		atomic.AddInt64(&pool.inUse, -1)
+		pool.idleSince[instance] = time.Now()
+		pool.emit(PoolInstanceReturned, instance, 0)
+		return nil
+	default:
+		return errors.New("Cannot return waPC instance to full pool")
+	}
+}
+
+// use records that an instance has been used, returning the number of times
+// it has been used
+func (pool *instancePool) use(instance wapc.Instance) int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.uses[instance]++
+	return pool.uses[instance]
+}
+
+// isStale returns whether the pool has been reset since the instance was
+// checked out
+func (pool *instancePool) isStale(instance wapc.Instance) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.stale[instance]
+}
+
+// discard closes an instance which was checked out of the pool, instead of
+// returning it, and replaces it with a new instance of the module unless the
+// pool has shrunk. The replacement is created with retries, without the pool
+// locked, and keeps its place in the pool while it is being created. If it
+// cannot be created, the pool is one instance short until get creates another
+// when none are available.
+func (pool *instancePool) discard(ctx context.Context, instance wapc.Instance) error {
+	defer pool.notify()
+
+	pool.mutex.Lock()
+	atomic.AddInt64(&pool.inUse, -1)
+	if pool.closed {
+		pool.mutex.Unlock()
+		return nil
+	}
+
+	// Instances are not replaced once the WasmGuest is shutting down, since
+	// the replacement would fail, or be closed straight away
+	if len(pool.instances) > pool.size || pool.context.Err() != nil {
+		defer pool.mutex.Unlock()
+		return pool.remove(instance)
+	}
+
+	for i, existing := range pool.instances {
+		if existing == instance {
+			pool.instances = append(pool.instances[:i], pool.instances[i+1:]...)
+			break
+		}
+	}
+	pool.emit(PoolInstanceDestroyed, instance, 0)
+	pool.forget(instance)
+	pool.pending++
+	pool.mutex.Unlock()
+
+	closeErr := instance.Close(ctx)
+	replacement, err := pool.instantiate()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.pending--
+	if err != nil {
+		// Wake up anything waiting for an instance, so that it can create
+		// one in place of the replacement
+		close(pool.resized)
+		pool.resized = make(chan struct{})
+		return fmt.Errorf("Failed to replace discarded waPC instance: %w", err)
+	}
+	if pool.closed || len(pool.instances) >= pool.size {
+		replacement.Close(pool.context)
+		return closeErr
+	}
+	pool.instances = append(pool.instances, replacement)
+	pool.idleSince[replacement] = time.Now()
+	pool.track(replacement)
+	pool.available <- replacement
+
+	return closeErr
+}
+
+// retire closes an instance which was checked out of the pool, instead of
+// returning it, without replacing it, for a pool which is going away. The
+// instance is closed with the timeout, after it has been removed from the
+// pool, so that closing it cannot hold up closing the pool. If the pool has
+// already been closed, so has the instance.
+func (pool *instancePool) retire(instance wapc.Instance, timeout time.Duration) error {
+	pool.mutex.Lock()
+	atomic.AddInt64(&pool.inUse, -1)
+	if pool.closed {
+		pool.mutex.Unlock()
+		pool.notify()
+		return nil
+	}
+	for i, existing := range pool.instances {
+		if existing == instance {
+			pool.instances = append(pool.instances[:i], pool.instances[i+1:]...)
+			break
+		}
+	}
+	pool.emit(PoolInstanceDestroyed, instance, 0)
+	pool.forget(instance)
+	pool.mutex.Unlock()
+	pool.notify()
+
+	// The pool context may already be cancelled during shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return instance.Close(ctx)
+}
+
+// remove closes an instance and removes it from the pool, which must already
+// be locked
+func (pool *instancePool) remove(instance wapc.Instance) error {
+	for i, existing := range pool.instances {
+		if existing == instance {
+			pool.instances = append(pool.instances[:i], pool.instances[i+1:]...)
+			break
+		}
+	}
+	pool.emit(PoolInstanceDestroyed, instance, 0)
+	pool.forget(instance)
+
+	return instance.Close(pool.context)
+}
+
+// forget removes everything recorded about an instance which has been removed
+// from the pool, which must already be locked
+func (pool *instancePool) forget(instance wapc.Instance) {
+	delete(pool.uses, instance)
+	delete(pool.idleSince, instance)
+	delete(pool.memory, instance)
+	delete(pool.ids, instance)
+	delete(pool.stale, instance)
+}
+
+// resize changes the maximum number of instances in the pool, creating new
+// instances until there are at least warm instances. Idle instances beyond the
+// new size are closed immediately, and checked out instances are closed when
+// they are returned.
+func (pool *instancePool) resize(size int, warm int) error {
+	defer pool.notify()
+
+	pool.resizing.Lock()
+	defer pool.resizing.Unlock()
+
+	pool.mutex.Lock()
+	var closeErr error
+	available := make(chan wapc.Instance, size)
+	pool.size = size
+drain:
+	for {
+		select {
+		case instance := <-pool.available:
+			if len(pool.instances) <= size {
+				available <- instance
+			} else if err := pool.remove(instance); err != nil && closeErr == nil {
+				closeErr = err
+			}
+		default:
+			break drain
+		}
+	}
+	pool.available = available
+	close(pool.resized)
+	pool.resized = make(chan struct{})
+	pool.mutex.Unlock()
+
+	if err := pool.fill(warm); err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// reset replaces every instance in the pool with a new instance of the
+// module. Idle instances are replaced immediately, and checked out instances
+// are replaced when they are returned, so that their invocations can finish.
+func (pool *instancePool) reset() error {
+	defer pool.notify()
+
+	pool.resizing.Lock()
+	defer pool.resizing.Unlock()
+
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		return ErrGuestClosed
+	}
+
+	var closeErr error
+	count := len(pool.instances)
+drain:
+	for {
+		select {
+		case instance := <-pool.available:
+			if err := pool.remove(instance); err != nil && closeErr == nil {
+				closeErr = err
+			}
+		default:
+			break drain
+		}
+	}
+	for _, instance := range pool.instances {
+		pool.stale[instance] = true
+	}
+	pool.mutex.Unlock()
+
+	if err := pool.fill(count); err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// fill creates idle instances until there are at least limit instances in the
+// pool, or it is full
+func (pool *instancePool) fill(limit int) error {
+	for pool.reserve(limit) {
+		instance, err := pool.instantiate()
+		if err != nil {
+			pool.unreserve()
+			return fmt.Errorf("Failed to create waPC instance: %w", err)
+		}
+
+		pool.mutex.Lock()
+		pool.pending--
+		pool.instances = append(pool.instances, instance)
+		pool.idleSince[instance] = time.Now()
+		pool.track(instance)
+		pool.available <- instance
+		pool.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// evictIdle closes idle instances which have not been used for longer than
+// the timeout, while there are more than min instances in the pool, returning
+// the number of instances closed. Checked out instances are never evicted, and
+// new instances are created again when they are needed.
+func (pool *instancePool) evictIdle(timeout time.Duration, min int) (int, error) {
+	defer pool.notify()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	var idle []wapc.Instance
+drain:
+	for {
+		select {
+		case instance := <-pool.available:
+			idle = append(idle, instance)
+		default:
+			break drain
+		}
+	}
+
+	evicted := 0
+	var closeErr error
+	now := time.Now()
+	for _, instance := range idle {
+		if len(pool.instances) > min && now.Sub(pool.idleSince[instance]) > timeout {
+			if err := pool.remove(instance); err != nil && closeErr == nil {
+				closeErr = err
+			}
+			evicted++
+			continue
+		}
+		pool.available <- instance
+	}
+
+	return evicted, closeErr
+}
+
+// capacity returns the maximum number of instances in the pool
+func (pool *instancePool) capacity() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.size
+}
+
+// stats returns the current state of the pool
+func (pool *instancePool) stats() PoolStats {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	stats := PoolStats{
+		Size:  len(pool.instances),
+		InUse: int(atomic.LoadInt64(&pool.inUse)),
+		Idle:  len(pool.available),
+	}
+
+	for _, instance := range pool.instances {
+		size := uint64(pool.memory[instance])
+		stats.Memory.Total += size
+		if size > stats.Memory.Max {
+			stats.Memory.Max = size
+		}
+	}
+	if len(pool.instances) > 0 {
+		stats.Memory.Mean = stats.Memory.Total / uint64(len(pool.instances))
+	}
+
+	return stats
+}
+
+// observeMemory records the linear memory size of an instance which is not
+// checked out, or is being returned, so that measuring it cannot race with an
+// invocation growing the memory. The pool must already be locked.
+func (pool *instancePool) observeMemory(instance wapc.Instance) {
+	pool.memory[instance] = instance.MemorySize(pool.context)
+}
+
+// instanceMemory returns the linear memory of each instance in the pool, in
+// the order they were created
+func (pool *instancePool) instanceMemory() []InstanceMemory {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	memory := make([]InstanceMemory, 0, len(pool.instances))
+	for _, instance := range pool.instances {
+		size := pool.memory[instance]
+		memory = append(memory, InstanceMemory{Bytes: uint64(size), Pages: size / wasmPageSize})
+	}
+
+	return memory
+}
+
+// close closes all the instances in the pool, including any which are checked
+// out, returning the first error. Checked out instances are not returned to
+// the pool after it has been closed.
+func (pool *instancePool) close(ctx context.Context) error {
+	defer pool.notify()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.closed = true
+
+	var firstErr error
+	inUse := int(atomic.LoadInt64(&pool.inUse))
+	for i, instance := range pool.instances {
+		if err := instance.Close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		pool.queue(PoolEvent{Kind: PoolInstanceDestroyed, Instance: pool.ids[instance], Size: len(pool.instances) - i - 1, InUse: inUse})
+	}
+
+	return firstErr
+}
@@ -0,0 +1,165 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero/sys"
+	"github.com/wapc/wapc-go"
+)
+
+const (
+	// DefaultInstantiationAttempts is how many times creating a waPC instance
+	// is attempted in total unless WithInstantiationRetry is used
+	DefaultInstantiationAttempts = 3
+	// DefaultInstantiationBackoff is how long to wait before retrying to create
+	// a waPC instance the first time, unless WithInstantiationRetry is used
+	DefaultInstantiationBackoff = 50 * time.Millisecond
+)
+
+// ErrCompileFailed is matched by the error returned when the engine cannot
+// compile a Wasm module, which is never retried
+var ErrCompileFailed = errors.New("Failed to compile Wasm module")
+
+// compileError is the error from the engine compiling a module, which is a
+// separate step from instantiating it
+type compileError struct {
+	description string
+	size        int
+	err         error
+}
+
+// Error returns the message of the compile error, with the module
+func (e *compileError) Error() string {
+	return fmt.Sprintf("Failed to compile %s (%d bytes): %s", e.description, e.size, e.err)
+}
+
+// Unwrap returns the error from the engine
+func (e *compileError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether the target is ErrCompileFailed
+func (e *compileError) Is(target error) bool {
+	return target == ErrCompileFailed
+}
+
+// permanentInstantiationMessages identify errors instantiating a compiled
+// module which mean that it can never be instantiated, since neither wazero
+// nor waPC have error types for them. They are, in order, a trap in the start
+// function, an import which is missing from a host module, an import of a
+// missing host module, an import with the wrong signature, a data segment
+// outside of memory, and a module without the waPC guest call function. Each
+// is checked against the wazero and waPC versions in use by the tests.
+var permanentInstantiationMessages = []string{
+	"wasm error:",
+	"is not exported in module",
+	"not instantiated",
+	"import[",
+	"out of bounds memory access",
+	"didn't export function",
+}
+
+// instantiationRetry is how many times, and how often, creating a waPC
+// instance is attempted, and the logger for retries
+type instantiationRetry struct {
+	attempts int
+	backoff  time.Duration
+	logger   Logger
+}
+
+// WithInstantiationRetry retries creating a waPC instance, up to the specified
+// number of attempts in total, if it fails with an error which may be
+// transient, such as running out of memory while the peer is starting. This
+// applies to the instances created when the WasmGuest is loaded, as well as
+// those created lazily, those replacing discarded instances, and those created
+// when the pool is resized, reset or reloaded. The first retry waits for about
+// the backoff, with jitter so that pools do not retry in step, and the backoff
+// doubles for each subsequent retry.
+//
+// Compiling the module, which happens once before its instances are created,
+// is not retried, and its errors match ErrCompileFailed. Errors which mean the
+// module can never be instantiated, such as a missing import, or a trap or
+// exit in the guest start function, are not retried either. By default, instantiation is attempted
+// DefaultInstantiationAttempts times, starting with
+// DefaultInstantiationBackoff, and one attempt disables retries.
+func WithInstantiationRetry(maxAttempts int, backoff time.Duration) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if maxAttempts < 1 {
+			return fmt.Errorf("Invalid instantiation attempts %d: must be at least 1", maxAttempts)
+		}
+		if backoff < 0 {
+			return fmt.Errorf("Invalid instantiation backoff %s: must not be negative", backoff)
+		}
+		wg.instantiationRetry = instantiationRetry{attempts: maxAttempts, backoff: backoff}
+		return nil
+	}
+}
+
+// isPermanentInstantiationError returns whether an error creating a waPC
+// instance would happen again if it were retried. Errors with a type or
+// sentinel are recognised first, and the messages are only checked for errors
+// from the engine which have neither.
+func isPermanentInstantiationError(err error) bool {
+	var exitErr *sys.ExitError
+	if errors.Is(err, ErrInvalidWasm) || errors.Is(err, ErrCompileFailed) || errors.Is(err, ErrGuestClosed) || errors.As(err, &exitErr) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, permanent := range permanentInstantiationMessages {
+		if strings.Contains(msg, permanent) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jitter returns a random duration between half and one and a half times the
+// backoff
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)+1))
+}
+
+// instantiate creates a new instance of the module, retrying errors which may
+// be transient until the attempts run out or the pool context is done
+func (pool *instancePool) instantiate() (wapc.Instance, error) {
+	backoff := pool.retry.backoff
+	for attempt := 1; ; attempt++ {
+		instance, err := pool.module.Instantiate(pool.context)
+		if err == nil {
+			return instance, nil
+		}
+		if attempt >= pool.retry.attempts || isPermanentInstantiationError(err) {
+			if attempt > 1 {
+				return nil, fmt.Errorf("%w after %d attempts", err, attempt)
+			}
+			return nil, err
+		}
+
+		wait := jitter(backoff)
+		pool.retry.logger.Errorf("[host] Retrying waPC instance creation in %s after %d of %d attempts: %s", wait, attempt, pool.retry.attempts, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-pool.context.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w, and the guest was closed before the next attempt", err)
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrIntegrityCheckFailed is returned when the bytes of a Wasm module do not
+// match the digest or signature they were expected to have
+var ErrIntegrityCheckFailed = errors.New("Wasm module failed integrity check")
+
+// WithExpectedDigest refuses to compile a Wasm module unless its SHA-256
+// digest is the specified hex encoded digest, for example the digest of an
+// approved build. The digest is checked on the raw bytes before compilation,
+// for the initial module and for every module passed to Reload. For a
+// compressed module, the raw bytes are the decompressed module, so the digest
+// is the same whether or not it is compressed.
+func WithExpectedDigest(digest string) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		decoded, err := hex.DecodeString(digest)
+		if err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("Invalid expected digest %q: must be a hex encoded SHA-256 digest", digest)
+		}
+		wg.expectedDigest = decoded
+		return nil
+	}
+}
+
+// WithSignature refuses to compile a Wasm module unless the signature was made
+// over its bytes by the private key for the public key, which must be an
+// ed25519.PublicKey or *ecdsa.PublicKey. Ed25519 signatures are over the raw
+// module bytes, and ECDSA signatures are ASN.1 encoded signatures over the
+// SHA-256 digest of the module bytes. The signature is checked before
+// compilation, for the initial module and for every module passed to Reload,
+// so reloading requires a module signed with the same signature. A compressed
+// module must be signed once it is decompressed.
+func WithSignature(signature []byte, publicKey crypto.PublicKey) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if len(signature) == 0 {
+			return errors.New("Invalid Wasm module signature: must not be empty")
+		}
+
+		switch key := publicKey.(type) {
+		case ed25519.PublicKey:
+			if len(key) != ed25519.PublicKeySize {
+				return fmt.Errorf("Invalid Wasm module public key: Ed25519 keys must be %d bytes", ed25519.PublicKeySize)
+			}
+		case *ecdsa.PublicKey:
+			if key == nil {
+				return errors.New("Invalid Wasm module public key: must not be nil")
+			}
+		case nil:
+			return errors.New("Invalid Wasm module public key: must not be nil")
+		default:
+			return fmt.Errorf("Invalid Wasm module public key %T: must be an Ed25519 or ECDSA public key", publicKey)
+		}
+
+		wg.signature = signature
+		wg.publicKey = publicKey
+		return nil
+	}
+}
+
+// verifyIntegrity checks the Wasm module bytes against the expected digest
+// and signature, if there are any
+func (wg *WasmGuest) verifyIntegrity(wasmBytes []byte, digest [sha256.Size]byte) error {
+	if wg.expectedDigest != nil && !bytes.Equal(digest[:], wg.expectedDigest) {
+		return fmt.Errorf("%w: SHA-256 digest is %x, expected %x", ErrIntegrityCheckFailed, digest, wg.expectedDigest)
+	}
+
+	switch key := wg.publicKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, wasmBytes, wg.signature) {
+			return fmt.Errorf("%w: Ed25519 signature is not valid", ErrIntegrityCheckFailed)
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], wg.signature) {
+			return fmt.Errorf("%w: ECDSA signature is not valid", ErrIntegrityCheckFailed)
+		}
+	}
+
+	return nil
+}
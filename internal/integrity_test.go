@@ -0,0 +1,135 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/hyperledgendary/fabric-chaincode-wasm/internal"
+)
+
+var _ = Describe("Integrity", func() {
+	var (
+		wasmBytes []byte
+		proxy     *internal.FabricProxy
+	)
+
+	BeforeEach(func() {
+		wasmBytes = testGuestWasm()
+		proxy = internal.NewFabricProxy(internal.NewContextStore())
+	})
+
+	Describe("WithExpectedDigest", func() {
+		It("should create a guest if the digest matches", func() {
+			digest := sha256.Sum256(wasmBytes)
+
+			wasmGuest, err := internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithPoolSize(1), internal.WithExpectedDigest(hex.EncodeToString(digest[:])))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should refuse modules with a different digest", func() {
+			expected := sha256.Sum256([]byte("approved"))
+			actual := sha256.Sum256(wasmBytes)
+
+			wasmGuest, err := internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithExpectedDigest(hex.EncodeToString(expected[:])))
+			Expect(wasmGuest).To(BeNil())
+			Expect(errors.Is(err, internal.ErrIntegrityCheckFailed)).To(BeTrue())
+			Expect(err).To(MatchError("Wasm module failed integrity check: SHA-256 digest is " + hex.EncodeToString(actual[:]) + ", expected " + hex.EncodeToString(expected[:])))
+		})
+
+		It("should refuse to reload modules with a different digest", func() {
+			digest := sha256.Sum256(wasmBytes)
+			wasmGuest, err := internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithPoolSize(1), internal.WithExpectedDigest(hex.EncodeToString(digest[:])))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			err = wasmGuest.Reload(append(append([]byte{}, wasmBytes...), 0x00, 0x00))
+			Expect(errors.Is(err, internal.ErrIntegrityCheckFailed)).To(BeTrue())
+			Expect(wasmGuest.WasmDigest()).To(Equal(hex.EncodeToString(digest[:])))
+		})
+
+		It("should not accept digests which are not hex encoded SHA-256 digests", func() {
+			_, err := internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithExpectedDigest("bond"))
+			Expect(err).To(MatchError(`Invalid expected digest "bond": must be a hex encoded SHA-256 digest`))
+
+			_, err = internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithExpectedDigest("0007"))
+			Expect(err).To(MatchError(`Invalid expected digest "0007": must be a hex encoded SHA-256 digest`))
+		})
+	})
+
+	Describe("WithSignature", func() {
+		It("should create a guest with a valid Ed25519 signature", func() {
+			publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+
+			wasmGuest, err := internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithPoolSize(1), internal.WithSignature(ed25519.Sign(privateKey, wasmBytes), publicKey))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+		})
+
+		It("should create a guest with a valid ECDSA signature", func() {
+			privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+			digest := sha256.Sum256(wasmBytes)
+			signature, err := ecdsa.SignASN1(rand.Reader, privateKey, digest[:])
+			Expect(err).NotTo(HaveOccurred())
+
+			wasmGuest, err := internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithPoolSize(1), internal.WithSignature(signature, &privateKey.PublicKey))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+		})
+
+		It("should refuse modules with an invalid signature", func() {
+			publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+
+			wasmGuest, err := internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithSignature(ed25519.Sign(privateKey, []byte("approved")), publicKey))
+			Expect(wasmGuest).To(BeNil())
+			Expect(errors.Is(err, internal.ErrIntegrityCheckFailed)).To(BeTrue())
+			Expect(err).To(MatchError("Wasm module failed integrity check: Ed25519 signature is not valid"))
+
+			ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+
+			wasmGuest, err = internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithSignature([]byte("bond"), &ecdsaKey.PublicKey))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Wasm module failed integrity check: ECDSA signature is not valid"))
+		})
+
+		It("should not accept invalid signatures or public keys", func() {
+			publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+			rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithSignature(nil, publicKey))
+			Expect(err).To(MatchError("Invalid Wasm module signature: must not be empty"))
+
+			_, err = internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithSignature([]byte("bond"), nil))
+			Expect(err).To(MatchError("Invalid Wasm module public key: must not be nil"))
+
+			_, err = internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithSignature([]byte("bond"), ed25519.PublicKey("bond")))
+			Expect(err).To(MatchError("Invalid Wasm module public key: Ed25519 keys must be 32 bytes"))
+
+			_, err = internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithSignature([]byte("bond"), &rsaKey.PublicKey))
+			Expect(err).To(MatchError("Invalid Wasm module public key *rsa.PublicKey: must be an Ed25519 or ECDSA public key"))
+		})
+	})
+})
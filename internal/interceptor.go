@@ -0,0 +1,50 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+)
+
+// Invoker invokes a Wasm guest operation
+type Invoker func(ctx context.Context, operation string, payload []byte) ([]byte, error)
+
+// Interceptor wraps the invocation of a Wasm guest operation, for example to
+// check authorization, log, or transform the payload or result. It should call
+// next to continue the invocation, or return without calling it to reject the
+// invocation.
+type Interceptor func(ctx context.Context, operation string, payload []byte, next Invoker) ([]byte, error)
+
+// WithInterceptors adds interceptors to the invocations made using
+// InvokeWasmOperation, and the functions which use it such as InvokeAsync. The
+// first interceptor is the outermost, and the innermost next acquires a waPC
+// instance from the pool and invokes the operation. Interceptors run after the
+// tracing span is started, and before the payload size is checked.
+//
+// Note: interceptors are not used by InvokeBatch or Ping.
+func WithInterceptors(interceptors ...Interceptor) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		for _, interceptor := range interceptors {
+			if interceptor == nil {
+				return errors.New("Invalid interceptor: must not be nil")
+			}
+		}
+		wg.interceptors = append(wg.interceptors, interceptors...)
+		return nil
+	}
+}
+
+// chainInterceptors returns an Invoker which calls the interceptors in order
+// around the invoker
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, operation string, payload []byte) ([]byte, error) {
+			return interceptor(ctx, operation, payload, next)
+		}
+	}
+
+	return invoker
+}
@@ -5,6 +5,7 @@
 
 //counterfeiter:generate -o fakes/stub.go --fake-name ChaincodeStubInterface github.com/hyperledger/fabric-chaincode-go/shim.ChaincodeStubInterface
 //counterfeiter:generate -o fakes/state_query_iterator.go --fake-name StateQueryIteratorInterface github.com/hyperledger/fabric-chaincode-go/shim.StateQueryIteratorInterface
+//counterfeiter:generate -o fakes/history_query_iterator.go --fake-name HistoryQueryIteratorInterface github.com/hyperledger/fabric-chaincode-go/shim.HistoryQueryIteratorInterface
 
 package internal_test
 
@@ -0,0 +1,32 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+)
+
+// InvokeResult is the result of invoking a Wasm guest operation, or the error
+// if it failed
+type InvokeResult struct {
+	Result []byte
+	Err    error
+}
+
+// InvokeAsync invokes a Wasm guest operation in a new goroutine, like
+// InvokeWasmOperation, and delivers the result on the returned channel. The
+// invocation still waits for the concurrency limit and the pool, and cancelling
+// the context interrupts it with an error on the channel. The channel is
+// buffered, so the goroutine finishes even if the caller never receives the
+// result, and it is closed after the result is delivered.
+func (wg *WasmGuest) InvokeAsync(ctx context.Context, operation string, payload []byte) <-chan InvokeResult {
+	results := make(chan InvokeResult, 1)
+	go func() {
+		defer close(results)
+		result, err := wg.InvokeWasmOperation(ctx, operation, payload)
+		results <- InvokeResult{Result: result, Err: err}
+	}()
+
+	return results
+}
@@ -0,0 +1,89 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"regexp"
+)
+
+// InvokePhase identifies the stage of an invocation which failed
+type InvokePhase string
+
+const (
+	// PhaseRequest is checking the request before invoking the operation
+	PhaseRequest InvokePhase = "request"
+	// PhaseAcquire is waiting for, and checking out, a waPC instance
+	PhaseAcquire InvokePhase = "acquire"
+	// PhaseInvoke is running the operation in the Wasm guest
+	PhaseInvoke InvokePhase = "invoke"
+)
+
+// ErrRequestRejected is matched by an InvokeError when the request was
+// rejected before invoking the operation, in which case retrying the same
+// request will fail again
+var ErrRequestRejected = errors.New("Wasm operation request rejected")
+
+// ErrAcquireFailed is matched by an InvokeError when a waPC instance could not
+// be acquired, in which case it may be worth retrying the invocation
+var ErrAcquireFailed = errors.New("Failed to acquire waPC instance")
+
+// ErrInvokeFailed is matched by an InvokeError when the Wasm operation failed
+var ErrInvokeFailed = errors.New("Wasm operation failed")
+
+var phaseErrors = map[InvokePhase]error{
+	PhaseRequest: ErrRequestRejected,
+	PhaseAcquire: ErrAcquireFailed,
+	PhaseInvoke:  ErrInvokeFailed,
+}
+
+// InvokeError is returned by InvokeWasmOperation to describe which operation
+// failed, and at what stage. Failures returning a waPC instance to the pool
+// after the operation are logged, and do not affect the result.
+type InvokeError struct {
+	Operation string
+	Phase     InvokePhase
+	Err       error
+}
+
+// Error returns the message of the underlying error
+func (e *InvokeError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *InvokeError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is the sentinel error for the phase which
+// failed
+func (e *InvokeError) Is(target error) bool {
+	return target == phaseErrors[e.Phase]
+}
+
+// unknownOperationPattern matches the errors waPC guest SDKs report when no
+// handler is registered for the operation, since waPC guests dispatch
+// operations by name behind __guest_call rather than exporting them
+var unknownOperationPattern = regexp.MustCompile(`(?i)unknown (function|operation)|no handler registered for function|could not find function`)
+
+// isUnknownOperation returns whether the guest failed to invoke an operation
+// because it does not have one with that name, as opposed to the operation
+// itself failing or the invocation failing in the host or runtime
+func isUnknownOperation(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var invokeErr *InvokeError
+	if errors.As(err, &invokeErr) && invokeErr.Phase != PhaseInvoke {
+		return false
+	}
+	if isInvocationFailure(context.Background(), err) {
+		return false
+	}
+
+	return unknownOperationPattern.MatchString(err.Error())
+}
@@ -0,0 +1,94 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// leaseOperation names the acquisition of a Lease in errors, since it is not
+// for a particular operation
+const leaseOperation = "lease"
+
+// ErrLeaseReleased is returned when invoking an operation on a Lease which has
+// already been released
+var ErrLeaseReleased = errors.New("Lease has been released")
+
+// Lease is a waPC instance checked out of the pool by Acquire, so that a
+// sequence of operations can be invoked on the same instance and share the
+// guest in-memory state. The instance is not available to other invocations
+// until the Lease is released, and Drain and CloseWithTimeout wait for it to
+// be released like any other invocation in progress.
+type Lease struct {
+	mutex         sync.Mutex
+	instanceLease *instanceLease
+	released      bool
+}
+
+// Acquire checks out a waPC instance from the pool, waiting for the circuit
+// breaker, concurrency limit and pool like InvokeWasmOperation. The Lease must
+// be released by calling Release once the operations have been invoked. The
+// context is also used to redirect guest output with WithGuestOutput, for
+// every operation invoked on the Lease. Errors are returned as an InvokeError.
+func (wg *WasmGuest) Acquire(ctx context.Context) (*Lease, error) {
+	lease, err := wg.acquireLease(ctx, leaseOperation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Lease{instanceLease: lease}, nil
+}
+
+// Invoke invokes an operation on the leased instance, checking the payload
+// size and rate limit like InvokeWasmOperation, but without the interceptors.
+// If the operation fails, the instance is discarded when the Lease is
+// released, rather than returned to the pool, since the guest state may be
+// inconsistent. Operations are invoked one at a time, so concurrent calls wait
+// for each other. Errors are returned as an InvokeError.
+func (lease *Lease) Invoke(ctx context.Context, operation string, payload []byte) (result []byte, err error) {
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+
+	if lease.released {
+		return nil, &InvokeError{Operation: operation, Phase: PhaseRequest, Err: ErrLeaseReleased}
+	}
+
+	wg := lease.instanceLease.wg
+	ctx, span := startSpan(ctx, wg.tracer, "LeaseInvoke",
+		SpanAttribute{Key: "wasm.operation", Value: operation},
+		SpanAttribute{Key: "wasm.payload_size", Value: len(payload)},
+	)
+	defer func() { endInvokeSpan(span, err) }()
+
+	if err := wg.checkPayload(operation, payload); err != nil {
+		return nil, err
+	}
+	if err := wg.checkRateLimit(operation); err != nil {
+		return nil, err
+	}
+
+	result, err = lease.instanceLease.invoke(ctx, operation, payload)
+	if err != nil {
+		lease.instanceLease.failed = true
+	}
+
+	return result, err
+}
+
+// Release returns the leased instance to the pool, or discards it if an
+// operation failed. It waits for an operation in progress on the Lease to
+// finish first. Releasing a Lease which has already been released does
+// nothing.
+func (lease *Lease) Release() {
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+
+	if lease.released {
+		return
+	}
+	lease.released = true
+	lease.instanceLease.release()
+}
@@ -0,0 +1,525 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// emptyKeySubstitute is the start key the shim uses for ranges with an empty
+// start key, so that open ranges do not include composite keys
+const emptyKeySubstitute = "\x01"
+
+// MemoryLedger is an in-memory world state and private data, for testing Wasm
+// chaincode end to end without a peer. Each transaction uses a MemoryStub from
+// NewStub, and its writes only change the ledger when it is committed.
+type MemoryLedger struct {
+	mutex   sync.RWMutex
+	state   map[string][]byte
+	private map[string]map[string][]byte
+}
+
+// NewMemoryLedger returns an empty ledger
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{
+		state:   make(map[string][]byte),
+		private: make(map[string]map[string][]byte),
+	}
+}
+
+// PutState sets the value of a key in the world state, for example to set the
+// initial state before a test
+func (ledger *MemoryLedger) PutState(key string, value []byte) {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	ledger.state[key] = append([]byte(nil), value...)
+}
+
+// PutPrivateData sets the value of a key in a private data collection
+func (ledger *MemoryLedger) PutPrivateData(collection, key string, value []byte) {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	ledger.collection(collection)[key] = append([]byte(nil), value...)
+}
+
+// State returns a copy of the world state
+func (ledger *MemoryLedger) State() map[string][]byte {
+	ledger.mutex.RLock()
+	defer ledger.mutex.RUnlock()
+
+	return copyState(ledger.state)
+}
+
+// PrivateData returns a copy of a private data collection
+func (ledger *MemoryLedger) PrivateData(collection string) map[string][]byte {
+	ledger.mutex.RLock()
+	defer ledger.mutex.RUnlock()
+
+	return copyState(ledger.private[collection])
+}
+
+// NewStub returns a stub for a transaction, which reads the state of the
+// ledger and buffers its writes until it is committed
+func (ledger *MemoryLedger) NewStub(channelID, txID string) *MemoryStub {
+	return &MemoryStub{
+		ledger:    ledger,
+		channelID: channelID,
+		txID:      txID,
+		Timestamp: time.Now(),
+	}
+}
+
+// collection returns the state of a private data collection, creating it if
+// necessary. The ledger must already be locked for writing.
+func (ledger *MemoryLedger) collection(name string) map[string][]byte {
+	state, ok := ledger.private[name]
+	if !ok {
+		state = make(map[string][]byte)
+		ledger.private[name] = state
+	}
+	return state
+}
+
+func (ledger *MemoryLedger) get(collection, key string) []byte {
+	ledger.mutex.RLock()
+	defer ledger.mutex.RUnlock()
+
+	state := ledger.state
+	if collection != "" {
+		state = ledger.private[collection]
+	}
+
+	value, ok := state[key]
+	if !ok {
+		return nil
+	}
+	return append([]byte(nil), value...)
+}
+
+// rangeOf returns the world state from the start key (inclusive) to the end
+// key (exclusive) in key order, where an empty end key means an open range
+func (ledger *MemoryLedger) rangeOf(startKey, endKey string) []*queryresult.KV {
+	ledger.mutex.RLock()
+	defer ledger.mutex.RUnlock()
+
+	var results []*queryresult.KV
+	for key, value := range ledger.state {
+		if key >= startKey && (endKey == "" || key < endKey) {
+			results = append(results, &queryresult.KV{Key: key, Value: append([]byte(nil), value...)})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+
+	return results
+}
+
+func copyState(state map[string][]byte) map[string][]byte {
+	copied := make(map[string][]byte, len(state))
+	for key, value := range state {
+		copied[key] = append([]byte(nil), value...)
+	}
+	return copied
+}
+
+// MemoryStub is the stub for a transaction using a MemoryLedger. As for
+// Fabric, reads do not see the writes of the same transaction, which are
+// returned by Writes until they are committed.
+//
+// The arguments, transient data, creator and timestamp of the transaction can
+// be set before invoking the chaincode. The Creator is a serialized msp
+// SerializedIdentity. Rich queries, history, chaincode to chaincode calls,
+// private data ranges and key level endorsement policies are not supported,
+// and return an error.
+type MemoryStub struct {
+	Args      [][]byte
+	Transient map[string][]byte
+	Creator   []byte
+	Timestamp time.Time
+
+	ledger    *MemoryLedger
+	channelID string
+	txID      string
+	mutex     sync.Mutex
+	writes    []StateWrite
+	events    []*peer.ChaincodeEvent
+}
+
+// Writes returns the writes buffered by the transaction, in the order the
+// chaincode made them
+func (stub *MemoryStub) Writes() []StateWrite {
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+
+	return append([]StateWrite(nil), stub.writes...)
+}
+
+// Events returns the events set by the transaction. As for Fabric, only the
+// last event is emitted when the transaction is committed.
+func (stub *MemoryStub) Events() []*peer.ChaincodeEvent {
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+
+	return append([]*peer.ChaincodeEvent(nil), stub.events...)
+}
+
+// Commit applies the buffered writes of the transaction to the ledger, and
+// clears them
+func (stub *MemoryStub) Commit() {
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+
+	ledger := stub.ledger
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	for _, write := range stub.writes {
+		state := ledger.state
+		if write.Collection != "" {
+			state = ledger.collection(write.Collection)
+		}
+
+		if write.IsDelete || write.IsPurge {
+			delete(state, write.Key)
+		} else {
+			state[write.Key] = write.Value
+		}
+	}
+	stub.writes = nil
+}
+
+func (stub *MemoryStub) write(write StateWrite) error {
+	if write.Key == "" {
+		return fmt.Errorf("Invalid key: must not be empty")
+	}
+	if !utf8.ValidString(write.Key) {
+		return fmt.Errorf("Invalid key %q: must be a UTF-8 string", write.Key)
+	}
+	write.Value = append([]byte(nil), write.Value...)
+
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+
+	stub.writes = append(stub.writes, write)
+	return nil
+}
+
+// unsupported returns the error for stub methods which are not supported
+func unsupported(method string) error {
+	return fmt.Errorf("%s is not supported by MemoryStub", method)
+}
+
+// GetArgs returns the arguments of the transaction
+func (stub *MemoryStub) GetArgs() [][]byte {
+	return stub.Args
+}
+
+// GetStringArgs returns the arguments of the transaction as strings
+func (stub *MemoryStub) GetStringArgs() []string {
+	args := make([]string, 0, len(stub.Args))
+	for _, arg := range stub.Args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+// GetFunctionAndParameters returns the first argument as the function name,
+// and the remaining arguments as its parameters
+func (stub *MemoryStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+// GetArgsSlice returns the arguments of the transaction concatenated
+func (stub *MemoryStub) GetArgsSlice() ([]byte, error) {
+	return bytes.Join(stub.Args, nil), nil
+}
+
+// GetTxID returns the transaction ID
+func (stub *MemoryStub) GetTxID() string {
+	return stub.txID
+}
+
+// GetChannelID returns the channel ID
+func (stub *MemoryStub) GetChannelID() string {
+	return stub.channelID
+}
+
+// InvokeChaincode is not supported
+func (stub *MemoryStub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) peer.Response {
+	return shim.Error(unsupported("InvokeChaincode").Error())
+}
+
+// GetState returns the committed value of the key, or nil if it does not
+// exist
+func (stub *MemoryStub) GetState(key string) ([]byte, error) {
+	return stub.ledger.get("", key), nil
+}
+
+// PutState buffers a write of the key
+func (stub *MemoryStub) PutState(key string, value []byte) error {
+	return stub.write(StateWrite{Key: key, Value: value})
+}
+
+// DelState buffers a delete of the key
+func (stub *MemoryStub) DelState(key string) error {
+	return stub.write(StateWrite{Key: key, IsDelete: true})
+}
+
+// SetStateValidationParameter is not supported
+func (stub *MemoryStub) SetStateValidationParameter(key string, ep []byte) error {
+	return unsupported("SetStateValidationParameter")
+}
+
+// GetStateValidationParameter is not supported
+func (stub *MemoryStub) GetStateValidationParameter(key string) ([]byte, error) {
+	return nil, unsupported("GetStateValidationParameter")
+}
+
+// GetStateByRange returns an iterator over the committed states from the start
+// key (inclusive) to the end key (exclusive). As for the shim, an empty start
+// key does not include composite keys.
+func (stub *MemoryStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if startKey == "" {
+		startKey = emptyKeySubstitute
+	}
+	return &memoryIterator{results: stub.ledger.rangeOf(startKey, endKey)}, nil
+}
+
+// GetStateByRangeWithPagination returns an iterator over a page of the
+// committed states in the range, starting from the bookmark. The bookmark for
+// the next page is the first key after the page, or empty after the last page.
+func (stub *MemoryStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	if startKey == "" {
+		startKey = emptyKeySubstitute
+	}
+	return paginate(stub.ledger.rangeOf(startKey, endKey), pageSize, bookmark)
+}
+
+// GetStateByPartialCompositeKey returns an iterator over the committed states
+// with composite keys starting with the object type and attributes
+func (stub *MemoryStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryIterator{results: stub.ledger.rangeOf(prefix, prefix+string(utf8.MaxRune))}, nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination returns an iterator over a page
+// of the committed states with the partial composite key, starting from the
+// bookmark
+func (stub *MemoryStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return paginate(stub.ledger.rangeOf(prefix, prefix+string(utf8.MaxRune)), pageSize, bookmark)
+}
+
+// CreateCompositeKey creates a composite key in the same way as the shim
+func (stub *MemoryStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+
+// SplitCompositeKey splits a composite key into its object type and
+// attributes
+func (stub *MemoryStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	return splitCompositeKey(compositeKey)
+}
+
+// GetQueryResult is not supported
+func (stub *MemoryStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, unsupported("GetQueryResult")
+}
+
+// GetQueryResultWithPagination is not supported
+func (stub *MemoryStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	return nil, nil, unsupported("GetQueryResultWithPagination")
+}
+
+// GetHistoryForKey is not supported
+func (stub *MemoryStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return nil, unsupported("GetHistoryForKey")
+}
+
+// GetPrivateData returns the committed value of the key in the collection, or
+// nil if it does not exist
+func (stub *MemoryStub) GetPrivateData(collection, key string) ([]byte, error) {
+	if collection == "" {
+		return nil, fmt.Errorf("Invalid collection: must not be empty")
+	}
+	return stub.ledger.get(collection, key), nil
+}
+
+// GetPrivateDataHash returns the SHA-256 hash of the committed value of the key
+// in the collection, or nil if it does not exist
+func (stub *MemoryStub) GetPrivateDataHash(collection, key string) ([]byte, error) {
+	value, err := stub.GetPrivateData(collection, key)
+	if value == nil || err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(value)
+	return hash[:], nil
+}
+
+// PutPrivateData buffers a write of the key in the collection
+func (stub *MemoryStub) PutPrivateData(collection string, key string, value []byte) error {
+	if collection == "" {
+		return fmt.Errorf("Invalid collection: must not be empty")
+	}
+	return stub.write(StateWrite{Collection: collection, Key: key, Value: value})
+}
+
+// DelPrivateData buffers a delete of the key in the collection
+func (stub *MemoryStub) DelPrivateData(collection, key string) error {
+	if collection == "" {
+		return fmt.Errorf("Invalid collection: must not be empty")
+	}
+	return stub.write(StateWrite{Collection: collection, Key: key, IsDelete: true})
+}
+
+// PurgePrivateData buffers a purge of the key in the collection, which removes
+// it from the collection in the same way as a delete
+func (stub *MemoryStub) PurgePrivateData(collection, key string) error {
+	if collection == "" {
+		return fmt.Errorf("Invalid collection: must not be empty")
+	}
+	return stub.write(StateWrite{Collection: collection, Key: key, IsPurge: true})
+}
+
+// SetPrivateDataValidationParameter is not supported
+func (stub *MemoryStub) SetPrivateDataValidationParameter(collection, key string, ep []byte) error {
+	return unsupported("SetPrivateDataValidationParameter")
+}
+
+// GetPrivateDataValidationParameter is not supported
+func (stub *MemoryStub) GetPrivateDataValidationParameter(collection, key string) ([]byte, error) {
+	return nil, unsupported("GetPrivateDataValidationParameter")
+}
+
+// GetPrivateDataByRange is not supported
+func (stub *MemoryStub) GetPrivateDataByRange(collection, startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return nil, unsupported("GetPrivateDataByRange")
+}
+
+// GetPrivateDataByPartialCompositeKey is not supported
+func (stub *MemoryStub) GetPrivateDataByPartialCompositeKey(collection, objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	return nil, unsupported("GetPrivateDataByPartialCompositeKey")
+}
+
+// GetPrivateDataQueryResult is not supported
+func (stub *MemoryStub) GetPrivateDataQueryResult(collection, query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, unsupported("GetPrivateDataQueryResult")
+}
+
+// GetCreator returns the serialized identity which created the transaction
+func (stub *MemoryStub) GetCreator() ([]byte, error) {
+	return stub.Creator, nil
+}
+
+// GetTransient returns the transient data of the transaction
+func (stub *MemoryStub) GetTransient() (map[string][]byte, error) {
+	return stub.Transient, nil
+}
+
+// GetBinding returns no binding, since there is no proposal
+func (stub *MemoryStub) GetBinding() ([]byte, error) {
+	return nil, nil
+}
+
+// GetDecorations returns no decorations, since there is no proposal
+func (stub *MemoryStub) GetDecorations() map[string][]byte {
+	return nil
+}
+
+// GetSignedProposal is not supported
+func (stub *MemoryStub) GetSignedProposal() (*peer.SignedProposal, error) {
+	return nil, unsupported("GetSignedProposal")
+}
+
+// GetTxTimestamp returns the timestamp of the transaction, which is when the
+// stub was created unless it is set
+func (stub *MemoryStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return timestamppb.New(stub.Timestamp), nil
+}
+
+// SetEvent records an event for the transaction
+func (stub *MemoryStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("Invalid event name: must not be empty")
+	}
+
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+
+	stub.events = append(stub.events, &peer.ChaincodeEvent{TxId: stub.txID, EventName: name, Payload: append([]byte(nil), payload...)})
+	return nil
+}
+
+// paginate returns an iterator over the page of results starting at the
+// bookmark key, with the bookmark for the next page
+func paginate(results []*queryresult.KV, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	if pageSize < 1 {
+		return nil, nil, fmt.Errorf("Invalid page size %d: must be at least 1", pageSize)
+	}
+
+	start := sort.Search(len(results), func(i int) bool { return results[i].Key >= bookmark })
+	end := start + int(pageSize)
+	if end > len(results) {
+		end = len(results)
+	}
+
+	metadata := &peer.QueryResponseMetadata{FetchedRecordsCount: int32(end - start)}
+	if end < len(results) {
+		metadata.Bookmark = results[end].Key
+	}
+
+	return &memoryIterator{results: results[start:end]}, metadata, nil
+}
+
+// memoryIterator iterates over states read from a MemoryLedger
+type memoryIterator struct {
+	results []*queryresult.KV
+	closed  bool
+}
+
+func (iterator *memoryIterator) HasNext() bool {
+	return !iterator.closed && len(iterator.results) > 0
+}
+
+func (iterator *memoryIterator) Next() (*queryresult.KV, error) {
+	if iterator.closed {
+		return nil, fmt.Errorf("Iterator is closed")
+	}
+	if len(iterator.results) == 0 {
+		return nil, fmt.Errorf("No more states")
+	}
+
+	result := iterator.results[0]
+	iterator.results = iterator.results[1:]
+	return result, nil
+}
+
+func (iterator *memoryIterator) Close() error {
+	iterator.closed = true
+	return nil
+}
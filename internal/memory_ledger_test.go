@@ -0,0 +1,241 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hyperledgendary/fabric-chaincode-wasm/internal"
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+var _ = Describe("MemoryLedger", func() {
+	var (
+		ctx          context.Context
+		txContext    *contract.TransactionContext
+		ledger       *internal.MemoryLedger
+		stub         *internal.MemoryStub
+		contextStore *internal.ContextStore
+		proxy        *internal.FabricProxy
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		txContext = &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"}
+
+		ledger = internal.NewMemoryLedger()
+		ledger.PutState("001", []byte("bond"))
+		ledger.PutState("002", []byte("moneypenny"))
+		ledger.PutState("003", []byte("q"))
+
+		stub = ledger.NewStub("channel1", "txn1")
+		contextStore = internal.NewContextStore()
+		contextStore.Put("channel1", "txn1", stub)
+		proxy = internal.NewFabricProxy(contextStore)
+	})
+
+	call := func(operation string, request interface{}) []byte {
+		var payload []byte
+		var err error
+		if message, ok := request.(proto.Message); ok {
+			payload, err = proto.Marshal(message)
+		} else {
+			payload, err = json.Marshal(request)
+		}
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := proxy.FabricCall(ctx, "wapc", "LedgerService", operation, payload)
+		Expect(err).NotTo(HaveOccurred())
+		return result
+	}
+
+	readRange := func(operation string, request interface{}) ([]string, *internal.QueryResponseMetadata) {
+		response := &internal.IteratorResponse{}
+		Expect(json.Unmarshal(call(operation, request), response)).To(Succeed())
+
+		next := &internal.IteratorNextResponse{}
+		Expect(json.Unmarshal(call("IteratorNext", &internal.IteratorNextRequest{Context: txContext, IteratorID: response.IteratorID}), next)).To(Succeed())
+		Expect(next.HasMore).To(BeFalse())
+
+		keys := []string{}
+		for _, state := range next.States {
+			keys = append(keys, state.Key)
+		}
+		return keys, response.Metadata
+	}
+
+	It("should let a guest read the initial state", func() {
+		wasmFile := writeTestGuestWasm()
+		defer os.Remove(wasmFile)
+		wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+		Expect(err).NotTo(HaveOccurred())
+		defer wasmGuest.Close()
+
+		payload, err := proto.Marshal(&contract.ReadStateRequest{Context: txContext, StateKey: "001"})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := wasmGuest.InvokeWasmOperation(ctx, "read", payload)
+		Expect(err).NotTo(HaveOccurred())
+
+		response := &contract.ReadStateResponse{}
+		Expect(proto.Unmarshal(result, response)).To(Succeed())
+		Expect(response.GetState().GetValue()).To(Equal([]byte("bond")))
+	})
+
+	It("should buffer writes until the transaction is committed", func() {
+		call("CreateState", &contract.CreateStateRequest{Context: txContext, State: &contract.State{Key: "004", Value: []byte("m")}})
+		call("UpdateState", &contract.UpdateStateRequest{Context: txContext, State: &contract.State{Key: "001", Value: []byte("james bond")}})
+		Expect(stub.DelState("003")).To(Succeed())
+
+		Expect(stub.Writes()).To(Equal([]internal.StateWrite{
+			{Key: "004", Value: []byte("m")},
+			{Key: "001", Value: []byte("james bond")},
+			{Key: "003", IsDelete: true},
+		}))
+		value, err := stub.GetState("001")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("bond")), "Should not read the writes of the same transaction")
+
+		stub.Commit()
+		Expect(stub.Writes()).To(BeEmpty())
+		Expect(ledger.State()).To(Equal(map[string][]byte{
+			"001": []byte("james bond"),
+			"002": []byte("moneypenny"),
+			"004": []byte("m"),
+		}))
+	})
+
+	It("should buffer private data writes until the transaction is committed", func() {
+		ledger.PutPrivateData("secrets", "001", []byte("licence to kill"))
+
+		value, err := stub.GetPrivateData("secrets", "001")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("licence to kill")))
+		hash, err := stub.GetPrivateDataHash("secrets", "001")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hash).To(HaveLen(32))
+
+		Expect(stub.PutPrivateData("secrets", "002", []byte("gadgets"))).To(Succeed())
+		Expect(stub.DelPrivateData("secrets", "001")).To(Succeed())
+		stub.Commit()
+
+		Expect(ledger.PrivateData("secrets")).To(Equal(map[string][]byte{"002": []byte("gadgets")}))
+		Expect(ledger.State()).To(HaveLen(3))
+	})
+
+	It("should read ranges of the committed state in key order", func() {
+		compositeKey, err := shim.CreateCompositeKey("agent", []string{"007"})
+		Expect(err).NotTo(HaveOccurred())
+		ledger.PutState(compositeKey, []byte("bond"))
+
+		keys, _ := readRange("GetStateByRange", &internal.GetStateByRangeRequest{Context: txContext, StartKey: "002"})
+		Expect(keys).To(Equal([]string{"002", "003"}))
+
+		keys, _ = readRange("GetStateByRange", &internal.GetStateByRangeRequest{Context: txContext})
+		Expect(keys).To(Equal([]string{"001", "002", "003"}), "Should not include composite keys in an open range")
+	})
+
+	It("should read states by partial composite key", func() {
+		for _, attributes := range [][]string{{"mi6", "007"}, {"mi6", "006"}, {"cia", "leiter"}} {
+			key, err := shim.CreateCompositeKey("agent", attributes)
+			Expect(err).NotTo(HaveOccurred())
+			ledger.PutState(key, []byte(attributes[1]))
+		}
+
+		response := &internal.IteratorResponse{}
+		Expect(json.Unmarshal(call("GetStateByPartialCompositeKey", &internal.GetStateByPartialCompositeKeyRequest{Context: txContext, ObjectType: "agent", Attributes: []string{"mi6"}}), response)).To(Succeed())
+		next := &internal.IteratorNextResponse{}
+		Expect(json.Unmarshal(call("IteratorNext", &internal.IteratorNextRequest{Context: txContext, IteratorID: response.IteratorID}), next)).To(Succeed())
+
+		values := []string{}
+		for _, state := range next.States {
+			values = append(values, string(state.Value))
+		}
+		Expect(values).To(Equal([]string{"006", "007"}))
+	})
+
+	It("should page through states by partial composite key using the bookmarks", func() {
+		for _, attributes := range [][]string{{"mi6", "007"}, {"mi6", "006"}, {"mi6", "009"}, {"cia", "leiter"}, {"mi60", "m"}} {
+			key, err := shim.CreateCompositeKey("agent", attributes)
+			Expect(err).NotTo(HaveOccurred())
+			ledger.PutState(key, []byte(attributes[1]))
+		}
+
+		var scanned []string
+		bookmark := ""
+		for {
+			keys, metadata := readRange("GetStateByPartialCompositeKeyWithPagination", &internal.GetStateByPartialCompositeKeyWithPaginationRequest{Context: txContext, ObjectType: "agent", Attributes: []string{"mi6"}, PageSize: 2, Bookmark: bookmark})
+			Expect(metadata.FetchedRecordsCount).To(Equal(int32(len(keys))))
+			scanned = append(scanned, keys...)
+			if bookmark = metadata.Bookmark; bookmark == "" {
+				break
+			}
+		}
+
+		var expected []string
+		for _, agent := range []string{"006", "007", "009"} {
+			key, err := shim.CreateCompositeKey("agent", []string{"mi6", agent})
+			Expect(err).NotTo(HaveOccurred())
+			expected = append(expected, key)
+		}
+		Expect(scanned).To(Equal(expected), "Should not include keys whose attribute only starts with the partial key")
+	})
+
+	It("should page through ranges using the bookmarks", func() {
+		ledger.PutState("004", []byte("m"))
+		ledger.PutState("005", []byte("felix"))
+
+		var scanned []string
+		bookmark := ""
+		for {
+			keys, metadata := readRange("GetStateByRangeWithPagination", &internal.GetStateByRangeWithPaginationRequest{Context: txContext, StartKey: "002", PageSize: 2, Bookmark: bookmark})
+			Expect(metadata.FetchedRecordsCount).To(Equal(int32(len(keys))))
+			scanned = append(scanned, keys...)
+			if bookmark = metadata.Bookmark; bookmark == "" {
+				break
+			}
+		}
+		Expect(scanned).To(Equal([]string{"002", "003", "004", "005"}))
+	})
+
+	It("should simulate the transient data, creator and arguments of the transaction", func() {
+		stub.Transient = map[string][]byte{"pin": []byte("0000")}
+		stub.Creator = []byte("creator")
+		stub.Args = [][]byte{[]byte("transfer"), []byte("007")}
+
+		transient := &internal.TransientResponse{}
+		Expect(json.Unmarshal(call("GetTransient", &internal.TransactionRequest{Context: txContext}), transient)).To(Succeed())
+		Expect(transient.Transient).To(Equal(map[string][]byte{"pin": []byte("0000")}))
+
+		creator := &internal.CreatorResponse{}
+		Expect(json.Unmarshal(call("GetCreator", &internal.TransactionRequest{Context: txContext}), creator)).To(Succeed())
+		Expect(creator.Creator).To(Equal([]byte("creator")))
+
+		function, parameters := stub.GetFunctionAndParameters()
+		Expect(function).To(Equal("transfer"))
+		Expect(parameters).To(Equal([]string{"007"}))
+		Expect(stub.GetTxID()).To(Equal("txn1"))
+		Expect(stub.GetChannelID()).To(Equal("channel1"))
+	})
+
+	It("should return an error for unsupported stub methods", func() {
+		_, err := stub.GetQueryResult(`{"selector":{}}`)
+		Expect(err).To(MatchError("GetQueryResult is not supported by MemoryStub"))
+
+		response := stub.InvokeChaincode("other", nil, "")
+		Expect(response.Status).To(Equal(int32(shim.ERROR)))
+		Expect(response.Message).To(Equal("InvokeChaincode is not supported by MemoryStub"))
+	})
+
+	It("should reject an empty key", func() {
+		Expect(stub.PutState("", []byte("bond"))).To(MatchError("Invalid key: must not be empty"))
+		Expect(stub.Writes()).To(BeEmpty())
+	})
+})
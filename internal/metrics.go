@@ -0,0 +1,26 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"time"
+)
+
+// Metrics is used by the WasmGuest to record measurements of invocations,
+// for example to expose them to Prometheus
+type Metrics interface {
+	// ObserveAcquire records how long an invocation waited for a waPC
+	// instance, and the error if one could not be acquired
+	ObserveAcquire(wait time.Duration, err error)
+	// ObserveInvocation records how long the guest took to run an operation,
+	// and the error if the operation failed
+	ObserveInvocation(operation string, duration time.Duration, err error)
+}
+
+// noopMetrics discards all measurements
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveAcquire(wait time.Duration, err error) {}
+
+func (noopMetrics) ObserveInvocation(operation string, duration time.Duration, err error) {}
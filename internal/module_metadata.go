@@ -0,0 +1,31 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+// ModuleMetadataSection is the name of the Wasm custom section returned by
+// ModuleMetadata. There is no standard format for its contents, which guest
+// SDKs can use to describe the contract, such as its name and version, and
+// the version of the SDK it was built with.
+const ModuleMetadataSection = "fabric-chaincode-metadata"
+
+// ModuleMetadata returns the contents of the ModuleMetadataSection custom
+// section of the Wasm module, for example so that the host can reject a guest
+// built with an incompatible SDK version. It returns false if the module does
+// not have the section.
+func (wg *WasmGuest) ModuleMetadata() ([]byte, bool) {
+	return wg.CustomSection(ModuleMetadataSection)
+}
+
+// CustomSection returns the contents of the named custom section of the Wasm
+// module, which are read when the module is loaded or reloaded. It returns
+// false if the module does not have the section. If the module has several
+// custom sections with the name, the first is returned.
+func (wg *WasmGuest) CustomSection(name string) ([]byte, bool) {
+	content, ok := wg.currentModule().customSections[name]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte{}, content...), true
+}
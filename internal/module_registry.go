@@ -0,0 +1,177 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/wapc/wapc-go"
+)
+
+type sharedModuleKey struct{}
+
+// ModuleRegistry shares compiled Wasm modules between WasmGuests, so that
+// several WasmGuests running the same Wasm bytes only compile them once. Each
+// WasmGuest still has its own pool of waPC instances, host call handlers,
+// logger and guest output.
+//
+// Modules are shared by WasmGuests with the same SHA-256 digest of the Wasm
+// bytes, memory limit, WASI environment variables, preopened directories and
+// syscall policy, since these are part of the wazero runtime the module is
+// compiled for. A compiled module is closed when the last WasmGuest using it
+// is closed, or reloads a different module.
+type ModuleRegistry struct {
+	mutex   sync.Mutex
+	modules map[string]*registeredModule
+}
+
+// registeredModule is a compiled waPC module, and the number of WasmGuest
+// modules using it
+type registeredModule struct {
+	module wapc.Module
+	refs   int
+}
+
+// NewModuleRegistry returns an empty ModuleRegistry
+func NewModuleRegistry() *ModuleRegistry {
+	return &ModuleRegistry{modules: make(map[string]*registeredModule)}
+}
+
+// WithModuleRegistry compiles the Wasm module using the registry, sharing the
+// compiled module with any other WasmGuest using the registry for the same
+// Wasm bytes and runtime configuration. Modules are not shared if
+// WithModuleConfig sets the guest console Logger, which is part of the
+// compiled module.
+//
+// Note: a module registry is only supported by the default wazero engine
+func WithModuleRegistry(registry *ModuleRegistry) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if registry == nil {
+			return fmt.Errorf("Invalid module registry: must not be nil")
+		}
+		wg.registry = registry
+		return nil
+	}
+}
+
+// Len returns the number of compiled modules in the registry
+func (registry *ModuleRegistry) Len() int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return len(registry.modules)
+}
+
+// acquire returns the compiled module registered with the key, compiling it if
+// it is not registered, and counts another reference to it. Compilation holds
+// the registry lock, so that concurrent WasmGuests do not compile the same
+// module twice.
+func (registry *ModuleRegistry) acquire(key string, compile func() (wapc.Module, error)) (wapc.Module, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registered, ok := registry.modules[key]
+	if !ok {
+		module, err := compile()
+		if err != nil {
+			return nil, err
+		}
+		registered = &registeredModule{module: module}
+		registry.modules[key] = registered
+	}
+	registered.refs++
+
+	return registered.module, nil
+}
+
+// release removes a reference to the compiled module registered with the key,
+// closing it if it was the last one
+func (registry *ModuleRegistry) release(ctx context.Context, key string) error {
+	registry.mutex.Lock()
+	registered, ok := registry.modules[key]
+	if !ok {
+		registry.mutex.Unlock()
+		return nil
+	}
+	registered.refs--
+	if registered.refs > 0 {
+		registry.mutex.Unlock()
+		return nil
+	}
+	delete(registry.modules, key)
+	registry.mutex.Unlock()
+
+	return registered.module.Close(ctx)
+}
+
+// registryKey identifies the compiled module for the Wasm module digest and
+// the runtime configuration of the WasmGuest
+func (wg *WasmGuest) registryKey(digest string) string {
+	var mounts map[string]interface{}
+	if !wg.wasiFS.empty() {
+		mounts = make(map[string]interface{})
+		for name, fsys := range wg.wasiFS.mounts {
+			mounts[name] = fsys
+		}
+	}
+
+	return fmt.Sprintf("%s memory=%d env=%v fs=%v syscalls=%s", digest, wg.memoryLimit, wg.wasiEnv, mounts, wg.syscallPolicy)
+}
+
+// sharedModule is a WasmGuest's reference to a module compiled by a
+// ModuleRegistry. Its instances pass host calls, and guest console messages,
+// to the WasmGuest which instantiated them, rather than the one which compiled
+// the module.
+type sharedModule struct {
+	wapc.Module
+	registry *ModuleRegistry
+	key      string
+	wg       *WasmGuest
+	hostCall wapc.HostCallHandler
+}
+
+// sharedModuleFromContext returns the shared module of the instance being
+// instantiated or invoked, if there is one
+func sharedModuleFromContext(ctx context.Context) (*sharedModule, bool) {
+	module, ok := ctx.Value(sharedModuleKey{}).(*sharedModule)
+	return module, ok
+}
+
+// sharedHostCall is the host call handler of modules compiled by a
+// ModuleRegistry, which calls the handler of the shared module in the context
+func sharedHostCall(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+	module, ok := sharedModuleFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("Host call %s %s made outside an invocation of a shared module", namespace, operation)
+	}
+
+	return module.hostCall(ctx, binding, namespace, operation, payload)
+}
+
+func (module *sharedModule) Instantiate(ctx context.Context) (wapc.Instance, error) {
+	instance, err := module.Module.Instantiate(context.WithValue(ctx, sharedModuleKey{}, module))
+	if err != nil {
+		return nil, err
+	}
+
+	return &sharedInstance{Instance: instance, module: module}, nil
+}
+
+// Close releases the WasmGuest's reference to the compiled module
+func (module *sharedModule) Close(ctx context.Context) error {
+	return module.registry.release(ctx, module.key)
+}
+
+// sharedInstance is an instance of a shared module, which identifies the
+// module in the context of each invocation
+type sharedInstance struct {
+	wapc.Instance
+	module *sharedModule
+}
+
+func (instance *sharedInstance) Invoke(ctx context.Context, operation string, payload []byte) ([]byte, error) {
+	return instance.Instance.Invoke(context.WithValue(ctx, sharedModuleKey{}, instance.module), operation, payload)
+}
@@ -0,0 +1,82 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+// multiResultLengthSize is the size of the length before each multiple
+// result value
+const multiResultLengthSize = 4
+
+// EncodeMultiResult frames multiple values as a single operation result, for
+// InvokeMulti. Each value is written as its length, as a 4 byte little-endian
+// unsigned integer, followed by the value bytes, with no header or padding.
+// An empty value is a zero length, and no values is an empty result, so a
+// guest with a single value to return writes it after its length.
+//
+// For example, the values "bond" and "" are framed as the bytes
+//
+//	04 00 00 00 62 6f 6e 64 00 00 00 00
+func EncodeMultiResult(values [][]byte) []byte {
+	size := 0
+	for _, value := range values {
+		size += multiResultLengthSize + len(value)
+	}
+
+	result := make([]byte, 0, size)
+	for _, value := range values {
+		var length [multiResultLengthSize]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(value)))
+		result = append(append(result, length[:]...), value...)
+	}
+
+	return result
+}
+
+// DecodeMultiResult splits an operation result framed as described for
+// EncodeMultiResult into its values. The values share the memory of the
+// result.
+func DecodeMultiResult(result []byte) ([][]byte, error) {
+	values := [][]byte{}
+	for offset := 0; offset < len(result); {
+		if len(result)-offset < multiResultLengthSize {
+			return nil, fmt.Errorf("Invalid multiple result: %d bytes at offset %d is too short for a value length", len(result)-offset, offset)
+		}
+		length := binary.LittleEndian.Uint32(result[offset:])
+		offset += multiResultLengthSize
+
+		if uint64(length) > uint64(len(result)-offset) {
+			return nil, fmt.Errorf("Invalid multiple result: value %d of %d bytes exceeds the %d remaining bytes", len(values)+1, length, len(result)-offset)
+		}
+		values = append(values, result[offset:offset+int(length)])
+		offset += int(length)
+	}
+
+	return values, nil
+}
+
+// InvokeMulti invokes a Wasm guest operation which returns multiple values,
+// framed as described for EncodeMultiResult, and returns the values.
+func InvokeMulti(ctx context.Context, invoker WasmGuestInvoker, operation string, payload []byte) ([][]byte, error) {
+	result, err := invoker.InvokeWasmOperation(ctx, operation, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := DecodeMultiResult(result)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode result from operation %s: %w", operation, err)
+	}
+
+	return values, nil
+}
+
+// InvokeMulti invokes the Wasm guest operation like the InvokeMulti function
+func (wg *WasmGuest) InvokeMulti(ctx context.Context, operation string, payload []byte) ([][]byte, error) {
+	return InvokeMulti(ctx, wg, operation, payload)
+}
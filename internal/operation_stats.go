@@ -0,0 +1,136 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBuckets is the number of latency histogram buckets. The first bucket
+// is up to 10µs, and each bucket after that is up to twice the one before it,
+// so the last bucket holds anything over about 84s.
+const latencyBuckets = 24
+
+// firstBucketBound is the upper bound of the first latency histogram bucket
+const firstBucketBound = 10 * time.Microsecond
+
+// OpStats summarizes how long the guest took to run an operation, excluding
+// the time spent waiting for a waPC instance. The percentiles are estimated
+// from a histogram with buckets which double in size, so they are the upper
+// bound of the bucket containing the percentile, capped at the maximum.
+type OpStats struct {
+	// Count is the number of invocations of the operation
+	Count uint64
+	// Errors is the number of invocations which returned an error
+	Errors uint64
+	// Total is the sum of the durations of every invocation
+	Total time.Duration
+	// Min and Max are the shortest and longest durations
+	Min, Max time.Duration
+	// P50, P95 and P99 are the estimated 50th, 95th and 99th percentiles
+	P50, P95, P99 time.Duration
+}
+
+// latencyHistogram counts the durations of invocations of an operation
+type latencyHistogram struct {
+	count, errors uint64
+	total         time.Duration
+	min, max      time.Duration
+	buckets       [latencyBuckets]uint64
+}
+
+// bucketBound returns the upper bound of the histogram bucket
+func bucketBound(bucket int) time.Duration {
+	return firstBucketBound << uint(bucket)
+}
+
+func (h *latencyHistogram) observe(duration time.Duration, err error) {
+	if h.count == 0 || duration < h.min {
+		h.min = duration
+	}
+	if duration > h.max {
+		h.max = duration
+	}
+	h.count++
+	if err != nil {
+		h.errors++
+	}
+	h.total += duration
+
+	bucket := 0
+	for bucket < latencyBuckets-1 && duration > bucketBound(bucket) {
+		bucket++
+	}
+	h.buckets[bucket]++
+}
+
+// percentile returns the estimated duration which the fraction of invocations
+// took no longer than
+func (h *latencyHistogram) percentile(fraction float64) time.Duration {
+	rank := uint64(fraction * float64(h.count))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen uint64
+	for bucket, count := range h.buckets {
+		seen += count
+		if seen >= rank {
+			if bound := bucketBound(bucket); bucket < latencyBuckets-1 && bound < h.max {
+				return bound
+			}
+			return h.max
+		}
+	}
+
+	return h.max
+}
+
+func (h *latencyHistogram) stats() OpStats {
+	return OpStats{
+		Count:  h.count,
+		Errors: h.errors,
+		Total:  h.total,
+		Min:    h.min,
+		Max:    h.max,
+		P50:    h.percentile(0.50),
+		P95:    h.percentile(0.95),
+		P99:    h.percentile(0.99),
+	}
+}
+
+// operationStats keeps a latency histogram for each operation which has been
+// invoked. The zero value is ready to use.
+type operationStats struct {
+	mutex      sync.Mutex
+	histograms map[string]*latencyHistogram
+}
+
+func (s *operationStats) observe(operation string, duration time.Duration, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.histograms == nil {
+		s.histograms = make(map[string]*latencyHistogram)
+	}
+	h, ok := s.histograms[operation]
+	if !ok {
+		h = &latencyHistogram{}
+		s.histograms[operation] = h
+	}
+	h.observe(duration, err)
+}
+
+func (s *operationStats) snapshot() map[string]OpStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snapshot := make(map[string]OpStats, len(s.histograms))
+	for operation, h := range s.histograms {
+		snapshot[operation] = h.stats()
+	}
+
+	return snapshot
+}
@@ -0,0 +1,122 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/wapc/wapc-go"
+)
+
+// PoolEventKind identifies what happened to a waPC instance in the pool
+type PoolEventKind string
+
+const (
+	// PoolInstanceCreated is when an instance is added to the pool
+	PoolInstanceCreated PoolEventKind = "created"
+	// PoolInstanceAcquired is when an instance is checked out of the pool
+	PoolInstanceAcquired PoolEventKind = "acquired"
+	// PoolInstanceReturned is when a checked out instance is returned to the
+	// pool
+	PoolInstanceReturned PoolEventKind = "returned"
+	// PoolInstanceDestroyed is when an instance is closed and removed from the
+	// pool, for example when it is discarded after a failed invocation
+	PoolInstanceDestroyed PoolEventKind = "destroyed"
+)
+
+// PoolEvent describes a change to a waPC instance in the pool, and what the
+// pool looked like afterwards
+type PoolEvent struct {
+	Kind PoolEventKind
+	// Instance identifies the instance within its pool, starting from 1
+	Instance uint64
+	// Wait is how long it took to acquire the instance, for acquired events
+	Wait time.Duration
+	// Size is the number of instances in the pool after the event
+	Size int
+	// InUse is the number of instances checked out of the pool after the event
+	InUse int
+}
+
+// PoolHook is called for each PoolEvent, for example to detect instances which
+// are checked out for too long. Hooks are called after the pool locks have
+// been released, possibly from several goroutines at once, and delay the
+// invocation which caused the event, so they should be quick.
+type PoolHook func(event PoolEvent)
+
+// WithPoolHook adds a hook which is called as waPC instances are created,
+// acquired, returned and destroyed. This is lower level than the Metrics
+// interface, and there are no hooks by default.
+func WithPoolHook(hook PoolHook) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if hook == nil {
+			return errors.New("Invalid pool hook: must not be nil")
+		}
+		wg.poolHooks = append(wg.poolHooks, hook)
+		return nil
+	}
+}
+
+// track records a new instance, which is not checked out, and queues its
+// created event. The pool must already be locked, or not yet be shared.
+func (pool *instancePool) track(instance wapc.Instance) {
+	pool.nextID++
+	pool.ids[instance] = pool.nextID
+	pool.observeMemory(instance)
+	pool.emit(PoolInstanceCreated, instance, 0)
+}
+
+// emit queues an event for the hooks, which are called by notify once the pool
+// is unlocked. The pool must already be locked, or not yet be shared.
+func (pool *instancePool) emit(kind PoolEventKind, instance wapc.Instance, wait time.Duration) {
+	pool.queue(PoolEvent{
+		Kind:     kind,
+		Instance: pool.ids[instance],
+		Wait:     wait,
+		Size:     len(pool.instances),
+		InUse:    int(atomic.LoadInt64(&pool.inUse)),
+	})
+}
+
+// queue adds an event for the hooks, if there are any. The pool must already
+// be locked, or not yet be shared.
+func (pool *instancePool) queue(event PoolEvent) {
+	if len(pool.hooks) > 0 {
+		pool.events = append(pool.events, event)
+	}
+}
+
+// acquired queues the acquired event for an instance, and calls the hooks
+func (pool *instancePool) acquired(instance wapc.Instance, wait time.Duration) {
+	if len(pool.hooks) == 0 {
+		return
+	}
+
+	pool.mutex.Lock()
+	pool.emit(PoolInstanceAcquired, instance, wait)
+	pool.mutex.Unlock()
+
+	pool.notify()
+}
+
+// notify calls the hooks with the queued events, and must not be called with
+// the pool locked
+func (pool *instancePool) notify() {
+	if len(pool.hooks) == 0 {
+		return
+	}
+
+	pool.mutex.Lock()
+	events := pool.events
+	pool.events = nil
+	pool.mutex.Unlock()
+
+	for _, event := range events {
+		for _, hook := range pool.hooks {
+			hook(event)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when invoking an operation faster than its rate
+// limit allows. The InvokeError also matches ErrAcquireFailed, since the
+// invocation may succeed if it is retried later.
+var ErrRateLimited = errors.New("Wasm operation rate limit exceeded")
+
+// RateLimit is the rate at which an operation can be invoked, in invocations
+// per second, with bursts of up to Burst invocations
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// WithOperationRateLimits limits the rate at which each of the operations can
+// be invoked using InvokeWasmOperation, for example to throttle an expensive
+// rich query operation without throttling cheap point reads. Invocations over
+// the limit fail immediately with ErrRateLimited, before waiting for a waPC
+// instance. Each operation invoked using InvokeBatch or a Lease also counts
+// towards its limit. Operations without a rate limit are not throttled.
+//
+// Note: rate limits are not used by Ping or Warmup.
+func WithOperationRateLimits(limits map[string]RateLimit) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if wg.rateLimiters == nil {
+			wg.rateLimiters = make(map[string]*rateLimiter, len(limits))
+		}
+
+		for operation, limit := range limits {
+			if !(limit.Rate > 0) || math.IsInf(limit.Rate, 0) {
+				return fmt.Errorf("Invalid rate limit for operation %s: rate %v must be positive", operation, limit.Rate)
+			}
+			if limit.Burst < 1 {
+				return fmt.Errorf("Invalid rate limit for operation %s: burst %d must be at least 1", operation, limit.Burst)
+			}
+			wg.rateLimiters[operation] = newRateLimiter(limit)
+		}
+		return nil
+	}
+}
+
+// checkRateLimit returns an InvokeError if the operation has been invoked
+// too often
+func (wg *WasmGuest) checkRateLimit(operation string) error {
+	limiter, ok := wg.rateLimiters[operation]
+	if !ok {
+		return nil
+	}
+
+	if wait := limiter.allow(); wait > 0 {
+		err := fmt.Errorf("%w for operation %s: retry in %s", ErrRateLimited, operation, wait.Round(time.Millisecond))
+		wg.logger.Errorf("[host] error invoking operation %s: %s", operation, err)
+		return &InvokeError{Operation: operation, Phase: PhaseAcquire, Err: err}
+	}
+
+	return nil
+}
+
+// rateLimiter is a token bucket, which holds up to burst tokens and refills
+// at the rate per second
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		rate:   limit.Rate,
+		burst:  float64(limit.Burst),
+		tokens: float64(limit.Burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if there is one, returning zero, or otherwise returns
+// how long until the next token is available
+func (rl *rateLimiter) allow() time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	rl.tokens = math.Min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	rl.last = now
+
+	if rl.tokens >= 1 {
+		rl.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+}
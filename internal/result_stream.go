@@ -0,0 +1,153 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// ResultStreamNamespace is the waPC host call namespace a guest uses to
+	// stream the result of an operation invoked with InvokeStream, which
+	// cannot be used for custom host call handlers
+	ResultStreamNamespace = "ResultStream"
+
+	// ResultStreamWrite is the host call operation which writes a chunk of
+	// the streamed result
+	ResultStreamWrite = "Write"
+)
+
+// ErrNotStreaming is returned to a guest which writes a result chunk while
+// invoked other than by InvokeStream
+var ErrNotStreaming = errors.New("Operation result is not being streamed")
+
+// ErrStreamClosed is returned to a guest which writes a result chunk after
+// InvokeStream has returned, or once the context of the invocation is done,
+// such as a guest which carries on running after a timeout
+var ErrStreamClosed = errors.New("Operation result stream is closed")
+
+type resultStreamKey struct{}
+
+// resultStream is the writer for the result of an operation invoked with
+// InvokeStream, and how much has been written to it. The mutex is held while
+// writing to the writer, so that closing the stream waits for a write in
+// progress, and nothing is written once InvokeStream returns.
+type resultStream struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	chunks int
+	bytes  int
+	err    error
+	closed bool
+}
+
+// write writes a chunk of the result, remembering the first error from the
+// writer so that the invocation fails even if the guest ignores it. Writes
+// are rejected once the stream is closed or the context is done.
+func (stream *resultStream) write(ctx context.Context, chunk []byte) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if stream.closed {
+		return ErrStreamClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %s", ErrStreamClosed, err)
+	}
+	if stream.err != nil {
+		return stream.err
+	}
+	if len(chunk) == 0 {
+		return nil
+	}
+
+	n, err := stream.writer.Write(chunk)
+	stream.bytes += n
+	if err == nil && n < len(chunk) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		stream.err = fmt.Errorf("Result stream failed after %d bytes: %w", stream.bytes, err)
+		return stream.err
+	}
+	stream.chunks++
+
+	return nil
+}
+
+// failure returns the first error from the writer, if there has been one
+func (stream *resultStream) failure() error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	return stream.err
+}
+
+// close stops any more chunks being written, waiting for a write in progress
+// to finish, and returns the first error from the writer
+func (stream *resultStream) close() error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	stream.closed = true
+	return stream.err
+}
+
+// InvokeStream invokes a Wasm guest operation like InvokeWasmOperation, but
+// writes the result to w as the guest produces it, rather than buffering all
+// of it, for operations such as exports and reports with large results.
+//
+// The guest streams its result as a sequence of chunks, each of which is the
+// payload of a wapc/ResultStream/Write host call. The host writes each chunk
+// to w before the host call returns, with an empty response, so the guest can
+// reuse its buffer for the next chunk. If w fails, the host call returns the
+// error to the guest and the invocation fails with it, whether or not the
+// guest handles it. Once the operation returns, its result, if it is not
+// empty, is written to w as the final chunk. A guest which does not stream
+// therefore works unchanged, with its single-shot result written to w.
+//
+// Only the final chunk is limited by WithMaxResultBytes. Errors are returned
+// as an InvokeError, apart from a failure writing the final chunk to w.
+func (wg *WasmGuest) InvokeStream(ctx context.Context, operation string, payload []byte, w io.Writer) error {
+	stream := &resultStream{writer: w}
+	result, err := wg.InvokeWasmOperation(context.WithValue(ctx, resultStreamKey{}, stream), operation, payload)
+	if err != nil {
+		// The guest may carry on running after a timeout or cancellation, so
+		// the stream is closed to stop it writing to w after returning
+		if streamErr := stream.close(); streamErr != nil {
+			return &InvokeError{Operation: operation, Phase: PhaseInvoke, Err: streamErr}
+		}
+		return err
+	}
+	defer stream.close()
+
+	if streamErr := stream.failure(); streamErr != nil {
+		return &InvokeError{Operation: operation, Phase: PhaseInvoke, Err: streamErr}
+	}
+	if err := stream.write(context.Background(), result); err != nil {
+		return err
+	}
+	wg.logger.Debugf("[host] Streamed %d bytes in %d chunks from operation %s", stream.bytes, stream.chunks, operation)
+
+	return nil
+}
+
+// writeResultStream is the host call handler for the ResultStreamNamespace,
+// which writes a chunk to the result stream of the invocation in the context
+func writeResultStream(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+	if binding != "wapc" || operation != ResultStreamWrite {
+		return nil, fmt.Errorf("Operation not supported: %s %s %s", binding, namespace, operation)
+	}
+
+	stream, ok := ctx.Value(resultStreamKey{}).(*resultStream)
+	if !ok {
+		return nil, ErrNotStreaming
+	}
+
+	return []byte{}, stream.write(ctx, payload)
+}
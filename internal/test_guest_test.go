@@ -0,0 +1,383 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal_test
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/hyperledgendary/fabric-chaincode-wasm/internal"
+)
+
+// sampleContractWasm is the sample contract, built with the waPC guest SDK,
+// which registers its operations for __guest_call rather than exporting them
+const sampleContractWasm = "../contracts/fabric_contract.wasm"
+
+var (
+	sampleContractOnce     sync.Once
+	sampleContractRegistry = internal.NewModuleRegistry()
+)
+
+// newSampleContractGuest returns a WasmGuest for the sample contract. The
+// sample contract is slow to compile, so the compiled module is shared using a
+// registry, which keeps it for the rest of the tests with a WasmGuest which is
+// never closed.
+func newSampleContractGuest(proxy *internal.FabricProxy, opts ...internal.WasmGuestOption) (*internal.WasmGuest, error) {
+	sampleContractOnce.Do(func() {
+		internal.NewWasmGuest(sampleContractWasm, proxy, internal.WithLazyInstantiation(), internal.WithModuleRegistry(sampleContractRegistry))
+	})
+
+	return internal.NewWasmGuest(sampleContractWasm, proxy, append(opts, internal.WithModuleRegistry(sampleContractRegistry))...)
+}
+
+// testGuestWasm returns a minimal waPC guest module for exercising the
+// WasmGuest host code without a full contract. The guest dispatches on the
+// first byte of the operation name:
+//
+//	e... (echo)    responds with the request payload
+//	f... (fail)    reports a guest error
+//	u... (trap)    executes an unreachable instruction
+//	m... (memory)  loads from an address out of bounds of memory
+//	d... (divide)  divides an integer by zero
+//	c... (count)   increments a global counter and responds with its value
+//	h... (host)    forwards the payload to the host call wapc/Test/Call
+//	r... (read)    forwards the payload to wapc/LedgerService/ReadState
+//	_... (ping)    responds with an empty payload
+//	__... (shake)  responds with the handshake response, if there is one, or
+//	               otherwise reports an unknown operation
+//	o... (out)     writes the payload to stdout
+//	w... (warn)    writes the payload to stderr
+//	g... (grow)    grows memory by one page per payload byte
+//	s... (spin)    loops a million times per payload byte
+//	v... (vars)    responds with the WASI environment variables
+//	p... (path)    responds with the start of the WASI file named by the payload
+//	i... (input)   responds with the start of WASI stdin
+//	t... (time)    responds with the WASI clock whose ID is the payload byte
+//	n... (noise)   responds with one WASI random byte per payload byte
+//	l... (log)     logs the payload to the waPC console
+//	x... (xport)   streams the payload twice to wapc/ResultStream/Write, then
+//	               responds with the payload
+//	k... (keep)    streams the payload to wapc/ResultStream/Write until the
+//	               host call fails
+//
+// The operation name is written at offset 0 and the payload at offset 256.
+// The guest call function is also exported as _ping for Ping.
+func testGuestWasm() []byte {
+	return testGuestWasmWithHandshake("")
+}
+
+// testGuestWasmWithHandshake returns the test guest module, which responds to
+// __... operations with the handshake response, unless it is empty
+func testGuestWasmWithHandshake(handshake string) []byte {
+	const (
+		fnGuestRequest = iota
+		fnGuestResponse
+		fnGuestError
+		fnHostCall
+		fnHostResponseLen
+		fnHostResponse
+		fnHostErrorLen
+		fnHostError
+		fnFdWrite
+		fnEnvironSizesGet
+		fnEnvironGet
+		fnPathOpen
+		fnFdRead
+		fnClockTimeGet
+		fnRandomGet
+		fnConsoleLog
+		fnGuestCall
+	)
+
+	const (
+		payloadPtr = 256
+		counterPtr = 128
+		iovecPtr   = 192
+		resultPtr  = 224
+		dataPtr    = 1024
+		bufferPtr  = 2048
+	)
+
+	data := []byte("wapcTestCallguest failedunknown operationgrow failedLedgerServiceReadStateopen failedResultStreamWrite")
+	bindingPtr, namespacePtr, operationPtr := dataPtr, dataPtr+4, dataPtr+8
+	failedPtr, failedLen := dataPtr+12, 12
+	unknownPtr, unknownLen := dataPtr+24, 17
+	growFailedPtr, growFailedLen := dataPtr+41, 11
+	ledgerPtr, readStatePtr := dataPtr+52, dataPtr+65
+	openFailedPtr, openFailedLen := dataPtr+74, 11
+	streamPtr, streamWritePtr := dataPtr+85, dataPtr+97
+	handshakePtr := dataPtr + len(data)
+	data = append(data, handshake...)
+
+	i32, i64 := byte(0x7f), byte(0x7e)
+	types := [][]byte{
+		funcType([]byte{i32, i32}, nil),
+		funcType([]byte{i32, i32, i32, i32, i32, i32, i32, i32}, []byte{i32}),
+		funcType(nil, []byte{i32}),
+		funcType([]byte{i32}, nil),
+		funcType([]byte{i32, i32}, []byte{i32}),
+		funcType([]byte{i32, i32, i32, i32}, []byte{i32}),
+		funcType([]byte{i32, i32, i32, i32, i32, i64, i64, i32, i32}, []byte{i32}),
+		funcType([]byte{i32, i64, i32}, []byte{i32}),
+	}
+	imports := [][]byte{
+		importFunc("__guest_request", 0),
+		importFunc("__guest_response", 0),
+		importFunc("__guest_error", 0),
+		importFunc("__host_call", 1),
+		importFunc("__host_response_len", 2),
+		importFunc("__host_response", 3),
+		importFunc("__host_error_len", 2),
+		importFunc("__host_error", 3),
+		cat(name("wasi_snapshot_preview1"), name("fd_write"), []byte{0x00}, uleb(5)),
+		cat(name("wasi_snapshot_preview1"), name("environ_sizes_get"), []byte{0x00}, uleb(4)),
+		cat(name("wasi_snapshot_preview1"), name("environ_get"), []byte{0x00}, uleb(4)),
+		cat(name("wasi_snapshot_preview1"), name("path_open"), []byte{0x00}, uleb(6)),
+		cat(name("wasi_snapshot_preview1"), name("fd_read"), []byte{0x00}, uleb(5)),
+		cat(name("wasi_snapshot_preview1"), name("clock_time_get"), []byte{0x00}, uleb(7)),
+		cat(name("wasi_snapshot_preview1"), name("random_get"), []byte{0x00}, uleb(4)),
+		importFunc("__console_log", 0),
+	}
+
+	respond := func(ptr, length []byte) []byte {
+		return cat(ptr, length, call(fnGuestResponse), i32Const(1), []byte{0x0f})
+	}
+	fail := func(ptr, length int) []byte {
+		return cat(i32Const(ptr), i32Const(length), call(fnGuestError), i32Const(0), []byte{0x0f})
+	}
+	whenOp := func(first byte, body []byte) []byte {
+		return cat(i32Const(0), []byte{0x2d, 0x00, 0x00}, i32Const(int(first)), []byte{0x46, 0x04, 0x40}, body, []byte{0x0b})
+	}
+	localGet := func(i int) []byte { return []byte{0x20, byte(i)} }
+	load := func(ptr int) []byte { return cat(i32Const(ptr), []byte{0x28, 0x02, 0x00}) }
+	store := func(ptr, value int) []byte { return cat(i32Const(ptr), i32Const(value), []byte{0x36, 0x02, 0x00}) }
+	write := func(fd int) []byte {
+		return cat(
+			i32Const(iovecPtr), i32Const(payloadPtr), []byte{0x36, 0x02, 0x00},
+			i32Const(iovecPtr+4), localGet(1), []byte{0x36, 0x02, 0x00},
+			i32Const(fd), i32Const(iovecPtr), i32Const(1), i32Const(iovecPtr+8), call(fnFdWrite), []byte{0x1a},
+			respond(i32Const(payloadPtr), i32Const(0)),
+		)
+	}
+	hostCall := func(namespacePtr, namespaceLen, operationPtr, operationLen int) []byte {
+		return cat(
+			i32Const(bindingPtr), i32Const(4),
+			i32Const(namespacePtr), i32Const(namespaceLen),
+			i32Const(operationPtr), i32Const(operationLen),
+			i32Const(payloadPtr), localGet(1),
+			call(fnHostCall),
+			[]byte{0x04, 0x40},
+			call(fnHostResponseLen), []byte{0x21, 0x02},
+			i32Const(payloadPtr), call(fnHostResponse),
+			respond(i32Const(payloadPtr), localGet(2)),
+			[]byte{0x0b},
+			call(fnHostErrorLen), []byte{0x21, 0x02},
+			i32Const(payloadPtr), call(fnHostError),
+			i32Const(payloadPtr), localGet(2), call(fnGuestError), i32Const(0), []byte{0x0f},
+		)
+	}
+
+	shake := fail(unknownPtr, unknownLen)
+	if handshake != "" {
+		shake = respond(i32Const(handshakePtr), i32Const(len(handshake)))
+	}
+
+	streamWrite := cat(
+		i32Const(bindingPtr), i32Const(4),
+		i32Const(streamPtr), i32Const(12),
+		i32Const(streamWritePtr), i32Const(5),
+		i32Const(payloadPtr), localGet(1),
+		call(fnHostCall),
+		[]byte{0x45, 0x04, 0x40},
+		call(fnHostErrorLen), []byte{0x21, 0x02},
+		i32Const(bufferPtr), call(fnHostError),
+		i32Const(bufferPtr), localGet(2), call(fnGuestError), i32Const(0), []byte{0x0f},
+		[]byte{0x0b},
+	)
+
+	body := cat(
+		i32Const(0), i32Const(payloadPtr), call(fnGuestRequest),
+		whenOp('e', respond(i32Const(payloadPtr), localGet(1))),
+		whenOp('f', fail(failedPtr, failedLen)),
+		whenOp('u', []byte{0x00}),
+		whenOp('m', cat(load(-1), []byte{0x1a}, respond(i32Const(payloadPtr), i32Const(0)))),
+		whenOp('d', cat(i32Const(1), i32Const(0), []byte{0x6d, 0x1a}, respond(i32Const(payloadPtr), i32Const(0)))),
+		whenOp('c', cat(
+			i32Const(counterPtr),
+			[]byte{0x23, 0x00}, i32Const(1), []byte{0x6a, 0x24, 0x00},
+			[]byte{0x23, 0x00}, []byte{0x36, 0x02, 0x00},
+			respond(i32Const(counterPtr), i32Const(4)),
+		)),
+		whenOp('h', hostCall(namespacePtr, 4, operationPtr, 4)),
+		whenOp('r', hostCall(ledgerPtr, 13, readStatePtr, 9)),
+		whenOp('_', cat(
+			i32Const(1), []byte{0x2d, 0x00, 0x00}, i32Const('_'), []byte{0x46, 0x04, 0x40},
+			shake,
+			[]byte{0x0b},
+			respond(i32Const(payloadPtr), i32Const(0)),
+		)),
+		whenOp('o', write(1)),
+		whenOp('w', write(2)),
+		whenOp('g', cat(
+			localGet(1), []byte{0x40, 0x00}, i32Const(-1), []byte{0x46, 0x04, 0x40},
+			fail(growFailedPtr, growFailedLen),
+			[]byte{0x0b},
+			respond(i32Const(payloadPtr), i32Const(0)),
+		)),
+		whenOp('s', cat(
+			localGet(1), i32Const(1000000), []byte{0x6c, 0x21, 0x02},
+			[]byte{0x02, 0x40, 0x03, 0x40},
+			localGet(2), []byte{0x45, 0x0d, 0x01},
+			localGet(2), i32Const(1), []byte{0x6b, 0x21, 0x02},
+			[]byte{0x0c, 0x00, 0x0b, 0x0b},
+			respond(i32Const(payloadPtr), i32Const(0)),
+		)),
+		whenOp('v', cat(
+			i32Const(resultPtr), i32Const(resultPtr+4), call(fnEnvironSizesGet), []byte{0x1a},
+			i32Const(bufferPtr), i32Const(payloadPtr), call(fnEnvironGet), []byte{0x1a},
+			respond(i32Const(payloadPtr), load(resultPtr+4)),
+		)),
+		whenOp('p', cat(
+			i32Const(3), i32Const(0), i32Const(payloadPtr), localGet(1), i32Const(0),
+			i64Const(0), i64Const(0), i32Const(0), i32Const(resultPtr), call(fnPathOpen),
+			[]byte{0x04, 0x40},
+			fail(openFailedPtr, openFailedLen),
+			[]byte{0x0b},
+			store(iovecPtr, bufferPtr), store(iovecPtr+4, 4096),
+			load(resultPtr), i32Const(iovecPtr), i32Const(1), i32Const(resultPtr+4), call(fnFdRead), []byte{0x1a},
+			respond(i32Const(bufferPtr), load(resultPtr+4)),
+		)),
+		whenOp('i', cat(
+			store(iovecPtr, bufferPtr), store(iovecPtr+4, 4096),
+			i32Const(0), i32Const(iovecPtr), i32Const(1), i32Const(resultPtr+4), call(fnFdRead), []byte{0x1a},
+			respond(i32Const(bufferPtr), load(resultPtr+4)),
+		)),
+		whenOp('t', cat(
+			i32Const(payloadPtr), []byte{0x2d, 0x00, 0x00}, i64Const(0), i32Const(resultPtr), call(fnClockTimeGet), []byte{0x1a},
+			respond(i32Const(resultPtr), i32Const(8)),
+		)),
+		whenOp('n', cat(
+			i32Const(bufferPtr), localGet(1), call(fnRandomGet), []byte{0x1a},
+			respond(i32Const(bufferPtr), localGet(1)),
+		)),
+		whenOp('l', cat(
+			i32Const(payloadPtr), localGet(1), call(fnConsoleLog),
+			respond(i32Const(payloadPtr), i32Const(0)),
+		)),
+		whenOp('x', cat(
+			streamWrite, streamWrite,
+			respond(i32Const(payloadPtr), localGet(1)),
+		)),
+		whenOp('k', cat(
+			[]byte{0x03, 0x40},
+			streamWrite,
+			[]byte{0x0c, 0x00, 0x0b},
+		)),
+		fail(unknownPtr, unknownLen),
+	)
+	code := cat([]byte{0x01, 0x01, i32}, body, []byte{0x0b})
+
+	exports := [][]byte{
+		cat(name("memory"), []byte{0x02, 0x00}),
+		cat(name("__guest_call"), []byte{0x00, fnGuestCall}),
+		cat(name("_ping"), []byte{0x00, fnGuestCall}),
+	}
+
+	module := cat(
+		[]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00},
+		section(1, vec(types...)),
+		section(2, vec(imports...)),
+		section(3, vec([]byte{4})),
+		section(5, vec([]byte{0x00, 0x01})),
+		section(6, vec(cat([]byte{i32, 0x01}, i32Const(0), []byte{0x0b}))),
+		section(7, vec(exports...)),
+		section(10, vec(cat(uleb(len(code)), code))),
+		section(11, vec(cat([]byte{0x00}, i32Const(dataPtr), []byte{0x0b}, uleb(len(data)), data))),
+	)
+
+	return module
+}
+
+// writeTestGuestWasm writes the test guest module to a temporary file and
+// returns its name
+func writeTestGuestWasm() string {
+	file, err := ioutil.TempFile("", "test_guest_*.wasm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(testGuestWasm()); err != nil {
+		os.Remove(file.Name())
+		panic(err)
+	}
+
+	return file.Name()
+}
+
+func cat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func uleb(v int) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			out = append(out, b|0x80)
+		} else {
+			return append(out, b)
+		}
+	}
+}
+
+func sleb(v int) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func vec(items ...[]byte) []byte {
+	return cat(uleb(len(items)), cat(items...))
+}
+
+func name(s string) []byte {
+	return cat(uleb(len(s)), []byte(s))
+}
+
+func section(id byte, content []byte) []byte {
+	return cat([]byte{id}, uleb(len(content)), content)
+}
+
+func funcType(params, results []byte) []byte {
+	return cat([]byte{0x60}, uleb(len(params)), params, uleb(len(results)), results)
+}
+
+func importFunc(field string, typeIndex int) []byte {
+	return cat(name("wapc"), name(field), []byte{0x00}, uleb(typeIndex))
+}
+
+func i32Const(v int) []byte {
+	return cat([]byte{0x41}, sleb(v))
+}
+
+func i64Const(v int) []byte {
+	return cat([]byte{0x42}, sleb(v))
+}
+
+func call(index int) []byte {
+	return cat([]byte{0x10}, uleb(index))
+}
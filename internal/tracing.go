@@ -0,0 +1,64 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+)
+
+// SpanAttribute is a key value pair describing a span
+type SpanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Tracer is used by the WasmGuest to start a span for each invocation, and a
+// child span for each host call made by the guest. It follows the shape of the
+// OpenTelemetry tracing API so that an OpenTelemetry tracer can be adapted to
+// it, without this package depending on OpenTelemetry.
+type Tracer interface {
+	// Start starts a span, returning a context containing the span so that
+	// spans started with that context are its children
+	Start(ctx context.Context, name string, attributes ...SpanAttribute) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttributes adds attributes to the span
+	SetAttributes(attributes ...SpanAttribute)
+	// End ends the span, with the error if the traced operation failed
+	End(err error)
+}
+
+// noopTracer starts spans which do nothing
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attributes ...SpanAttribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attributes ...SpanAttribute) {}
+
+func (noopSpan) End(err error) {}
+
+type spanKey struct{}
+
+// startSpan starts a span using the tracer, and returns a context which can
+// be used to add attributes to the span with spanFromContext
+func startSpan(ctx context.Context, tracer Tracer, name string, attributes ...SpanAttribute) (context.Context, Span) {
+	ctx, span := tracer.Start(ctx, name, attributes...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFromContext returns the current span started by startSpan, or a span
+// which does nothing if there isn't one
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+
+	return noopSpan{}
+}
@@ -0,0 +1,216 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WithTransactionAffinity pins each transaction to a waPC instance for the
+// duration of the transaction, so that every operation invoked with the same
+// transaction in the context, set using WithTransaction, runs on the same
+// instance and shares the guest in-memory state, as with a Lease but without
+// the caller having to manage one. The first invocation for a transaction
+// checks out an instance from the pool, which is not available to other
+// transactions until it is released.
+//
+// The instance is released when ReleaseTransaction is called, which
+// WasmContract does once each transaction completes, or when the context of
+// the first invocation for the transaction is done, or after the TTL, which
+// guards against leaking instances for transactions which are never released.
+// It is also released if an operation on it fails, since the guest state may
+// be inconsistent, and for every transaction when the WasmGuest is drained,
+// reloaded or closed. Invocations without a transaction in the context, and
+// those using InvokeBatch or Acquire, are not pinned.
+func WithTransactionAffinity(ttl time.Duration) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if ttl <= 0 {
+			return fmt.Errorf("Invalid transaction affinity TTL %s: must be positive", ttl)
+		}
+		wg.affinity = &transactionAffinity{ttl: ttl, pins: make(map[stubKey]*pinnedInstance)}
+		return nil
+	}
+}
+
+// transactionAffinity is the waPC instances pinned to transactions in progress
+type transactionAffinity struct {
+	mutex sync.Mutex
+	ttl   time.Duration
+	pins  map[stubKey]*pinnedInstance
+}
+
+// pinnedInstance is the waPC instance leased for a transaction, which is
+// locked while an operation is invoked on it
+type pinnedInstance struct {
+	mutex    sync.Mutex
+	lease    *instanceLease
+	released bool
+	timer    *time.Timer
+	stop     chan struct{}
+}
+
+// invoke invokes an operation on the instance pinned to the transaction,
+// pinning one first if there is not one already. Errors are returned as an
+// InvokeError.
+func (affinity *transactionAffinity) invoke(ctx context.Context, wg *WasmGuest, key stubKey, operation string, payload []byte) ([]byte, error) {
+	pin, err := affinity.pin(ctx, wg, key, operation)
+	if err != nil {
+		return nil, err
+	}
+	defer pin.mutex.Unlock()
+
+	result, err := pin.lease.invoke(ctx, operation, payload)
+	if err != nil {
+		pin.lease.failed = true
+		wg.logger.Debugf("[host] Unpinning waPC instance for transaction %s after operation %s failed", key.txID, operation)
+		affinity.remove(key, pin)
+		pin.release()
+	}
+
+	return result, err
+}
+
+// pin returns the instance pinned to the transaction, locked for an
+// invocation, checking one out of the pool if there is not one already
+func (affinity *transactionAffinity) pin(ctx context.Context, wg *WasmGuest, key stubKey, operation string) (*pinnedInstance, error) {
+	for {
+		affinity.mutex.Lock()
+		pin, ok := affinity.pins[key]
+		if ok {
+			affinity.mutex.Unlock()
+
+			// The pin may have been released while waiting for another
+			// invocation on it to finish, in which case a new one is pinned
+			pin.mutex.Lock()
+			if !pin.released {
+				return pin, nil
+			}
+			pin.mutex.Unlock()
+			continue
+		}
+
+		// Other invocations for the transaction wait for the pin to be
+		// locked while the lease is acquired
+		pin = &pinnedInstance{stop: make(chan struct{})}
+		pin.mutex.Lock()
+		affinity.pins[key] = pin
+		affinity.mutex.Unlock()
+
+		lease, err := wg.acquireLease(ctx, operation)
+		if err != nil {
+			affinity.remove(key, pin)
+			pin.released = true
+			pin.mutex.Unlock()
+			return nil, err
+		}
+		pin.lease = lease
+		wg.logger.Debugf("[host] Pinned waPC instance for transaction %s", key.txID)
+
+		pin.timer = time.AfterFunc(affinity.ttl, func() {
+			wg.logger.Errorf("[host] Unpinning waPC instance for transaction %s after the TTL of %s", key.txID, affinity.ttl)
+			affinity.release(key, pin)
+		})
+		go func() {
+			select {
+			case <-ctx.Done():
+				wg.logger.Debugf("[host] Unpinning waPC instance for transaction %s: %s", key.txID, ctx.Err())
+				affinity.release(key, pin)
+			case <-pin.stop:
+			}
+		}()
+
+		return pin, nil
+	}
+}
+
+// remove removes the pin for the transaction, if it has not already been
+// replaced
+func (affinity *transactionAffinity) remove(key stubKey, pin *pinnedInstance) {
+	affinity.mutex.Lock()
+	defer affinity.mutex.Unlock()
+
+	if affinity.pins[key] == pin {
+		delete(affinity.pins, key)
+	}
+}
+
+// release removes the pin for the transaction and releases its instance,
+// waiting for an invocation in progress on it to finish first
+func (affinity *transactionAffinity) release(key stubKey, pin *pinnedInstance) {
+	affinity.remove(key, pin)
+
+	pin.mutex.Lock()
+	defer pin.mutex.Unlock()
+	pin.release()
+}
+
+// releaseAll releases every pinned instance, without waiting for invocations
+// in progress, whose instances are released when they finish
+func (affinity *transactionAffinity) releaseAll() {
+	affinity.mutex.Lock()
+	pins := affinity.pins
+	affinity.pins = make(map[stubKey]*pinnedInstance)
+	affinity.mutex.Unlock()
+
+	for key, pin := range pins {
+		go affinity.release(key, pin)
+	}
+}
+
+// release returns the instance to the pool, or discards it if an operation
+// failed, unless it has already been released. The pin must be locked.
+func (pin *pinnedInstance) release() {
+	if pin.released {
+		return
+	}
+	pin.released = true
+	pin.timer.Stop()
+	close(pin.stop)
+	pin.lease.release()
+}
+
+// ReleaseTransaction releases the waPC instance pinned to the transaction by
+// WithTransactionAffinity, if there is one, waiting for an operation in
+// progress on it to finish first. It does nothing if transaction affinity is
+// not enabled.
+func (wg *WasmGuest) ReleaseTransaction(channelID string, txID string) {
+	if wg.affinity == nil {
+		return
+	}
+
+	key := stubKey{channelID: channelID, txID: txID}
+	wg.affinity.mutex.Lock()
+	pin, ok := wg.affinity.pins[key]
+	wg.affinity.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	wg.logger.Debugf("[host] Unpinning waPC instance for transaction %s", txID)
+	wg.affinity.release(key, pin)
+}
+
+// PinnedTransactions returns the number of transactions with a waPC instance
+// pinned by WithTransactionAffinity
+func (wg *WasmGuest) PinnedTransactions() int {
+	if wg.affinity == nil {
+		return 0
+	}
+
+	wg.affinity.mutex.Lock()
+	defer wg.affinity.mutex.Unlock()
+
+	return len(wg.affinity.pins)
+}
+
+// releasePins releases every pinned instance, if transaction affinity is
+// enabled
+func (wg *WasmGuest) releasePins() {
+	if wg.affinity != nil {
+		wg.affinity.releaseAll()
+	}
+}
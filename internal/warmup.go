@@ -0,0 +1,67 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/wapc/wapc-go"
+)
+
+// Warmup invokes the operations in order on every waPC instance in the pool,
+// so that the guest code is already warm for the first transactions after
+// the WasmGuest is created. With lazy instantiation, only the instances which
+// have already been created are warmed up.
+//
+// The operations are invoked using WithSimulation, so any state writes they
+// make are discarded, and they are not counted in the metrics or operation
+// stats. There is no transaction for their host calls, so they should be
+// operations which do not need the ledger. If an operation fails, the
+// remaining operations are not invoked, and the instance is discarded if the
+// failure may have left it in a bad state.
+func (wg *WasmGuest) Warmup(ctx context.Context, operations []Operation) error {
+	for _, operation := range operations {
+		if err := wg.checkPayload(operation.Name, operation.Payload); err != nil {
+			return err
+		}
+	}
+
+	module, err := wg.acquireModule()
+	if err != nil {
+		return err
+	}
+	defer module.inFlight.Done()
+
+	count := module.pool.stats().Size
+	instances := make([]wapc.Instance, 0, count)
+	failed := make(map[wapc.Instance]bool)
+	defer func() {
+		for _, wapcInstance := range instances {
+			wg.release(module, wapcInstance, failed[wapcInstance])
+		}
+	}()
+
+	for len(instances) < count {
+		wapcInstance, err := module.pool.get(ctx, wg.acquireTimeout)
+		if err != nil {
+			return fmt.Errorf("Failed to warm up Wasm guest: %w", err)
+		}
+		instances = append(instances, wapcInstance)
+	}
+
+	warmupCtx, _ := WithSimulation(ctx)
+	wg.logger.Debugf("[host] Warming up %d waPC instances with %d operations", count, len(operations))
+	for _, wapcInstance := range instances {
+		for _, operation := range operations {
+			if _, err := wg.invoke(warmupCtx, wapcInstance, operation.Name, operation.Payload); err != nil {
+				failed[wapcInstance] = isInvocationFailure(ctx, err)
+				wg.logger.Errorf("[host] error warming up operation %s: %s", operation.Name, err)
+				return fmt.Errorf("Failed to warm up Wasm guest with operation %s: %w", operation.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
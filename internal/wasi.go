@@ -0,0 +1,238 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// wasiEnv is an environment variable set for WASI guests
+type wasiEnv struct {
+	key, value string
+}
+
+// WithWasiEnv sets an environment variable for WASI guests, such as the
+// chaincode ID. Guests have no environment variables unless they are set using
+// this option, and the host environment is never passed through.
+func WithWasiEnv(key, value string) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if key == "" || strings.ContainsAny(key, "=\x00") || strings.Contains(value, "\x00") {
+			return fmt.Errorf("Invalid WASI environment variable %q: must be a non-empty name without '=' or NUL characters", key)
+		}
+		if key == CodecEnv {
+			return fmt.Errorf("Invalid WASI environment variable %q: set using WithCodec", key)
+		}
+		for _, env := range wg.wasiEnv {
+			if env.key == key {
+				return fmt.Errorf("Invalid WASI environment variable %q: already set", key)
+			}
+		}
+		wg.wasiEnv = append(wg.wasiEnv, wasiEnv{key: key, value: value})
+		return nil
+	}
+}
+
+// WithWasiPreopen gives WASI guests read-only access to the host directory at
+// the specified absolute guest path, for example to read configuration files.
+// Guests have no filesystem access unless a directory is preopened using this
+// option, and there is no way for guests to modify preopened directories.
+//
+// Note: the contents of preopened directories must be identical on every peer
+// to keep endorsement deterministic, and, as for os.DirFS, symbolic links in
+// the directory may refer to files outside it.
+func WithWasiPreopen(guestPath, hostDir string) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if !path.IsAbs(guestPath) || path.Clean(guestPath) != guestPath {
+			return fmt.Errorf("Invalid WASI preopen %q: guest path must be a clean absolute path", guestPath)
+		}
+
+		info, err := os.Stat(hostDir)
+		if err != nil {
+			return fmt.Errorf("Invalid WASI preopen %q: %s", guestPath, err.Error())
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Invalid WASI preopen %q: %s is not a directory", guestPath, hostDir)
+		}
+
+		if err := wg.wasiFS.mount(guestPath, os.DirFS(hostDir)); err != nil {
+			return fmt.Errorf("Invalid WASI preopen %q: %s", guestPath, err.Error())
+		}
+		return nil
+	}
+}
+
+// wasiRuntime is a wazero runtime which configures the WASI environment
+// variables, preopened directories, clocks and random bytes of each module it
+// instantiates
+type wasiRuntime struct {
+	wazero.Runtime
+	env      []wasiEnv
+	fs       *mountFS
+	syscalls SyscallPolicy
+}
+
+func (r wasiRuntime) InstantiateModule(ctx context.Context, compiled wazero.CompiledModule, config wazero.ModuleConfig) (api.Module, error) {
+	for _, env := range r.env {
+		config = config.WithEnv(env.key, env.value)
+	}
+	if !r.fs.empty() {
+		config = config.WithFS(r.fs)
+	}
+	config = withSyscallPolicy(ctx, r.syscalls, config)
+
+	return r.Runtime.InstantiateModule(ctx, compiled, config)
+}
+
+// mountFS is a read-only filesystem made up of other filesystems mounted at
+// absolute paths. Directories containing mount points, such as the root, are
+// empty apart from the mount points.
+type mountFS struct {
+	mounts map[string]fs.FS
+}
+
+// mount adds a filesystem at the clean absolute path
+func (m *mountFS) mount(mountPath string, fsys fs.FS) error {
+	name := fsName(mountPath)
+	for existing := range m.mounts {
+		if existing == name || within(name, existing) || within(existing, name) {
+			return fmt.Errorf("overlaps existing preopen /%s", strings.TrimPrefix(existing, "."))
+		}
+	}
+
+	if m.mounts == nil {
+		m.mounts = make(map[string]fs.FS)
+	}
+	m.mounts[name] = fsys
+
+	return nil
+}
+
+func (m *mountFS) empty() bool {
+	return m == nil || len(m.mounts) == 0
+}
+
+// Open opens the named file in the filesystem mounted at the longest matching
+// path, or a directory containing mount points
+func (m *mountFS) Open(name string) (fs.File, error) {
+	name = fsName(name)
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	for mountName, fsys := range m.mounts {
+		if name == mountName {
+			return fsys.Open(".")
+		}
+		if within(name, mountName) {
+			rel := name
+			if mountName != "." {
+				rel = strings.TrimPrefix(name, mountName+"/")
+			}
+			return fsys.Open(rel)
+		}
+	}
+
+	var entries []fs.DirEntry
+	for mountName := range m.mounts {
+		if within(mountName, name) {
+			child := mountName
+			if name != "." {
+				child = strings.TrimPrefix(mountName, name+"/")
+			}
+			entries = append(entries, mountDirEntry(strings.SplitN(child, "/", 2)[0]))
+		}
+	}
+	if entries == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return &mountDir{name: path.Base(name), entries: dedupeEntries(entries)}, nil
+}
+
+// fsName converts an absolute or relative slash separated path to an fs.FS
+// path name
+func fsName(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// within returns whether the fs.FS path name is inside the directory dir
+func within(name, dir string) bool {
+	if dir == "." {
+		return name != "."
+	}
+	return strings.HasPrefix(name, dir+"/")
+}
+
+func dedupeEntries(entries []fs.DirEntry) []fs.DirEntry {
+	deduped := entries[:0]
+	for i, entry := range entries {
+		if i == 0 || entry.Name() != entries[i-1].Name() {
+			deduped = append(deduped, entry)
+		}
+	}
+	return deduped
+}
+
+// mountDir is a read-only directory containing mount points
+type mountDir struct {
+	name    string
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *mountDir) Stat() (fs.FileInfo, error) {
+	return mountDirEntry(d.name), nil
+}
+
+func (d *mountDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *mountDir) Close() error {
+	return nil
+}
+
+func (d *mountDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if count > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		if count < len(remaining) {
+			remaining = remaining[:count]
+		}
+	}
+	d.offset += len(remaining)
+
+	return remaining, nil
+}
+
+// mountDirEntry describes a directory in a mountFS
+type mountDirEntry string
+
+func (e mountDirEntry) Name() string               { return string(e) }
+func (e mountDirEntry) IsDir() bool                { return true }
+func (e mountDirEntry) Type() fs.FileMode          { return fs.ModeDir }
+func (e mountDirEntry) Info() (fs.FileInfo, error) { return e, nil }
+func (e mountDirEntry) Size() int64                { return 0 }
+func (e mountDirEntry) Mode() fs.FileMode          { return fs.ModeDir | 0555 }
+func (e mountDirEntry) ModTime() time.Time         { return time.Time{} }
+func (e mountDirEntry) Sys() interface{}           { return nil }
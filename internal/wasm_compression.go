@@ -0,0 +1,76 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// MaxDecompressedWasmBytes is the largest Wasm module which is decompressed,
+// so that a corrupt or malicious compressed module cannot exhaust memory
+const MaxDecompressedWasmBytes = 256 << 20
+
+var (
+	// gzipMagic is the magic number at the start of gzip compressed data
+	gzipMagic = []byte{0x1f, 0x8b}
+	// zstdMagic is the magic number at the start of a zstd frame
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ErrDecompressionFailed is returned when the bytes of a Wasm module are
+// compressed, but cannot be decompressed, as opposed to ErrInvalidWasm for
+// bytes which are not a valid Wasm binary module once decompressed
+var ErrDecompressionFailed = errors.New("Failed to decompress Wasm module")
+
+// decompressWasm returns the decompressed bytes of a gzip compressed Wasm
+// module, detected by the gzip magic number, or the bytes unchanged if they
+// are not compressed. zstd compressed modules are detected, but not
+// supported, so they fail with a clearer error than an invalid module.
+func decompressWasm(wasmBytes []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(wasmBytes, gzipMagic):
+		return gunzipWasm(wasmBytes)
+	case bytes.HasPrefix(wasmBytes, zstdMagic):
+		return nil, fmt.Errorf("%w: zstd compression is not supported, use gzip", ErrDecompressionFailed)
+	}
+
+	return wasmBytes, nil
+}
+
+func gunzipWasm(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("%w: gzip: %s", ErrDecompressionFailed, err.Error())
+	}
+	defer reader.Close()
+
+	wasmBytes, err := ioutil.ReadAll(io.LimitReader(reader, MaxDecompressedWasmBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: gzip: %s", ErrDecompressionFailed, err.Error())
+	}
+	if len(wasmBytes) > MaxDecompressedWasmBytes {
+		return nil, fmt.Errorf("%w: gzip: exceeds the maximum of %d bytes", ErrDecompressionFailed, MaxDecompressedWasmBytes)
+	}
+
+	return wasmBytes, nil
+}
+
+// loadWasmBytes decompresses the bytes of a Wasm module if they are
+// compressed, and checks that they look like a Wasm binary module
+func loadWasmBytes(wasmBytes []byte) ([]byte, error) {
+	wasmBytes, err := decompressWasm(wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateWasmBytes(wasmBytes); err != nil {
+		return nil, err
+	}
+
+	return wasmBytes, nil
+}
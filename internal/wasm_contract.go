@@ -4,7 +4,9 @@
 package internal
 
 import (
+	"context"
 	"log"
+	"time"
 
 	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
 	"github.com/hyperledger/fabric-chaincode-go/shim"
@@ -13,6 +15,14 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// InvokeOperation is the guest operation invoked for Fabric Invoke
+// transactions
+const InvokeOperation = "InvokeTransaction"
+
+// InitOperation is the guest operation invoked for the Fabric Init
+// transaction, which guests do not need to register
+const InitOperation = "InitTransaction"
+
 // WasmContract provides the Init and Invoke functions required by Fabric and
 // represents a smart contract in Wasm.
 type WasmContract struct {
@@ -20,6 +30,12 @@ type WasmContract struct {
 	wasmGuestInvoker WasmGuestInvoker
 }
 
+// transactionReleaser is implemented by invokers which pin transactions to
+// waPC instances, such as a WasmGuest using WithTransactionAffinity
+type transactionReleaser interface {
+	ReleaseTransaction(channelID string, txID string)
+}
+
 // NewWasmContract returns a new smart contract to invoke Wasm transactions
 func NewWasmContract(contextStore *ContextStore, invoker WasmGuestInvoker) *WasmContract {
 	contract := WasmContract{}
@@ -29,14 +45,24 @@ func NewWasmContract(contextStore *ContextStore, invoker WasmGuestInvoker) *Wasm
 	return &contract
 }
 
-// Init does nothing
+// Init calls the Wasm InitOperation so that the contract can run any one-time
+// setup, or does nothing if the guest reports that it has no such operation
 func (wc *WasmContract) Init(APIstub shim.ChaincodeStubInterface) pb.Response {
-	return shim.Success(nil)
+	result, err := wc.callTransaction(APIstub, InitOperation)
+	if isUnknownOperation(err) {
+		log.Printf("[host] no %s operation, skipping init\n", InitOperation)
+		return shim.Success(nil)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(result)
 }
 
 // Invoke calls a Wasm transaction
 func (wc *WasmContract) Invoke(APIstub shim.ChaincodeStubInterface) pb.Response {
-	result, err := wc.callTransaction(APIstub)
+	result, err := wc.callTransaction(APIstub, InvokeOperation)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -44,7 +70,7 @@ func (wc *WasmContract) Invoke(APIstub shim.ChaincodeStubInterface) pb.Response
 	return shim.Success(result)
 }
 
-func (wc *WasmContract) callTransaction(APIstub shim.ChaincodeStubInterface) ([]byte, error) {
+func (wc *WasmContract) callTransaction(APIstub shim.ChaincodeStubInterface, operation string) ([]byte, error) {
 	txID := APIstub.GetTxID()
 	channelID := APIstub.GetChannelID()
 
@@ -59,6 +85,9 @@ func (wc *WasmContract) callTransaction(APIstub shim.ChaincodeStubInterface) ([]
 			log.Printf("[host] error removing stub for context chid %s txid %s: %s\n", channelID, txID, err)
 		}
 	}()
+	if releaser, ok := wc.wasmGuestInvoker.(transactionReleaser); ok {
+		defer releaser.ReleaseTransaction(channelID, txID)
+	}
 
 	function, params := APIstub.GetFunctionAndParameters()
 
@@ -68,7 +97,7 @@ func (wc *WasmContract) callTransaction(APIstub shim.ChaincodeStubInterface) ([]
 		return nil, err
 	}
 
-	log.Printf("[host] calling %s with context chid %s txid %s\n", function, channelID, txID)
+	log.Printf("[host] calling %s %s with context chid %s txid %s\n", operation, function, channelID, txID)
 
 	args, err := createInvokeTransactionArgs(channelID, txID, function, params, transientMap)
 	if err != nil {
@@ -76,7 +105,9 @@ func (wc *WasmContract) callTransaction(APIstub shim.ChaincodeStubInterface) ([]
 		return nil, err
 	}
 
-	result, err := wc.wasmGuestInvoker.InvokeWasmOperation("InvokeTransaction", args)
+	ctx := WithTransaction(context.Background(), channelID, txID, APIstub)
+	ctx = WithTransactionSeed(ctx, transactionTimestamp(APIstub), []byte(txID))
+	result, err := wc.wasmGuestInvoker.InvokeWasmOperation(ctx, operation, args)
 	if err != nil {
 		log.Printf("[host] error invoking transaction: %s\n", err)
 		return nil, err
@@ -90,6 +121,17 @@ func (wc *WasmContract) callTransaction(APIstub shim.ChaincodeStubInterface) ([]
 	return responsePayload, nil
 }
 
+// transactionTimestamp returns the proposal timestamp, or the zero time if the
+// proposal does not have a timestamp
+func transactionTimestamp(APIstub shim.ChaincodeStubInterface) time.Time {
+	timestamp, err := APIstub.GetTxTimestamp()
+	if err != nil || timestamp == nil {
+		return time.Time{}
+	}
+
+	return time.Unix(timestamp.GetSeconds(), int64(timestamp.GetNanos())).UTC()
+}
+
 func createInvokeTransactionArgs(channelID string, txID string, fnname string, params []string, transientMap map[string][]byte) ([]byte, error) {
 	args := make([][]byte, len(params))
 	for i, p := range params {
@@ -107,7 +149,7 @@ func createInvokeTransactionArgs(channelID string, txID string, fnname string, p
 		TransientArgs:   transientMap,
 	}
 
-	argsBuffer, err := proto.Marshal(msg)
+	argsBuffer, err := marshalDeterministic(msg)
 	if err != nil {
 		return nil, err
 	}
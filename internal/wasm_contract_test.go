@@ -4,6 +4,11 @@
 package internal_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"google.golang.org/protobuf/proto"
@@ -15,12 +20,13 @@ import (
 
 var _ = Describe("WasmContract", func() {
 	var (
+		contextStore *internal.ContextStore
 		wasmContract *internal.WasmContract
 		wasmInvoker  *fakes.WasmGuestInvoker
 	)
 
 	BeforeEach(func() {
-		contextStore := internal.NewContextStore()
+		contextStore = internal.NewContextStore()
 		wasmInvoker = &fakes.WasmGuestInvoker{}
 
 		wasmContract = internal.NewWasmContract(contextStore, wasmInvoker)
@@ -46,6 +52,55 @@ var _ = Describe("WasmContract", func() {
 				Expect(result.Status).To(Equal(int32(200)))
 				Expect(result.Payload).To(Equal([]byte("bond")))
 			})
+
+			It("should invoke the invoke operation", func() {
+				wasmContract.Invoke(stub)
+
+				_, operation, _ := wasmInvoker.InvokeWasmOperationArgsForCall(0)
+				Expect(operation).To(Equal(internal.InvokeOperation))
+			})
+
+			It("should pass the stub for the transaction to the guest in the context", func() {
+				stub.GetChannelIDReturns("channel1")
+				stub.GetTxIDReturns("txn1")
+				stub.GetStateReturns([]byte("bond"), nil)
+				wasmContract.Invoke(stub)
+
+				ctx, _, _ := wasmInvoker.InvokeWasmOperationArgsForCall(0)
+				proxy := internal.NewFabricProxy(internal.NewContextStore())
+				payload, _ := proto.Marshal(&contract.ReadStateRequest{
+					Context:  &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"},
+					StateKey: "007",
+				})
+				_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "ReadState", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stub.GetStateCallCount()).To(Equal(1))
+			})
+
+			It("should close iterators left open by the guest when the transaction completes", func() {
+				stub.GetChannelIDReturns("channel1")
+				stub.GetTxIDReturns("txn1")
+				iterator := &fakes.StateQueryIteratorInterface{}
+				stub.GetStateByRangeReturns(iterator, nil)
+
+				proxy := internal.NewFabricProxy(contextStore)
+				wasmInvoker.InvokeWasmOperationStub = func(ctx context.Context, operation string, args []byte) ([]byte, error) {
+					payload, _ := json.Marshal(&internal.GetStateByRangeRequest{
+						Context:  &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"},
+						StartKey: "001",
+						EndKey:   "009",
+					})
+					_, err := proxy.FabricCall(ctx, "wapc", "LedgerService", "GetStateByRange", payload)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contextStore.OpenIterators("channel1", "txn1")).To(Equal(1))
+					return nil, nil
+				}
+
+				wasmContract.Invoke(stub)
+
+				Expect(iterator.CloseCallCount()).To(Equal(1))
+				Expect(contextStore.OpenIterators("channel1", "txn1")).To(Equal(0))
+			})
 		})
 
 		Context("With transient data", func() {
@@ -66,7 +121,7 @@ var _ = Describe("WasmContract", func() {
 
 				Expect(result.Status).To(Equal(int32(200)))
 
-				operation, args := wasmInvoker.InvokeWasmOperationArgsForCall(0)
+				_, operation, args := wasmInvoker.InvokeWasmOperationArgsForCall(0)
 				Expect(operation).To(Equal("InvokeTransaction"))
 				Expect(args).NotTo(BeNil())
 
@@ -77,6 +132,116 @@ var _ = Describe("WasmContract", func() {
 				Expect(transientData).To(HaveKeyWithValue("pin", []byte("0000")))
 				Expect(transientData).To(HaveKeyWithValue("ssn", []byte("0123456789")))
 			})
+
+			It("should serialize the InvokeTransactionRequest message deterministically", func() {
+				transientData := map[string][]byte{}
+				for i := 0; i < 50; i++ {
+					transientData[fmt.Sprintf("key%d", i)] = []byte{byte(i)}
+				}
+				stub.GetTransientReturns(transientData, nil)
+
+				for i := 0; i < 100; i++ {
+					Expect(wasmContract.Invoke(stub).Status).To(Equal(int32(200)))
+				}
+
+				_, _, expected := wasmInvoker.InvokeWasmOperationArgsForCall(0)
+				for i := 1; i < wasmInvoker.InvokeWasmOperationCallCount(); i++ {
+					_, _, args := wasmInvoker.InvokeWasmOperationArgsForCall(i)
+					Expect(args).To(Equal(expected))
+				}
+			})
+		})
+	})
+
+	Describe("Init", func() {
+		var stub *fakes.ChaincodeStubInterface
+
+		BeforeEach(func() {
+			stub = &fakes.ChaincodeStubInterface{}
+			stub.GetChannelIDReturns("channel1")
+			stub.GetTxIDReturns("txn1")
+			stub.GetFunctionAndParametersReturns("setup", []string{"007"})
+		})
+
+		Context("When the guest has the init operation", func() {
+			BeforeEach(func() {
+				itr := &contract.InvokeTransactionResponse{}
+				itr.Payload = []byte("ready")
+				response, _ := proto.Marshal(itr)
+
+				wasmInvoker.InvokeWasmOperationReturns(response, nil)
+			})
+
+			It("should invoke the init operation", func() {
+				result := wasmContract.Init(stub)
+				Expect(result.Status).To(Equal(int32(200)))
+				Expect(result.Payload).To(Equal([]byte("ready")))
+
+				Expect(wasmInvoker.InvokeWasmOperationCallCount()).To(Equal(1))
+				_, operation, args := wasmInvoker.InvokeWasmOperationArgsForCall(0)
+				Expect(operation).To(Equal("InitTransaction"))
+
+				itr := &contract.InvokeTransactionRequest{}
+				Expect(proto.Unmarshal(args, itr)).To(Succeed())
+				Expect(itr.GetTransactionName()).To(Equal("setup"))
+				Expect(itr.GetArgs()).To(Equal([][]byte{[]byte("007")}))
+				Expect(itr.GetContext().GetChannelId()).To(Equal("channel1"))
+				Expect(itr.GetContext().GetTransactionId()).To(Equal("txn1"))
+			})
+
+			It("should return a shim.Error if the init operation fails", func() {
+				wasmInvoker.InvokeWasmOperationReturns(nil, errors.New("setup failed"))
+
+				result := wasmContract.Init(stub)
+				Expect(result.Status).To(Equal(int32(500)))
+				Expect(result.Message).To(Equal("setup failed"))
+			})
+
+			It("should return a shim.Error if the guest cannot be invoked", func() {
+				err := &internal.InvokeError{Operation: internal.InitOperation, Phase: internal.PhaseAcquire, Err: errors.New("unknown operation")}
+				wasmInvoker.InvokeWasmOperationReturns(nil, err)
+
+				result := wasmContract.Init(stub)
+				Expect(result.Status).To(Equal(int32(500)))
+				Expect(result.Message).To(Equal("unknown operation"))
+			})
+		})
+
+		Context("When the guest does not have the init operation", func() {
+			It("should succeed if the guest reports an unknown operation", func() {
+				err := &internal.InvokeError{Operation: internal.InitOperation, Phase: internal.PhaseInvoke, Err: errors.New("Guest call failed: Unknown function being called")}
+				wasmInvoker.InvokeWasmOperationReturns(nil, err)
+
+				result := wasmContract.Init(stub)
+				Expect(result.Status).To(Equal(int32(200)))
+				Expect(result.Payload).To(BeNil())
+				Expect(wasmInvoker.InvokeWasmOperationCallCount()).To(Equal(1))
+			})
+
+			It("should succeed with a waPC guest which dispatches operations through __guest_call", func() {
+				invoked := []string{}
+				record := func(ctx context.Context, operation string, payload []byte, next internal.Invoker) ([]byte, error) {
+					invoked = append(invoked, operation)
+					return next(ctx, operation, payload)
+				}
+				wasmGuest, err := internal.NewWasmGuestFromBytes(testGuestWasm(), internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithInterceptors(record))
+				Expect(err).NotTo(HaveOccurred())
+				defer wasmGuest.Close()
+
+				result := internal.NewWasmContract(contextStore, wasmGuest).Init(stub)
+				Expect(result.Status).To(Equal(int32(200)))
+				Expect(invoked).To(Equal([]string{internal.InitOperation}))
+			})
+
+			It("should succeed with the sample contract", func() {
+				wasmGuest, err := newSampleContractGuest(internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+				Expect(err).NotTo(HaveOccurred())
+				defer wasmGuest.Close()
+
+				result := internal.NewWasmContract(contextStore, wasmGuest).Init(stub)
+				Expect(result.Status).To(Equal(int32(200)))
+				Expect(result.Payload).To(BeNil())
+			})
 		})
 	})
 })
@@ -6,12 +6,22 @@
 package internal
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"github.com/wapc/wapc-go/engines/wazero"
+	"io"
 	"io/ioutil"
-	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/wapc/wapc-go"
@@ -21,91 +31,1472 @@ import (
 //
 //counterfeiter:generate -o fakes/wapc_guest_invoker.go --fake-name WasmGuestInvoker . WasmGuestInvoker
 type WasmGuestInvoker interface {
-	InvokeWasmOperation(operation string, payload []byte) ([]byte, error)
+	InvokeWasmOperation(ctx context.Context, operation string, payload []byte) ([]byte, error)
 }
 
 // WasmGuest encapsulates external dependencies required to invoke operations
 // in Wasm guest code. Currently this uses a pool of waPC instances.
 type WasmGuest struct {
-	wapcModule *wapc.Module
-	wapcPool   *wapc.Pool
+	module     *guestModule
 	wapcEngine *wapc.Engine
 	context    context.Context
+	cancel     context.CancelFunc
+	poolSize   int
+	lazy       bool
+	minWarm    int
+
+	maxInstanceUses    int
+	idleTimeout        time.Duration
+	instantiationRetry instantiationRetry
+
+	acquireTimeout  time.Duration
+	acquireAttempts int
+	acquireBackoff  time.Duration
+	maxPayload      int
+	maxResult       int
+	maxConcurrency  int
+	concurrency     chan struct{}
+	breaker         *circuitBreaker
+	rateLimiters    map[string]*rateLimiter
+	codec           Codec
+	interceptors    []Interceptor
+	poolHooks       []PoolHook
+	invoker         Invoker
+	logger          Logger
+	metrics         Metrics
+	operationStats  operationStats
+	health          healthTracker
+	affinity        *transactionAffinity
+	tracer          Tracer
+	stdout          io.Writer
+	stderr          io.Writer
+	stdin           []byte
+	prefixOutput    bool
+
+	proxy              *FabricProxy
+	hostCallHandlers   map[string]wapc.HostCallHandler
+	hostCallDecorators []HostCallDecorator
+	hostCallHandler    wapc.HostCallHandler
+
+	memoryLimit        uint64
+	memoryLimitSet     bool
+	maxExecutionTime   time.Duration
+	compilationCache   string
+	registry           *ModuleRegistry
+	requiredOperations []string
+	minProtocolVersion int
+	configureModule    []func(config *ModuleConfig)
+	wasiEnv            []wasiEnv
+	wasiFS             *mountFS
+	syscallPolicy      SyscallPolicy
+	expectedDigest     []byte
+	signature          []byte
+	publicKey          crypto.PublicKey
+	fetchTimeout       time.Duration
+	fetchHeader        http.Header
+	fetchClient        *http.Client
+	maxFetchBytes      int64
+
+	reconfiguring sync.Mutex
+	mutex         sync.RWMutex
+	closed        bool
+	draining      bool
+}
+
+// ErrGuestClosed is returned when invoking an operation on a WasmGuest which
+// has been closed
+var ErrGuestClosed = errors.New("Wasm guest is closed")
+
+// ErrForcedClose is returned by CloseWithTimeout when invocations were still
+// in progress at the deadline, and were interrupted by closing their waPC
+// instances
+var ErrForcedClose = errors.New("Wasm guest closed before in-flight invocations finished")
+
+// ErrGuestPanicked is returned when invoking a guest operation panics
+var ErrGuestPanicked = errors.New("Wasm guest panicked")
+
+// ErrExecutionTimeout is returned when a guest operation is interrupted for
+// exceeding the maximum execution time
+var ErrExecutionTimeout = errors.New("Wasm operation exceeded maximum execution time")
+
+// ErrPayloadTooLarge is returned when the payload for a guest operation, or the
+// result it returns, exceeds the configured maximum size
+var ErrPayloadTooLarge = errors.New("Wasm payload too large")
+
+// ErrPoolUnavailable is returned by Ping when a waPC instance cannot be
+// acquired from the pool
+var ErrPoolUnavailable = errors.New("waPC instance unavailable")
+
+// ErrPingFailed is returned by Ping when the guest ping operation fails
+var ErrPingFailed = errors.New("Wasm guest ping failed")
+
+// PingOperation is the conventional no-op operation invoked by Ping, if it is
+// exported by the Wasm module
+const PingOperation = "_ping"
+
+// DefaultPoolSize is the number of waPC instances in the pool unless
+// configured using the WithPoolSize option
+const DefaultPoolSize = 10
+
+// DefaultAcquireTimeout is how long to wait for a waPC instance from the pool
+// unless configured using the WithAcquireTimeout option
+const DefaultAcquireTimeout = 250 * time.Millisecond
+
+// DefaultMaxPayloadBytes is the maximum size of the payload for a guest
+// operation unless configured using the WithMaxPayloadBytes option
+const DefaultMaxPayloadBytes = 16 << 20
+
+// DefaultMemoryLimit is the maximum linear memory, in bytes, of each waPC
+// instance unless configured using the WithMemoryLimit option
+const DefaultMemoryLimit = 256 << 20
+
+// WasmGuestOption configures a WasmGuest when it is created
+type WasmGuestOption func(wg *WasmGuest) error
+
+// WithPoolSize sets the number of waPC instances in the pool, which must be
+// at least one
+func WithPoolSize(size int) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if size < 1 {
+			return fmt.Errorf("Invalid pool size %d: must be at least 1", size)
+		}
+		wg.poolSize = size
+		return nil
+	}
 }
 
-func consoleLog(msg string) {
-	fmt.Println(msg)
+// WithLazyInstantiation creates waPC instances when they are first needed,
+// instead of filling the pool when the WasmGuest is created. Instances are
+// kept in the pool once they have been created.
+func WithLazyInstantiation() WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		wg.lazy = true
+		return nil
+	}
 }
 
-// NewWasmGuest returns a new WasmGuest capable of invoking Wasm operations
-func NewWasmGuest(wasmFile string, proxy *FabricProxy) (*WasmGuest, error) {
-	wg := &WasmGuest{}
-	ctx, _ := context.WithCancel(context.Background())
-	engine := wazero.Engine()
+// WithMinWarmInstances sets the number of waPC instances created up front when
+// using lazy instantiation, which must not be negative or exceed the pool size
+func WithMinWarmInstances(count int) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if count < 0 {
+			return fmt.Errorf("Invalid minimum warm instances %d: must not be negative", count)
+		}
+		wg.minWarm = count
+		return nil
+	}
+}
+
+// WithMaxConcurrency limits the number of operations which can be invoked at
+// the same time. Additional callers wait in turn until the context is done,
+// before waiting for a waPC instance. Zero, the default, means no limit.
+func WithMaxConcurrency(limit int) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if limit < 0 {
+			return fmt.Errorf("Invalid max concurrency %d: must not be negative", limit)
+		}
+		wg.maxConcurrency = limit
+		return nil
+	}
+}
+
+// WithMaxInstanceUses replaces waPC instances with fresh ones, resetting their
+// linear memory, after they have been used for the specified number of
+// invocations. Zero, the default, means instances are never replaced.
+func WithMaxInstanceUses(uses int) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if uses < 0 {
+			return fmt.Errorf("Invalid max instance uses %d: must not be negative", uses)
+		}
+		wg.maxInstanceUses = uses
+		return nil
+	}
+}
+
+// WithIdleTimeout closes waPC instances which have been idle in the pool for
+// longer than the timeout, to reclaim their memory, keeping at least the
+// minimum warm instances set using WithMinWarmInstances. Evicted instances are
+// created again when they are next needed. Instances which are in use are
+// never evicted. A timeout of zero does not evict idle instances.
+func WithIdleTimeout(timeout time.Duration) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if timeout < 0 {
+			return fmt.Errorf("Invalid idle timeout %s: must not be negative", timeout)
+		}
+		wg.idleTimeout = timeout
+		return nil
+	}
+}
+
+// WithLogger sets the logger used for host and guest messages, instead of
+// the standard log package
+func WithLogger(logger Logger) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if logger == nil {
+			return fmt.Errorf("Invalid logger: must not be nil")
+		}
+		wg.logger = logger
+		return nil
+	}
+}
+
+// WithMetrics sets the Metrics used to record invocations, instead of
+// discarding the measurements
+func WithMetrics(metrics Metrics) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if metrics == nil {
+			return fmt.Errorf("Invalid metrics: must not be nil")
+		}
+		wg.metrics = metrics
+		return nil
+	}
+}
+
+// WithTracer sets the Tracer used to start spans for invocations and host
+// calls, instead of not tracing them
+func WithTracer(tracer Tracer) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if tracer == nil {
+			return fmt.Errorf("Invalid tracer: must not be nil")
+		}
+		wg.tracer = tracer
+		return nil
+	}
+}
+
+// WithHostCallHandler registers a handler for guest host calls to the
+// specified namespace, in addition to the Fabric operations handled by the
+// FabricProxy. The namespaces used by FabricProxy, and the
+// ResultStreamNamespace, cannot be registered.
+func WithHostCallHandler(namespace string, handler wapc.HostCallHandler) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if namespace == "" {
+			return fmt.Errorf("Invalid host call namespace: must not be empty")
+		}
+		if fabricNamespaces[namespace] {
+			return fmt.Errorf("Invalid host call namespace %s: reserved for Fabric operations", namespace)
+		}
+		if namespace == ResultStreamNamespace {
+			return fmt.Errorf("Invalid host call namespace %s: reserved for result streams", namespace)
+		}
+		if _, ok := wg.hostCallHandlers[namespace]; ok {
+			return fmt.Errorf("Invalid host call namespace %s: already registered", namespace)
+		}
+		if handler == nil {
+			return fmt.Errorf("Invalid host call handler for namespace %s: must not be nil", namespace)
+		}
+		wg.hostCallHandlers[namespace] = handler
+		return nil
+	}
+}
+
+// WithStdout sets the writer for anything the guest writes to stdout, instead
+// of os.Stdout. Use WithGuestOutput to capture the output of an individual
+// invocation.
+func WithStdout(stdout io.Writer) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if stdout == nil {
+			return fmt.Errorf("Invalid stdout: must not be nil")
+		}
+		wg.stdout = stdout
+		return nil
+	}
+}
+
+// WithStderr sets the writer for anything the guest writes to stderr, instead
+// of os.Stderr. Use WithGuestOutput to capture the output of an individual
+// invocation.
+func WithStderr(stderr io.Writer) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if stderr == nil {
+			return fmt.Errorf("Invalid stderr: must not be nil")
+		}
+		wg.stderr = stderr
+		return nil
+	}
+}
+
+// WithOutputLinePrefix prefixes each line the guest writes to stdout or stderr
+// during an invocation with the transaction ID and operation, such as
+// "[txid=txn1] [op=InvokeTransaction] ", so that the output of invocations
+// which interleave can be grouped by transaction. Partial lines are buffered
+// until the guest writes a newline, or the invocation ends.
+func WithOutputLinePrefix() WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		wg.prefixOutput = true
+		return nil
+	}
+}
+
+// WithMemoryLimit sets the maximum linear memory, in bytes, of each waPC
+// instance. The limit is rounded down to a whole number of Wasm pages and must
+// be between one page (64 KiB) and 4 GiB. Guests which try to grow their memory
+// beyond the limit fail rather than exhausting host memory.
+func WithMemoryLimit(limit uint64) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if limit < wasmPageSize || limit > 1<<32 {
+			return fmt.Errorf("Invalid memory limit %d: must be between %d and %d bytes", limit, wasmPageSize, uint64(1<<32))
+		}
+		wg.memoryLimit = limit - limit%wasmPageSize
+		wg.memoryLimitSet = true
+		return nil
+	}
+}
+
+// WithMaxExecutionTime sets how long a guest operation may run before it is
+// interrupted and fails with ErrExecutionTimeout. The interrupted waPC instance
+// is discarded and replaced. A time of zero does not limit guest operations.
+//
+// Note: guest code which does not call back into the host cannot be stopped,
+// so it is abandoned to run to completion in the background.
+func WithMaxExecutionTime(maxTime time.Duration) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if maxTime < 0 {
+			return fmt.Errorf("Invalid maximum execution time %s: must not be negative", maxTime)
+		}
+		wg.maxExecutionTime = maxTime
+		return nil
+	}
+}
 
+// WithCompilationCache stores compiled Wasm modules in the specified
+// directory so that they do not need to be recompiled when the chaincode
+// restarts. Modules are cached in a subdirectory named after the SHA-256 digest
+// of the Wasm bytes, so changing the module does not use a stale compilation.
+//
+// Note: the same cache directory must not be used by WasmGuests for the same
+// module at the same time.
+func WithCompilationCache(dir string) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if dir == "" {
+			return fmt.Errorf("Invalid compilation cache: directory must not be empty")
+		}
+		wg.compilationCache = dir
+		return nil
+	}
+}
+
+// WithEngine uses the specified waPC engine, such as the wasmer engine, to
+// compile and run the Wasm module instead of the default wazero engine, which
+// does not need CGo. Host calls, including the Fabric host calls and handlers
+// registered using WithHostCallHandler, guest console logging, and the default
+// stdout and stderr writers are supported by every engine.
+//
+// The following features depend on the wazero runtime and are only supported
+// by the default engine:
+//
+//   - WithMemoryLimit, WithCompilationCache, WithWasiEnv, WithWasiPreopen,
+//     WithSyscallPolicy, WithModuleRegistry and WithStdin, which fail when
+//     creating the WasmGuest if used with another engine
+//   - WithGuestOutput, where guest output is written to the WasmGuest stdout
+//     and stderr writers instead
+//   - WithGuestInput, where guest stdin is empty instead
+//   - WithMaxExecutionTime and cancelling invocations part way, which stop
+//     waiting for the operation but may not interrupt the guest, depending on
+//     whether the engine honours the context
+func WithEngine(engine wapc.Engine) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if engine == nil {
+			return fmt.Errorf("Invalid engine: must not be nil")
+		}
+		wg.wapcEngine = &engine
+		return nil
+	}
+}
+
+// ModuleConfig is the waPC module configuration, and host call handler, used
+// to compile the Wasm module
+type ModuleConfig struct {
+	wapc.ModuleConfig
+
+	// HostCallHandler handles every host call made by the guest
+	HostCallHandler wapc.HostCallHandler
+}
+
+// WithModuleConfig customizes the waPC module configuration used to compile
+// the Wasm module, for waPC settings which do not have their own option. The
+// configure function is called with the configuration built from the other
+// options, for example to wrap the host call handler, and anything it sets to
+// nil reverts to the default. The guest console Logger is nil unless the
+// configure function sets it, in which case it is passed guest console
+// messages instead of the WasmGuest logger, without the fields identifying the
+// invocation. The guest stdout and stderr set here are still redirected by
+// WithGuestOutput.
+func WithModuleConfig(configure func(config *ModuleConfig)) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if configure == nil {
+			return errors.New("Invalid module configuration: must not be nil")
+		}
+		wg.configureModule = append(wg.configureModule, configure)
+		return nil
+	}
+}
+
+// moduleConfig returns the waPC module configuration from the options, with a
+// nil Logger unless one is configured
+func (wg *WasmGuest) moduleConfig() ModuleConfig {
+	config := ModuleConfig{HostCallHandler: wg.hostCall}
+	config.Stdout = wg.stdout
+	config.Stderr = wg.stderr
+
+	for _, configure := range wg.configureModule {
+		configure(&config)
+	}
+
+	if config.HostCallHandler == nil {
+		config.HostCallHandler = wg.hostCall
+	}
+	if config.Stdout == nil {
+		config.Stdout = wg.stdout
+	}
+	if config.Stderr == nil {
+		config.Stderr = wg.stderr
+	}
+
+	return config
+}
+
+// WithRequiredOperations checks that the Wasm module exports the specified
+// operations before the WasmGuest is created
+func WithRequiredOperations(operations ...string) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		wg.requiredOperations = append(wg.requiredOperations, operations...)
+		return nil
+	}
+}
+
+// WithAcquireTimeout sets how long to wait for a waPC instance to become
+// available in the pool. A timeout of zero waits until an instance is free.
+func WithAcquireTimeout(timeout time.Duration) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if timeout < 0 {
+			return fmt.Errorf("Invalid acquire timeout %s: must not be negative", timeout)
+		}
+		wg.acquireTimeout = timeout
+		return nil
+	}
+}
+
+// WithAcquireRetry retries waiting for a waPC instance, up to the specified
+// number of attempts in total, if the pool is still saturated after the
+// acquire timeout. The first retry waits for the backoff, which doubles for
+// each subsequent retry, so that bursts of invocations fail less often than
+// with one long acquire timeout. Retries stop early if the invocation context
+// is cancelled, or its deadline would pass before the next retry. Retries
+// have no effect with an acquire timeout of zero, which never times out.
+func WithAcquireRetry(maxAttempts int, backoff time.Duration) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if maxAttempts < 1 {
+			return fmt.Errorf("Invalid acquire attempts %d: must be at least 1", maxAttempts)
+		}
+		if backoff < 0 {
+			return fmt.Errorf("Invalid acquire backoff %s: must not be negative", backoff)
+		}
+		wg.acquireAttempts = maxAttempts
+		wg.acquireBackoff = backoff
+		return nil
+	}
+}
+
+// WithMaxPayloadBytes sets the maximum size of the payload for a guest
+// operation. Larger payloads are rejected with ErrPayloadTooLarge before
+// acquiring a waPC instance, rather than being copied into guest memory. A
+// limit of zero does not limit payloads.
+func WithMaxPayloadBytes(limit int) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if limit < 0 {
+			return fmt.Errorf("Invalid maximum payload size %d: must not be negative", limit)
+		}
+		wg.maxPayload = limit
+		return nil
+	}
+}
+
+// WithMaxResultBytes sets the maximum size of the result returned by a guest
+// operation, which fails with ErrPayloadTooLarge if the result is larger. A
+// limit of zero, the default, does not limit results.
+//
+// Note: the result has already been copied out of guest memory when it is
+// checked, so this stops unbounded results being passed on rather than being
+// allocated by the host.
+func WithMaxResultBytes(limit int) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if limit < 0 {
+			return fmt.Errorf("Invalid maximum result size %d: must not be negative", limit)
+		}
+		wg.maxResult = limit
+		return nil
+	}
+}
+
+// wasmMagic is the magic number at the start of every Wasm binary module
+var wasmMagic = []byte{0x00, 0x61, 0x73, 0x6d}
+
+// wasmVersion is the only supported Wasm binary format version
+const wasmVersion = 1
+
+// ErrInvalidWasm is returned when the bytes of a Wasm module are not a valid
+// Wasm binary module, before attempting to compile them
+var ErrInvalidWasm = errors.New("Invalid Wasm module")
+
+// NewWasmGuest returns a new WasmGuest capable of invoking Wasm operations
+// in the specified Wasm file
+func NewWasmGuest(wasmFile string, proxy *FabricProxy, opts ...WasmGuestOption) (*WasmGuest, error) {
 	wasmBytes, err := ioutil.ReadFile(wasmFile)
 	if err != nil {
 		return nil, err
 	}
 
-	module, err := engine.New(ctx, proxy.FabricCall, wasmBytes, &wapc.ModuleConfig{
-		Logger: wapc.PrintlnLogger,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
-	})
+	wasmBytes, err = loadWasmBytes(wasmBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load Wasm file %s: %w", wasmFile, err)
+	}
+
+	return newWasmGuest("Wasm file "+wasmFile, wasmBytes, proxy, opts...)
+}
 
+// NewWasmGuestFromReader returns a new WasmGuest capable of invoking Wasm
+// operations in the Wasm module read from the reader
+func NewWasmGuestFromReader(reader io.Reader, proxy *FabricProxy, opts ...WasmGuestOption) (*WasmGuest, error) {
+	wasmBytes, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
 
-	wg.wapcModule = &module
+	return NewWasmGuestFromBytes(wasmBytes, proxy, opts...)
+}
 
-	pool, err := wapc.NewPool(context.Background(), module, 10)
+// NewWasmGuestFromBytes returns a new WasmGuest capable of invoking Wasm
+// operations in the Wasm module bytes. Like the other loaders, it accepts gzip
+// compressed modules, which are decompressed before they are compiled, and
+// fails with ErrDecompressionFailed if they cannot be decompressed.
+func NewWasmGuestFromBytes(wasmBytes []byte, proxy *FabricProxy, opts ...WasmGuestOption) (*WasmGuest, error) {
+	wasmBytes, err := loadWasmBytes(wasmBytes)
 	if err != nil {
 		return nil, err
 	}
-	wg.wapcPool = pool
-	wg.wapcEngine = &engine
+
+	return newWasmGuest("Wasm module", wasmBytes, proxy, opts...)
+}
+
+// newWasmGuest returns a new WasmGuest for the validated Wasm module bytes,
+// using the description of where they came from in compilation errors
+func newWasmGuest(description string, wasmBytes []byte, proxy *FabricProxy, opts ...WasmGuestOption) (*WasmGuest, error) {
+	wg, err := configureWasmGuest(proxy, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return wg.load(description, wasmBytes)
+}
+
+// configureWasmGuest returns a WasmGuest configured using the options, which
+// is ready to load a Wasm module
+func configureWasmGuest(proxy *FabricProxy, opts ...WasmGuestOption) (*WasmGuest, error) {
+	wg := &WasmGuest{
+		poolSize:        DefaultPoolSize,
+		acquireTimeout:  DefaultAcquireTimeout,
+		acquireAttempts: 1,
+		maxPayload:      DefaultMaxPayloadBytes,
+		logger:          stdLogger{},
+		metrics:         noopMetrics{},
+		tracer:          noopTracer{},
+		stdout:          os.Stdout,
+		stderr:          os.Stderr,
+		memoryLimit:     DefaultMemoryLimit,
+		wasiFS:          &mountFS{},
+		fetchTimeout:    DefaultFetchTimeout,
+		maxFetchBytes:   DefaultMaxFetchBytes,
+
+		instantiationRetry: instantiationRetry{attempts: DefaultInstantiationAttempts, backoff: DefaultInstantiationBackoff},
+
+		proxy:            proxy,
+		hostCallHandlers: make(map[string]wapc.HostCallHandler),
+	}
+	for _, opt := range opts {
+		if err := opt(wg); err != nil {
+			return nil, err
+		}
+	}
+
+	if wg.minWarm > wg.poolSize {
+		return nil, fmt.Errorf("Invalid minimum warm instances %d: must not exceed pool size %d", wg.minWarm, wg.poolSize)
+	}
+
+	if wg.maxConcurrency > 0 {
+		wg.concurrency = make(chan struct{}, wg.maxConcurrency)
+	}
+
+	wg.invoker = chainInterceptors(wg.interceptors, wg.invokeOperation)
+	wg.hostCallHandler = decorateHostCall(wg.hostCallDecorators, wg.dispatchHostCall)
+
+	if wg.wapcEngine != nil {
+		if err := wg.requireDefaultEngineFeatures(); err != nil {
+			return nil, err
+		}
+	} else {
+		engine := wg.newEngine()
+		wg.wapcEngine = &engine
+	}
+
+	return wg, nil
+}
+
+// load compiles the validated Wasm module bytes for the configured WasmGuest,
+// using the description of where they came from in compilation errors
+func (wg *WasmGuest) load(description string, wasmBytes []byte) (*WasmGuest, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	wg.context = ctx
+	wg.cancel = cancel
+
+	module, err := wg.newGuestModule(description, wasmBytes, wg.poolSize)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	wg.module = module
+
+	if wg.idleTimeout > 0 {
+		go wg.evictIdleInstances()
+	}
 
 	return wg, nil
 }
 
-// InvokeWasmOperation invoke a Wasm guest operation
-func (wg *WasmGuest) InvokeWasmOperation(operation string, payload []byte) (result []byte, err error) {
-	log.Printf("[host] Getting waPC Instance\n")
-	wapcInstance, err := wg.wapcPool.Get(10 * time.Millisecond)
+// requireDefaultEngineFeatures returns an error if the WasmGuest is configured
+// to use features which are only supported by the default wazero engine
+func (wg *WasmGuest) requireDefaultEngineFeatures() error {
+	name := (*wg.wapcEngine).Name()
+	if wg.memoryLimitSet {
+		return fmt.Errorf("Invalid memory limit %d: not supported by the %s engine", wg.memoryLimit, name)
+	}
+	if wg.compilationCache != "" {
+		return fmt.Errorf("Invalid compilation cache %s: not supported by the %s engine", wg.compilationCache, name)
+	}
+	if len(wg.wasiEnv) > 0 {
+		return fmt.Errorf("Invalid WASI environment variables: not supported by the %s engine", name)
+	}
+	if !wg.wasiFS.empty() {
+		return fmt.Errorf("Invalid WASI preopens: not supported by the %s engine", name)
+	}
+	if wg.syscallPolicy != SyscallsFake {
+		return fmt.Errorf("Invalid syscall policy %s: not supported by the %s engine", wg.syscallPolicy, name)
+	}
+	if wg.registry != nil {
+		return fmt.Errorf("Invalid module registry: not supported by the %s engine", name)
+	}
+	if wg.stdin != nil {
+		return fmt.Errorf("Invalid stdin: not supported by the %s engine", name)
+	}
+
+	return nil
+}
+
+// validateWasmBytes checks that the bytes look like a Wasm binary module,
+// returning an error wrapping ErrInvalidWasm if they do not
+func validateWasmBytes(wasmBytes []byte) error {
+	if len(wasmBytes) == 0 {
+		return fmt.Errorf("%w: no bytes", ErrInvalidWasm)
+	}
+	if !bytes.HasPrefix(wasmBytes, wasmMagic) {
+		return fmt.Errorf("%w: missing \\0asm magic header", ErrInvalidWasm)
+	}
+	if len(wasmBytes) < wasmHeaderSize {
+		return fmt.Errorf("%w: header is truncated after %d bytes", ErrInvalidWasm, len(wasmBytes))
+	}
+	if version := binary.LittleEndian.Uint32(wasmBytes[len(wasmMagic):wasmHeaderSize]); version != wasmVersion {
+		return fmt.Errorf("%w: unsupported binary format version %d, must be %d", ErrInvalidWasm, version, wasmVersion)
+	}
+
+	return nil
+}
+
+// newGuestModule compiles the Wasm module and creates a pool of up to size
+// waPC instances of it. The description of the module is used in compilation
+// errors.
+func (wg *WasmGuest) newGuestModule(description string, wasmBytes []byte, size int) (*guestModule, error) {
+	digest := sha256.Sum256(wasmBytes)
+	if err := wg.verifyIntegrity(wasmBytes, digest); err != nil {
+		wg.logger.Errorf("[host] error verifying %s: %s", description, err)
+		return nil, err
+	}
+
+	exportedFunctions, err := readWasmExportedFunctions(wasmBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidWasm, err.Error())
+	}
+	customSections, err := readWasmCustomSections(wasmBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidWasm, err.Error())
+	}
+	gm := &guestModule{exportedFunctions: make(map[string]bool), customSections: customSections}
+	for _, name := range exportedFunctions {
+		gm.exportedFunctions[name] = true
+	}
+
+	if err := gm.requireOperations(wg.requiredOperations...); err != nil {
+		return nil, err
+	}
+
+	gm.digest = hex.EncodeToString(digest[:])
+
+	engineCtx, err := wg.compilationCacheContext(wg.context, gm.digest)
 	if err != nil {
-		log.Printf("[host] error getting waPC instance: %s\n", err)
 		return nil, err
 	}
-	defer func() {
-		log.Printf("[host] Returning waPC Instance\n")
-		err = wg.wapcPool.Return(wapcInstance)
 
+	config := wg.moduleConfig()
+	shared := wg.registry != nil && config.Logger == nil
+	if config.Logger == nil {
+		// Engines other than the default only pass the message to the logger,
+		// so there is no invocation to attribute it to
+		config.Logger = func(msg string) { wg.guestConsoleLog(context.Background(), gm.digest, msg) }
+		engineCtx = withConsoleLog(engineCtx, gm.digest)
+	}
+
+	engine := *wg.wapcEngine
+	var module wapc.Module
+	if shared {
+		key := wg.registryKey(gm.digest)
+		module, err = wg.registry.acquire(key, func() (wapc.Module, error) {
+			return engine.New(engineCtx, sharedHostCall, wasmBytes, &config.ModuleConfig)
+		})
+		if err == nil {
+			module = &sharedModule{Module: module, registry: wg.registry, key: key, wg: wg, hostCall: config.HostCallHandler}
+		}
+	} else {
+		module, err = engine.New(engineCtx, config.HostCallHandler, wasmBytes, &config.ModuleConfig)
+	}
+	if err != nil {
+		return nil, &compileError{description: description, size: len(wasmBytes), err: err}
+	}
+	gm.module = &outputModule{Module: module, stdout: config.Stdout, stderr: config.Stderr, stdin: wg.stdin, prefixLines: wg.prefixOutput}
+
+	warm := size
+	if wg.lazy {
+		warm = wg.minWarm
+	}
+
+	retry := wg.instantiationRetry
+	retry.logger = wg.logger
+	pool, err := newInstancePool(wg.context, gm.module, size, warm, wg.maxInstanceUses, retry, wg.poolHooks)
+	if err != nil {
+		gm.module.Close(wg.context)
+		return nil, err
+	}
+	gm.pool = pool
+
+	return gm, nil
+}
+
+// hostCall traces guest host calls, and passes them to the host call handler
+// with its decorators, adding the code of a HostCallError to the error
+// returned to the guest
+func (wg *WasmGuest) hostCall(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+	ctx, span := startSpan(ctx, wg.tracer, "HostCall",
+		SpanAttribute{Key: "host.binding", Value: binding},
+		SpanAttribute{Key: "host.namespace", Value: namespace},
+		SpanAttribute{Key: "host.operation", Value: operation},
+		SpanAttribute{Key: "host.payload_size", Value: len(payload)},
+	)
+	var err error
+	defer func() { span.End(err) }()
+
+	result, err := wg.hostCallHandler(ctx, binding, namespace, operation, payload)
+	return result, encodeHostCallError(err)
+}
+
+// dispatchHostCall is the handler for the innermost host call decorator, which
+// writes to the result stream, or calls the handler registered for the
+// namespace, or the FabricProxy
+func (wg *WasmGuest) dispatchHostCall(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+	if namespace == ResultStreamNamespace {
+		return writeResultStream(ctx, binding, namespace, operation, payload)
+	}
+	if handler, ok := wg.hostCallHandlers[namespace]; ok {
+		return handler(ctx, binding, namespace, operation, payload)
+	}
+
+	return wg.proxy.FabricCall(ctx, binding, namespace, operation, payload)
+}
+
+// RequireOperations returns an error listing any of the specified operations
+// which are not exported by the Wasm module
+func (wg *WasmGuest) RequireOperations(operations ...string) error {
+	return wg.currentModule().requireOperations(operations...)
+}
+
+// HasOperation returns whether the Wasm module exports the specified operation
+// as a function. Operations which a waPC guest registers for __guest_call to
+// dispatch by name are not exported, so they are not reported.
+func (wg *WasmGuest) HasOperation(operation string) bool {
+	return wg.currentModule().exportedFunctions[operation]
+}
+
+// Operations returns the sorted names of the operations exported by the Wasm
+// module, which are the exported functions apart from the waPC protocol
+// functions such as __guest_call. Operations which a waPC guest registers for
+// __guest_call to dispatch by name are not visible in the Wasm module, so they
+// are only included if the guest also exports them as functions.
+func (wg *WasmGuest) Operations() []string {
+	return wg.currentModule().operations()
+}
+
+// currentModule returns the Wasm module used for new invocations
+func (wg *WasmGuest) currentModule() *guestModule {
+	wg.mutex.RLock()
+	defer wg.mutex.RUnlock()
+
+	return wg.module
+}
+
+// acquireModule returns the Wasm module to use for an invocation, which must
+// be released by calling done on its in-flight wait group
+func (wg *WasmGuest) acquireModule() (*guestModule, error) {
+	wg.mutex.RLock()
+	defer wg.mutex.RUnlock()
+
+	if wg.closed {
+		return nil, ErrGuestClosed
+	}
+	if wg.draining {
+		return nil, ErrGuestDraining
+	}
+	wg.module.inFlight.Add(1)
+
+	return wg.module, nil
+}
+
+// InvokeWasmOperation invoke a Wasm guest operation. The context can be used
+// to cancel waiting for a waPC instance and is passed on to the guest, and to
+// the host calls made by the guest. Errors are returned as an InvokeError.
+func (wg *WasmGuest) InvokeWasmOperation(ctx context.Context, operation string, payload []byte) (result []byte, err error) {
+	ctx, span := startSpan(ctx, wg.tracer, "InvokeWasmOperation",
+		SpanAttribute{Key: "wasm.operation", Value: operation},
+		SpanAttribute{Key: "wasm.payload_size", Value: len(payload)},
+	)
+	defer func() { endInvokeSpan(span, err) }()
+
+	return wg.invoker(ctx, operation, payload)
+}
+
+// invokeOperation is the Invoker for the innermost interceptor, which invokes
+// the operation on an instance from the pool
+func (wg *WasmGuest) invokeOperation(ctx context.Context, operation string, payload []byte) ([]byte, error) {
+	if err := wg.checkPayload(operation, payload); err != nil {
+		return nil, err
+	}
+	if err := wg.checkRateLimit(operation); err != nil {
+		return nil, err
+	}
+	if tx, ok := transactionFromContext(ctx); ok && wg.affinity != nil {
+		return wg.affinity.invoke(ctx, wg, tx.key, operation, payload)
+	}
+
+	lease, err := wg.acquireLease(ctx, operation)
+	if err != nil {
+		return nil, err
+	}
+	defer lease.release()
+
+	return lease.invoke(ctx, operation, payload)
+}
+
+// Operation is a Wasm guest operation and its payload, for invoking in a batch
+type Operation struct {
+	Name    string
+	Payload []byte
+}
+
+// InvokeBatch invokes the operations in order on a single waPC instance, so
+// that they share the guest in-memory state and only wait for the pool once.
+// If an operation fails, the remaining operations are not invoked and the
+// results of the operations which succeeded are returned with the error. The
+// instance is then discarded rather than returned to the pool, since the guest
+// state may be inconsistent. Errors are returned as an InvokeError for the
+// operation which failed.
+//
+// Each operation in the batch counts towards its rate limit, set using
+// WithOperationRateLimits, and the whole batch is rejected with ErrRateLimited
+// before waiting for a waPC instance if any operation is over its limit.
+func (wg *WasmGuest) InvokeBatch(ctx context.Context, operations []Operation) (results [][]byte, err error) {
+	ctx, span := startSpan(ctx, wg.tracer, "InvokeBatch",
+		SpanAttribute{Key: "wasm.batch_size", Value: len(operations)},
+	)
+	defer func() { endInvokeSpan(span, err) }()
+
+	results = make([][]byte, 0, len(operations))
+	if len(operations) == 0 {
+		return results, nil
+	}
+
+	for _, operation := range operations {
+		if err := wg.checkPayload(operation.Name, operation.Payload); err != nil {
+			return results, err
+		}
+	}
+	for i, operation := range operations {
+		if err := wg.checkRateLimit(operation.Name); err != nil {
+			var invokeErr *InvokeError
+			if errors.As(err, &invokeErr) {
+				err = &InvokeError{Operation: invokeErr.Operation, Phase: invokeErr.Phase, Err: fmt.Errorf("Batch operation %d of %d rejected: %w", i+1, len(operations), invokeErr.Err)}
+			}
+			return results, err
+		}
+	}
+
+	lease, err := wg.acquireLease(ctx, operations[0].Name)
+	if err != nil {
+		return results, err
+	}
+	defer lease.release()
+
+	for i, operation := range operations {
+		result, err := lease.invoke(ctx, operation.Name, operation.Payload)
 		if err != nil {
-			log.Printf("[host] error returning waPC instance: %s\n", err)
+			lease.failed = true
+			if invokeErr, ok := err.(*InvokeError); ok {
+				invokeErr.Err = fmt.Errorf("Batch operation %d of %d failed: %w", i+1, len(operations), invokeErr.Err)
+			}
+			return results, err
 		}
-	}()
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// endInvokeSpan records the outcome of an invocation and ends its span
+func endInvokeSpan(span Span, err error) {
+	outcome := "success"
+	var invokeErr *InvokeError
+	if errors.As(err, &invokeErr) {
+		outcome = string(invokeErr.Phase) + " failed"
+	}
+	span.SetAttributes(SpanAttribute{Key: "wasm.outcome", Value: outcome})
+	span.End(err)
+}
+
+// checkPayload returns an InvokeError if the payload for an operation is
+// larger than the maximum payload size
+func (wg *WasmGuest) checkPayload(operation string, payload []byte) error {
+	if wg.maxPayload > 0 && len(payload) > wg.maxPayload {
+		err := fmt.Errorf("Payload for operation %s is %d bytes, exceeding the maximum of %d bytes: %w", operation, len(payload), wg.maxPayload, ErrPayloadTooLarge)
+		wg.logger.Errorf("[host] error checking request: %s", err)
+		return &InvokeError{Operation: operation, Phase: PhaseRequest, Err: err}
+	}
+
+	return nil
+}
+
+// recordOutcome updates the circuit breaker with the outcome of an invocation
+func (wg *WasmGuest) recordOutcome(outcome invocationOutcome) {
+	if state, changed := wg.breaker.done(outcome); changed {
+		wg.logger.Infof("[host] Circuit breaker %s", state)
+	}
+}
+
+// CircuitState returns the state of the circuit breaker, which is always
+// closed unless the WithCircuitBreaker option is used
+func (wg *WasmGuest) CircuitState() CircuitState {
+	if wg.breaker == nil {
+		return CircuitClosed
+	}
+	return wg.breaker.currentState()
+}
+
+// retireTimeout is how long closing an instance of a pool which is going away
+// can take, so that shutdown is not held up
+const retireTimeout = time.Second
+
+// release returns an instance to the module's pool, or discards it if the
+// invocation failed in a way which may have left it in a bad state. While the
+// WasmGuest is shutting down, instances are closed instead, since their pool
+// is going away.
+func (wg *WasmGuest) release(module *guestModule, wapcInstance wapc.Instance, failed bool) {
+	if wg.isRetiring(module) {
+		wg.logger.Debugf("[host] Closing waPC Instance of a pool which is shutting down")
+		if err := module.pool.retire(wapcInstance, retireTimeout); err != nil {
+			wg.logger.Debugf("[host] error closing waPC instance during shutdown: %s", err)
+		}
+		return
+	}
+
+	if failed {
+		wg.logger.Debugf("[host] Discarding waPC Instance")
+		if err := module.pool.discard(wg.context, wapcInstance); err != nil {
+			wg.logger.Errorf("[host] error discarding waPC instance: %s", err)
+		}
+		return
+	}
+
+	wg.logger.Debugf("[host] Returning waPC Instance")
+	if err := module.pool.put(wapcInstance); err != nil {
+		wg.logger.Errorf("[host] error returning waPC instance: %s", err)
+	}
+}
+
+// Ping checks that the guest is responsive by acquiring a waPC instance and,
+// if the Wasm module exports it, invoking the PingOperation. An error wrapping
+// ErrPoolUnavailable means an instance could not be acquired, whereas an error
+// wrapping ErrPingFailed means the guest ping operation failed.
+func (wg *WasmGuest) Ping(ctx context.Context) error {
+	module, err := wg.acquireModule()
+	if err != nil {
+		return err
+	}
+	defer module.inFlight.Done()
+
+	wapcInstance, err := module.pool.get(ctx, wg.acquireTimeout)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrPoolUnavailable, err.Error())
+	}
+	failed := false
+	defer func() { wg.release(module, wapcInstance, failed) }()
 
-	ctx := context.TODO()
+	if !module.exportedFunctions[PingOperation] {
+		return nil
+	}
+
+	if _, err := wg.invoke(ctx, wapcInstance, PingOperation, nil); err != nil {
+		failed = isInvocationFailure(ctx, err)
+		return fmt.Errorf("%w: %s", ErrPingFailed, err.Error())
+	}
+
+	return nil
+}
+
+// acquireConcurrency waits for one of the limited number of concurrent
+// invocations to become available
+func (wg *WasmGuest) acquireConcurrency(ctx context.Context) error {
+	select {
+	case wg.concurrency <- struct{}{}:
+		return nil
+	default:
+	}
+
+	select {
+	case wg.concurrency <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-wg.context.Done():
+		return ErrGuestClosed
+	}
+}
+
+// invokeInstance calls the operation on the waPC instance, recovering from
+// any panic so that misbehaving guest code cannot crash the chaincode
+func invokeInstance(ctx context.Context, wapcInstance wapc.Instance, operation string, payload []byte) (result []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w in operation %s: %v [%s]", ErrGuestPanicked, operation, r, stackSummary(5))
+		}
+	}()
 
-	log.Printf("[host] Invoking operation %s\n", operation)
 	result, err = wapcInstance.Invoke(ctx, operation, payload)
 	if err != nil {
-		log.Printf("[host] error invoking transaction: %s\n", err)
-		return nil, err
+		return nil, classifyRuntimeError(classifyTrap(operation, err))
+	}
+	if result != nil {
+		// The wazero engine returns a view of guest memory, which would be
+		// overwritten by the next invocation of the instance
+		result = append([]byte{}, result...)
 	}
 
-	return result, nil
+	return result, err
 }
 
-// Close closes the WasmGuest, rendering it unusable for invoking further operations
-func (wg *WasmGuest) Close() {
-	log.Printf("[host] Closing waPC Pool")
-	wg.wapcPool.Close(wg.context)
+// stackSummary returns up to maxFrames frames of the current goroutine's
+// stack, excluding the Go runtime, on a single line
+func stackSummary(maxFrames int) string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+
+	summary := []string{}
+	for len(summary) < maxFrames {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			summary = append(summary, fmt.Sprintf("%s (%s:%d)", frame.Function, filepath.Base(frame.File), frame.Line))
+		}
+		if !more {
+			break
+		}
+	}
+
+	return strings.Join(summary, " <- ")
+}
+
+// isInvocationFailure returns true if an error from invoking an operation
+// means the waPC instance may have been left in an inconsistent state, for
+// example after a trap, an error from the runtime, or an interruption. An
+// error reported by the guest itself is not a failure of the instance,
+// however it is wrapped.
+func isInvocationFailure(ctx context.Context, err error) bool {
+	var trap *GuestTrap
+	var runtimeErr *runtimeError
+	if errors.As(err, &trap) || errors.As(err, &runtimeErr) {
+		return true
+	}
+	if errors.Is(err, ErrExecutionTimeout) || errors.Is(err, ErrGuestPanicked) || errors.Is(err, ErrGuestClosed) {
+		return true
+	}
+
+	return ctx.Err() != nil && errors.Is(err, ctx.Err())
+}
+
+// invoke calls the operation on the waPC instance, returning early if the
+// context is done, the maximum execution time is exceeded, or the WasmGuest is
+// closed
+func (wg *WasmGuest) invoke(ctx context.Context, wapcInstance wapc.Instance, operation string, payload []byte) ([]byte, error) {
+	invokeCtx := withInvocation(ctx, operation)
+	if wg.maxExecutionTime > 0 {
+		var cancel context.CancelFunc
+		invokeCtx, cancel = context.WithTimeout(invokeCtx, wg.maxExecutionTime)
+		defer cancel()
+	}
+
+	done := make(chan InvokeResult, 1)
+	go func() {
+		result, err := invokeInstance(invokeCtx, wapcInstance, operation, payload)
+		done <- InvokeResult{Result: result, Err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.Result, r.Err
+	case <-invokeCtx.Done():
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("Operation %s interrupted: %w", operation, ctx.Err())
+		}
+		return nil, fmt.Errorf("Operation %s interrupted after %s: %w", operation, wg.maxExecutionTime, ErrExecutionTimeout)
+	case <-wg.context.Done():
+		return nil, fmt.Errorf("Operation %s interrupted: %w", operation, ErrGuestClosed)
+	}
+}
+
+// evictIdleInstances periodically closes instances which have been idle for
+// longer than the idle timeout, until the WasmGuest is closed
+func (wg *WasmGuest) evictIdleInstances() {
+	interval := wg.idleTimeout / 2
+	if interval == 0 {
+		interval = wg.idleTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wg.context.Done():
+			return
+		case <-ticker.C:
+			wg.evictIdle()
+		}
+	}
+}
+
+// evictIdle closes instances of the current module which have been idle for
+// longer than the idle timeout
+func (wg *WasmGuest) evictIdle() {
+	module, err := wg.acquireModule()
+	if err != nil {
+		return
+	}
+	defer module.inFlight.Done()
+
+	evicted, err := module.pool.evictIdle(wg.idleTimeout, wg.minWarm)
+	if err != nil {
+		wg.logger.Errorf("[host] error evicting idle waPC instances: %s", err)
+	}
+	if evicted > 0 {
+		wg.logger.Debugf("[host] Evicted %d idle waPC instances", evicted)
+	}
+}
+
+// PoolSize returns the number of waPC instances in the pool
+func (wg *WasmGuest) PoolSize() int {
+	return wg.currentModule().pool.capacity()
+}
+
+// Resize changes the number of waPC instances in the pool without recompiling
+// the Wasm module. Growing the pool creates the new instances, unless using
+// lazy instantiation. Shrinking the pool closes idle instances immediately,
+// and instances which are in use when they are returned.
+func (wg *WasmGuest) Resize(size int) error {
+	wg.reconfiguring.Lock()
+	defer wg.reconfiguring.Unlock()
+
+	wg.mutex.RLock()
+	closed, module := wg.closed, wg.module
+	wg.mutex.RUnlock()
+
+	if closed {
+		return ErrGuestClosed
+	}
+	if size < 1 {
+		return fmt.Errorf("Invalid pool size %d: must be at least 1", size)
+	}
+	if size < wg.minWarm {
+		return fmt.Errorf("Invalid pool size %d: must not be less than minimum warm instances %d", size, wg.minWarm)
+	}
+
+	warm := size
+	if wg.lazy {
+		warm = wg.minWarm
+	}
+
+	wg.logger.Debugf("[host] Resizing waPC Pool to %d instances", size)
+	return module.pool.resize(size, warm)
+}
+
+// Reset replaces every waPC instance in the pool with a new instance of the
+// compiled Wasm module, clearing any in-memory guest state without recompiling
+// it, for example between test cases. Idle instances are replaced immediately,
+// and instances which are in use are replaced when their invocations finish,
+// so invocations after Reset returns only use new instances.
+func (wg *WasmGuest) Reset() error {
+	wg.reconfiguring.Lock()
+	defer wg.reconfiguring.Unlock()
+
+	wg.mutex.RLock()
+	closed, module := wg.closed, wg.module
+	wg.mutex.RUnlock()
+
+	if closed {
+		return ErrGuestClosed
+	}
+
+	wg.logger.Debugf("[host] Resetting waPC Pool")
+	return module.pool.reset()
+}
+
+// Reload replaces the Wasm module without interrupting invocations which are
+// already in progress. The new module is compiled, and its pool created,
+// before new invocations are switched to it, so the current module remains in
+// use if there is a problem with the new one. Reload then waits for any
+// invocations still using the old module to finish before closing it. The
+// bytes may be gzip compressed.
+func (wg *WasmGuest) Reload(wasmBytes []byte) error {
+	wasmBytes, err := loadWasmBytes(wasmBytes)
+	if err != nil {
+		return err
+	}
+
+	wg.reconfiguring.Lock()
+	defer wg.reconfiguring.Unlock()
+
+	if wg.isClosed() {
+		return ErrGuestClosed
+	}
+
+	wg.logger.Infof("[host] Reloading Wasm module")
+	module, err := wg.newGuestModule("Wasm module", wasmBytes, wg.PoolSize())
+	if err != nil {
+		wg.logger.Errorf("[host] error reloading Wasm module: %s", err)
+		return fmt.Errorf("Failed to reload Wasm module: %w", err)
+	}
+
+	wg.mutex.Lock()
+	if wg.closed {
+		wg.mutex.Unlock()
+		wg.closeModule(module)
+		return ErrGuestClosed
+	}
+	old := wg.module
+	wg.module = module
+	wg.mutex.Unlock()
+	wg.releasePins()
+
+	wg.logger.Infof("[host] Reloaded Wasm module %s, waiting for invocations of module %s to finish", module.digest, old.digest)
+	old.inFlight.Wait()
+
+	return wg.closeModule(old)
+}
+
+// WasmDigest returns the hex encoded SHA-256 digest of the Wasm module
+func (wg *WasmGuest) WasmDigest() string {
+	return wg.currentModule().digest
+}
+
+// MemoryLimit returns the maximum linear memory, in bytes, of each waPC
+// instance
+func (wg *WasmGuest) MemoryLimit() uint64 {
+	return wg.memoryLimit
+}
+
+// EngineName returns the name of the waPC engine running the Wasm module
+func (wg *WasmGuest) EngineName() string {
+	return (*wg.wapcEngine).Name()
+}
+
+// MaxPayloadBytes returns the maximum size of the payload for a guest
+// operation, or zero if there is no limit
+func (wg *WasmGuest) MaxPayloadBytes() int {
+	return wg.maxPayload
+}
+
+// MaxResultBytes returns the maximum size of the result returned by a guest
+// operation, or zero if there is no limit
+func (wg *WasmGuest) MaxResultBytes() int {
+	return wg.maxResult
+}
+
+// MaxConcurrency returns the maximum number of concurrent invocations, or
+// zero if there is no limit
+func (wg *WasmGuest) MaxConcurrency() int {
+	return wg.maxConcurrency
+}
+
+// Stats returns the current state of the waPC instance pool
+func (wg *WasmGuest) Stats() PoolStats {
+	return wg.currentModule().pool.stats()
+}
+
+// InstanceMemory returns the linear memory of each waPC instance in the pool,
+// as of when it was created or last returned to the pool, for example to
+// decide whether the WithMaxInstanceUses option or a higher memory limit is
+// needed. Measuring the memory does not wait for invocations in progress.
+func (wg *WasmGuest) InstanceMemory() []InstanceMemory {
+	return wg.currentModule().pool.instanceMemory()
+}
+
+// OperationStats returns the latency stats of each operation which has been
+// invoked, keyed by operation name. The latencies only include the time the
+// guest took to run the operation, not the time spent waiting for a waPC
+// instance, so slow operations can be told apart from pool contention.
+func (wg *WasmGuest) OperationStats() map[string]OpStats {
+	return wg.operationStats.snapshot()
+}
+
+// AcquireTimeout returns how long to wait for a waPC instance from the pool
+func (wg *WasmGuest) AcquireTimeout() time.Duration {
+	return wg.acquireTimeout
+}
+
+// isRetiring returns whether the pool of the module is going away, because the
+// WasmGuest is draining or closed, or the module has been replaced by Reload,
+// in which case instances are closed rather than returned to the pool
+func (wg *WasmGuest) isRetiring(module *guestModule) bool {
+	wg.mutex.RLock()
+	defer wg.mutex.RUnlock()
+
+	return wg.closed || wg.draining || wg.module != module || wg.context.Err() != nil
+}
+
+func (wg *WasmGuest) isClosed() bool {
+	wg.mutex.RLock()
+	defer wg.mutex.RUnlock()
+
+	return wg.closed
+}
+
+// closeError reports failures closing both the waPC pool and module
+type closeError struct {
+	poolErr   error
+	moduleErr error
+}
+
+func (e *closeError) Error() string {
+	return fmt.Sprintf("Failed to close waPC pool: %s; failed to close waPC module: %s", e.poolErr, e.moduleErr)
+}
+
+func (e *closeError) Unwrap() []error {
+	return []error{e.poolErr, e.moduleErr}
+}
+
+// Close closes the WasmGuest, rendering it unusable for invoking further
+// operations. Both the waPC pool and module are closed even if closing the
+// pool fails, and any errors are returned. Invocations which are still in
+// progress are interrupted, and fail with ErrGuestClosed; use CloseWithTimeout
+// to let them finish first. Closing a WasmGuest which is already closed does
+// nothing.
+func (wg *WasmGuest) Close() error {
+	wg.mutex.Lock()
+	if wg.closed {
+		wg.mutex.Unlock()
+		return nil
+	}
+	wg.closed = true
+	module := wg.module
+	wg.mutex.Unlock()
+	wg.releasePins()
+
+	defer wg.cancel()
+
+	return wg.closeModule(module)
+}
+
+// CloseWithTimeout closes the WasmGuest like Close, but first stops new
+// invocations and waits up to the timeout for invocations which are already in
+// progress to finish. If any are still in progress at the deadline, they are
+// interrupted by closing their waPC instances, and an error wrapping
+// ErrForcedClose is returned. A timeout of zero does not wait.
+func (wg *WasmGuest) CloseWithTimeout(timeout time.Duration) error {
+	wg.mutex.Lock()
+	if wg.closed {
+		wg.mutex.Unlock()
+		return nil
+	}
+	wg.closed = true
+	module := wg.module
+	wg.mutex.Unlock()
+	wg.releasePins()
+
+	defer wg.cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		module.inFlight.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		return wg.closeModule(module)
+	case <-timer.C:
+	}
+
+	active := module.inFlight.active()
+	if active == 0 {
+		return wg.closeModule(module)
+	}
+
+	wg.logger.Errorf("[host] Timed out after %s waiting for %d invocations to finish", timeout, active)
+	wg.cancel()
+
+	forcedErr := fmt.Errorf("%w after %s", ErrForcedClose, timeout)
+	if err := wg.closeModule(module); err != nil {
+		return fmt.Errorf("%w: %s", forcedErr, err.Error())
+	}
+
+	return forcedErr
+}
+
+// closeModule closes the waPC pool and module, even if closing the pool fails
+func (wg *WasmGuest) closeModule(module *guestModule) error {
+	wg.logger.Infof("[host] Closing waPC Pool")
+	poolErr := module.pool.close(wg.context)
+	if poolErr != nil {
+		wg.logger.Errorf("[host] error closing waPC pool: %s", poolErr)
+	}
+
+	wg.logger.Infof("[host] Closing waPC Module")
+	moduleErr := module.module.Close(wg.context)
+	if moduleErr != nil {
+		wg.logger.Errorf("[host] error closing waPC module: %s", moduleErr)
+	}
+
+	switch {
+	case poolErr != nil && moduleErr != nil:
+		return &closeError{poolErr: poolErr, moduleErr: moduleErr}
+	case poolErr != nil:
+		return fmt.Errorf("Failed to close waPC pool: %w", poolErr)
+	case moduleErr != nil:
+		return fmt.Errorf("Failed to close waPC module: %w", moduleErr)
+	}
 
-	log.Printf("[host] Closing waPC Module")
-	g := *wg.wapcModule
-	g.Close(wg.context)
+	return nil
 }
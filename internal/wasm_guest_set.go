@@ -0,0 +1,201 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModuleSeparator separates the module name from the operation name when
+// invoking an operation using a WasmGuestSet
+const ModuleSeparator = "."
+
+// ErrModuleNotFound is returned when invoking an operation in a module which
+// is not in a WasmGuestSet
+var ErrModuleNotFound = errors.New("Wasm module not found")
+
+// WasmGuestSet routes operations to one of several named WasmGuests, so that
+// one chaincode process can serve a bundle of contracts. Each WasmGuest keeps
+// its own module, pool and limits. Operations are named <module>.<operation>,
+// and operations without a module name are routed to the default module, if
+// there is one.
+type WasmGuestSet struct {
+	mutex         sync.RWMutex
+	guests        map[string]*WasmGuest
+	defaultModule string
+}
+
+// NewWasmGuestSet returns an empty WasmGuestSet
+func NewWasmGuestSet() *WasmGuestSet {
+	return &WasmGuestSet{
+		guests: make(map[string]*WasmGuest),
+	}
+}
+
+// Add adds a WasmGuest to the set with the specified module name, which must
+// not be empty or contain the ModuleSeparator
+func (set *WasmGuestSet) Add(name string, guest *WasmGuest) error {
+	if name == "" || strings.Contains(name, ModuleSeparator) {
+		return fmt.Errorf("Invalid module name %q: must not be empty or contain %q", name, ModuleSeparator)
+	}
+	if guest == nil {
+		return fmt.Errorf("Invalid Wasm guest for module %s: must not be nil", name)
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if _, ok := set.guests[name]; ok {
+		return fmt.Errorf("Invalid module name %q: already added", name)
+	}
+	set.guests[name] = guest
+
+	return nil
+}
+
+// SetDefault routes operations without a module name to the named module,
+// for example the InvokeOperation invoked by WasmContract
+func (set *WasmGuestSet) SetDefault(name string) error {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if _, ok := set.guests[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrModuleNotFound, name)
+	}
+	set.defaultModule = name
+
+	return nil
+}
+
+// Guest returns the WasmGuest with the specified module name
+func (set *WasmGuestSet) Guest(name string) (*WasmGuest, bool) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	guest, ok := set.guests[name]
+	return guest, ok
+}
+
+// Names returns the sorted names of the modules in the set
+func (set *WasmGuestSet) Names() []string {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	return set.sortedNames()
+}
+
+// route returns the WasmGuest and operation name for an operation named
+// <module>.<operation>, or an operation without a module name in the default
+// module
+func (set *WasmGuestSet) route(operation string) (*WasmGuest, string, error) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	name := set.defaultModule
+	if i := strings.Index(operation, ModuleSeparator); i >= 0 {
+		name, operation = operation[:i], operation[i+len(ModuleSeparator):]
+	} else if name == "" {
+		return nil, "", fmt.Errorf("Invalid operation %q: must be <module>%s<operation> without a default module", operation, ModuleSeparator)
+	}
+
+	guest, ok := set.guests[name]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrModuleNotFound, name)
+	}
+
+	return guest, operation, nil
+}
+
+// InvokeWasmOperation invokes an operation named <module>.<operation> in the
+// named module, or an operation without a module name in the default module
+func (set *WasmGuestSet) InvokeWasmOperation(ctx context.Context, operation string, payload []byte) ([]byte, error) {
+	guest, moduleOperation, err := set.route(operation)
+	if err != nil {
+		return nil, &InvokeError{Operation: operation, Phase: PhaseRequest, Err: err}
+	}
+
+	return guest.InvokeWasmOperation(ctx, moduleOperation, payload)
+}
+
+// HasOperation returns whether the module in the operation name, or the
+// default module, exports the operation
+func (set *WasmGuestSet) HasOperation(operation string) bool {
+	guest, moduleOperation, err := set.route(operation)
+	if err != nil {
+		return false
+	}
+
+	return guest.HasOperation(moduleOperation)
+}
+
+// Operations returns the sorted operations of every module in the set, named
+// <module>.<operation>
+func (set *WasmGuestSet) Operations() []string {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	operations := []string{}
+	for _, name := range set.sortedNames() {
+		for _, operation := range set.guests[name].Operations() {
+			operations = append(operations, name+ModuleSeparator+operation)
+		}
+	}
+
+	return operations
+}
+
+// Close closes every WasmGuest in the set, returning the first error
+func (set *WasmGuestSet) Close() error {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	var firstErr error
+	for _, name := range set.sortedNames() {
+		if err := set.guests[name].Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Failed to close module %s: %w", name, err)
+		}
+	}
+
+	return firstErr
+}
+
+// CloseWithTimeout closes every WasmGuest in the set like
+// WasmGuest.CloseWithTimeout, with one deadline for all of them, returning the
+// first error
+func (set *WasmGuestSet) CloseWithTimeout(timeout time.Duration) error {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	deadline := time.Now().Add(timeout)
+
+	var firstErr error
+	for _, name := range set.sortedNames() {
+		remaining := time.Until(deadline)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if err := set.guests[name].CloseWithTimeout(remaining); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Failed to close module %s: %w", name, err)
+		}
+	}
+
+	return firstErr
+}
+
+// sortedNames returns the sorted module names, with the set already locked
+func (set *WasmGuestSet) sortedNames() []string {
+	names := make([]string, 0, len(set.guests))
+	for name := range set.guests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
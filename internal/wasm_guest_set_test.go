@@ -0,0 +1,126 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/hyperledgendary/fabric-chaincode-wasm/internal"
+)
+
+var _ = Describe("WasmGuestSet", func() {
+	var (
+		wasmFile string
+		set      *internal.WasmGuestSet
+		assets   *internal.WasmGuest
+		orders   *internal.WasmGuest
+	)
+
+	BeforeEach(func() {
+		wasmFile = writeTestGuestWasm()
+		proxy := internal.NewFabricProxy(internal.NewContextStore())
+
+		var err error
+		assets, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+		Expect(err).NotTo(HaveOccurred())
+		orders, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2), internal.WithMaxPayloadBytes(4))
+		Expect(err).NotTo(HaveOccurred())
+
+		set = internal.NewWasmGuestSet()
+		Expect(set.Add("assets", assets)).To(Succeed())
+		Expect(set.Add("orders", orders)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(set.Close()).To(Succeed())
+		os.Remove(wasmFile)
+	})
+
+	It("should route operations to the named module", func() {
+		result, err := set.InvokeWasmOperation(context.Background(), "assets.count", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]byte{1, 0, 0, 0}))
+
+		result, err = set.InvokeWasmOperation(context.Background(), "orders.count", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]byte{1, 0, 0, 0}))
+
+		result, err = set.InvokeWasmOperation(context.Background(), "assets.count", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]byte{2, 0, 0, 0}))
+	})
+
+	It("should keep the limits of each module", func() {
+		_, err := set.InvokeWasmOperation(context.Background(), "assets.echo", []byte("james"))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = set.InvokeWasmOperation(context.Background(), "orders.echo", []byte("james"))
+		Expect(errors.Is(err, internal.ErrPayloadTooLarge)).To(BeTrue())
+
+		Expect(assets.PoolSize()).To(Equal(1))
+		Expect(orders.PoolSize()).To(Equal(2))
+	})
+
+	It("should route operations without a module name to the default module", func() {
+		_, err := set.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+		Expect(err).To(MatchError(`Invalid operation "echo": must be <module>.<operation> without a default module`))
+		Expect(errors.Is(err, internal.ErrRequestRejected)).To(BeTrue())
+		Expect(set.HasOperation("_ping")).To(BeFalse())
+
+		Expect(set.SetDefault("orders")).To(Succeed())
+
+		result, err := set.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]byte("bond")))
+		Expect(set.HasOperation("_ping")).To(BeTrue())
+	})
+
+	It("should report which modules export an operation", func() {
+		Expect(set.HasOperation("assets._ping")).To(BeTrue())
+		Expect(set.HasOperation("assets.missing")).To(BeFalse())
+		Expect(set.HasOperation("missing._ping")).To(BeFalse())
+	})
+
+	It("should fail for modules which are not in the set", func() {
+		_, err := set.InvokeWasmOperation(context.Background(), "missing.echo", nil)
+		Expect(err).To(MatchError("Wasm module not found: missing"))
+		Expect(errors.Is(err, internal.ErrModuleNotFound)).To(BeTrue())
+
+		Expect(set.SetDefault("missing")).To(MatchError("Wasm module not found: missing"))
+	})
+
+	It("should list the modules in the set", func() {
+		Expect(set.Names()).To(Equal([]string{"assets", "orders"}))
+
+		guest, ok := set.Guest("orders")
+		Expect(ok).To(BeTrue())
+		Expect(guest).To(BeIdenticalTo(orders))
+
+		_, ok = set.Guest("missing")
+		Expect(ok).To(BeFalse())
+
+		Expect(set.Operations()).To(Equal([]string{"assets._ping", "orders._ping"}))
+	})
+
+	It("should not accept invalid modules", func() {
+		Expect(set.Add("", assets)).To(MatchError(`Invalid module name "": must not be empty or contain "."`))
+		Expect(set.Add("asset.v2", assets)).To(MatchError(`Invalid module name "asset.v2": must not be empty or contain "."`))
+		Expect(set.Add("assets", assets)).To(MatchError(`Invalid module name "assets": already added`))
+		Expect(set.Add("empty", nil)).To(MatchError("Invalid Wasm guest for module empty: must not be nil"))
+	})
+
+	It("should close every module", func() {
+		Expect(set.Close()).To(Succeed())
+
+		_, err := assets.InvokeWasmOperation(context.Background(), "echo", nil)
+		Expect(errors.Is(err, internal.ErrGuestClosed)).To(BeTrue())
+		_, err = orders.InvokeWasmOperation(context.Background(), "echo", nil)
+		Expect(errors.Is(err, internal.ErrGuestClosed)).To(BeTrue())
+	})
+})
@@ -0,0 +1,4347 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/hyperledgendary/fabric-chaincode-wasm/internal"
+	"github.com/hyperledgendary/fabric-chaincode-wasm/internal/fakes"
+	contract "github.com/hyperledgendary/fabric-ledger-protos-go/contract"
+	"github.com/tetratelabs/wazero/sys"
+	"github.com/wapc/wapc-go"
+	wazeroengine "github.com/wapc/wapc-go/engines/wazero"
+	"google.golang.org/protobuf/proto"
+)
+
+// testEngine is a waPC engine which delegates to the wazero engine, recording
+// the modules it creates, optionally panicking when invoking operations, and
+// failing to create instances with any instantiation errors
+type testEngine struct {
+	wapc.Engine
+	modules int
+	panics  bool
+
+	mutex                 sync.Mutex
+	instantiations        int
+	instantiationFailures []error
+	invokeErr             error
+}
+
+// invokeError returns the error the instances return instead of invoking the
+// guest, if there is one
+func (engine *testEngine) invokeError() error {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	return engine.invokeErr
+}
+
+// instantiate counts an attempt to create an instance, returning the next
+// instantiation error if there is one
+func (engine *testEngine) instantiate() error {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	engine.instantiations++
+	if len(engine.instantiationFailures) == 0 {
+		return nil
+	}
+	err := engine.instantiationFailures[0]
+	engine.instantiationFailures = engine.instantiationFailures[1:]
+	return err
+}
+
+func (engine *testEngine) Name() string {
+	return "test"
+}
+
+func (engine *testEngine) New(ctx context.Context, host wapc.HostCallHandler, guest []byte, config *wapc.ModuleConfig) (wapc.Module, error) {
+	module, err := engine.Engine.New(ctx, host, guest, config)
+	if err != nil {
+		return nil, err
+	}
+	engine.modules++
+
+	return &testEngineModule{Module: module, engine: engine, panics: engine.panics}, nil
+}
+
+type testEngineModule struct {
+	wapc.Module
+	engine *testEngine
+	panics bool
+}
+
+func (module *testEngineModule) Instantiate(ctx context.Context) (wapc.Instance, error) {
+	if err := module.engine.instantiate(); err != nil {
+		return nil, err
+	}
+	instance, err := module.Module.Instantiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &testEngineInstance{Instance: instance, engine: module.engine, panics: module.panics}, nil
+}
+
+type testEngineInstance struct {
+	wapc.Instance
+	engine *testEngine
+	panics bool
+}
+
+func (instance *testEngineInstance) Invoke(ctx context.Context, operation string, payload []byte) ([]byte, error) {
+	if instance.panics {
+		panic("engine failure")
+	}
+	if err := instance.engine.invokeError(); err != nil {
+		return nil, err
+	}
+
+	return instance.Instance.Invoke(ctx, operation, payload)
+}
+
+// poolCounts returns the pool stats without the memory stats, which depend on
+// the test guest
+func poolCounts(stats internal.PoolStats) internal.PoolStats {
+	stats.Memory = internal.MemoryStats{}
+	return stats
+}
+
+type recordingLogger struct {
+	sync.Mutex
+	debug, info, errors []string
+}
+
+func (logger *recordingLogger) Debugf(format string, args ...interface{}) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.debug = append(logger.debug, fmt.Sprintf(format, args...))
+}
+
+func (logger *recordingLogger) Infof(format string, args ...interface{}) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.info = append(logger.info, fmt.Sprintf(format, args...))
+}
+
+func (logger *recordingLogger) Errorf(format string, args ...interface{}) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.errors = append(logger.errors, fmt.Sprintf(format, args...))
+}
+
+// gzipBytes returns the gzip compressed bytes
+func gzipBytes(uncompressed []byte) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(uncompressed); err != nil {
+		panic(err)
+	}
+	if err := writer.Close(); err != nil {
+		panic(err)
+	}
+
+	return compressed.Bytes()
+}
+
+// chunkWriter records each chunk written to it, and fails once it has
+// written the chunks allowed, if there is a limit
+type chunkWriter struct {
+	chunks  [][]byte
+	limit   int
+	limited bool
+	onWrite func()
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.limited && len(w.chunks) >= w.limit {
+		return 0, errors.New("writer failed")
+	}
+	w.chunks = append(w.chunks, append([]byte{}, p...))
+	if w.onWrite != nil {
+		w.onWrite()
+	}
+	return len(p), nil
+}
+
+type observation struct {
+	operation string
+	duration  time.Duration
+	err       error
+}
+
+type recordingMetrics struct {
+	sync.Mutex
+	acquires, invocations []observation
+}
+
+func (metrics *recordingMetrics) ObserveAcquire(wait time.Duration, err error) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.acquires = append(metrics.acquires, observation{duration: wait, err: err})
+}
+
+func (metrics *recordingMetrics) ObserveInvocation(operation string, duration time.Duration, err error) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.invocations = append(metrics.invocations, observation{operation: operation, duration: duration, err: err})
+}
+
+type recordedSpan struct {
+	name       string
+	parent     *recordedSpan
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (span *recordedSpan) SetAttributes(attributes ...internal.SpanAttribute) {
+	for _, attribute := range attributes {
+		span.attributes[attribute.Key] = attribute.Value
+	}
+}
+
+func (span *recordedSpan) End(err error) {
+	span.err = err
+	span.ended = true
+}
+
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpanKey struct{}
+
+func (tracer *recordingTracer) Start(ctx context.Context, name string, attributes ...internal.SpanAttribute) (context.Context, internal.Span) {
+	tracer.Lock()
+	defer tracer.Unlock()
+
+	parent, _ := ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, parent: parent, attributes: map[string]interface{}{}}
+	span.SetAttributes(attributes...)
+	tracer.spans = append(tracer.spans, span)
+
+	return context.WithValue(ctx, recordedSpanKey{}, span), span
+}
+
+// blockingReadState returns a payload for the test guest read operation with
+// a stub which blocks reading the state until the release channel is closed
+func blockingReadState(contextStore *internal.ContextStore) (payload []byte, reading chan struct{}, release chan struct{}) {
+	reading = make(chan struct{})
+	release = make(chan struct{})
+
+	stub := &fakes.ChaincodeStubInterface{}
+	stub.GetStateStub = func(key string) ([]byte, error) {
+		close(reading)
+		<-release
+		return []byte("bond"), nil
+	}
+	contextStore.Put("channel1", "txn1", stub)
+
+	request := &contract.ReadStateRequest{
+		Context:  &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"},
+		StateKey: "007",
+	}
+	payload, err := proto.Marshal(request)
+	Expect(err).NotTo(HaveOccurred())
+
+	return payload, reading, release
+}
+
+var _ = Describe("WasmGuest", func() {
+	var (
+		wasmFile string
+		proxy    *internal.FabricProxy
+	)
+
+	BeforeEach(func() {
+		wasmFile = writeTestGuestWasm()
+		proxy = internal.NewFabricProxy(internal.NewContextStore())
+	})
+
+	AfterEach(func() {
+		os.Remove(wasmFile)
+	})
+
+	Describe("NewWasmGuest", func() {
+		It("should use the default pool size", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.PoolSize()).To(Equal(internal.DefaultPoolSize))
+		})
+
+		It("should use a configured pool size", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(3))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.PoolSize()).To(Equal(3))
+		})
+
+		It("should fail with a pool size of zero", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(0))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid pool size 0: must be at least 1"))
+		})
+
+		It("should fail with a negative pool size", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(-1))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid pool size -1: must be at least 1"))
+		})
+
+		It("should fail with a nil logger", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithLogger(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid logger: must not be nil"))
+		})
+
+		It("should use the default acquire timeout", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.AcquireTimeout()).To(Equal(internal.DefaultAcquireTimeout))
+		})
+
+		It("should use a configured acquire timeout", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithAcquireTimeout(0))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.AcquireTimeout()).To(BeZero())
+		})
+
+		It("should fail with a negative acquire timeout", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithAcquireTimeout(-time.Second))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid acquire timeout -1s: must not be negative"))
+		})
+	})
+
+	Describe("NewWasmGuestFromBytes", func() {
+		It("should create a guest from Wasm module bytes", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes(testGuestWasm(), proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should fail with no bytes", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes([]byte{}, proxy)
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid Wasm module: no bytes"))
+		})
+
+		It("should fail without the Wasm magic header", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes([]byte("bond"), proxy)
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid Wasm module: missing \\0asm magic header"))
+		})
+
+		It("should fail with a truncated header", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes([]byte{0x00, 0x61, 0x73, 0x6d, 0x01}, proxy)
+			Expect(wasmGuest).To(BeNil())
+			Expect(errors.Is(err, internal.ErrInvalidWasm)).To(BeTrue())
+			Expect(err).To(MatchError("Invalid Wasm module: header is truncated after 5 bytes"))
+		})
+
+		It("should fail with an unsupported binary format version", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes([]byte{0x00, 0x61, 0x73, 0x6d, 0x02, 0x00, 0x00, 0x00}, proxy)
+			Expect(wasmGuest).To(BeNil())
+			Expect(errors.Is(err, internal.ErrInvalidWasm)).To(BeTrue())
+			Expect(err).To(MatchError("Invalid Wasm module: unsupported binary format version 2, must be 1"))
+		})
+
+		It("should include the size of modules which fail to compile", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x01, 0xff}, proxy)
+			Expect(wasmGuest).To(BeNil())
+			Expect(errors.Is(err, internal.ErrInvalidWasm)).To(BeFalse())
+			Expect(errors.Is(err, internal.ErrCompileFailed)).To(BeTrue())
+			Expect(err).To(MatchError(HavePrefix("Failed to compile Wasm module (11 bytes): ")))
+		})
+
+		It("should include the file name in errors for Wasm files", func() {
+			emptyFile, err := ioutil.TempFile("", "empty_*.wasm")
+			Expect(err).NotTo(HaveOccurred())
+			emptyFile.Close()
+			defer os.Remove(emptyFile.Name())
+
+			wasmGuest, err := internal.NewWasmGuest(emptyFile.Name(), proxy)
+			Expect(wasmGuest).To(BeNil())
+			Expect(errors.Is(err, internal.ErrInvalidWasm)).To(BeTrue())
+			Expect(err).To(MatchError("Failed to load Wasm file " + emptyFile.Name() + ": Invalid Wasm module: no bytes"))
+
+			Expect(ioutil.WriteFile(emptyFile.Name(), []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x01, 0xff}, 0600)).To(Succeed())
+			_, err = internal.NewWasmGuest(emptyFile.Name(), proxy)
+			Expect(err).To(MatchError(HavePrefix("Failed to compile Wasm file " + emptyFile.Name() + " (11 bytes): ")))
+		})
+	})
+
+	Describe("RequireOperations", func() {
+		It("should succeed if the operations are exported", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.RequireOperations("__guest_call")).To(Succeed())
+		})
+
+		It("should list the operations which are not exported", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			err = wasmGuest.RequireOperations("Transfer", "__guest_call", "Query")
+			Expect(err).To(MatchError("Missing required Wasm operations: Transfer, Query"))
+		})
+
+		It("should fail to create a guest which does not export required operations", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithRequiredOperations("__guest_call", "Transfer"))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Missing required Wasm operations: Transfer"))
+		})
+	})
+
+	Describe("HasOperation", func() {
+		It("should report whether an operation is exported", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.HasOperation(internal.PingOperation)).To(BeTrue())
+			Expect(wasmGuest.HasOperation(internal.InitOperation)).To(BeFalse())
+		})
+	})
+
+	Describe("Operations", func() {
+		It("should list the exported operations apart from the waPC protocol functions", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Operations()).To(Equal([]string{internal.PingOperation}))
+			Expect(wasmGuest.HasOperation("__guest_call")).To(BeTrue())
+		})
+	})
+
+	Describe("ModuleMetadata", func() {
+		customSection := func(sectionName string, content string) []byte {
+			return section(0, append(name(sectionName), content...))
+		}
+
+		It("should return the metadata custom section of the Wasm module", func() {
+			wasmBytes := append(testGuestWasm(), customSection(internal.ModuleMetadataSection, `{"sdk":"1.2.0"}`)...)
+			wasmGuest, err := internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			metadata, ok := wasmGuest.ModuleMetadata()
+			Expect(ok).To(BeTrue())
+			Expect(metadata).To(MatchJSON(`{"sdk":"1.2.0"}`))
+		})
+
+		It("should report that a module has no metadata", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			metadata, ok := wasmGuest.ModuleMetadata()
+			Expect(ok).To(BeFalse())
+			Expect(metadata).To(BeNil())
+		})
+
+		It("should return the first custom section with the name", func() {
+			wasmBytes := append(testGuestWasm(), customSection("contract", "bond")...)
+			wasmBytes = append(wasmBytes, customSection("contract", "not bond")...)
+			wasmGuest, err := internal.NewWasmGuestFromBytes(wasmBytes, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			content, ok := wasmGuest.CustomSection("contract")
+			Expect(ok).To(BeTrue())
+			Expect(content).To(Equal([]byte("bond")))
+
+			content[0] = 'B'
+			content, _ = wasmGuest.CustomSection("contract")
+			Expect(content).To(Equal([]byte("bond")), "Should return a copy of the section")
+		})
+
+		It("should return the metadata of the reloaded module", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Reload(append(testGuestWasm(), customSection(internal.ModuleMetadataSection, "v2")...))).To(Succeed())
+			metadata, ok := wasmGuest.ModuleMetadata()
+			Expect(ok).To(BeTrue())
+			Expect(metadata).To(Equal([]byte("v2")))
+		})
+	})
+
+	Describe("Handshake", func() {
+		var logger *recordingLogger
+
+		BeforeEach(func() {
+			logger = &recordingLogger{}
+		})
+
+		handshakes := func() int {
+			logger.Lock()
+			defer logger.Unlock()
+
+			count := 0
+			for _, msg := range logger.debug {
+				if strings.HasPrefix(msg, "[host] Handshake") {
+					count++
+				}
+			}
+			return count
+		}
+
+		It("should perform the handshake once for each instance before its first invocation", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes(testGuestWasmWithHandshake(`{"protocol_version":1}`), proxy, internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			Expect(handshakes()).To(Equal(0))
+
+			for i := 0; i < 3; i++ {
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(Equal([]byte("bond")))
+			}
+			Expect(handshakes()).To(Equal(1))
+			Expect(wasmGuest.Operations()).NotTo(ContainElement(internal.HandshakeOperation))
+		})
+
+		It("should fail fast when the guest speaks an unsupported protocol version", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes(testGuestWasmWithHandshake(`{"protocol_version":2,"sdk_version":"2.0.0"}`), proxy, internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			for i := 0; i < 2; i++ {
+				_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+				Expect(err).To(MatchError(internal.ErrProtocolMismatch))
+				Expect(err).To(MatchError(ContainSubstring("guest speaks version 2 (SDK 2.0.0), host supports versions 0 to 1")))
+				var invokeErr *internal.InvokeError
+				Expect(errors.As(err, &invokeErr)).To(BeTrue())
+				Expect(invokeErr.Phase).To(Equal(internal.PhaseInvoke))
+			}
+			Expect(handshakes()).To(Equal(1))
+		})
+
+		It("should fail when the handshake response is invalid", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes(testGuestWasmWithHandshake("bond"), proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).To(MatchError(ContainSubstring("Handshake failed: invalid response")))
+		})
+
+		It("should treat a guest which does not have the handshake operation as a legacy guest", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			for i := 0; i < 2; i++ {
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(Equal([]byte("bond")))
+			}
+			Expect(handshakes()).To(Equal(1))
+		})
+
+		It("should reject a legacy guest when it is first invoked, if legacy guests are not supported", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMinProtocolVersion(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			for i := 0; i < 2; i++ {
+				_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+				Expect(err).To(MatchError(internal.ErrProtocolMismatch))
+				Expect(err).To(MatchError(ContainSubstring("guest speaks version 0, host supports versions 1 to 1")))
+			}
+			Expect(handshakes()).To(Equal(1))
+		})
+
+		It("should perform the handshake through __guest_call with the sample contract", func() {
+			wasmGuest, err := newSampleContractGuest(proxy, internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "missing", nil)
+			Expect(err).To(MatchError(ContainSubstring("Unknown function being called")))
+			Expect(err).NotTo(MatchError(ContainSubstring("Handshake failed")))
+			Expect(handshakes()).To(Equal(1))
+
+			strictGuest, err := newSampleContractGuest(proxy, internal.WithPoolSize(1), internal.WithMinProtocolVersion(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer strictGuest.Close()
+
+			_, err = strictGuest.InvokeWasmOperation(context.Background(), "missing", nil)
+			Expect(err).To(MatchError(internal.ErrProtocolMismatch))
+		})
+
+		It("should reject an invalid minimum protocol version", func() {
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithMinProtocolVersion(internal.ProtocolVersion+1))
+			Expect(err).To(MatchError(fmt.Sprintf("Invalid minimum protocol version %d: must be between 0 and %d", internal.ProtocolVersion+1, internal.ProtocolVersion)))
+		})
+	})
+
+	Describe("NewWasmGuestFromReader", func() {
+		It("should create a guest from a Wasm module reader", func() {
+			wasmGuest, err := internal.NewWasmGuestFromReader(bytes.NewReader(testGuestWasm()), proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+	})
+
+	Describe("Compressed Wasm modules", func() {
+		It("should decompress a gzip compressed module", func() {
+			wasmGuest, err := internal.NewWasmGuestFromBytes(gzipBytes(testGuestWasm()), proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should decompress a gzip compressed file", func() {
+			file, err := ioutil.TempFile("", "test_guest_*.wasm.gz")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(file.Name())
+			_, err = file.Write(gzipBytes(testGuestWasm()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+
+			wasmGuest, err := internal.NewWasmGuest(file.Name(), proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should reload a gzip compressed module", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			digest := wasmGuest.WasmDigest()
+
+			Expect(wasmGuest.Reload(gzipBytes(testGuestWasm()))).To(Succeed())
+			Expect(wasmGuest.WasmDigest()).To(Equal(digest))
+		})
+
+		It("should check the expected digest of the decompressed module", func() {
+			digest := sha256.Sum256(testGuestWasm())
+			wasmGuest, err := internal.NewWasmGuestFromBytes(gzipBytes(testGuestWasm()), proxy, internal.WithPoolSize(1), internal.WithExpectedDigest(hex.EncodeToString(digest[:])))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+		})
+
+		It("should report a module which cannot be decompressed", func() {
+			compressed := gzipBytes(testGuestWasm())
+			_, err := internal.NewWasmGuestFromBytes(compressed[:len(compressed)/2], proxy)
+			Expect(err).To(MatchError(internal.ErrDecompressionFailed))
+			Expect(err).NotTo(MatchError(internal.ErrInvalidWasm))
+			Expect(err).To(MatchError(HavePrefix("Failed to decompress Wasm module: gzip: ")))
+		})
+
+		It("should report a zstd compressed module as unsupported", func() {
+			_, err := internal.NewWasmGuestFromBytes([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, proxy)
+			Expect(err).To(MatchError("Failed to decompress Wasm module: zstd compression is not supported, use gzip"))
+		})
+
+		It("should report a compressed module which is not a Wasm module", func() {
+			_, err := internal.NewWasmGuestFromBytes(gzipBytes([]byte("bond")), proxy)
+			Expect(err).To(MatchError(internal.ErrInvalidWasm))
+			Expect(err).NotTo(MatchError(internal.ErrDecompressionFailed))
+		})
+	})
+
+	Describe("InvokeWasmOperation", func() {
+		It("should return the result of the guest operation", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should return an error reported by the guest operation", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "fail", []byte("bond"))
+			Expect(result).To(BeNil())
+			Expect(err).To(MatchError("guest failed"))
+
+			result, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred(), "Should return the instance to the pool after an error")
+			Expect(result).To(Equal([]byte("bond")))
+		})
+	})
+
+	Describe("InvokeBatch", func() {
+		It("should invoke the operations in order on the same instance", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			results, err := wasmGuest.InvokeBatch(context.Background(), []internal.Operation{
+				{Name: "count"},
+				{Name: "echo", Payload: []byte("bond")},
+				{Name: "count"},
+				{Name: "count"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(Equal([][]byte{
+				{1, 0, 0, 0},
+				[]byte("bond"),
+				{2, 0, 0, 0},
+				{3, 0, 0, 0},
+			}))
+
+			stats := wasmGuest.Stats()
+			Expect(stats.InUse).To(Equal(0))
+			Expect(stats.Idle).To(Equal(2))
+		})
+
+		It("should return no results for an empty batch", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			results, err := wasmGuest.InvokeBatch(context.Background(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(BeEmpty())
+		})
+
+		It("should stop at the first failure and discard the instance", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			results, err := wasmGuest.InvokeBatch(context.Background(), []internal.Operation{
+				{Name: "count"},
+				{Name: "fail"},
+				{Name: "count"},
+			})
+			Expect(err).To(MatchError("Batch operation 2 of 3 failed: guest failed"))
+			Expect(errors.Is(err, internal.ErrInvokeFailed)).To(BeTrue())
+			var invokeErr *internal.InvokeError
+			Expect(errors.As(err, &invokeErr)).To(BeTrue())
+			Expect(invokeErr.Operation).To(Equal("fail"))
+			Expect(results).To(Equal([][]byte{{1, 0, 0, 0}}))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}))
+		})
+
+		It("should check every payload before invoking any operations", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMaxPayloadBytes(4))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			results, err := wasmGuest.InvokeBatch(context.Background(), []internal.Operation{
+				{Name: "count"},
+				{Name: "echo", Payload: []byte("james")},
+			})
+			Expect(errors.Is(err, internal.ErrPayloadTooLarge)).To(BeTrue())
+			Expect(results).To(BeEmpty())
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}))
+		})
+
+		It("should fail if the guest is closed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			_, err = wasmGuest.InvokeBatch(context.Background(), []internal.Operation{{Name: "echo"}})
+			Expect(errors.Is(err, internal.ErrGuestClosed)).To(BeTrue())
+		})
+	})
+
+	Describe("Acquire", func() {
+		It("should invoke the operations on the leased instance until it is released", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			lease, err := wasmGuest.Acquire(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 2, InUse: 1, Idle: 1}))
+
+			for _, expected := range []uint32{1, 2} {
+				result, err := lease.Invoke(context.Background(), "count", nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binary.LittleEndian.Uint32(result)).To(Equal(expected))
+			}
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binary.LittleEndian.Uint32(result)).To(Equal(uint32(1)), "Should use the other instance")
+
+			lease.Release()
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 2, InUse: 0, Idle: 2}))
+		})
+
+		It("should discard the instance on release if an operation failed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			lease, err := wasmGuest.Acquire(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			_, err = lease.Invoke(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = lease.Invoke(context.Background(), "fail", nil)
+			Expect(err).To(HaveOccurred())
+			lease.Release()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binary.LittleEndian.Uint32(result)).To(Equal(uint32(1)))
+		})
+
+		It("should fail to invoke operations after the lease is released", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			lease, err := wasmGuest.Acquire(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			lease.Release()
+			lease.Release()
+
+			_, err = lease.Invoke(context.Background(), "echo", nil)
+			Expect(err).To(MatchError(internal.ErrLeaseReleased))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should check the payload size of each operation", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMaxPayloadBytes(4))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			lease, err := wasmGuest.Acquire(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			defer lease.Release()
+
+			_, err = lease.Invoke(context.Background(), "echo", []byte("james bond"))
+			Expect(err).To(MatchError(internal.ErrPayloadTooLarge))
+		})
+
+		It("should fail to acquire an instance after the guest is closed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			_, err = wasmGuest.Acquire(context.Background())
+			Expect(err).To(MatchError(internal.ErrGuestClosed))
+		})
+
+		It("should make Drain wait for the lease to be released", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			lease, err := wasmGuest.Acquire(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			drained := make(chan error, 1)
+			go func() { drained <- wasmGuest.Drain(context.Background()) }()
+			Consistently(drained, 100*time.Millisecond).ShouldNot(Receive())
+
+			lease.Release()
+			Eventually(drained).Should(Receive(BeNil()))
+		})
+	})
+
+	Describe("Transaction affinity", func() {
+		count := func(ctx context.Context, wasmGuest *internal.WasmGuest) uint32 {
+			result, err := wasmGuest.InvokeWasmOperation(ctx, "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			return binary.LittleEndian.Uint32(result)
+		}
+
+		It("should invoke the operations of a transaction on the same instance until it is released", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2), internal.WithTransactionAffinity(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			txCtx := internal.WithTransaction(context.Background(), "channel1", "txn1", nil)
+			Expect(count(txCtx, wasmGuest)).To(Equal(uint32(1)))
+			Expect(count(txCtx, wasmGuest)).To(Equal(uint32(2)))
+			Expect(wasmGuest.PinnedTransactions()).To(Equal(1))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 2, InUse: 1, Idle: 1}))
+
+			otherCtx := internal.WithTransaction(context.Background(), "channel1", "txn2", nil)
+			Expect(count(otherCtx, wasmGuest)).To(Equal(uint32(1)), "Should use the other instance")
+			Expect(count(txCtx, wasmGuest)).To(Equal(uint32(3)))
+
+			wasmGuest.ReleaseTransaction("channel1", "txn1")
+			wasmGuest.ReleaseTransaction("channel1", "txn2")
+			Expect(wasmGuest.PinnedTransactions()).To(Equal(0))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 2, InUse: 0, Idle: 2}))
+		})
+
+		It("should not pin invocations without a transaction", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithTransactionAffinity(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			count(context.Background(), wasmGuest)
+			Expect(wasmGuest.PinnedTransactions()).To(Equal(0))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should release the instance after the TTL", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithTransactionAffinity(50*time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			count(internal.WithTransaction(context.Background(), "channel1", "txn1", nil), wasmGuest)
+			Expect(wasmGuest.PinnedTransactions()).To(Equal(1))
+
+			Eventually(wasmGuest.PinnedTransactions).Should(Equal(0))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should release the instance when the context is cancelled", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithTransactionAffinity(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			txCtx, cancel := context.WithCancel(internal.WithTransaction(context.Background(), "channel1", "txn1", nil))
+			count(txCtx, wasmGuest)
+			Expect(wasmGuest.PinnedTransactions()).To(Equal(1))
+
+			cancel()
+			Eventually(wasmGuest.PinnedTransactions).Should(Equal(0))
+			Eventually(func() internal.PoolStats { return poolCounts(wasmGuest.Stats()) }).Should(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should discard the instance if an operation fails", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithTransactionAffinity(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			txCtx := internal.WithTransaction(context.Background(), "channel1", "txn1", nil)
+			Expect(count(txCtx, wasmGuest)).To(Equal(uint32(1)))
+			_, err = wasmGuest.InvokeWasmOperation(txCtx, "fail", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(wasmGuest.PinnedTransactions()).To(Equal(0))
+
+			Expect(count(txCtx, wasmGuest)).To(Equal(uint32(1)))
+		})
+
+		It("should release every instance when the guest is drained", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithTransactionAffinity(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			count(internal.WithTransaction(context.Background(), "channel1", "txn1", nil), wasmGuest)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(wasmGuest.Drain(ctx)).To(Succeed())
+			Expect(wasmGuest.PinnedTransactions()).To(Equal(0))
+		})
+
+		It("should reject an invalid TTL", func() {
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithTransactionAffinity(0))
+			Expect(err).To(MatchError("Invalid transaction affinity TTL 0s: must be positive"))
+		})
+	})
+
+	Describe("OperationStats", func() {
+		It("should record the latency of each operation", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.OperationStats()).To(BeEmpty())
+
+			for i := 0; i < 3; i++ {
+				_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "fail", nil)
+			Expect(err).To(HaveOccurred())
+
+			stats := wasmGuest.OperationStats()
+			Expect(stats).To(HaveLen(2))
+			Expect(stats["echo"].Count).To(Equal(uint64(3)))
+			Expect(stats["echo"].Errors).To(BeZero())
+			Expect(stats["fail"].Count).To(Equal(uint64(1)))
+			Expect(stats["fail"].Errors).To(Equal(uint64(1)))
+
+			echo := stats["echo"]
+			Expect(echo.Total).To(BeNumerically(">=", echo.Max))
+			Expect(echo.Min).To(BeNumerically("<=", echo.P50))
+			Expect(echo.P50).To(BeNumerically("<=", echo.P95))
+			Expect(echo.P95).To(BeNumerically("<=", echo.P99))
+			Expect(echo.P99).To(BeNumerically("<=", echo.Max))
+		})
+
+		It("should exclude the time spent waiting for an instance", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithAcquireTimeout(0))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			read := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			echo := wasmGuest.InvokeAsync(context.Background(), "echo", []byte("bond"))
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			Eventually(read).Should(Receive())
+			Eventually(echo).Should(Receive())
+
+			stats := wasmGuest.OperationStats()
+			Expect(stats["read"].Max).To(BeNumerically(">=", 50*time.Millisecond))
+			Expect(stats["echo"].Max).To(BeNumerically("<", 50*time.Millisecond))
+		})
+	})
+
+	Describe("Simulate", func() {
+		It("should return the result with the writes made by the guest", func() {
+			contextStore := internal.NewContextStore()
+			stub := &fakes.ChaincodeStubInterface{}
+			contextStore.Put("channel1", "txn1", stub)
+			fabricProxy := internal.NewFabricProxy(contextStore)
+
+			createState := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return fabricProxy.FabricCall(ctx, binding, "LedgerService", "CreateState", payload)
+			}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, fabricProxy, internal.WithPoolSize(1), internal.WithHostCallHandler("Test", createState))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, err := proto.Marshal(&contract.CreateStateRequest{
+				Context: &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"},
+				State:   &contract.State{Key: "007", Value: []byte("bond")},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, writeSet, err := wasmGuest.Simulate(context.Background(), "host", payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(BeEmpty())
+			Expect(writeSet.Writes()).To(Equal([]internal.StateWrite{{Key: "007", Value: []byte("bond")}}))
+			Expect(stub.GetStateCallCount()).To(Equal(1))
+			Expect(stub.PutStateCallCount()).To(Equal(0))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "host", payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stub.PutStateCallCount()).To(Equal(1), "Should only buffer writes when simulating")
+		})
+	})
+
+	Describe("InvokeAsync", func() {
+		It("should deliver the result on the channel and close it", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			results := wasmGuest.InvokeAsync(context.Background(), "echo", []byte("bond"))
+			Eventually(results).Should(Receive(Equal(internal.InvokeResult{Result: []byte("bond")})))
+			Eventually(results).Should(BeClosed())
+		})
+
+		It("should deliver the error on the channel", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			var result internal.InvokeResult
+			Eventually(wasmGuest.InvokeAsync(context.Background(), "fail", nil)).Should(Receive(&result))
+			Expect(result.Result).To(BeNil())
+			Expect(result.Err).To(MatchError("guest failed"))
+		})
+
+		It("should fan out invocations within the concurrency limit", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2), internal.WithMaxConcurrency(2), internal.WithAcquireTimeout(0))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			var pending []<-chan internal.InvokeResult
+			for i := 0; i < 5; i++ {
+				pending = append(pending, wasmGuest.InvokeAsync(context.Background(), "echo", []byte{byte(i)}))
+			}
+			for i, results := range pending {
+				Eventually(results).Should(Receive(Equal(internal.InvokeResult{Result: []byte{byte(i)}})))
+			}
+		})
+
+		It("should interrupt the invocation when the context is cancelled", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			defer close(release)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			results := wasmGuest.InvokeAsync(ctx, "read", payload)
+			Eventually(reading).Should(BeClosed())
+			cancel()
+
+			var result internal.InvokeResult
+			Eventually(results).Should(Receive(&result))
+			Expect(errors.Is(result.Err, context.Canceled)).To(BeTrue())
+		})
+
+		It("should finish the invocation if the channel is abandoned", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+			Expect(wasmGuest.Stats().InUse).To(Equal(1))
+
+			close(release)
+			Eventually(func() internal.PoolStats { return poolCounts(wasmGuest.Stats()) }).Should(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+	})
+
+	Describe("Interceptors", func() {
+		It("should call the interceptors in order around the invocation", func() {
+			var calls []string
+			record := func(name string) internal.Interceptor {
+				return func(ctx context.Context, operation string, payload []byte, next internal.Invoker) ([]byte, error) {
+					calls = append(calls, name+" before "+operation)
+					result, err := next(ctx, operation, payload)
+					calls = append(calls, name+" after "+string(result))
+					return result, err
+				}
+			}
+
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1),
+				internal.WithInterceptors(record("outer")),
+				internal.WithInterceptors(record("inner")),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+			Expect(calls).To(Equal([]string{"outer before echo", "inner before echo", "inner after bond", "outer after bond"}))
+		})
+
+		It("should allow interceptors to transform the payload and result", func() {
+			transform := func(ctx context.Context, operation string, payload []byte, next internal.Invoker) ([]byte, error) {
+				result, err := next(ctx, operation, append([]byte("hello "), payload...))
+				return bytes.ToUpper(result), err
+			}
+
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithInterceptors(transform))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("HELLO BOND")))
+		})
+
+		It("should allow interceptors to reject the invocation", func() {
+			rejectErr := errors.New("Not authorized")
+			reject := func(ctx context.Context, operation string, payload []byte, next internal.Invoker) ([]byte, error) {
+				return nil, rejectErr
+			}
+
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithInterceptors(reject))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "counter", nil)
+			Expect(result).To(BeNil())
+			Expect(err).To(BeIdenticalTo(rejectErr))
+			Expect(wasmGuest.OperationStats()).To(BeEmpty())
+		})
+
+		It("should not accept nil interceptors", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithInterceptors(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid interceptor: must not be nil"))
+		})
+	})
+
+	Describe("Host call decorators", func() {
+		It("should call the decorators in order around the host call handler", func() {
+			var calls []string
+			record := func(name string) internal.HostCallDecorator {
+				return func(next wapc.HostCallHandler) wapc.HostCallHandler {
+					return func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+						calls = append(calls, name+" before "+namespace+"/"+operation)
+						result, err := next(ctx, binding, namespace, operation, payload)
+						calls = append(calls, name+" after "+string(result))
+						return result, err
+					}
+				}
+			}
+			handler := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return append([]byte("host "), payload...), nil
+			}
+
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1),
+				internal.WithHostCallHandler("Test", handler),
+				internal.WithHostCallDecorators(record("outer")),
+				internal.WithHostCallDecorators(record("inner")),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("host bond")))
+			Expect(calls).To(Equal([]string{"outer before Test/Call", "inner before Test/Call", "inner after host bond", "outer after host bond"}))
+		})
+
+		It("should allow decorators to stub Fabric operations", func() {
+			stub := func(next wapc.HostCallHandler) wapc.HostCallHandler {
+				return func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+					if namespace == "LedgerService" && operation == "ReadState" {
+						return []byte("stubbed"), nil
+					}
+					return next(ctx, binding, namespace, operation, payload)
+				}
+			}
+
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithHostCallDecorators(stub))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", []byte("007"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("stubbed")))
+		})
+
+		It("should not accept nil decorators", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithHostCallDecorators(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid host call decorator: must not be nil"))
+		})
+	})
+
+	Describe("Memory limit", func() {
+		It("should use the default memory limit", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.MemoryLimit()).To(Equal(uint64(internal.DefaultMemoryLimit)))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "grow", make([]byte, 8))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should fail guest operations which exceed the memory limit", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMemoryLimit(4*65536+100))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.MemoryLimit()).To(Equal(uint64(4 * 65536)))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "grow", make([]byte, 2))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "grow", make([]byte, 2))
+			Expect(err).To(MatchError("grow failed"))
+		})
+
+		It("should fail with a memory limit less than one page", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithMemoryLimit(1024))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid memory limit 1024: must be between 65536 and 4294967296 bytes"))
+		})
+	})
+
+	Describe("Invoke errors", func() {
+		It("should identify failures to acquire an instance", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(errors.Is(err, internal.ErrAcquireFailed)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrInvokeFailed)).To(BeFalse())
+
+			var invokeErr *internal.InvokeError
+			Expect(errors.As(err, &invokeErr)).To(BeTrue())
+			Expect(invokeErr.Operation).To(Equal("echo"))
+			Expect(invokeErr.Phase).To(Equal(internal.PhaseAcquire))
+			Expect(invokeErr.Err).To(Equal(internal.ErrGuestClosed))
+		})
+
+		It("should identify an exhausted pool", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithAcquireTimeout(time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			results := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(errors.Is(err, internal.ErrPoolExhausted)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrAcquireFailed)).To(BeTrue())
+			Expect(err).To(MatchError("Timed out after 1ms waiting for waPC instance"))
+
+			close(release)
+			Eventually(results).Should(Receive())
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "fail", nil)
+			Expect(errors.Is(err, internal.ErrPoolExhausted)).To(BeFalse())
+		})
+
+		It("should identify guest operation failures", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "fail", nil)
+			Expect(errors.Is(err, internal.ErrInvokeFailed)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrAcquireFailed)).To(BeFalse())
+			Expect(err).To(MatchError("guest failed"))
+
+			var invokeErr *internal.InvokeError
+			Expect(errors.As(err, &invokeErr)).To(BeTrue())
+			Expect(invokeErr.Operation).To(Equal("fail"))
+			Expect(invokeErr.Phase).To(Equal(internal.PhaseInvoke))
+		})
+
+		It("should identify guest traps as operation failures", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+			Expect(errors.Is(err, internal.ErrInvokeFailed)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("unreachable"))
+		})
+	})
+
+	Describe("Guest traps", func() {
+		var wasmGuest *internal.WasmGuest
+
+		BeforeEach(func() {
+			var err error
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			wasmGuest.Close()
+		})
+
+		trap := func(operation string) *internal.GuestTrap {
+			_, err := wasmGuest.InvokeWasmOperation(context.Background(), operation, nil)
+			Expect(err).To(MatchError(internal.ErrInvokeFailed))
+
+			var trap *internal.GuestTrap
+			Expect(errors.As(err, &trap)).To(BeTrue())
+			return trap
+		}
+
+		It("should classify an unreachable instruction", func() {
+			t := trap("unreachable")
+			Expect(t.Operation).To(Equal("unreachable"))
+			Expect(t.Kind).To(Equal(internal.TrapUnreachable))
+			Expect(t.Stack).NotTo(BeEmpty())
+			Expect(t.Error()).To(HavePrefix("Operation unreachable trapped with unreachable: "))
+		})
+
+		It("should classify an out of bounds memory access", func() {
+			Expect(trap("memory").Kind).To(Equal(internal.TrapOutOfBoundsMemoryAccess))
+		})
+
+		It("should classify an integer divide by zero", func() {
+			Expect(trap("divide").Kind).To(Equal(internal.TrapIntegerDivideByZero))
+		})
+
+		It("should discard the trapped instance", func() {
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}))
+
+			trap("divide")
+
+			result, err = wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}), "Should use a new instance")
+		})
+
+		It("should not classify a guest error as a trap", func() {
+			_, err := wasmGuest.InvokeWasmOperation(context.Background(), "fail", nil)
+			Expect(err).To(HaveOccurred())
+
+			var trap *internal.GuestTrap
+			Expect(errors.As(err, &trap)).To(BeFalse())
+		})
+	})
+
+	Describe("Failed invocations", func() {
+		It("should return the instance to the pool after a guest error", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "fail", nil)
+			Expect(err).To(HaveOccurred())
+
+			result, err = wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{2, 0, 0, 0}), "Should reuse the same instance")
+		})
+
+		It("should replace the instance after a trap", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+			Expect(err).To(HaveOccurred())
+
+			result, err = wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}), "Should use a new instance")
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+	})
+
+	Describe("Invocation failures", func() {
+		var (
+			engine    *testEngine
+			wasmGuest *internal.WasmGuest
+		)
+
+		BeforeEach(func() {
+			engine = &testEngine{Engine: wazeroengine.Engine()}
+			var err error
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithEngine(engine))
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}))
+		})
+
+		AfterEach(func() {
+			wasmGuest.Close()
+		})
+
+		invokeWithError := func(err error) {
+			engine.mutex.Lock()
+			engine.invokeErr = err
+			engine.mutex.Unlock()
+
+			_, invokeErr := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(invokeErr).To(MatchError(err.Error()))
+
+			engine.mutex.Lock()
+			engine.invokeErr = nil
+			engine.mutex.Unlock()
+		}
+
+		It("should keep the instance after a wrapped guest error", func() {
+			invokeWithError(fmt.Errorf("Transfer failed: %w", errors.New("insufficient funds")))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{2, 0, 0, 0}), "Should reuse the same instance")
+		})
+
+		It("should discard the instance after an error from the engine", func() {
+			invokeWithError(errors.New("error invoking guest with closed instance"))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}), "Should use a new instance")
+		})
+
+		It("should discard the instance after the guest exits", func() {
+			invokeWithError(sys.NewExitError("test", 1))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}), "Should use a new instance")
+		})
+	})
+
+	Describe("Maximum execution time", func() {
+		It("should not interrupt operations which complete in time", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMaxExecutionTime(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should interrupt operations which exceed the maximum execution time", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithMaxExecutionTime(time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, _, release := blockingReadState(contextStore)
+			defer close(release)
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+			Expect(result).To(BeNil())
+			Expect(errors.Is(err, internal.ErrExecutionTimeout)).To(BeTrue())
+			Expect(err).To(MatchError("Operation read interrupted after 1ms: Wasm operation exceeded maximum execution time"))
+
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}), "Should replace the interrupted instance")
+		})
+
+		It("should interrupt operations when the context is cancelled", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, _, release := blockingReadState(contextStore)
+			defer close(release)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			defer cancel()
+
+			result, err := wasmGuest.InvokeWasmOperation(ctx, "read", payload)
+			Expect(result).To(BeNil())
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		})
+
+		It("should fail with a negative maximum execution time", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithMaxExecutionTime(-time.Second))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid maximum execution time -1s: must not be negative"))
+		})
+	})
+
+	Describe("Compilation cache", func() {
+		var cacheDir string
+
+		BeforeEach(func() {
+			var err error
+			cacheDir, err = ioutil.TempDir("", "wasm_cache")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(cacheDir)
+		})
+
+		It("should cache compiled modules by digest", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithCompilationCache(cacheDir))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			digest := sha256.Sum256(testGuestWasm())
+			Expect(wasmGuest.WasmDigest()).To(Equal(hex.EncodeToString(digest[:])))
+			Expect(filepath.Join(cacheDir, wasmGuest.WasmDigest())).To(BeADirectory())
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should fail with an empty cache directory name", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithCompilationCache(""))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid compilation cache: directory must not be empty"))
+		})
+	})
+
+	Describe("Engine", func() {
+		It("should use the wazero engine by default", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.EngineName()).To(Equal("wazero"))
+		})
+
+		It("should use the specified engine", func() {
+			engine := &testEngine{Engine: wazeroengine.Engine()}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithEngine(engine))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.EngineName()).To(Equal("test"))
+			Expect(engine.modules).To(Equal(1))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should support host calls with the specified engine", func() {
+			engine := &testEngine{Engine: wazeroengine.Engine()}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithEngine(engine),
+				internal.WithHostCallHandler("Test", func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+					return append([]byte("host "), payload...), nil
+				}),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("host bond")))
+		})
+
+		It("should recover when the engine panics", func() {
+			engine := &testEngine{Engine: wazeroengine.Engine(), panics: true}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithEngine(engine))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(errors.Is(err, internal.ErrGuestPanicked)).To(BeTrue())
+			Expect(err).To(MatchError(ContainSubstring("engine failure")))
+			Expect(wasmGuest.Stats().Size).To(Equal(1))
+		})
+
+		It("should not accept a memory limit with another engine", func() {
+			engine := &testEngine{Engine: wazeroengine.Engine()}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithEngine(engine), internal.WithMemoryLimit(1<<20))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid memory limit 1048576: not supported by the test engine"))
+			Expect(engine.modules).To(Equal(0))
+		})
+
+		It("should not accept the default memory limit set explicitly with another engine", func() {
+			engine := &testEngine{Engine: wazeroengine.Engine()}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithEngine(engine), internal.WithMemoryLimit(internal.DefaultMemoryLimit))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError(fmt.Sprintf("Invalid memory limit %d: not supported by the test engine", internal.DefaultMemoryLimit)))
+			Expect(engine.modules).To(Equal(0))
+		})
+
+		It("should not accept a compilation cache with another engine", func() {
+			engine := &testEngine{Engine: wazeroengine.Engine()}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithCompilationCache("cache"), internal.WithEngine(engine))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid compilation cache cache: not supported by the test engine"))
+		})
+
+		It("should not accept a nil engine", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithEngine(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid engine: must not be nil"))
+		})
+	})
+
+	Describe("Instantiation retry", func() {
+		var engine *testEngine
+
+		BeforeEach(func() {
+			engine = &testEngine{Engine: wazeroengine.Engine()}
+		})
+
+		It("should retry transient errors creating instances when the guest is loaded", func() {
+			engine.instantiationFailures = []error{errors.New("out of memory"), errors.New("out of memory")}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithEngine(engine), internal.WithInstantiationRetry(3, time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(engine.instantiations).To(Equal(3))
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should give up after the maximum number of attempts", func() {
+			engine.instantiationFailures = []error{errors.New("out of memory"), errors.New("out of memory")}
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithEngine(engine), internal.WithInstantiationRetry(2, time.Millisecond))
+			Expect(err).To(MatchError("out of memory after 2 attempts"))
+			Expect(engine.instantiations).To(Equal(2))
+		})
+
+		It("should not retry errors which mean the module can never be instantiated", func() {
+			engine.instantiationFailures = []error{errors.New("start function[0] failed: wasm error: unreachable")}
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithEngine(engine), internal.WithInstantiationRetry(3, time.Millisecond))
+			Expect(err).To(MatchError("start function[0] failed: wasm error: unreachable"))
+			Expect(engine.instantiations).To(Equal(1))
+		})
+
+		It("should retry creating instances lazily", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLazyInstantiation(), internal.WithEngine(engine), internal.WithInstantiationRetry(2, time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			engine.mutex.Lock()
+			engine.instantiationFailures = []error{errors.New("out of memory")}
+			engine.mutex.Unlock()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(engine.instantiations).To(Equal(2))
+		})
+
+		It("should not retry the errors from the engine which mean the module can never be instantiated", func() {
+			header := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+			void := section(1, vec(funcType(nil, nil)))
+			modules := []struct {
+				wasm    []byte
+				message string
+			}{
+				{cat(header, void, section(3, vec([]byte{0x00})), section(8, uleb(0)), section(10, vec([]byte{0x03, 0x00, 0x00, 0x0b}))), "wasm error:"},
+				{cat(header, void, section(2, vec(importFunc("__missing", 0)))), "is not exported in module"},
+				{cat(header, void, section(2, vec(cat(name("missing"), name("call"), []byte{0x00, 0x00})))), "not instantiated"},
+				{cat(header, void, section(2, vec(importFunc("__console_log", 0)))), "import["},
+				{cat(header, section(5, vec([]byte{0x00, 0x01})), section(11, vec(cat([]byte{0x00}, i32Const(65536), []byte{0x0b}, uleb(1), []byte{0x00})))), "out of bounds memory access"},
+				{header, "didn't export function"},
+			}
+
+			for _, module := range modules {
+				engine := &testEngine{Engine: wazeroengine.Engine()}
+				_, err := internal.NewWasmGuestFromBytes(module.wasm, proxy, internal.WithPoolSize(1), internal.WithEngine(engine), internal.WithInstantiationRetry(3, time.Millisecond))
+				Expect(err).To(MatchError(ContainSubstring(module.message)))
+				Expect(errors.Is(err, internal.ErrCompileFailed)).To(BeFalse())
+				Expect(engine.instantiations).To(Equal(1), module.message)
+			}
+		})
+
+		It("should retry creating the replacement for a discarded instance", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMaxInstanceUses(1), internal.WithEngine(engine), internal.WithInstantiationRetry(2, time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			engine.mutex.Lock()
+			engine.instantiationFailures = []error{errors.New("out of memory")}
+			engine.mutex.Unlock()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(engine.instantiations).To(Equal(3))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, Idle: 1}))
+		})
+
+		It("should create an instance when a discarded instance cannot be replaced", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMaxInstanceUses(1), internal.WithEngine(engine), internal.WithInstantiationRetry(1, 0))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			engine.mutex.Lock()
+			engine.instantiationFailures = []error{errors.New("out of memory")}
+			engine.mutex.Unlock()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{}))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+			Expect(engine.instantiations).To(Equal(4))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, Idle: 1}))
+		})
+
+		It("should not retry with a single attempt", func() {
+			engine.instantiationFailures = []error{errors.New("out of memory")}
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithEngine(engine), internal.WithInstantiationRetry(1, 0))
+			Expect(err).To(MatchError("out of memory"))
+			Expect(engine.instantiations).To(Equal(1))
+		})
+
+		It("should reject invalid retry settings", func() {
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithInstantiationRetry(0, time.Millisecond))
+			Expect(err).To(MatchError("Invalid instantiation attempts 0: must be at least 1"))
+			_, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithInstantiationRetry(1, -time.Millisecond))
+			Expect(err).To(MatchError("Invalid instantiation backoff -1ms: must not be negative"))
+		})
+	})
+
+	Describe("Lazy instantiation", func() {
+		It("should create instances when they are needed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(3), internal.WithLazyInstantiation())
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 0, InUse: 0, Idle: 0}))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should create the minimum warm instances up front", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(3), internal.WithLazyInstantiation(), internal.WithMinWarmInstances(2))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 2, InUse: 0, Idle: 2}))
+		})
+
+		It("should not create more instances than the pool size", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2), internal.WithLazyInstantiation(), internal.WithAcquireTimeout(0))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					_, err := wasmGuest.InvokeWasmOperation(context.Background(), "spin", []byte{1})
+					Expect(err).NotTo(HaveOccurred())
+				}()
+			}
+			wg.Wait()
+
+			Expect(wasmGuest.Stats().Size).To(BeNumerically("<=", 2))
+		})
+
+		It("should fail when the minimum warm instances exceed the pool size", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2), internal.WithMinWarmInstances(3))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid minimum warm instances 3: must not exceed pool size 2"))
+		})
+
+		It("should fail with a negative minimum warm instances", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithMinWarmInstances(-1))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid minimum warm instances -1: must not be negative"))
+		})
+	})
+
+	Describe("Max payload size", func() {
+		It("should limit payloads to 16 MiB by default", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.MaxPayloadBytes()).To(Equal(16 << 20))
+			Expect(wasmGuest.MaxResultBytes()).To(Equal(0))
+		})
+
+		It("should reject payloads larger than the maximum", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMaxPayloadBytes(4))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("james"))
+			Expect(err).To(MatchError("Payload for operation echo is 5 bytes, exceeding the maximum of 4 bytes: Wasm payload too large"))
+			Expect(errors.Is(err, internal.ErrPayloadTooLarge)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrRequestRejected)).To(BeTrue())
+
+			var invokeErr *internal.InvokeError
+			Expect(errors.As(err, &invokeErr)).To(BeTrue())
+			Expect(invokeErr.Phase).To(Equal(internal.PhaseRequest))
+			Expect(wasmGuest.Stats().InUse).To(Equal(0))
+		})
+
+		It("should not limit payloads with a maximum of zero", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMaxPayloadBytes(0))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload := bytes.Repeat([]byte("7"), 32<<10)
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(payload))
+		})
+
+		It("should reject results larger than the maximum", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMaxResultBytes(4))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("james"))
+			Expect(err).To(MatchError("Result of operation echo is 5 bytes, exceeding the maximum of 4 bytes: Wasm payload too large"))
+			Expect(errors.Is(err, internal.ErrPayloadTooLarge)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrInvokeFailed)).To(BeTrue())
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should not accept negative maximum sizes", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithMaxPayloadBytes(-1))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid maximum payload size -1: must not be negative"))
+
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithMaxResultBytes(-1))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid maximum result size -1: must not be negative"))
+		})
+	})
+
+	Describe("Rate limits", func() {
+		It("should reject invocations of an operation over its rate limit", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1),
+				internal.WithOperationRateLimits(map[string]internal.RateLimit{"echo": {Rate: 0.001, Burst: 2}}),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			for i := 0; i < 2; i++ {
+				_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(result).To(BeNil())
+			Expect(errors.Is(err, internal.ErrRateLimited)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrAcquireFailed)).To(BeTrue())
+			Expect(err).To(MatchError(HavePrefix("Wasm operation rate limit exceeded for operation echo: retry in ")))
+			Expect(wasmGuest.OperationStats()["echo"].Count).To(Equal(uint64(2)))
+		})
+
+		It("should count each operation in a batch towards its rate limit", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1),
+				internal.WithOperationRateLimits(map[string]internal.RateLimit{"echo": {Rate: 0.001, Burst: 2}}),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			batch := []internal.Operation{{Name: "counter"}, {Name: "echo", Payload: []byte("bond")}, {Name: "echo", Payload: []byte("james")}, {Name: "echo", Payload: []byte("bond")}}
+			results, err := wasmGuest.InvokeBatch(context.Background(), batch)
+			Expect(results).To(BeEmpty())
+			Expect(errors.Is(err, internal.ErrRateLimited)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrAcquireFailed)).To(BeTrue())
+			Expect(err).To(MatchError(HavePrefix("Batch operation 4 of 4 rejected: Wasm operation rate limit exceeded for operation echo: retry in ")))
+			Expect(wasmGuest.OperationStats()["counter"].Count).To(Equal(uint64(0)), "Should reject the batch before invoking any operation")
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(errors.Is(err, internal.ErrRateLimited)).To(BeTrue())
+		})
+
+		It("should not throttle operations without a rate limit", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1),
+				internal.WithOperationRateLimits(map[string]internal.RateLimit{"echo": {Rate: 0.001, Burst: 1}}),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 10; i++ {
+				_, err = wasmGuest.InvokeWasmOperation(context.Background(), "counter", nil)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("should allow invocations again once the rate allows", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1),
+				internal.WithOperationRateLimits(map[string]internal.RateLimit{"echo": {Rate: 20, Burst: 1}}),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(errors.Is(err, internal.ErrRateLimited)).To(BeTrue())
+
+			Eventually(func() error {
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+				return err
+			}).Should(Succeed())
+		})
+
+		It("should fail with an invalid rate", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithOperationRateLimits(map[string]internal.RateLimit{"echo": {Rate: 0, Burst: 1}}))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid rate limit for operation echo: rate 0 must be positive"))
+		})
+
+		It("should fail with an invalid burst", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithOperationRateLimits(map[string]internal.RateLimit{"echo": {Rate: 1}}))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid rate limit for operation echo: burst 0 must be at least 1"))
+		})
+	})
+
+	Describe("Circuit breaker", func() {
+		It("should always be closed by default", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			for i := 0; i < 3; i++ {
+				_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+				Expect(err).To(HaveOccurred())
+			}
+			Expect(wasmGuest.CircuitState()).To(Equal(internal.CircuitClosed))
+		})
+
+		It("should open after consecutive failures and close after a successful probe", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithCircuitBreaker(2, 100*time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(wasmGuest.CircuitState()).To(Equal(internal.CircuitClosed))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(wasmGuest.CircuitState()).To(Equal(internal.CircuitOpen))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(errors.Is(err, internal.ErrCircuitOpen)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrAcquireFailed)).To(BeTrue())
+			Expect(err).To(MatchError(HavePrefix("Wasm guest circuit breaker is open: retry in ")))
+
+			Eventually(wasmGuest.CircuitState).Should(Equal(internal.CircuitHalfOpen))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+			Expect(wasmGuest.CircuitState()).To(Equal(internal.CircuitClosed))
+		})
+
+		It("should reopen if the probe fails", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithCircuitBreaker(1, 100*time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(wasmGuest.CircuitState()).To(Equal(internal.CircuitOpen))
+
+			Eventually(wasmGuest.CircuitState).Should(Equal(internal.CircuitHalfOpen))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, internal.ErrCircuitOpen)).To(BeFalse())
+			Expect(wasmGuest.CircuitState()).To(Equal(internal.CircuitOpen))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(errors.Is(err, internal.ErrCircuitOpen)).To(BeTrue())
+		})
+
+		It("should only allow one probe while half-open", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(2), internal.WithCircuitBreaker(1, 50*time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+			Expect(err).To(HaveOccurred())
+			Eventually(wasmGuest.CircuitState).Should(Equal(internal.CircuitHalfOpen))
+
+			payload, reading, release := blockingReadState(contextStore)
+			done := make(chan error, 1)
+			go func() {
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				done <- err
+			}()
+			Eventually(reading).Should(BeClosed())
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).To(MatchError("Wasm guest circuit breaker is open: waiting for probe invocation"))
+
+			close(release)
+			Eventually(done).Should(Receive(BeNil()))
+			Expect(wasmGuest.CircuitState()).To(Equal(internal.CircuitClosed))
+		})
+
+		It("should not count errors reported by the guest as failures", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithCircuitBreaker(1, time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			for i := 0; i < 3; i++ {
+				_, err = wasmGuest.InvokeWasmOperation(context.Background(), "fail", nil)
+				Expect(err).To(MatchError("guest failed"))
+			}
+			Expect(wasmGuest.CircuitState()).To(Equal(internal.CircuitClosed))
+		})
+
+		It("should not accept invalid settings", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithCircuitBreaker(0, time.Second))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid circuit breaker threshold 0: must be at least 1"))
+
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithCircuitBreaker(1, 0))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid circuit breaker cooldown 0s: must be positive"))
+		})
+	})
+
+	Describe("Max concurrency", func() {
+		It("should not limit concurrency by default", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.MaxConcurrency()).To(BeZero())
+		})
+
+		It("should queue callers until an invocation completes", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(2), internal.WithMaxConcurrency(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			Expect(wasmGuest.MaxConcurrency()).To(Equal(1))
+
+			payload, reading, release := blockingReadState(contextStore)
+
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				Expect(err).NotTo(HaveOccurred())
+			}()
+			<-reading
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			defer cancel()
+			result, err := wasmGuest.InvokeWasmOperation(ctx, "echo", []byte("bond"))
+			Expect(result).To(BeNil())
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			Expect(wasmGuest.Stats().InUse).To(Equal(1))
+
+			close(release)
+			<-done
+			result, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should fail with a negative max concurrency", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithMaxConcurrency(-1))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid max concurrency -1: must not be negative"))
+		})
+	})
+
+	Describe("Acquire retry", func() {
+		var (
+			contextStore *internal.ContextStore
+			logger       *recordingLogger
+		)
+
+		BeforeEach(func() {
+			contextStore = internal.NewContextStore()
+			logger = &recordingLogger{}
+		})
+
+		debugMessages := func() []string {
+			logger.Lock()
+			defer logger.Unlock()
+			return append([]string{}, logger.debug...)
+		}
+
+		// saturate invokes the blocking read operation on the only instance in the
+		// pool, returning a function to release it and wait for the read to finish
+		saturate := func(wasmGuest *internal.WasmGuest) func() {
+			payload, reading, release := blockingReadState(contextStore)
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				Expect(err).NotTo(HaveOccurred())
+			}()
+			<-reading
+
+			return func() {
+				close(release)
+				<-done
+			}
+		}
+
+		It("should retry until an instance becomes available", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithLogger(logger),
+				internal.WithAcquireTimeout(time.Millisecond), internal.WithAcquireRetry(10, 20*time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			release := saturate(wasmGuest)
+
+			invoked := make(chan []byte, 1)
+			go func() {
+				defer GinkgoRecover()
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+				Expect(err).NotTo(HaveOccurred())
+				invoked <- result
+			}()
+
+			Eventually(debugMessages).Should(ContainElement("[host] Retrying waPC instance in 20ms after 1 of 10 attempts: Timed out after 1ms waiting for waPC instance"))
+			release()
+			Eventually(invoked, "5s").Should(Receive(Equal([]byte("bond"))))
+		})
+
+		It("should fail after the maximum number of attempts", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithLogger(logger),
+				internal.WithAcquireTimeout(time.Millisecond), internal.WithAcquireRetry(3, time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			release := saturate(wasmGuest)
+			defer release()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).To(MatchError(ContainSubstring("Timed out after 1ms waiting for waPC instance after 3 attempts")))
+			Expect(errors.Is(err, internal.ErrPoolExhausted)).To(BeTrue())
+			Expect(debugMessages()).To(ContainElement("[host] Retrying waPC instance in 2ms after 2 of 3 attempts: Timed out after 1ms waiting for waPC instance"))
+		})
+
+		It("should not retry if the deadline would pass first", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1),
+				internal.WithAcquireTimeout(time.Millisecond), internal.WithAcquireRetry(3, time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			release := saturate(wasmGuest)
+			defer release()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			_, err = wasmGuest.InvokeWasmOperation(ctx, "echo", []byte("bond"))
+			Expect(err).To(MatchError(ContainSubstring("Timed out after 1ms waiting for waPC instance, and the deadline would pass before the next attempt in 1m0s")))
+		})
+
+		It("should stop retrying when the context is cancelled", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithLogger(logger),
+				internal.WithAcquireTimeout(time.Millisecond), internal.WithAcquireRetry(3, time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			release := saturate(wasmGuest)
+			defer release()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			invoked := make(chan error, 1)
+			go func() {
+				_, err := wasmGuest.InvokeWasmOperation(ctx, "echo", []byte("bond"))
+				invoked <- err
+			}()
+
+			Eventually(debugMessages).Should(ContainElement(HavePrefix("[host] Retrying waPC instance in 1m0s after 1 of 3 attempts")))
+			cancel()
+
+			var invokeErr error
+			Eventually(invoked).Should(Receive(&invokeErr))
+			Expect(errors.Is(invokeErr, context.Canceled)).To(BeTrue())
+		})
+
+		It("should not accept invalid retries", func() {
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithAcquireRetry(0, time.Millisecond))
+			Expect(err).To(MatchError("Invalid acquire attempts 0: must be at least 1"))
+
+			_, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithAcquireRetry(2, -time.Millisecond))
+			Expect(err).To(MatchError("Invalid acquire backoff -1ms: must not be negative"))
+		})
+	})
+
+	Describe("Max instance uses", func() {
+		It("should keep using instances by default", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			for i := uint32(1); i <= 3; i++ {
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binary.LittleEndian.Uint32(result)).To(Equal(i))
+			}
+		})
+
+		It("should replace instances after the maximum number of uses", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMaxInstanceUses(2))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			var counts []uint32
+			for i := 0; i < 5; i++ {
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+				Expect(err).NotTo(HaveOccurred())
+				counts = append(counts, binary.LittleEndian.Uint32(result))
+			}
+
+			Expect(counts).To(Equal([]uint32{1, 2, 1, 2, 1}))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should fail with a negative max instance uses", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithMaxInstanceUses(-1))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid max instance uses -1: must not be negative"))
+		})
+	})
+
+	Describe("Idle timeout", func() {
+		It("should evict idle instances down to the minimum warm instances", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(3), internal.WithMinWarmInstances(1), internal.WithIdleTimeout(50*time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Stats().Size).To(Equal(3))
+			Eventually(func() int { return wasmGuest.Stats().Size }).Should(Equal(1))
+			Consistently(func() int { return wasmGuest.Stats().Size }, 150*time.Millisecond).Should(Equal(1))
+			Expect(wasmGuest.PoolSize()).To(Equal(3))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should create evicted instances again when they are needed", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(2), internal.WithIdleTimeout(50*time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Eventually(func() int { return wasmGuest.Stats().Size }).Should(Equal(0))
+
+			payload, reading, release := blockingReadState(contextStore)
+			done := make(chan error, 1)
+			go func() {
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				done <- err
+			}()
+			Eventually(reading).Should(BeClosed())
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+			Expect(wasmGuest.Stats().Size).To(Equal(2))
+
+			close(release)
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("should not evict instances which are in use", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(2), internal.WithIdleTimeout(20*time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			done := make(chan error, 1)
+			go func() {
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				done <- err
+			}()
+			Eventually(reading).Should(BeClosed())
+
+			Eventually(func() internal.PoolStats { return poolCounts(wasmGuest.Stats()) }).Should(Equal(internal.PoolStats{Size: 1, InUse: 1, Idle: 0}))
+			Consistently(func() int { return wasmGuest.Stats().InUse }, 100*time.Millisecond).Should(Equal(1))
+
+			close(release)
+			Eventually(done).Should(Receive(BeNil()))
+			Expect(wasmGuest.Stats().Size).To(BeNumerically("<=", 1))
+		})
+
+		It("should not accept a negative idle timeout", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithIdleTimeout(-time.Second))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid idle timeout -1s: must not be negative"))
+		})
+	})
+
+	Describe("Ping", func() {
+		It("should invoke the ping operation", func() {
+			logger := &recordingLogger{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Ping(context.Background())).To(Succeed())
+			Expect(logger.debug).To(ContainElement("[host] Returning waPC Instance"))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should report when an instance cannot be acquired", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithAcquireTimeout(time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				Expect(err).NotTo(HaveOccurred())
+			}()
+			<-reading
+
+			err = wasmGuest.Ping(context.Background())
+			Expect(errors.Is(err, internal.ErrPoolUnavailable)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrPingFailed)).To(BeFalse())
+			Expect(err).To(MatchError("waPC instance unavailable: Timed out after 1ms waiting for waPC instance"))
+
+			close(release)
+			<-done
+			Expect(wasmGuest.Ping(context.Background())).To(Succeed())
+		})
+
+		It("should fail after the guest is closed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			Expect(wasmGuest.Ping(context.Background())).To(MatchError(internal.ErrGuestClosed))
+		})
+	})
+
+	Describe("Warmup", func() {
+		It("should invoke the operations on every instance", func() {
+			metrics := &recordingMetrics{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2), internal.WithMetrics(metrics))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Warmup(context.Background(), []internal.Operation{{Name: "count"}, {Name: "echo", Payload: []byte("bond")}})).To(Succeed())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 2, InUse: 0, Idle: 2}))
+			Expect(wasmGuest.OperationStats()).To(BeEmpty())
+			Expect(metrics.invocations).To(BeEmpty())
+
+			for i := 0; i < 2; i++ {
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binary.LittleEndian.Uint32(result)).To(Equal(uint32(2)))
+			}
+		})
+
+		It("should discard state writes", func() {
+			contextStore := internal.NewContextStore()
+			stub := &fakes.ChaincodeStubInterface{}
+			contextStore.Put("channel1", "txn1", stub)
+			fabricProxy := internal.NewFabricProxy(contextStore)
+
+			createState := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return fabricProxy.FabricCall(ctx, binding, "LedgerService", "CreateState", payload)
+			}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, fabricProxy, internal.WithPoolSize(1), internal.WithHostCallHandler("Test", createState))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, err := proto.Marshal(&contract.CreateStateRequest{
+				Context: &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"},
+				State:   &contract.State{Key: "007", Value: []byte("bond")},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(wasmGuest.Warmup(context.Background(), []internal.Operation{{Name: "host", Payload: payload}})).To(Succeed())
+			Expect(stub.PutStateCallCount()).To(Equal(0))
+		})
+
+		It("should stop at the first operation which fails", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			err = wasmGuest.Warmup(context.Background(), []internal.Operation{{Name: "fail"}, {Name: "count"}})
+			Expect(err).To(MatchError("Failed to warm up Wasm guest with operation fail: guest failed"))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binary.LittleEndian.Uint32(result)).To(Equal(uint32(1)))
+		})
+
+		It("should only warm up instances which have been created", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2), internal.WithLazyInstantiation(), internal.WithMinWarmInstances(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Warmup(context.Background(), []internal.Operation{{Name: "count"}})).To(Succeed())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should fail after the guest is closed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			Expect(wasmGuest.Warmup(context.Background(), []internal.Operation{{Name: "count"}})).To(MatchError(internal.ErrGuestClosed))
+		})
+	})
+
+	Describe("Resize", func() {
+		It("should grow the pool", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Resize(3)).To(Succeed())
+			Expect(wasmGuest.PoolSize()).To(Equal(3))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 3, InUse: 0, Idle: 3}))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should not create instances when growing a lazy pool", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLazyInstantiation(), internal.WithMinWarmInstances(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Resize(3)).To(Succeed())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should shrink the pool", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(3))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Resize(1)).To(Succeed())
+			Expect(wasmGuest.PoolSize()).To(Equal(1))
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should not close instances which are in use when shrinking the pool", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(2))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).NotTo(BeEmpty())
+			}()
+			<-reading
+
+			Expect(wasmGuest.Resize(1)).To(Succeed())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 1, Idle: 0}))
+
+			close(release)
+			<-done
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should provide new instances to waiting callers", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithAcquireTimeout(0))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				Expect(err).NotTo(HaveOccurred())
+			}()
+			<-reading
+
+			waiting := make(chan []byte)
+			go func() {
+				defer GinkgoRecover()
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+				Expect(err).NotTo(HaveOccurred())
+				waiting <- result
+			}()
+
+			Expect(wasmGuest.Resize(2)).To(Succeed())
+			Eventually(waiting).Should(Receive(Equal([]byte("bond"))))
+
+			close(release)
+			<-done
+		})
+
+		It("should fail with an invalid pool size", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Resize(0)).To(MatchError("Invalid pool size 0: must be at least 1"))
+		})
+
+		It("should fail with fewer than the minimum warm instances", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(3), internal.WithLazyInstantiation(), internal.WithMinWarmInstances(2))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Resize(1)).To(MatchError("Invalid pool size 1: must not be less than minimum warm instances 2"))
+		})
+
+		It("should fail after the guest is closed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			Expect(wasmGuest.Resize(2)).To(MatchError(internal.ErrGuestClosed))
+		})
+	})
+
+	Describe("InvokeMulti", func() {
+		It("should return the values framed by the guest", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			values, err := wasmGuest.InvokeMulti(context.Background(), "echo", internal.EncodeMultiResult([][]byte{[]byte("shaken"), []byte("stirred")}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(values).To(Equal([][]byte{[]byte("shaken"), []byte("stirred")}))
+		})
+	})
+
+	Describe("InvokeStream", func() {
+		var wasmGuest *internal.WasmGuest
+
+		BeforeEach(func() {
+			var err error
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			wasmGuest.Close()
+		})
+
+		It("should write each chunk streamed by the guest, followed by its result", func() {
+			w := &chunkWriter{}
+			Expect(wasmGuest.InvokeStream(context.Background(), "xport", []byte("bond"), w)).To(Succeed())
+			Expect(w.chunks).To(Equal([][]byte{[]byte("bond"), []byte("bond"), []byte("bond")}))
+		})
+
+		It("should write the result of an operation which does not stream", func() {
+			w := &chunkWriter{}
+			Expect(wasmGuest.InvokeStream(context.Background(), "echo", []byte("bond"), w)).To(Succeed())
+			Expect(w.chunks).To(Equal([][]byte{[]byte("bond")}))
+
+			w = &chunkWriter{}
+			Expect(wasmGuest.InvokeStream(context.Background(), "_ping", nil, w)).To(Succeed())
+			Expect(w.chunks).To(BeEmpty())
+		})
+
+		It("should fail when the writer fails", func() {
+			w := &chunkWriter{limit: 1, limited: true}
+			err := wasmGuest.InvokeStream(context.Background(), "xport", []byte("bond"), w)
+			Expect(err).To(MatchError(ContainSubstring("Result stream failed after 4 bytes: writer failed")))
+			var invokeErr *internal.InvokeError
+			Expect(errors.As(err, &invokeErr)).To(BeTrue())
+			Expect(invokeErr.Operation).To(Equal("xport"))
+			Expect(w.chunks).To(Equal([][]byte{[]byte("bond")}))
+		})
+
+		It("should not write to the writer after returning", func() {
+			w := &chunkWriter{}
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			err := wasmGuest.InvokeStream(ctx, "keep", []byte("bond"), w)
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+			written := len(w.chunks)
+			Expect(written).To(BeNumerically(">", 0))
+			Consistently(func() int { return len(w.chunks) }, 100*time.Millisecond).Should(Equal(written))
+		})
+
+		It("should reject chunks streamed after the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := &chunkWriter{onWrite: cancel}
+
+			err := wasmGuest.InvokeStream(ctx, "xport", []byte("bond"), w)
+			Expect(err).To(HaveOccurred())
+			Expect(w.chunks).To(Equal([][]byte{[]byte("bond")}))
+		})
+
+		It("should fail when the writer fails to write the result", func() {
+			w := &chunkWriter{limit: 0, limited: true}
+			err := wasmGuest.InvokeStream(context.Background(), "echo", []byte("bond"), w)
+			Expect(err).To(MatchError("Result stream failed after 0 bytes: writer failed"))
+		})
+
+		It("should fail a guest which streams when it is not invoked by InvokeStream", func() {
+			_, err := wasmGuest.InvokeWasmOperation(context.Background(), "xport", []byte("bond"))
+			Expect(err).To(MatchError(ContainSubstring(internal.ErrNotStreaming.Error())))
+		})
+
+		It("should fail when the guest fails", func() {
+			w := &chunkWriter{}
+			err := wasmGuest.InvokeStream(context.Background(), "fail", nil, w)
+			Expect(err).To(MatchError(ContainSubstring("guest failed")))
+			Expect(w.chunks).To(BeEmpty())
+		})
+
+		It("should not allow the result stream namespace to be registered", func() {
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithHostCallHandler(internal.ResultStreamNamespace, func(context.Context, string, string, string, []byte) ([]byte, error) {
+				return nil, nil
+			}))
+			Expect(err).To(MatchError("Invalid host call namespace ResultStream: reserved for result streams"))
+		})
+	})
+
+	Describe("Reset", func() {
+		count := func(wasmGuest *internal.WasmGuest) uint32 {
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			return binary.LittleEndian.Uint32(result)
+		}
+
+		It("should clear the guest state of idle instances", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(count(wasmGuest)).To(Equal(uint32(1)))
+			Expect(count(wasmGuest)).To(Equal(uint32(2)))
+
+			Expect(wasmGuest.Reset()).To(Succeed())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+			Expect(count(wasmGuest)).To(Equal(uint32(1)))
+		})
+
+		It("should replace instances which are in use when their invocations finish", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(count(wasmGuest)).To(Equal(uint32(1)))
+
+			payload, reading, release := blockingReadState(contextStore)
+			read := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			Expect(wasmGuest.Reset()).To(Succeed())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 1, Idle: 0}))
+
+			close(release)
+			var result internal.InvokeResult
+			Eventually(read).Should(Receive(&result))
+			Expect(result.Err).NotTo(HaveOccurred())
+			Expect(result.Result).NotTo(BeEmpty())
+
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+			Expect(count(wasmGuest)).To(Equal(uint32(1)))
+		})
+
+		It("should keep the size of a lazy pool", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(3), internal.WithLazyInstantiation(), internal.WithMinWarmInstances(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(count(wasmGuest)).To(Equal(uint32(1)))
+			Expect(wasmGuest.Reset()).To(Succeed())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+			Expect(count(wasmGuest)).To(Equal(uint32(1)))
+		})
+
+		It("should fail after the guest is closed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			Expect(wasmGuest.Reset()).To(MatchError(internal.ErrGuestClosed))
+		})
+	})
+
+	Describe("Module registry", func() {
+		var registry *internal.ModuleRegistry
+
+		BeforeEach(func() {
+			registry = internal.NewModuleRegistry()
+		})
+
+		hostCallHandler := func(name string) wapc.HostCallHandler {
+			return func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return append([]byte(name+" "), payload...), nil
+			}
+		}
+
+		It("should compile the module once for guests with the same Wasm bytes", func() {
+			stdout1, stdout2 := &bytes.Buffer{}, &bytes.Buffer{}
+			wasmGuest1, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleRegistry(registry),
+				internal.WithHostCallHandler("Test", hostCallHandler("a")), internal.WithStdout(stdout1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest1.Close()
+			wasmGuest2, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleRegistry(registry),
+				internal.WithHostCallHandler("Test", hostCallHandler("b")), internal.WithStdout(stdout2))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest2.Close()
+			Expect(registry.Len()).To(Equal(1))
+
+			result, err := wasmGuest1.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("a bond")))
+			result, err = wasmGuest2.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("b bond")))
+
+			_, err = wasmGuest2.InvokeWasmOperation(context.Background(), "out", []byte("shaken"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stdout1.String()).To(BeEmpty())
+			Expect(stdout2.String()).To(Equal("shaken"))
+		})
+
+		It("should keep separate instances for each guest", func() {
+			wasmGuest1, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleRegistry(registry))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest1.Close()
+			wasmGuest2, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleRegistry(registry))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest2.Close()
+
+			for _, wasmGuest := range []*internal.WasmGuest{wasmGuest1, wasmGuest1, wasmGuest2} {
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			result, err := wasmGuest2.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binary.LittleEndian.Uint32(result)).To(Equal(uint32(2)))
+		})
+
+		It("should close the compiled module when the last guest using it is closed", func() {
+			wasmGuest1, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleRegistry(registry))
+			Expect(err).NotTo(HaveOccurred())
+			wasmGuest2, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleRegistry(registry))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(wasmGuest1.Close()).To(Succeed())
+			Expect(registry.Len()).To(Equal(1))
+			result, err := wasmGuest2.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+
+			Expect(wasmGuest2.Close()).To(Succeed())
+			Expect(registry.Len()).To(Equal(0))
+		})
+
+		It("should release the old module when a guest reloads", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleRegistry(registry))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Reload(append(testGuestWasm(), section(0, name("reloaded"))...))).To(Succeed())
+			Expect(registry.Len()).To(Equal(1))
+		})
+
+		It("should compile the module separately for a different runtime configuration", func() {
+			wasmGuest1, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleRegistry(registry))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest1.Close()
+			wasmGuest2, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleRegistry(registry), internal.WithMemoryLimit(32*65536))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest2.Close()
+
+			Expect(registry.Len()).To(Equal(2))
+		})
+
+		It("should reject a nil registry", func() {
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithModuleRegistry(nil))
+			Expect(err).To(MatchError("Invalid module registry: must not be nil"))
+		})
+	})
+
+	Describe("Reload", func() {
+		var reloadedWasm []byte
+
+		BeforeEach(func() {
+			// A custom section changes the digest without changing the guest
+			reloadedWasm = append(testGuestWasm(), section(0, name("reloaded"))...)
+		})
+
+		It("should switch new invocations to the new module", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			oldDigest := wasmGuest.WasmDigest()
+			for _, expected := range []byte{1, 2} {
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(Equal([]byte{expected, 0, 0, 0}))
+			}
+
+			Expect(wasmGuest.Reload(reloadedWasm)).To(Succeed())
+			Expect(wasmGuest.WasmDigest()).NotTo(Equal(oldDigest))
+			Expect(wasmGuest.PoolSize()).To(Equal(1))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "count", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte{1, 0, 0, 0}), "Should use a new instance")
+		})
+
+		It("should let invocations of the old module finish", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			oldDigest := wasmGuest.WasmDigest()
+
+			payload, reading, release := blockingReadState(contextStore)
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				result, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).NotTo(BeEmpty())
+			}()
+			<-reading
+
+			reloaded := make(chan error, 1)
+			go func() {
+				reloaded <- wasmGuest.Reload(reloadedWasm)
+			}()
+			Eventually(wasmGuest.WasmDigest).ShouldNot(Equal(oldDigest))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred(), "Should not wait for the old pool")
+			Expect(result).To(Equal([]byte("bond")))
+			Expect(reloaded).NotTo(Receive(), "Should wait for the old invocation")
+
+			close(release)
+			<-done
+			Eventually(reloaded).Should(Receive(BeNil()))
+		})
+
+		It("should keep the current module if the new module is invalid", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			digest := wasmGuest.WasmDigest()
+
+			Expect(wasmGuest.Reload([]byte("bond"))).To(MatchError("Invalid Wasm module: missing \\0asm magic header"))
+			Expect(wasmGuest.Reload([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x07})).To(MatchError(HavePrefix("Failed to reload Wasm module: Invalid Wasm module")))
+			Expect(wasmGuest.WasmDigest()).To(Equal(digest))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should keep the current module if the new module does not export required operations", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithRequiredOperations(internal.PingOperation))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			err = wasmGuest.Reload([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00})
+			Expect(err).To(MatchError("Failed to reload Wasm module: Missing required Wasm operations: _ping"))
+			Expect(wasmGuest.HasOperation(internal.PingOperation)).To(BeTrue())
+		})
+
+		It("should fail after the guest is closed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			Expect(wasmGuest.Reload(reloadedWasm)).To(MatchError(internal.ErrGuestClosed))
+		})
+	})
+
+	Describe("Stats", func() {
+		It("should report idle instances", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(3))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 3, InUse: 0, Idle: 3}))
+		})
+
+		It("should report the memory of each instance", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			memory := wasmGuest.InstanceMemory()
+			Expect(memory).To(HaveLen(2))
+			initial := memory[0]
+			Expect(initial.Pages).To(BeNumerically(">", 0))
+			Expect(initial.Bytes).To(Equal(uint64(initial.Pages) * 65536))
+			Expect(memory[1]).To(Equal(initial))
+			Expect(wasmGuest.Stats().Memory).To(Equal(internal.MemoryStats{Total: 2 * initial.Bytes, Max: initial.Bytes, Mean: initial.Bytes}))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "grow", make([]byte, 2))
+			Expect(err).NotTo(HaveOccurred())
+
+			grown := initial.Bytes + 2*65536
+			Expect(wasmGuest.InstanceMemory()).To(ConsistOf(initial, internal.InstanceMemory{Bytes: grown, Pages: initial.Pages + 2}))
+			Expect(wasmGuest.Stats().Memory).To(Equal(internal.MemoryStats{Total: initial.Bytes + grown, Max: grown, Mean: (initial.Bytes + grown) / 2}))
+		})
+
+		It("should report the memory of checked out instances from before the invocation", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+			initial := wasmGuest.Stats().Memory
+
+			payload, reading, release := blockingReadState(contextStore)
+			results := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+			Expect(wasmGuest.Stats().Memory).To(Equal(initial))
+
+			close(release)
+			Eventually(results).Should(Receive())
+		})
+
+		It("should report no memory for an empty pool", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLazyInstantiation())
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.InstanceMemory()).To(BeEmpty())
+			Expect(wasmGuest.Stats().Memory).To(Equal(internal.MemoryStats{}))
+		})
+	})
+
+	Describe("Host call handlers", func() {
+		It("should route host calls to a registered namespace", func() {
+			handler := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return []byte(fmt.Sprintf("%s %s %s %s", binding, namespace, operation, payload)), nil
+			}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithHostCallHandler("Test", handler))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result)).To(Equal("wapc Test Call bond"))
+		})
+
+		It("should return host call handler errors to the guest", func() {
+			handler := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return nil, errors.New("no mr bond")
+			}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithHostCallHandler("Test", handler))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(result).To(BeNil())
+			Expect(err).To(MatchError("no mr bond"))
+		})
+
+		It("should return the error codes of host call errors to the guest", func() {
+			handler := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return nil, &internal.HostCallError{Code: internal.ErrorCodeMVCCReadConflict, Err: errors.New("no mr bond")}
+			}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithHostCallHandler("Test", handler))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(result).To(BeNil())
+			Expect(err).To(MatchError("[10 MVCC_READ_CONFLICT] no mr bond"))
+		})
+
+		It("should return the error codes of Fabric errors to the guest", func() {
+			contextStore := internal.NewContextStore()
+			stub := &fakes.ChaincodeStubInterface{}
+			stub.GetStateReturns(nil, errors.New("access denied for [GetState][mychannel]"))
+			contextStore.Put("channel1", "txn1", stub)
+
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, err := proto.Marshal(&contract.ReadStateRequest{Context: &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"}, StateKey: "007"})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+			Expect(result).To(BeNil())
+			Expect(err).To(MatchError("[8 ACCESS_DENIED] ReadState failed: access denied for [GetState][mychannel]"))
+		})
+
+		It("should route other host calls to the Fabric proxy", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(result).To(BeNil())
+			Expect(err).To(MatchError("[2 NOT_SUPPORTED] Operation not supported: wapc Test Call"))
+		})
+
+		It("should fail to register a Fabric namespace", func() {
+			handler := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return nil, nil
+			}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithHostCallHandler("LedgerService", handler))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid host call namespace LedgerService: reserved for Fabric operations"))
+		})
+
+		It("should fail to register a namespace twice", func() {
+			handler := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return nil, nil
+			}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithHostCallHandler("Test", handler), internal.WithHostCallHandler("Test", handler))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid host call namespace Test: already registered"))
+		})
+
+		It("should fail with a nil handler", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithHostCallHandler("Test", nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid host call handler for namespace Test: must not be nil"))
+		})
+	})
+
+	Describe("Module config", func() {
+		It("should wrap the host call handler", func() {
+			var calls []string
+			configure := func(config *internal.ModuleConfig) {
+				next := config.HostCallHandler
+				config.HostCallHandler = func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+					calls = append(calls, namespace+" "+operation)
+					return next(ctx, binding, namespace, operation, payload)
+				}
+			}
+			handler := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+				return payload, nil
+			}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithHostCallHandler("Test", handler), internal.WithModuleConfig(configure))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+			Expect(calls).To(Equal([]string{"Test Call"}))
+		})
+
+		It("should use the configured guest output writers", func() {
+			stdout := &bytes.Buffer{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleConfig(func(config *internal.ModuleConfig) {
+				config.Stdout = stdout
+			}))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "out", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stdout.String()).To(Equal("bond"))
+		})
+
+		It("should use the defaults for anything set to nil", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleConfig(func(config *internal.ModuleConfig) {
+				*config = internal.ModuleConfig{}
+			}))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(err).To(MatchError("[2 NOT_SUPPORTED] Operation not supported: wapc Test Call"))
+		})
+
+		It("should fail with a nil configure function", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithModuleConfig(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid module configuration: must not be nil"))
+		})
+
+		It("should pass guest console messages to a configured logger", func() {
+			var messages []string
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithModuleConfig(func(config *internal.ModuleConfig) {
+				config.Logger = func(msg string) { messages = append(messages, msg) }
+			}))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "log", []byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(messages).To(Equal([]string{"hello"}))
+		})
+	})
+
+	Describe("Guest console", func() {
+		var logger *recordingLogger
+
+		BeforeEach(func() {
+			logger = &recordingLogger{}
+		})
+
+		It("should log messages with the module and operation", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "log", []byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logger.info).To(ContainElement(fmt.Sprintf("[guest] module=%s operation=log: hello", wasmGuest.WasmDigest()[:12])))
+		})
+
+		It("should log messages with the transaction in the context", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			ctx := internal.WithTransaction(context.Background(), "channel1", "txn1", &fakes.ChaincodeStubInterface{})
+			_, err = wasmGuest.InvokeWasmOperation(ctx, "log", []byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logger.info).To(ContainElement(fmt.Sprintf("[guest] module=%s operation=log channel=channel1 txid=txn1: hello", wasmGuest.WasmDigest()[:12])))
+		})
+
+		It("should log messages with the module using another engine", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLogger(logger), internal.WithEngine(wazeroengine.Engine()))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			ctx := internal.WithTransaction(context.Background(), "channel1", "txn1", &fakes.ChaincodeStubInterface{})
+			_, err = wasmGuest.InvokeWasmOperation(ctx, "log", []byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logger.info).To(ContainElement(fmt.Sprintf("[guest] module=%s: hello", wasmGuest.WasmDigest()[:12])))
+		})
+	})
+
+	Describe("Syscall policy", func() {
+		wallClock := []byte{0}
+		monotonicClock := []byte{1}
+		timestamp := time.Date(2020, 7, 4, 12, 30, 0, 7, time.UTC)
+
+		readClock := func(wasmGuest *internal.WasmGuest, ctx context.Context, clock []byte) int64 {
+			result, err := wasmGuest.InvokeWasmOperation(ctx, "time", clock)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(HaveLen(8))
+			return int64(binary.LittleEndian.Uint64(result))
+		}
+
+		It("should use the fake wazero clocks by default", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			first := readClock(wasmGuest, context.Background(), wallClock)
+			Expect(readClock(wasmGuest, context.Background(), wallClock)).To(Equal(first + int64(time.Millisecond)))
+		})
+
+		It("should restart the clocks at the transaction timestamp for each invocation", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithSyscallPolicy(internal.SyscallsDeterministic))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			ctx := internal.WithTransactionSeed(context.Background(), timestamp, []byte("txn1"))
+			Expect(readClock(wasmGuest, ctx, wallClock)).To(Equal(timestamp.UnixNano()))
+			Expect(readClock(wasmGuest, ctx, wallClock)).To(Equal(timestamp.UnixNano()))
+			Expect(readClock(wasmGuest, ctx, monotonicClock)).To(Equal(int64(0)))
+		})
+
+		It("should start the wall clock at the Unix epoch without a transaction seed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithSyscallPolicy(internal.SyscallsDeterministic))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(readClock(wasmGuest, context.Background(), wallClock)).To(Equal(int64(0)))
+		})
+
+		It("should seed the random bytes with the transaction seed for each invocation", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2), internal.WithSyscallPolicy(internal.SyscallsDeterministic))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			ctx := internal.WithTransactionSeed(context.Background(), timestamp, []byte("txn1"))
+			first := sha256.Sum256([]byte("txn1\x00\x00\x00\x00\x00\x00\x00\x00"))
+			second := sha256.Sum256([]byte("txn1\x00\x00\x00\x00\x00\x00\x00\x01"))
+			expected := append(first[:], second[:8]...)
+
+			for i := 0; i < 3; i++ {
+				result, err := wasmGuest.InvokeWasmOperation(ctx, "noise", make([]byte, 40))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(Equal(expected))
+			}
+
+			otherCtx := internal.WithTransactionSeed(context.Background(), timestamp, []byte("txn2"))
+			result, err := wasmGuest.InvokeWasmOperation(otherCtx, "noise", make([]byte, 40))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).NotTo(Equal(expected))
+		})
+
+		It("should fail invocations which read the clocks or random bytes when trapping", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithSyscallPolicy(internal.SyscallsTrap))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "time", wallClock)
+			Expect(err).To(MatchError(ContainSubstring("Guest read the wall clock: Nondeterministic WASI call rejected")))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "time", monotonicClock)
+			Expect(err).To(MatchError(ContainSubstring("Guest read the monotonic clock: Nondeterministic WASI call rejected")))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "noise", []byte{0})
+			Expect(err).To(MatchError(ContainSubstring("Guest read the random bytes: Nondeterministic WASI call rejected")))
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte("bond")))
+		})
+
+		It("should not accept an invalid policy", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithSyscallPolicy(internal.SyscallPolicy(7)))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid syscall policy SyscallPolicy(7)"))
+		})
+
+		It("should not accept a policy with another engine", func() {
+			engine := &testEngine{Engine: wazeroengine.Engine()}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithEngine(engine), internal.WithSyscallPolicy(internal.SyscallsTrap))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid syscall policy trap: not supported by the test engine"))
+		})
+	})
+
+	Describe("WASI", func() {
+		var configDir string
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = ioutil.TempDir("", "wasi_config")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(configDir, "app.json"), []byte(`{"bond":7}`), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(configDir)
+		})
+
+		It("should not pass any environment variables by default", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "vars", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(BeEmpty())
+		})
+
+		It("should pass the specified environment variables", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1),
+				internal.WithWasiEnv("CHAINCODE_ID", "wasmcc:1"),
+				internal.WithWasiEnv("LEVEL", "debug"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "vars", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result)).To(Equal("CHAINCODE_ID=wasmcc:1\x00LEVEL=debug\x00"))
+		})
+
+		It("should not accept invalid environment variables", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithWasiEnv("A=B", "C"))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError(`Invalid WASI environment variable "A=B": must be a non-empty name without '=' or NUL characters`))
+
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithWasiEnv("A", "B"), internal.WithWasiEnv("A", "C"))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError(`Invalid WASI environment variable "A": already set`))
+		})
+
+		It("should not give access to the filesystem by default", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "path", []byte("config/app.json"))
+			Expect(err).To(MatchError(ContainSubstring("open failed")))
+		})
+
+		It("should give read access to preopened directories", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithWasiPreopen("/config", configDir))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "path", []byte("config/app.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte(`{"bond":7}`)))
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "path", []byte("app.json"))
+			Expect(err).To(MatchError(ContainSubstring("open failed")))
+		})
+
+		It("should give read access to a directory preopened at the root", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithWasiPreopen("/", configDir))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "path", []byte("app.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal([]byte(`{"bond":7}`)))
+		})
+
+		It("should not accept invalid preopens", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithWasiPreopen("config", configDir))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError(`Invalid WASI preopen "config": guest path must be a clean absolute path`))
+
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithWasiPreopen("/config", filepath.Join(configDir, "app.json")))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError(fmt.Sprintf(`Invalid WASI preopen "/config": %s is not a directory`, filepath.Join(configDir, "app.json"))))
+
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithWasiPreopen("/etc", configDir), internal.WithWasiPreopen("/etc/app", configDir))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError(`Invalid WASI preopen "/etc/app": overlaps existing preopen /etc`))
+		})
+
+		It("should not accept WASI configuration with another engine", func() {
+			engine := &testEngine{Engine: wazeroengine.Engine()}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithEngine(engine), internal.WithWasiPreopen("/config", configDir))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid WASI preopens: not supported by the test engine"))
+
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, proxy, internal.WithEngine(engine), internal.WithWasiEnv("A", "B"))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid WASI environment variables: not supported by the test engine"))
+		})
+	})
+
+	Describe("Guest output", func() {
+		It("should write guest output to the configured writers", func() {
+			var stdout, stderr bytes.Buffer
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithStdout(&stdout), internal.WithStderr(&stderr))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "out", []byte("shaken"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "warn", []byte("stirred"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(stdout.String()).To(Equal("shaken"))
+			Expect(stderr.String()).To(Equal("stirred"))
+		})
+
+		It("should capture guest output for an invocation", func() {
+			var stdout, stderr, captured bytes.Buffer
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithStdout(&stdout), internal.WithStderr(&stderr))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			ctx := internal.WithGuestOutput(context.Background(), &captured, nil)
+			_, err = wasmGuest.InvokeWasmOperation(ctx, "out", []byte("shaken"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = wasmGuest.InvokeWasmOperation(ctx, "warn", []byte("stirred"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "out", []byte("not stirred"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(captured.String()).To(Equal("shaken"))
+			Expect(stderr.String()).To(Equal("stirred"))
+			Expect(stdout.String()).To(Equal("not stirred"))
+		})
+
+		It("should prefix each line of guest output with the transaction and operation", func() {
+			var stdout, stderr bytes.Buffer
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithStdout(&stdout), internal.WithStderr(&stderr), internal.WithOutputLinePrefix())
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			ctx := internal.WithTransaction(context.Background(), "channel1", "txn1", &fakes.ChaincodeStubInterface{})
+			_, err = wasmGuest.InvokeWasmOperation(ctx, "out", []byte("shaken\nnot"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = wasmGuest.InvokeWasmOperation(ctx, "warn", []byte("stirred\n"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "out", []byte("martini\n"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(stdout.String()).To(Equal("[txid=txn1] [op=out] shaken\n[txid=txn1] [op=out] not\n[op=out] martini\n"))
+			Expect(stderr.String()).To(Equal("[txid=txn1] [op=warn] stirred\n"))
+		})
+
+		It("should prefix captured guest output", func() {
+			var stdout, captured bytes.Buffer
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithStdout(&stdout), internal.WithOutputLinePrefix())
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			ctx := internal.WithTransaction(context.Background(), "channel1", "txn1", &fakes.ChaincodeStubInterface{})
+			ctx = internal.WithGuestOutput(ctx, &captured, nil)
+			_, err = wasmGuest.InvokeWasmOperation(ctx, "out", []byte("shaken"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(captured.String()).To(Equal("[txid=txn1] [op=out] shaken\n"))
+			Expect(stdout.String()).To(BeEmpty())
+		})
+
+		It("should fail with a nil stdout", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithStdout(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid stdout: must not be nil"))
+		})
+
+		It("should fail with a nil stderr", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithStderr(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid stderr: must not be nil"))
+		})
+	})
+
+	Describe("Guest input", func() {
+		input := func(ctx context.Context, wasmGuest *internal.WasmGuest) string {
+			result, err := wasmGuest.InvokeWasmOperation(ctx, "input", nil)
+			Expect(err).NotTo(HaveOccurred())
+			return string(result)
+		}
+
+		It("should read empty stdin by default", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(input(context.Background(), wasmGuest)).To(BeEmpty())
+		})
+
+		It("should read the configured stdin from the start for each invocation", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2), internal.WithStdin(strings.NewReader("shaken")))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(input(context.Background(), wasmGuest)).To(Equal("shaken"))
+			Expect(input(context.Background(), wasmGuest)).To(Equal("shaken"))
+
+			results := []<-chan internal.InvokeResult{
+				wasmGuest.InvokeAsync(context.Background(), "input", nil),
+				wasmGuest.InvokeAsync(context.Background(), "input", nil),
+			}
+			for _, r := range results {
+				var result internal.InvokeResult
+				Eventually(r).Should(Receive(&result))
+				Expect(result.Err).NotTo(HaveOccurred())
+				Expect(string(result.Result)).To(Equal("shaken"))
+			}
+		})
+
+		It("should read stdin for an invocation", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithStdin(strings.NewReader("shaken")))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			ctx := internal.WithGuestInput(context.Background(), strings.NewReader("stirred"))
+			Expect(input(ctx, wasmGuest)).To(Equal("stirred"))
+			Expect(input(context.Background(), wasmGuest)).To(Equal("shaken"))
+		})
+
+		It("should not wait for stdin which blocks to release the instance", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			stdin, stdinWriter := io.Pipe()
+			defer stdinWriter.Close()
+
+			ctx, cancel := context.WithTimeout(internal.WithGuestInput(context.Background(), stdin), 50*time.Millisecond)
+			defer cancel()
+
+			var result internal.InvokeResult
+			Eventually(wasmGuest.InvokeAsync(ctx, "input", nil)).Should(Receive(&result))
+			Expect(errors.Is(result.Err, context.DeadlineExceeded)).To(BeTrue())
+
+			Expect(input(context.Background(), wasmGuest)).To(BeEmpty(), "Should replace the blocked instance")
+		})
+
+		It("should reject a nil stdin", func() {
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithStdin(nil))
+			Expect(err).To(MatchError("Invalid stdin: must not be nil"))
+		})
+
+		It("should reject stdin for another engine", func() {
+			_, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithEngine(&testEngine{Engine: wazeroengine.Engine()}), internal.WithStdin(strings.NewReader("shaken")))
+			Expect(err).To(MatchError("Invalid stdin: not supported by the test engine"))
+		})
+	})
+
+	Describe("Tracing", func() {
+		It("should trace invocations and the host calls they make", func() {
+			contextStore := internal.NewContextStore()
+			stub := &fakes.ChaincodeStubInterface{}
+			stub.GetStateReturns([]byte("bond"), nil)
+			contextStore.Put("channel1", "txn1", stub)
+
+			tracer := &recordingTracer{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithTracer(tracer))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, err := proto.Marshal(&contract.ReadStateRequest{
+				Context:  &contract.TransactionContext{ChannelId: "channel1", TransactionId: "txn1"},
+				StateKey: "007",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(tracer.spans).To(HaveLen(2))
+			invokeSpan, hostCallSpan := tracer.spans[0], tracer.spans[1]
+
+			Expect(invokeSpan.name).To(Equal("InvokeWasmOperation"))
+			Expect(invokeSpan.parent).To(BeNil())
+			Expect(invokeSpan.attributes).To(Equal(map[string]interface{}{
+				"wasm.operation":    "read",
+				"wasm.payload_size": len(payload),
+				"wasm.outcome":      "success",
+			}))
+			Expect(invokeSpan.ended).To(BeTrue())
+			Expect(invokeSpan.err).NotTo(HaveOccurred())
+
+			Expect(hostCallSpan.name).To(Equal("HostCall"))
+			Expect(hostCallSpan.parent).To(BeIdenticalTo(invokeSpan))
+			Expect(hostCallSpan.attributes).To(Equal(map[string]interface{}{
+				"host.binding":      "wapc",
+				"host.namespace":    "LedgerService",
+				"host.operation":    "ReadState",
+				"host.payload_size": len(payload),
+				"fabric.key":        "007",
+			}))
+			Expect(hostCallSpan.ended).To(BeTrue())
+			Expect(hostCallSpan.err).NotTo(HaveOccurred())
+		})
+
+		It("should record failed host calls", func() {
+			tracer := &recordingTracer{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithTracer(tracer))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "host", []byte("bond"))
+			Expect(err).To(HaveOccurred())
+
+			Expect(tracer.spans).To(HaveLen(2))
+			Expect(tracer.spans[0].attributes).To(HaveKeyWithValue("wasm.outcome", "invoke failed"))
+			Expect(tracer.spans[0].err).To(HaveOccurred())
+			Expect(tracer.spans[1].err).To(MatchError("Operation not supported: wapc Test Call"))
+		})
+
+		It("should record invocations which cannot acquire an instance", func() {
+			tracer := &recordingTracer{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithTracer(tracer))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", nil)
+			Expect(err).To(MatchError(internal.ErrGuestClosed))
+
+			Expect(tracer.spans).To(HaveLen(1))
+			Expect(tracer.spans[0].attributes).To(HaveKeyWithValue("wasm.outcome", "acquire failed"))
+			Expect(tracer.spans[0].err).To(MatchError(internal.ErrGuestClosed))
+		})
+
+		It("should not accept a nil tracer", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithTracer(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid tracer: must not be nil"))
+		})
+	})
+
+	Describe("Pool hooks", func() {
+		var (
+			mutex  sync.Mutex
+			events []internal.PoolEvent
+			hook   internal.PoolHook
+		)
+
+		BeforeEach(func() {
+			events = nil
+			hook = func(event internal.PoolEvent) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				event.Wait = 0
+				events = append(events, event)
+			}
+		})
+
+		recorded := func() []internal.PoolEvent {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return append([]internal.PoolEvent(nil), events...)
+		}
+
+		It("should report the lifecycle of each instance", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithPoolHook(hook))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			Expect(recorded()).To(Equal([]internal.PoolEvent{
+				{Kind: internal.PoolInstanceCreated, Instance: 1, Size: 1, InUse: 0},
+				{Kind: internal.PoolInstanceAcquired, Instance: 1, Size: 1, InUse: 1},
+				{Kind: internal.PoolInstanceReturned, Instance: 1, Size: 1, InUse: 0},
+				{Kind: internal.PoolInstanceAcquired, Instance: 1, Size: 1, InUse: 1},
+				{Kind: internal.PoolInstanceDestroyed, Instance: 1, Size: 0, InUse: 0},
+				{Kind: internal.PoolInstanceCreated, Instance: 2, Size: 1, InUse: 0},
+				{Kind: internal.PoolInstanceDestroyed, Instance: 2, Size: 0, InUse: 0},
+			}))
+		})
+
+		It("should report how long the acquire waited", func() {
+			var mutex sync.Mutex
+			var waits []time.Duration
+			waitHook := func(event internal.PoolEvent) {
+				if event.Kind == internal.PoolInstanceAcquired {
+					mutex.Lock()
+					defer mutex.Unlock()
+					waits = append(waits, event.Wait)
+				}
+			}
+
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithPoolHook(waitHook))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			results := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			waiting := wasmGuest.InvokeAsync(context.Background(), "echo", nil)
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+			Eventually(results).Should(Receive())
+			Eventually(waiting).Should(Receive())
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			Expect(waits).To(HaveLen(2))
+			Expect(waits[1]).To(BeNumerically(">=", 20*time.Millisecond))
+		})
+
+		It("should not hold the pool lock while calling hooks", func() {
+			var wasmGuest *internal.WasmGuest
+			statsHook := func(event internal.PoolEvent) {
+				if wasmGuest != nil {
+					wasmGuest.Stats()
+				}
+			}
+
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithPoolHook(statsHook))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should not accept nil hooks", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolHook(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid pool hook: must not be nil"))
+		})
+	})
+
+	Describe("Metrics", func() {
+		It("should record successful invocations", func() {
+			metrics := &recordingMetrics{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMetrics(metrics))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(metrics.acquires).To(HaveLen(1))
+			Expect(metrics.acquires[0].err).NotTo(HaveOccurred())
+			Expect(metrics.invocations).To(HaveLen(1))
+			Expect(metrics.invocations[0].operation).To(Equal("echo"))
+			Expect(metrics.invocations[0].duration).To(BeNumerically(">", 0))
+			Expect(metrics.invocations[0].err).NotTo(HaveOccurred())
+		})
+
+		It("should record failed invocations", func() {
+			metrics := &recordingMetrics{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithMetrics(metrics))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "fail", nil)
+			Expect(err).To(HaveOccurred())
+
+			Expect(metrics.invocations).To(HaveLen(1))
+			Expect(metrics.invocations[0].operation).To(Equal("fail"))
+			Expect(metrics.invocations[0].err).To(MatchError("guest failed"))
+		})
+
+		It("should record failures to acquire an instance", func() {
+			contextStore := internal.NewContextStore()
+			metrics := &recordingMetrics{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithAcquireTimeout(time.Millisecond), internal.WithMetrics(metrics))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+				Expect(err).NotTo(HaveOccurred())
+			}()
+			<-reading
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).To(HaveOccurred())
+
+			close(release)
+			<-done
+
+			metrics.Lock()
+			defer metrics.Unlock()
+			Expect(metrics.acquires).To(HaveLen(2))
+			Expect(metrics.acquires).To(ContainElement(WithTransform(func(o observation) error { return o.err }, MatchError("Timed out after 1ms waiting for waPC instance"))))
+			Expect(metrics.invocations).To(HaveLen(1))
+			Expect(metrics.invocations[0].operation).To(Equal("read"))
+		})
+
+		It("should fail with nil metrics", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithMetrics(nil))
+			Expect(wasmGuest).To(BeNil())
+			Expect(err).To(MatchError("Invalid metrics: must not be nil"))
+		})
+	})
+
+	Describe("Logging", func() {
+		It("should log pool activity at debug level", func() {
+			logger := &recordingLogger{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logger.debug).To(ContainElement("[host] Getting waPC Instance"))
+			Expect(logger.debug).To(ContainElement("[host] Returning waPC Instance"))
+			Expect(logger.errors).To(BeEmpty())
+		})
+
+		It("should log errors at error level", func() {
+			logger := &recordingLogger{}
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "fail", []byte("bond"))
+			Expect(err).To(HaveOccurred())
+
+			Expect(logger.errors).To(ContainElement("[host] error invoking transaction: guest failed"))
+		})
+	})
+
+	Describe("Transaction isolation", func() {
+		var (
+			contextStore *internal.ContextStore
+			wasmGuest    *internal.WasmGuest
+		)
+
+		BeforeEach(func() {
+			contextStore = internal.NewContextStore()
+
+			var err error
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(2))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(wasmGuest.Close()).To(Succeed())
+		})
+
+		readStatePayload := func(txID string) []byte {
+			payload, err := proto.Marshal(&contract.ReadStateRequest{
+				Context:  &contract.TransactionContext{ChannelId: "channel1", TransactionId: txID},
+				StateKey: "007",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return payload
+		}
+
+		readValue := func(result []byte) []byte {
+			response := &contract.ReadStateResponse{}
+			Expect(proto.Unmarshal(result, response)).To(Succeed())
+			return response.GetState().GetValue()
+		}
+
+		It("should route host calls from concurrent invocations to their own transaction stub", func() {
+			var reading sync.WaitGroup
+			reading.Add(2)
+			newStub := func(value string) *fakes.ChaincodeStubInterface {
+				stub := &fakes.ChaincodeStubInterface{}
+				stub.GetStateStub = func(key string) ([]byte, error) {
+					reading.Done()
+					reading.Wait()
+					return []byte(value), nil
+				}
+				return stub
+			}
+			stubs := map[string]*fakes.ChaincodeStubInterface{"txn1": newStub("bond"), "txn2": newStub("moneypenny")}
+
+			type readResult struct {
+				txID  string
+				value []byte
+				err   error
+			}
+			results := make(chan readResult, 2)
+			for txID, stub := range stubs {
+				contextStore.Put("channel1", txID, stub)
+				go func(txID string, stub *fakes.ChaincodeStubInterface) {
+					ctx := internal.WithTransaction(context.Background(), "channel1", txID, stub)
+					result, err := wasmGuest.InvokeWasmOperation(ctx, "read", readStatePayload(txID))
+					if err != nil {
+						results <- readResult{txID: txID, err: err}
+						return
+					}
+					results <- readResult{txID: txID, value: readValue(result)}
+				}(txID, stub)
+			}
+
+			values := map[string]string{}
+			for i := 0; i < 2; i++ {
+				var r readResult
+				Eventually(results).Should(Receive(&r))
+				Expect(r.err).NotTo(HaveOccurred())
+				values[r.txID] = string(r.value)
+			}
+			Expect(values).To(Equal(map[string]string{"txn1": "bond", "txn2": "moneypenny"}))
+			Expect(stubs["txn1"].GetStateCallCount()).To(Equal(1))
+			Expect(stubs["txn2"].GetStateCallCount()).To(Equal(1))
+		})
+
+		It("should not let a guest use the stub of another transaction in progress", func() {
+			stub := &fakes.ChaincodeStubInterface{}
+			other := &fakes.ChaincodeStubInterface{}
+			contextStore.Put("channel1", "txn1", stub)
+			contextStore.Put("channel1", "txn2", other)
+
+			ctx := internal.WithTransaction(context.Background(), "channel1", "txn1", stub)
+			_, err := wasmGuest.InvokeWasmOperation(ctx, "read", readStatePayload("txn2"))
+			Expect(err).To(MatchError(ContainSubstring("ReadState failed: Transaction context channel1 txn2 does not match the transaction being invoked")))
+			Expect(other.GetStateCallCount()).To(Equal(0))
+		})
+	})
+
+	Describe("Health", func() {
+		It("should report a new guest as live and ready", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			report := wasmGuest.Health()
+			Expect(report.Live).To(BeTrue())
+			Expect(report.Ready).To(BeTrue())
+			Expect(report.Loaded).To(BeTrue())
+			Expect(report.Digest).To(Equal(wasmGuest.WasmDigest()))
+			Expect(report.Circuit).To(Equal(internal.CircuitClosed))
+			Expect(report.PoolCapacity).To(Equal(2))
+			Expect(report.PoolIdle).To(Equal(2))
+			Expect(report.RecentInvocations).To(Equal(0))
+			Expect(report.LastSuccess.IsZero()).To(BeTrue())
+		})
+
+		It("should report the error rate of recent invocations", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			before := time.Now()
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "fail", nil)
+			Expect(err).To(HaveOccurred())
+
+			report := wasmGuest.Health()
+			Expect(report.RecentInvocations).To(Equal(2))
+			Expect(report.RecentErrors).To(Equal(1))
+			Expect(report.ErrorRate).To(Equal(0.5))
+			Expect(report.LastSuccess).To(BeTemporally(">=", before))
+		})
+
+		It("should only include the most recent invocations in the error rate", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "fail", nil)
+			Expect(err).To(HaveOccurred())
+			for i := 0; i < 100; i++ {
+				_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", nil)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			report := wasmGuest.Health()
+			Expect(report.RecentInvocations).To(Equal(100))
+			Expect(report.RecentErrors).To(Equal(0))
+		})
+
+		It("should report a guest with every instance in use as live but not ready", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			read := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			report := wasmGuest.Health()
+			Expect(report.Live).To(BeTrue())
+			Expect(report.Ready).To(BeFalse())
+			Expect(report.PoolInUse).To(Equal(1))
+
+			close(release)
+			Eventually(read).Should(Receive())
+			Expect(wasmGuest.Health().Ready).To(BeTrue())
+		})
+
+		It("should report a draining guest as live but not ready", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Drain(context.Background())).To(Succeed())
+
+			report := wasmGuest.Health()
+			Expect(report.Draining).To(BeTrue())
+			Expect(report.Live).To(BeTrue())
+			Expect(report.Ready).To(BeFalse())
+		})
+
+		It("should report a guest with an open circuit breaker as not live", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1), internal.WithCircuitBreaker(1, time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "unreachable", nil)
+			Expect(err).To(HaveOccurred())
+
+			report := wasmGuest.Health()
+			Expect(report.Circuit).To(Equal(internal.CircuitOpen))
+			Expect(report.Live).To(BeFalse())
+			Expect(report.Ready).To(BeFalse())
+		})
+
+		It("should report a closed guest as not live", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			report := wasmGuest.Health()
+			Expect(report.Closed).To(BeTrue())
+			Expect(report.Loaded).To(BeFalse())
+			Expect(report.Live).To(BeFalse())
+		})
+
+		It("should marshal the report as JSON", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			data, err := json.Marshal(wasmGuest.Health())
+			Expect(err).NotTo(HaveOccurred())
+			fields := map[string]interface{}{}
+			Expect(json.Unmarshal(data, &fields)).To(Succeed())
+			Expect(fields).To(HaveKeyWithValue("live", true))
+			Expect(fields).To(HaveKeyWithValue("ready", true))
+			Expect(fields).To(HaveKeyWithValue("circuit", "closed"))
+		})
+	})
+
+	Describe("Releasing instances during shutdown", func() {
+		var (
+			contextStore *internal.ContextStore
+			logger       *recordingLogger
+			wasmGuest    *internal.WasmGuest
+		)
+
+		BeforeEach(func() {
+			contextStore = internal.NewContextStore()
+			logger = &recordingLogger{}
+			var err error
+			wasmGuest, err = internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1), internal.WithLogger(logger))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			wasmGuest.Close()
+
+			logger.Lock()
+			defer logger.Unlock()
+			Expect(logger.errors).NotTo(ContainElement(ContainSubstring("error returning waPC instance")))
+			Expect(logger.errors).NotTo(ContainElement(ContainSubstring("error discarding waPC instance")))
+		})
+
+		It("should close instances returned while draining", func() {
+			payload, reading, release := blockingReadState(contextStore)
+			results := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			drained := make(chan error, 1)
+			go func() { drained <- wasmGuest.Drain(context.Background()) }()
+			Eventually(wasmGuest.Draining).Should(BeTrue())
+
+			close(release)
+			Eventually(drained).Should(Receive(BeNil()))
+			Eventually(results).Should(Receive())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 0, InUse: 0, Idle: 0}))
+		})
+
+		It("should close instances of a reloaded module", func() {
+			payload, reading, release := blockingReadState(contextStore)
+			results := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			reloaded := make(chan error, 1)
+			go func() { reloaded <- wasmGuest.Reload(testGuestWasm()) }()
+			Eventually(func() int { return poolCounts(wasmGuest.Stats()).Idle }).Should(Equal(1))
+
+			close(release)
+			Eventually(reloaded).Should(Receive(BeNil()))
+			var result internal.InvokeResult
+			Eventually(results).Should(Receive(&result))
+			Expect(result.Err).NotTo(HaveOccurred())
+			Expect(poolCounts(wasmGuest.Stats())).To(Equal(internal.PoolStats{Size: 1, InUse: 0, Idle: 1}))
+		})
+
+		It("should not replace instances discarded after a forced close", func() {
+			payload, reading, release := blockingReadState(contextStore)
+			defer close(release)
+			results := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			Expect(wasmGuest.CloseWithTimeout(10 * time.Millisecond)).To(MatchError(internal.ErrForcedClose))
+			var result internal.InvokeResult
+			Eventually(results).Should(Receive(&result))
+			Expect(result.Err).To(MatchError(internal.ErrGuestClosed))
+		})
+	})
+
+	Describe("Drain", func() {
+		It("should reject new invocations after waiting for those in progress", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			results := wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			drained := make(chan error, 1)
+			go func() {
+				drained <- wasmGuest.Drain(context.Background())
+			}()
+			Eventually(wasmGuest.Draining).Should(BeTrue())
+			Consistently(drained).ShouldNot(Receive())
+
+			_, err = wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(errors.Is(err, internal.ErrGuestDraining)).To(BeTrue())
+			Expect(errors.Is(err, internal.ErrAcquireFailed)).To(BeTrue())
+			Expect(wasmGuest.Ping(context.Background())).To(MatchError(internal.ErrGuestDraining))
+
+			close(release)
+			Eventually(drained).Should(Receive(BeNil()))
+			var result internal.InvokeResult
+			Eventually(results).Should(Receive(&result))
+			Expect(result.Err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+		})
+
+		It("should stop waiting when the context is done", func() {
+			contextStore := internal.NewContextStore()
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			payload, reading, release := blockingReadState(contextStore)
+			defer close(release)
+			wasmGuest.InvokeAsync(context.Background(), "read", payload)
+			Eventually(reading).Should(BeClosed())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			err = wasmGuest.Drain(ctx)
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(err).To(MatchError("Failed to drain Wasm guest with 1 invocations in progress: context deadline exceeded"))
+			Expect(wasmGuest.Draining()).To(BeTrue())
+		})
+
+		It("should return immediately when idle", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			defer wasmGuest.Close()
+
+			Expect(wasmGuest.Draining()).To(BeFalse())
+			Expect(wasmGuest.Drain(context.Background())).To(Succeed())
+			Expect(wasmGuest.Drain(context.Background())).To(Succeed())
+		})
+
+		It("should fail after the guest is closed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			Expect(wasmGuest.Drain(context.Background())).To(MatchError(internal.ErrGuestClosed))
+		})
+	})
+
+	Describe("Close", func() {
+		It("should close the pool and module without error", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(2))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(wasmGuest.Close()).To(Succeed())
+		})
+
+		It("should do nothing if already closed", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(wasmGuest.Close()).To(Succeed())
+			Expect(wasmGuest.Close()).To(Succeed())
+		})
+
+		It("should prevent further operations being invoked", func() {
+			wasmGuest, err := internal.NewWasmGuest(wasmFile, proxy, internal.WithPoolSize(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wasmGuest.Close()).To(Succeed())
+
+			result, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+			Expect(result).To(BeNil())
+			Expect(err).To(MatchError(internal.ErrGuestClosed))
+		})
+
+		Context("With a timeout", func() {
+			var (
+				contextStore *internal.ContextStore
+				wasmGuest    *internal.WasmGuest
+			)
+
+			BeforeEach(func() {
+				contextStore = internal.NewContextStore()
+
+				var err error
+				wasmGuest, err = internal.NewWasmGuest(wasmFile, internal.NewFabricProxy(contextStore), internal.WithPoolSize(1))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should wait for invocations in progress to finish", func() {
+				payload, reading, release := blockingReadState(contextStore)
+
+				invoked := make(chan error, 1)
+				go func() {
+					_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+					invoked <- err
+				}()
+				<-reading
+
+				closed := make(chan error, 1)
+				go func() {
+					closed <- wasmGuest.CloseWithTimeout(time.Minute)
+				}()
+
+				Eventually(func() error {
+					_, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+					return err
+				}).Should(MatchError(internal.ErrGuestClosed))
+				Consistently(closed, "50ms").ShouldNot(Receive())
+
+				close(release)
+				Eventually(invoked).Should(Receive(BeNil()))
+				Eventually(closed).Should(Receive(BeNil()))
+			})
+
+			It("should interrupt invocations still in progress at the deadline", func() {
+				payload, reading, release := blockingReadState(contextStore)
+				defer close(release)
+
+				invoked := make(chan error, 2)
+				go func() {
+					_, err := wasmGuest.InvokeWasmOperation(context.Background(), "read", payload)
+					invoked <- err
+				}()
+				<-reading
+				go func() {
+					_, err := wasmGuest.InvokeWasmOperation(context.Background(), "echo", []byte("bond"))
+					invoked <- err
+				}()
+
+				err := wasmGuest.CloseWithTimeout(10 * time.Millisecond)
+				Expect(errors.Is(err, internal.ErrForcedClose)).To(BeTrue())
+				Expect(err).To(MatchError("Wasm guest closed before in-flight invocations finished after 10ms"))
+
+				var invokeErr error
+				Eventually(invoked).Should(Receive(&invokeErr))
+				Expect(errors.Is(invokeErr, internal.ErrGuestClosed)).To(BeTrue())
+				Eventually(invoked).Should(Receive(&invokeErr))
+				Expect(errors.Is(invokeErr, internal.ErrGuestClosed)).To(BeTrue())
+			})
+
+			It("should close immediately without invocations in progress", func() {
+				Expect(wasmGuest.CloseWithTimeout(0)).To(Succeed())
+				Expect(wasmGuest.CloseWithTimeout(0)).To(Succeed())
+			})
+		})
+	})
+})
@@ -0,0 +1,176 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	wasmHeaderSize    = 8
+	wasmCustomSection = 0
+	wasmExportSection = 7
+	wasmExternFunc    = 0
+)
+
+// wasmSection is a section of a Wasm binary module
+type wasmSection struct {
+	id      byte
+	content []byte
+}
+
+// readWasmSections splits a Wasm binary module into sections, without
+// decoding their contents
+func readWasmSections(wasmBytes []byte) ([]wasmSection, error) {
+	if len(wasmBytes) < wasmHeaderSize {
+		return nil, errors.New("Wasm module header is truncated")
+	}
+
+	sections := []wasmSection{}
+	reader := &wasmReader{buf: wasmBytes[wasmHeaderSize:]}
+	for !reader.done() {
+		id, err := reader.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := reader.bytes()
+		if err != nil {
+			return nil, fmt.Errorf("Wasm section %d is truncated", id)
+		}
+
+		sections = append(sections, wasmSection{id: id, content: content})
+	}
+
+	return sections, nil
+}
+
+// readWasmExportedFunctions returns the names of the functions exported by a
+// Wasm binary module
+func readWasmExportedFunctions(wasmBytes []byte) ([]string, error) {
+	sections, err := readWasmSections(wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, section := range sections {
+		if section.id != wasmExportSection {
+			continue
+		}
+
+		reader := &wasmReader{buf: section.content}
+		count, err := reader.uint32()
+		if err != nil {
+			return nil, fmt.Errorf("Wasm export section is invalid: %s", err.Error())
+		}
+
+		for i := uint32(0); i < count; i++ {
+			name, err := reader.bytes()
+			if err != nil {
+				return nil, fmt.Errorf("Wasm export section is invalid: %s", err.Error())
+			}
+
+			kind, err := reader.byte()
+			if err != nil {
+				return nil, fmt.Errorf("Wasm export section is invalid: %s", err.Error())
+			}
+
+			if _, err := reader.uint32(); err != nil {
+				return nil, fmt.Errorf("Wasm export section is invalid: %s", err.Error())
+			}
+
+			if kind == wasmExternFunc {
+				names = append(names, string(name))
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// readWasmCustomSections returns the contents of the custom sections of a
+// Wasm binary module, keyed by name. If there are several custom sections with
+// the same name, the first is returned. The contents are copied, so that they
+// do not keep the rest of the module in memory.
+func readWasmCustomSections(wasmBytes []byte) (map[string][]byte, error) {
+	sections, err := readWasmSections(wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	custom := make(map[string][]byte)
+	for _, section := range sections {
+		if section.id != wasmCustomSection {
+			continue
+		}
+
+		reader := &wasmReader{buf: section.content}
+		name, err := reader.bytes()
+		if err != nil {
+			return nil, fmt.Errorf("Wasm custom section is invalid: %s", err.Error())
+		}
+
+		if _, ok := custom[string(name)]; !ok {
+			custom[string(name)] = append([]byte{}, section.content[reader.pos:]...)
+		}
+	}
+
+	return custom, nil
+}
+
+// wasmReader reads values encoded in the Wasm binary format
+type wasmReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *wasmReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.done() {
+		return 0, errors.New("unexpected end of data")
+	}
+
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// uint32 reads an unsigned LEB128 encoded integer
+func (r *wasmReader) uint32() (uint32, error) {
+	var result uint32
+	for shift := uint(0); shift < 35; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+
+		result |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return result, nil
+		}
+	}
+
+	return 0, errors.New("integer too large")
+}
+
+// bytes reads a length prefixed byte vector
+func (r *wasmReader) bytes() ([]byte, error) {
+	length, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	if int(length) > len(r.buf)-r.pos {
+		return nil, errors.New("unexpected end of data")
+	}
+
+	b := r.buf[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+	return b, nil
+}
@@ -0,0 +1,72 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/assemblyscript"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/wapc/wapc-go"
+	wazeroengine "github.com/wapc/wapc-go/engines/wazero"
+)
+
+// wasmPageSize is the size of a page of Wasm linear memory
+const wasmPageSize = 65536
+
+// newEngine returns a waPC engine using a wazero runtime configured for the
+// WasmGuest
+func (wg *WasmGuest) newEngine() wapc.Engine {
+	return wazeroengine.EngineWithRuntime(wg.newRuntime)
+}
+
+// compilationCacheContext returns a context which configures wazero to use
+// the compilation cache for the Wasm module with the specified digest, if one
+// has been configured
+func (wg *WasmGuest) compilationCacheContext(ctx context.Context, digest string) (context.Context, error) {
+	if wg.compilationCache == "" {
+		return ctx, nil
+	}
+
+	cacheCtx, err := experimental.WithCompilationCacheDirName(ctx, filepath.Join(wg.compilationCache, digest))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to use compilation cache %s: %s", wg.compilationCache, err.Error())
+	}
+
+	return cacheCtx, nil
+}
+
+// newRuntime returns a wazero runtime with the same host modules as the waPC
+// default runtime, and the memory limit, WASI environment variables,
+// preopened directories and syscall policy configured for the WasmGuest. Guest output from each
+// instance can be redirected using WithGuestOutput, and guest console messages
+// are logged with the invocation they belong to.
+func (wg *WasmGuest) newRuntime(ctx context.Context) (wazero.Runtime, error) {
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(wg.memoryLimit / wasmPageSize))
+	r := wazero.NewRuntimeWithConfig(ctx, config)
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		_ = r.Close(ctx)
+		return nil, err
+	}
+
+	envBuilder := r.NewHostModuleBuilder("env")
+	assemblyscript.NewFunctionExporter().WithAbortMessageDisabled().ExportFunctions(envBuilder)
+	if _, err := envBuilder.Instantiate(ctx, r); err != nil {
+		_ = r.Close(ctx)
+		return nil, err
+	}
+
+	runtime := outputRuntime{Runtime: wasiRuntime{Runtime: r, env: wg.guestEnv(), fs: wg.wasiFS, syscalls: wg.syscallPolicy}}
+	if digest, ok := ctx.Value(consoleLogKey{}).(string); ok {
+		return consoleRuntime{Runtime: runtime, wg: wg, digest: digest}, nil
+	}
+
+	return runtime, nil
+}
@@ -0,0 +1,184 @@
+// Copyright the Hyperledger Fabric contributors. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultFetchTimeout is how long NewWasmGuestFromURL waits to fetch the Wasm
+// module unless configured using the WithFetchTimeout option
+const DefaultFetchTimeout = 30 * time.Second
+
+// DefaultMaxFetchBytes is the largest response NewWasmGuestFromURL reads for
+// the Wasm module unless configured using the WithMaxFetchBytes option, so that
+// a misconfigured or hostile URL cannot exhaust memory
+const DefaultMaxFetchBytes = MaxDecompressedWasmBytes
+
+// ErrUnexpectedStatus is returned by NewWasmGuestFromURL when the server
+// responds to the request for the Wasm module without a 2xx status
+var ErrUnexpectedStatus = errors.New("unexpected HTTP status")
+
+// ErrFetchTooLarge is returned by NewWasmGuestFromURL when the response for
+// the Wasm module is larger than the maximum set using WithMaxFetchBytes
+var ErrFetchTooLarge = errors.New("Wasm module response too large")
+
+// WithFetchTimeout sets how long NewWasmGuestFromURL waits to fetch the Wasm
+// module, including reading the response. It has no effect on the other
+// constructors.
+func WithFetchTimeout(timeout time.Duration) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Invalid fetch timeout %s: must be positive", timeout)
+		}
+		wg.fetchTimeout = timeout
+		return nil
+	}
+}
+
+// WithFetchHeader adds a header to the request NewWasmGuestFromURL makes for
+// the Wasm module, for example an Authorization header for a private registry
+// or object store. It has no effect on the other constructors.
+func WithFetchHeader(name, value string) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if name == "" || strings.ContainsAny(name, ": \t\r\n") || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("Invalid fetch header %q: must be a non-empty name without separators, and a value without line breaks", name)
+		}
+		if wg.fetchHeader == nil {
+			wg.fetchHeader = make(http.Header)
+		}
+		wg.fetchHeader.Add(name, value)
+		return nil
+	}
+}
+
+// WithMaxFetchBytes sets the largest response NewWasmGuestFromURL reads for
+// the Wasm module, failing with ErrFetchTooLarge for larger responses, instead
+// of DefaultMaxFetchBytes. The limit applies to the bytes fetched, which may be
+// compressed. It has no effect on the other constructors.
+func WithMaxFetchBytes(limit int64) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if limit <= 0 {
+			return fmt.Errorf("Invalid maximum fetch size %d: must be positive", limit)
+		}
+		wg.maxFetchBytes = limit
+		return nil
+	}
+}
+
+// WithFetchClient sets the HTTP client NewWasmGuestFromURL uses to fetch the
+// Wasm module, for example to configure TLS or a proxy for a private registry.
+// By default, each fetch uses its own client rather than http.DefaultClient,
+// so that it does not share connections or configuration with the rest of the
+// process. The fetch timeout still applies. It has no effect on the other
+// constructors.
+func WithFetchClient(client *http.Client) WasmGuestOption {
+	return func(wg *WasmGuest) error {
+		if client == nil {
+			return errors.New("Invalid fetch client: must not be nil")
+		}
+		wg.fetchClient = client
+		return nil
+	}
+}
+
+// NewWasmGuestFromURL returns a new WasmGuest capable of invoking Wasm
+// operations in the Wasm module fetched from the http or https URL. The context
+// can be used to cancel fetching the module, which also gives up after the
+// fetch timeout. Use WithExpectedDigest or WithSignature to check that the
+// module is the one which was approved.
+func NewWasmGuestFromURL(ctx context.Context, wasmURL string, proxy *FabricProxy, opts ...WasmGuestOption) (*WasmGuest, error) {
+	u, err := url.Parse(wasmURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid Wasm module URL %q: must be an absolute http or https URL", redactURL(wasmURL))
+	}
+
+	wg, err := configureWasmGuest(proxy, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	wasmBytes, err := wg.fetch(ctx, u)
+	if err != nil {
+		wg.logger.Errorf("[host] error fetching Wasm module: %s", err)
+		return nil, err
+	}
+
+	wasmBytes, err = loadWasmBytes(wasmBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load Wasm module %s: %w", u.Redacted(), err)
+	}
+
+	return wg.load("Wasm module "+u.Redacted(), wasmBytes)
+}
+
+// fetch gets the Wasm module bytes from the URL using the configured client,
+// headers, timeout and maximum size
+func (wg *WasmGuest) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, wg.fetchTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch Wasm module %s: %w", u.Redacted(), err)
+	}
+	for name, values := range wg.fetchHeader {
+		request.Header[name] = append([]string(nil), values...)
+	}
+
+	client := wg.fetchClient
+	if client == nil {
+		client = newFetchClient()
+		defer client.CloseIdleConnections()
+	}
+
+	wg.logger.Debugf("[host] Fetching Wasm module %s", u.Redacted())
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch Wasm module: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		return nil, fmt.Errorf("Failed to fetch Wasm module %s: %w %s", u.Redacted(), ErrUnexpectedStatus, response.Status)
+	}
+
+	wasmBytes, err := ioutil.ReadAll(io.LimitReader(response.Body, wg.maxFetchBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Wasm module %s: %w", u.Redacted(), err)
+	}
+	if int64(len(wasmBytes)) > wg.maxFetchBytes {
+		return nil, fmt.Errorf("Failed to read Wasm module %s: %w: exceeds the maximum of %d bytes", u.Redacted(), ErrFetchTooLarge, wg.maxFetchBytes)
+	}
+
+	return wasmBytes, nil
+}
+
+// newFetchClient returns a client with its own copy of the default transport,
+// so that fetching does not share connections with the rest of the process
+func newFetchClient() *http.Client {
+	client := &http.Client{}
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		client.Transport = transport.Clone()
+	}
+	return client
+}
+
+// redactURL returns the URL with any password replaced, if it can be parsed
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<unparseable>"
+	}
+	return u.Redacted()
+}
@@ -17,6 +17,7 @@ type ChaincodeConfig struct {
 	CCID    string
 	Address string
 	WasmCC  string
+	WasmSHA string
 }
 
 func main() {
@@ -26,6 +27,7 @@ func main() {
 		CCID:    os.Getenv("CHAINCODE_ID"),
 		Address: os.Getenv("CHAINCODE_SERVER_ADDRESS"),
 		WasmCC:  os.Getenv("CHAINCODE_WASM_FILE"),
+		WasmSHA: os.Getenv("CHAINCODE_WASM_SHA256"),
 	}
 	log.Printf("[host] CCID: %s\n", config.CCID)
 	log.Printf("[host] Address: %s\n", config.Address)
@@ -34,11 +36,21 @@ func main() {
 	contextStore := internal.NewContextStore()
 	proxy := internal.NewFabricProxy(contextStore)
 
-	wasmGuest, err := internal.NewWasmGuest(config.WasmCC, proxy)
+	var opts []internal.WasmGuestOption
+	if len(config.WasmSHA) > 0 {
+		log.Printf("[host] WasmSHA: %s\n", config.WasmSHA)
+		opts = append(opts, internal.WithExpectedDigest(config.WasmSHA))
+	}
+
+	wasmGuest, err := internal.NewWasmGuest(config.WasmCC, proxy, opts...)
 	if err != nil {
 		panic(err)
 	}
-	defer wasmGuest.Close()
+	defer func() {
+		if err := wasmGuest.Close(); err != nil {
+			log.Printf("[host] Error closing Wasm guest: %s\n", err)
+		}
+	}()
 
 	contract := internal.NewWasmContract(contextStore, wasmGuest)
 